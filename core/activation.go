@@ -0,0 +1,197 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	. "southwinds.dev/pilotctl/types"
+	"strings"
+	"time"
+)
+
+const (
+	// HttpActivationProvider delegates activations to the external activation service
+	HttpActivationProvider = "http"
+	// LocalActivationProvider pilotctl issues activation tokens itself
+	LocalActivationProvider = "local"
+)
+
+// ActivationProvider reserves and issues host activations
+type ActivationProvider interface {
+	// Provision reserves an activation for the host with the specified mac-address
+	// providers issuing activations themselves return the activation token the host must present to activate
+	Provision(macAddress string) (*Activation, error)
+	// Activate verifies the activation request of a provisioned host and issues its activation
+	Activate(req ActivationRequest) (*Activation, error)
+}
+
+// NewActivationProvider creates the activation provider selected in the configuration
+func NewActivationProvider(cfg *Conf, db *Db) (ActivationProvider, error) {
+	switch cfg.GetActivationProvider() {
+	case HttpActivationProvider:
+		return &httpActivationProvider{
+			uri:    cfg.GetActivationURI(),
+			tenant: cfg.GetTenant(),
+			user:   cfg.GetActivationUser(),
+			pwd:    cfg.GetActivationPwd(),
+			client: &http.Client{
+				Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: cfg.GetActivationInsecureSkipVerify()}},
+				Timeout:   60 * time.Second,
+			},
+		}, nil
+	case LocalActivationProvider:
+		key, err := cfg.ActivationKey()
+		if err != nil {
+			return nil, fmt.Errorf("the local activation provider requires a signing key: %s", err)
+		}
+		return &localActivationProvider{
+			tenant:   cfg.GetTenant(),
+			key:      key,
+			validity: cfg.ActivationTokenValidity(),
+			db:       db,
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid activation provider '%s', valid values are '%s' or '%s'", cfg.GetActivationProvider(), HttpActivationProvider, LocalActivationProvider)
+	}
+}
+
+// httpActivationProvider uses the external activation service
+type httpActivationProvider struct {
+	uri    string
+	tenant string
+	user   string
+	pwd    string
+	client *http.Client
+}
+
+func (p *httpActivationProvider) Provision(macAddress string) (*Activation, error) {
+	// call activation service and reserve the mac-address for this tenant
+	_, err := HttpRequest(p.client, fmt.Sprintf("%s/provision/%s/%s", p.uri, p.tenant, macAddress), "POST", p.user, p.pwd, 201)
+	if err != nil {
+		return nil, fmt.Errorf("cannot provision mac-address %s with activation service: %s", macAddress, err)
+	}
+	// the activation service issues the activation to the host
+	return nil, nil
+}
+
+func (p *httpActivationProvider) Activate(ActivationRequest) (*Activation, error) {
+	return nil, fmt.Errorf("activations are issued by the activation service at %s", p.uri)
+}
+
+// localActivationProvider issues activation tokens without an external activation service
+// a signed token is issued for each registration and hosts activate by presenting it before it expires
+type localActivationProvider struct {
+	tenant   string
+	key      []byte
+	validity time.Duration
+	db       *Db
+}
+
+// activationClaims the content of an activation token issued by the local activation provider
+type activationClaims struct {
+	MacAddress string `json:"mac"`
+	Tenant     string `json:"tenant"`
+	Expires    int64  `json:"exp"`
+}
+
+func (p *localActivationProvider) Provision(macAddress string) (*Activation, error) {
+	issued := time.Now().UTC()
+	claims := activationClaims{
+		MacAddress: macKey(macAddress),
+		Tenant:     p.tenant,
+		Expires:    issued.Add(p.validity).Unix(),
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create activation token: %s\n", err)
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return &Activation{
+		MacAddress: macAddress,
+		Tenant:     p.tenant,
+		Token:      encoded + "." + base64.RawURLEncoding.EncodeToString(p.sign(encoded)),
+		Issued:     issued,
+		Expires:    time.Unix(claims.Expires, 0).UTC(),
+	}, nil
+}
+
+func (p *localActivationProvider) Activate(req ActivationRequest) (*Activation, error) {
+	if len(req.MacAddress) == 0 {
+		return nil, fmt.Errorf("mac-address is missing\n")
+	}
+	if len(req.HostUUID) == 0 {
+		return nil, fmt.Errorf("host UUID is missing\n")
+	}
+	if err := p.verify(req.Token, req.MacAddress, time.Now()); err != nil {
+		return nil, fmt.Errorf("cannot activate mac-address %s: %s\n", req.MacAddress, err)
+	}
+	// only the hash of the token is kept
+	hash := sha256.Sum256([]byte(req.Token))
+	err := p.db.RunCommand("select pilotctl_set_activation($1, $2, $3)", req.MacAddress, req.HostUUID, hex.EncodeToString(hash[:]))
+	if err != nil {
+		return nil, fmt.Errorf("cannot record activation for mac-address %s: %s\n", req.MacAddress, err)
+	}
+	return &Activation{
+		MacAddress: req.MacAddress,
+		HostUUID:   req.HostUUID,
+		Tenant:     p.tenant,
+		Issued:     time.Now().UTC(),
+	}, nil
+}
+
+// verify checks the activation token was signed by this provider for the mac-address and tenant and has not expired
+func (p *localActivationProvider) verify(token, macAddress string, now time.Time) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return fmt.Errorf("activation token is malformed")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, p.sign(parts[0])) {
+		return fmt.Errorf("activation token signature is invalid")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return fmt.Errorf("activation token is malformed")
+	}
+	var claims activationClaims
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return fmt.Errorf("activation token is malformed")
+	}
+	if claims.MacAddress != macKey(macAddress) || claims.Tenant != p.tenant {
+		return fmt.Errorf("activation token was not issued for this host")
+	}
+	if now.Unix() > claims.Expires {
+		return fmt.Errorf("activation token expired on %s", time.Unix(claims.Expires, 0).UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// sign returns the HMAC-SHA256 of the encoded claims of an activation token
+func (p *localActivationProvider) sign(encoded string) []byte {
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,51 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// checks activation tokens are only accepted for the registered host, unaltered and before they expire
+func TestLocalActivationToken(t *testing.T) {
+	p := &localActivationProvider{tenant: "acme", key: []byte("0123456789abcdef0123456789abcdef"), validity: time.Hour}
+	activation, err := p.Provision("AA:BB:CC:DD:EE:FF")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.verify(activation.Token, "aa-bb-cc-dd-ee-ff", time.Now()); err != nil {
+		t.Fatalf("valid token rejected: %s", err)
+	}
+	if err = p.verify(activation.Token, "aa:bb:cc:dd:ee:00", time.Now()); err == nil {
+		t.Fatal("token accepted for a different mac-address")
+	}
+	if err = p.verify(activation.Token, "aa:bb:cc:dd:ee:ff", time.Now().Add(2*time.Hour)); err == nil {
+		t.Fatal("expired token accepted")
+	}
+	parts := strings.Split(activation.Token, ".")
+	forged, _ := (&localActivationProvider{tenant: "acme", key: []byte("another key of at least 32 bytes"), validity: 48 * time.Hour}).Provision("aa:bb:cc:dd:ee:ff")
+	if err = p.verify(forged.Token, "aa:bb:cc:dd:ee:ff", time.Now()); err == nil {
+		t.Fatal("token signed with another key accepted")
+	}
+	if err = p.verify(strings.Split(forged.Token, ".")[0]+"."+parts[1], "aa:bb:cc:dd:ee:ff", time.Now()); err == nil {
+		t.Fatal("token with altered claims accepted")
+	}
+}
@@ -0,0 +1,161 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"fmt"
+	. "southwinds.dev/pilotctl/types"
+)
+
+// SetAdmissions admits a list of hosts reporting the outcome for each host
+// all admissions are validated against the logistics hierarchy and the scope of the user before any is applied,
+// updating the admission of an admitted host also requires access to its current placement
+// if allOrNothing is true, no admission is applied unless all of them can be applied
+func (r *API) SetAdmissions(access *Access, admissions []Admission, allOrNothing bool) []AdmissionResult {
+	var (
+		results = make([]AdmissionResult, len(admissions))
+		v       = newLogisticsValidator(r)
+		seen    = make(map[string]bool)
+		failed  bool
+	)
+	// validate all admissions first
+	for i, admission := range admissions {
+		results[i] = AdmissionResult{HostUUID: admission.HostUUID}
+		if err := validateAdmission(v, admission, seen); err != nil {
+			results[i].Status = AdmissionFailed
+			results[i].Reason = err.Error()
+			failed = true
+			continue
+		}
+		admitted, err := r.isAdmitted(admission.HostUUID)
+		if err != nil {
+			results[i].Status = AdmissionFailed
+			results[i].Reason = fmt.Sprintf("cannot check admission status: %s", err)
+			failed = true
+			continue
+		}
+		if admitted {
+			err = r.CheckHostAccess(access, PermApprove, admission.HostUUID)
+		}
+		if err == nil && !access.CanAt(PermApprove, admission.OrgGroup, admission.Org, admission.Area) {
+			err = fmt.Errorf("%w: cannot admit host '%s' outside of the scope of the user", ErrForbidden, admission.HostUUID)
+		}
+		if err != nil {
+			results[i].Status = AdmissionFailed
+			results[i].Reason = err.Error()
+			failed = true
+			continue
+		}
+		if admitted {
+			results[i].Status = AdmissionUpdated
+		} else {
+			results[i].Status = AdmissionAdmitted
+		}
+	}
+	if allOrNothing {
+		if failed {
+			return notApplied(results, "other admissions in the request are not valid")
+		}
+		// apply all the admissions in a single transaction
+		commands := make([]Command, len(admissions))
+		for i, admission := range admissions {
+			commands[i] = admissionCommand(admission)
+		}
+		if ix, err := r.db.RunCommands(commands); err != nil {
+			results = notApplied(results, fmt.Sprintf("admission of host '%s' failed", admissions[ix].HostUUID))
+			results[ix].Status = AdmissionFailed
+			results[ix].Reason = err.Error()
+		}
+		r.issueAdmissionCredentials(results)
+		return results
+	}
+	// otherwise, apply the valid admissions one by one
+	for i, admission := range admissions {
+		if results[i].Status == AdmissionFailed {
+			continue
+		}
+		cmd := admissionCommand(admission)
+		if err := r.db.RunCommand(cmd.Script, cmd.Args...); err != nil {
+			results[i].Status = AdmissionFailed
+			results[i].Reason = err.Error()
+		}
+	}
+	r.issueAdmissionCredentials(results)
+	return results
+}
+
+// issueAdmissionCredentials issues credentials to the hosts admitted for the first time
+func (r *API) issueAdmissionCredentials(results []AdmissionResult) {
+	for _, result := range results {
+		if result.Status == AdmissionAdmitted {
+			r.issueAdmissionCredential(result.HostUUID)
+		}
+	}
+}
+
+func validateAdmission(v *logisticsValidator, admission Admission, seen map[string]bool) error {
+	if len(admission.HostUUID) == 0 {
+		return fmt.Errorf("host UUID is missing")
+	}
+	if seen[admission.HostUUID] {
+		return fmt.Errorf("host '%s' appears more than once in the request", admission.HostUUID)
+	}
+	seen[admission.HostUUID] = true
+	return v.validate(admission.OrgGroup, admission.Org, admission.Area, admission.Location)
+}
+
+func admissionCommand(admission Admission) Command {
+	return Command{
+		Script: "select pilotctl_set_admission($1, $2, $3, $4, $5, $6)",
+		Args: []interface{}{
+			admission.HostUUID,
+			admission.OrgGroup,
+			admission.Org,
+			admission.Area,
+			admission.Location,
+			admission.Label,
+		},
+	}
+}
+
+// notApplied marks the valid admissions as not applied
+func notApplied(results []AdmissionResult, reason string) []AdmissionResult {
+	for i := range results {
+		if results[i].Status != AdmissionFailed {
+			results[i].Status = AdmissionNotApplied
+			results[i].Reason = reason
+		}
+	}
+	return results
+}
+
+// isAdmitted checks if the host has been admitted into service
+func (r *API) isAdmitted(hostUUID string) (bool, error) {
+	rows, err := r.db.Query("select * from pilotctl_is_admitted($1)", hostUUID)
+	if err != nil {
+		return false, err
+	}
+	var admitted bool
+	for rows.Next() {
+		if err = rows.Scan(&admitted); err != nil {
+			return false, err
+		}
+	}
+	return admitted, rows.Err()
+}
@@ -23,14 +23,12 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"github.com/jackc/pgx/v4"
 	"go.opentelemetry.io/collector/pdata/plog"
 	"go.opentelemetry.io/collector/pdata/pmetric"
 	"log"
 	"net/http"
-	"os"
-	"os/exec"
 	"path/filepath"
-	"regexp"
 	"southwinds.dev/artisan/core"
 	"southwinds.dev/artisan/data"
 	"southwinds.dev/artisan/registry"
@@ -45,16 +43,18 @@ import (
 
 // API backend services API
 type API struct {
-	conf  *Conf
-	db    *Db
-	iLink *ilink.Client
-	// host information
-	hostUUID string
-	hostname string
-	hostIP   string
+	conf       *Conf
+	db         *Db
+	iLink      *ilink.Client
+	activation ActivationProvider
+	secrets    SecretStore
 }
 
 func NewAPI(cfg *Conf) (*API, error) {
+	// without an audience, tokens issued by the provider to any of its clients would be accepted
+	if len(cfg.OIDCIssuer()) > 0 && len(cfg.OIDCAudience()) == 0 {
+		return nil, fmt.Errorf("%s is required when %s is set", ConfOIDCAudience, ConfOIDCIssuer)
+	}
 	db, err := NewDb(cfg.getDbHost(), cfg.getDbPort(), cfg.getDbName(), cfg.getDbUser(), cfg.getDbPwd(), cfg.getDbMaxConn())
 	if err != nil {
 		return nil, err
@@ -70,10 +70,20 @@ func NewAPI(cfg *Conf) (*API, error) {
 	if err != nil {
 		return nil, fmt.Errorf("cannot create interlink http client: %s", err)
 	}
+	activation, err := NewActivationProvider(cfg, db)
+	if err != nil {
+		return nil, err
+	}
+	secrets, err := NewSecretStore(cfg, db)
+	if err != nil {
+		return nil, err
+	}
 	return &API{
-		db:    db,
-		conf:  cfg,
-		iLink: il,
+		db:         db,
+		conf:       cfg,
+		iLink:      il,
+		activation: activation,
+		secrets:    secrets,
 	}, nil
 }
 
@@ -81,7 +91,11 @@ func (r *API) PingInterval() time.Duration {
 	return r.conf.PingIntervalSecs()
 }
 
-func (r *API) Register(reg *RegistrationRequest) (*RegistrationResponse, error) {
+func (r *API) Register(hostUUID string, reg *RegistrationRequest) (*RegistrationResponse, error) {
+	// the registering host can only register itself
+	if !strings.EqualFold(hostUUID, reg.MachineId) {
+		return nil, fmt.Errorf("host '%s' cannot register as host '%s'", hostUUID, reg.MachineId)
+	}
 	// registers the host with the cmdb
 	result, err := r.iLink.PutItem(&ilink.Item{
 		Key:         strings.ToUpper(fmt.Sprintf("HOST:%s", reg.MachineId)),
@@ -124,7 +138,7 @@ func (r *API) GetCommandValue(fxKey string) (*CmdInfo, error) {
 	if err != nil {
 		return nil, fmt.Errorf("cannot get input from map: %s", err)
 	}
-	return &CmdInfo{
+	info := &CmdInfo{
 		Function:      item.GetStringAttr("FX"),
 		Package:       item.GetStringAttr("PACKAGE"),
 		User:          item.GetStringAttr("USER"),
@@ -132,11 +146,17 @@ func (r *API) GetCommandValue(fxKey string) (*CmdInfo, error) {
 		Verbose:       item.GetBoolAttr("VERBOSE"),
 		Containerised: item.GetBoolAttr("CONTAINERISED"),
 		Input:         input,
-	}, nil
+	}
+	// secrets are only resolved when the command is dispatched
+	if err = r.ResolveSecrets(info); err != nil {
+		return nil, fmt.Errorf("cannot resolve secrets of function '%s': %s", fxKey, err)
+	}
+	return info, nil
 }
 
-func (r *API) Ping() (jobId int64, fxKey string, fxVersion int64, err error) {
-	rows, err := r.db.Query("select * from pilotctl_beat($1)", r.hostUUID)
+func (r *API) Ping(hostUUID string) (jobId int64, fxKey string, fxVersion int64, err error) {
+	// if the host is quarantined, only jobs for the allowed forensic commands are returned
+	rows, err := r.db.Query("select * from pilotctl_beat($1, $2)", hostUUID, r.conf.QuarantineAllowedCmds())
 	if err != nil {
 		return -1, "", -1, err
 	}
@@ -155,11 +175,18 @@ func (r *API) Ping() (jobId int64, fxKey string, fxVersion int64, err error) {
 // or: organisation key
 // ar: area key
 // loc: location key
-func (r *API) GetHosts(oGroup, or, ar, loc string, label []string) ([]Host, error) {
+// only the hosts the user can view are returned
+func (r *API) GetHosts(access *Access, oGroup, or, ar, loc string, label []string) ([]Host, error) {
 	hosts := make([]Host, 0)
-	pingInterval := r.PingInterval().Seconds()
-	// note: the interval for determining if host is down is set to 2 pings
-	rows, err := r.db.Query("select * from pilotctl_get_hosts($1, $2, $3, $4, $5, $6)", fmt.Sprintf("%.0f secs", 2*pingInterval), oGroup, or, ar, loc, label)
+	// the ping interval expected from each host
+	hostInterval, err := r.hostIntervals()
+	if err != nil {
+		return nil, err
+	}
+	// a host is down if it missed the number of pings of the interval recorded for it,
+	// or of the default interval if no interval has been recorded
+	rows, err := r.db.Query("select * from pilotctl_get_hosts($1, $2, $3, $4, $5, $6, $7)",
+		missedPings, fmt.Sprintf("%d secs", r.defaultPingInterval()), oGroup, or, ar, loc, label)
 	if err != nil {
 		return nil, fmt.Errorf("cannot get hosts: %s\n", err)
 	}
@@ -179,12 +206,19 @@ func (r *API) GetHosts(oGroup, or, ar, loc string, label []string) ([]Host, erro
 		scoreHigh     sql.NullInt32
 		scoreMedium   sql.NullInt32
 		scoreLow      sql.NullInt32
+		state         sql.NullString
+		qBy           sql.NullString
+		qReason       sql.NullString
+		qSince        sql.NullTime
 	)
 	for rows.Next() {
-		err = rows.Scan(&id, &uuId, &macAddress, &connected, &lastSeen, &orgGroup, &org, &area, &location, &inService, &labels, &scoreCritical, &scoreHigh, &scoreMedium, &scoreLow)
+		err = rows.Scan(&id, &uuId, &macAddress, &connected, &lastSeen, &orgGroup, &org, &area, &location, &inService, &labels, &scoreCritical, &scoreHigh, &scoreMedium, &scoreLow, &state, &qBy, &qReason, &qSince)
 		if err != nil {
 			return nil, err
 		}
+		if !access.CanAt(PermView, orgGroup.String, org.String, area.String) {
+			continue
+		}
 		var (
 			tt        int64
 			since     int
@@ -197,7 +231,15 @@ func (r *API) GetHosts(oGroup, or, ar, loc string, label []string) ([]Host, erro
 				return nil, err
 			}
 		}
-		hosts = append(hosts, Host{
+		var quarantine *Quarantine
+		if HostState(state.String) == HostQuarantined {
+			quarantine = &Quarantine{
+				By:     qBy.String,
+				Reason: qReason.String,
+				Since:  qSince.Time,
+			}
+		}
+		host := Host{
 			Id:             id,
 			HostUUID:       uuId,
 			HostMacAddress: macAddress,
@@ -214,7 +256,17 @@ func (r *API) GetHosts(oGroup, or, ar, loc string, label []string) ([]Host, erro
 			High:           int(scoreHigh.Int32),
 			Medium:         int(scoreMedium.Int32),
 			Low:            int(scoreLow.Int32),
-		})
+			State:          HostState(state.String),
+			Quarantine:     quarantine,
+		}
+		// the host is down if it missed its own pings, which are recorded when they arrive
+		// but can then be held waiting for a job in long-poll mode
+		host.PingInterval, host.PingWait = hostInterval(host)
+		if lastSeen.Valid {
+			threshold := missedPings*time.Duration(host.PingInterval)*time.Second + time.Duration(host.PingWait)*time.Second
+			host.Connected = time.Since(lastSeen.Time) < threshold
+		}
+		hosts = append(hosts, host)
 	}
 	return hosts, rows.Err()
 }
@@ -254,13 +306,8 @@ func (r *API) SetAdmission(admission Admission) error {
 	if len(admission.HostUUID) == 0 {
 		return fmt.Errorf("host UUID is missing")
 	}
-	return r.db.RunCommand("select pilotctl_set_admission($1, $2, $3, $4, $5, $6)",
-		admission.HostUUID,
-		admission.OrgGroup,
-		admission.Org,
-		admission.Area,
-		admission.Location,
-		admission.Label)
+	cmd := admissionCommand(admission)
+	return r.db.RunCommand(cmd.Script, cmd.Args...)
 }
 
 func (r *API) SetRegistration(registration Registration) error {
@@ -276,6 +323,51 @@ func (r *API) SetRegistration(registration Registration) error {
 		registration.Label)
 }
 
+// ProvisionRegistration reserves an activation for the host mac-address with the activation provider
+// and records the registration information
+func (r *API) ProvisionRegistration(registration Registration) (*Activation, error) {
+	if len(registration.MacAddress) == 0 {
+		return nil, fmt.Errorf("MAC-ADDRESS is missing")
+	}
+	activation, err := r.activation.Provision(registration.MacAddress)
+	if err != nil {
+		return nil, err
+	}
+	// as the provisioning of the mac-address has been successful records the host in pilot-ctl db
+	err = r.SetRegistration(registration)
+	if err != nil {
+		return nil, fmt.Errorf("cannot record registration information in database: %s", err)
+	}
+	return activation, nil
+}
+
+// ActivateHost issues an activation for a registered host using the activation provider
+// and admits the host using its registration information, issuing its first client certificate if it sent a CSR
+func (r *API) ActivateHost(req ActivationRequest) (*Activation, error) {
+	registration, err := r.GetRegistration(req.MacAddress)
+	if err != nil {
+		return nil, err
+	}
+	if registration == nil || registration.Status != RegistrationProvisioned {
+		return nil, fmt.Errorf("mac-address %s is not registered or has already been activated\n", req.MacAddress)
+	}
+	activation, err := r.activation.Activate(req)
+	if err != nil {
+		return nil, err
+	}
+	if err = r.AdmitRegistered(req.MacAddress, req.HostUUID); err != nil {
+		return nil, err
+	}
+	// the activation token proves the identity of the host, so its first client certificate is issued straight away;
+	// if it cannot be issued the host can still enrol with the credential issued on admission
+	if len(req.CSR) > 0 {
+		if activation.Certificate, err = r.issueHostCertificate(req.HostUUID, []byte(req.CSR)); err != nil {
+			log.Printf("WARNING: cannot issue certificate to activated host '%s': %s\n", req.HostUUID, err)
+		}
+	}
+	return activation, nil
+}
+
 // AdmitRegistered admits a host that has been registered with a mac-address after confirmation of activation
 func (r *API) AdmitRegistered(macAddress, hostUUID string) error {
 	if len(macAddress) == 0 {
@@ -284,43 +376,32 @@ func (r *API) AdmitRegistered(macAddress, hostUUID string) error {
 	if len(hostUUID) == 0 {
 		return fmt.Errorf("host UUID is missing\n")
 	}
-	return r.db.RunCommand("select pilotctl_admit_registered($1, $2)", macAddress, hostUUID)
+	err := r.db.RunCommand("select pilotctl_admit_registered($1, $2)", macAddress, hostUUID)
+	if err != nil {
+		return err
+	}
+	r.issueAdmissionCredential(hostUUID)
+	return nil
 }
 
 // AuthenticatePilot authenticates pilot requests
 func (r *API) AuthenticatePilot(token string) (*h.UserPrincipal, error) {
-	if len(token) == 0 {
-		msg := "authentication token is required and not provided"
-		log.Println(msg)
-		return nil, fmt.Errorf(msg)
-	}
-	value, err := base64.StdEncoding.DecodeString(reverse(token))
-	if err != nil {
-		msg := fmt.Sprintf("error decoding authentication token '%s': %s", token, err)
-		log.Println(msg)
-		return nil, fmt.Errorf(msg)
-	}
-	str := string(value)
-	// token is: hostUUID (0) | hostIP (1) | hostName (2) | timestamp (3)
-	parts := strings.Split(str, "|")
-	tokenTime, err := strconv.ParseInt(parts[3], 10, 64)
+	hostUUId, hostIP, hostname, err := parsePilotToken(token)
 	if err != nil {
-		msg := fmt.Sprintf("error parsing authentication token: %s; access denied", err)
-		log.Println(msg)
-		return nil, fmt.Errorf(msg)
+		return nil, err
 	}
-	timeOk := (time.Now().Unix() - tokenTime) < (5 * 60)
-	hostUUId := parts[0]
-	if !timeOk {
-		msg := fmt.Sprintf("authentication failed for Host UUID='%s': token has expired", hostUUId)
-		log.Println(msg)
-		return nil, fmt.Errorf(msg)
+	if err = r.checkLegacyToken(hostUUId); err != nil {
+		log.Println(err)
+		return nil, err
 	}
+	return r.admittedPilot(HostIdentity{HostUUID: hostUUId, HostIP: hostIP, Hostname: hostname, Auth: PilotAuthToken})
+}
+
+// admittedPilot returns the principal of an authenticated host pilot providing the host has been admitted
+func (r *API) admittedPilot(host HostIdentity) (*h.UserPrincipal, error) {
+	hostUUId, hostIP, hostname := host.HostUUID, host.HostIP, host.Hostname
 	rows, err := r.db.Query("select * from pilotctl_is_admitted($1)", hostUUId)
-	var hostname, hostIP string
 	if err != nil {
-		hostIP = parts[1]
-		hostname = parts[2]
 		msg := fmt.Sprintf("authentication failed for Host UUID='%s': cannot query admission table: %s\n"+
 			"additional info: host IP = '%s', hostname = '%s'\n", hostUUId, err, hostIP, hostname)
 		log.Println(msg)
@@ -337,12 +418,11 @@ func (r *API) AuthenticatePilot(token string) (*h.UserPrincipal, error) {
 		break
 	}
 
-	// captures token information for remote host
-	r.hostUUID = hostUUId
-	r.hostname = hostname
-	r.hostIP = hostIP
-
 	if !admitted {
+		// records the attempt so that the host is listed as awaiting admission
+		if err = r.touchPendingAdmission(hostUUId, hostIP, hostname); err != nil {
+			log.Printf("cannot record admission attempt for Host UUID='%s': %s\n", hostUUId, err)
+		}
 		// log an authentication error
 		msg := fmt.Sprintf("authentication failed for Host UUID='%s', host has not been admitted to service\n", hostUUId)
 		// no user principal is returned as authentication failed
@@ -351,18 +431,104 @@ func (r *API) AuthenticatePilot(token string) (*h.UserPrincipal, error) {
 	}
 
 	// otherwise, returns a principal to signify that authentication succeeded
+	return pilotPrincipal(host), nil
+}
+
+// AuthenticateRegisteringPilot authenticates pilot registration requests
+// unlike AuthenticatePilot, hosts do not have to be admitted as registration precedes admission
+func (r *API) AuthenticateRegisteringPilot(token string) (*h.UserPrincipal, error) {
+	hostUUId, hostIP, hostname, err := parsePilotToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if err = r.checkLegacyToken(hostUUId); err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	return pilotPrincipal(HostIdentity{HostUUID: hostUUId, HostIP: hostIP, Hostname: hostname, Auth: PilotAuthToken}), nil
+}
+
+// parsePilotToken decodes and checks the expiry of a pilot authentication token
+func parsePilotToken(token string) (hostUUID, hostIP, hostname string, err error) {
+	if len(token) == 0 {
+		msg := "authentication token is required and not provided"
+		log.Println(msg)
+		return "", "", "", fmt.Errorf(msg)
+	}
+	value, err := base64.StdEncoding.DecodeString(reverse(token))
+	if err != nil {
+		msg := fmt.Sprintf("error decoding authentication token '%s': %s", token, err)
+		log.Println(msg)
+		return "", "", "", fmt.Errorf(msg)
+	}
+	str := string(value)
+	// token is: hostUUID (0) | hostIP (1) | hostName (2) | timestamp (3)
+	parts := strings.Split(str, "|")
+	if len(parts) != 4 {
+		msg := "error parsing authentication token: invalid format; access denied"
+		log.Println(msg)
+		return "", "", "", fmt.Errorf(msg)
+	}
+	tokenTime, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil {
+		msg := fmt.Sprintf("error parsing authentication token: %s; access denied", err)
+		log.Println(msg)
+		return "", "", "", fmt.Errorf(msg)
+	}
+	timeOk := (time.Now().Unix() - tokenTime) < (5 * 60)
+	if !timeOk {
+		msg := fmt.Sprintf("authentication failed for Host UUID='%s': token has expired", parts[0])
+		log.Println(msg)
+		return "", "", "", fmt.Errorf(msg)
+	}
+	return parts[0], parts[1], parts[2], nil
+}
+
+// pilotPrincipal the principal of an authenticated host pilot
+func pilotPrincipal(host HostIdentity) *h.UserPrincipal {
 	return &h.UserPrincipal{
 		// use a dummy email with the pilot host uuid as username
-		Username: fmt.Sprintf("%s@pilot.com", hostUUId),
+		Username: fmt.Sprintf("%s@pilot.com", host.HostUUID),
 		// no access rights are required for pilot
 		Rights:  h.Controls{},
 		Created: time.Now(),
-	}, nil
+		// the host identity is carried with the principal so that it is scoped to the request
+		Context: host,
+	}
+}
+
+// PilotIdentity returns the identity of the host pilot that authenticated with the principal
+func PilotIdentity(principal *h.UserPrincipal) (HostIdentity, bool) {
+	if principal == nil {
+		return HostIdentity{}, false
+	}
+	host, ok := principal.Context.(HostIdentity)
+	return host, ok && len(host.HostUUID) > 0
 }
 
 // AuthenticateUser authenticate user requests
 func (r *API) AuthenticateUser(request http.Request) (*h.UserPrincipal, error) {
-	// get the credentials from the request header
+	// automation clients authenticate with api tokens and, if enabled, admin users with OpenID Connect tokens
+	if token, ok := bearerToken(request); ok {
+		var (
+			principal *h.UserPrincipal
+			err       error
+		)
+		if IsApiToken(token) {
+			principal, err = r.authenticateApiToken(token)
+		} else if r.oidcEnabled() {
+			principal, err = r.authenticateOIDC(token)
+		} else {
+			err = fmt.Errorf("bearer token is not a pilotctl api token and OIDC login is not enabled")
+		}
+		if err != nil {
+			msg := fmt.Sprintf("WARNING: bearer token authentication failed, %s\n", err)
+			log.Println(msg)
+			return nil, fmt.Errorf(msg)
+		}
+		return principal, nil
+	}
+	// otherwise, get the basic credentials from the request header
 	user, pwd := h.ParseBasicToken(request)
 	// validate the credentials and retrieve user access controls
 	userPrincipal, err := r.iLink.Login(&ilink.Login{
@@ -382,7 +548,11 @@ func (r *API) AuthenticateUser(request http.Request) (*h.UserPrincipal, error) {
 func (r *API) GetPackages() ([]PackageInfo, error) {
 	// the URI to connect to the Artisan registry
 	uri := fmt.Sprintf("%s/repository", r.conf.getArtRegUri())
-	bytes, err := makeRequest(uri, "GET", r.conf.getArtRegUser(), r.conf.getArtRegPwd(), nil)
+	pwd, err := r.registryPwd()
+	if err != nil {
+		return nil, err
+	}
+	bytes, err := makeRequest(uri, "GET", r.conf.getArtRegUser(), pwd, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -434,7 +604,11 @@ func (r *API) GetPackageAPI(name string) ([]*data.FxInfo, error) {
 	}
 	// the URI to connect to the Artisan registry
 	uri := fmt.Sprintf("%s/package/manifest/%s/%s/%s", r.conf.getArtRegUri(), n.Group, n.Name, n.Tag)
-	bytes, err := makeRequest(uri, "GET", r.conf.getArtRegUser(), r.conf.getArtRegPwd(), nil)
+	pwd, err := r.registryPwd()
+	if err != nil {
+		return nil, err
+	}
+	bytes, err := makeRequest(uri, "GET", r.conf.getArtRegUser(), pwd, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -451,6 +625,16 @@ func (r *API) GetPackageAPI(name string) ([]*data.FxInfo, error) {
 
 // PutCommand put the command in the Onix database
 func (r *API) PutCommand(cmd *Cmd) error {
+	// secret values are kept in the secret store and only referenced in Onix
+	// the secrets sealed for the previous version of the command are removed once they are no longer referenced
+	previous, prevErr := r.GetCommand(strings.Replace(cmd.Key, " ", "", -1))
+	if err := sealCommandSecrets(r.secrets, cmd); err != nil {
+		return err
+	}
+	pwd, err := r.registryPwdRef()
+	if err != nil {
+		return err
+	}
 	var meta map[string]interface{}
 	m := make(map[string]interface{}, 0)
 	m["input"] = cmd.Input
@@ -473,7 +657,7 @@ func (r *API) PutCommand(cmd *Cmd) error {
 			"FX":      cmd.Function,
 			// ensures credentials are for the registry tied to pilotctl
 			"USER":          r.conf.getArtRegUser(),
-			"PWD":           r.conf.getArtRegPwd(),
+			"PWD":           pwd,
 			"VERBOSE":       cmd.Verbose,
 			"CONTAINERISED": cmd.Containerised,
 		},
@@ -484,6 +668,9 @@ func (r *API) PutCommand(cmd *Cmd) error {
 	if err != nil {
 		return fmt.Errorf("cannot set command in Onix: %s\n", err)
 	}
+	if prevErr == nil {
+		removeCommandSecrets(r.secrets, previous, cmd)
+	}
 	return nil
 }
 
@@ -519,6 +706,9 @@ func (r *API) GetCommand(cmdName string) (*Cmd, error) {
 	if err != nil {
 		return nil, fmt.Errorf("cannot get command with key '%s' from Onix: %s", cmdName, err)
 	}
+	if item == nil {
+		return nil, fmt.Errorf("command with key '%s' not found in Onix", cmdName)
+	}
 	input, err := getInputFromMap(item.Meta)
 	if err != nil {
 		return nil, fmt.Errorf("cannot transform input map: %s", err)
@@ -537,10 +727,14 @@ func (r *API) GetCommand(cmdName string) (*Cmd, error) {
 }
 
 func (r *API) DeleteCommand(cmdName string) (string, error) {
+	cmd, cmdErr := r.GetCommand(cmdName)
 	result, err := r.iLink.DeleteItem(&ilink.Item{Key: cmdName})
 	if err != nil {
 		return "", fmt.Errorf("cannot delete command with key '%s' from Onix: %s", cmdName, err)
 	}
+	if cmdErr == nil {
+		removeCommandSecrets(r.secrets, cmd, nil)
+	}
 	return result.Operation, nil
 }
 
@@ -603,13 +797,17 @@ func (r *API) GetDictionaries(values bool) ([]*Dictionary, error) {
 	return result, nil
 }
 
-func (r *API) CompleteJob(status *JobResult) error {
+func (r *API) CompleteJob(hostUUID string, status *JobResult) error {
+	if err := r.checkJobDelivery(hostUUID, status); err != nil {
+		return err
+	}
 	logMsg := status.Log
 	// if there was a failure, and we have an error message, add it to the log
 	if !status.Success && len(status.Err) > 0 {
 		logMsg = fmt.Sprintf("%s !!! ERROR: %s\n", logMsg, status.Err)
 	}
-	return r.db.RunCommand("select pilotctl_complete_job($1, $2, $3)", status.JobId, logMsg, !status.Success)
+	// the job is only completed if it was dispatched to the host
+	return r.db.RunCommand("select pilotctl_complete_job($1, $2, $3, $4)", status.JobId, logMsg, !status.Success, hostUUID)
 }
 
 func (r *API) GetAreas(orgGroup string) ([]Area, error) {
@@ -675,15 +873,29 @@ func (r *API) GetOrgGroups() ([]Org, error) {
 	return orgs, nil
 }
 
-func (r *API) CreateJobBatch(info JobBatchInfo) (int64, error) {
+// the user must be able to run jobs on all the hosts in the batch, the batch is owned by the identity of the principal
+func (r *API) CreateJobBatch(principal *h.UserPrincipal, access *Access, info JobBatchInfo) (int64, error) {
 	if len(info.HostUUID) == 0 {
 		return -1, fmt.Errorf("host UUID is missing\n")
 	}
 	if len(info.FxKey) == 0 {
 		return -1, fmt.Errorf("fx is missing\n")
 	}
+	scope, err := r.hostsInScope(access, PermRun, info.HostUUID)
+	if err != nil {
+		return -1, err
+	}
+	for _, uuid := range info.HostUUID {
+		if scope != nil && !scope[uuid] {
+			return -1, fmt.Errorf("%w: cannot run jobs on host '%s'", ErrForbidden, uuid)
+		}
+	}
 	// create a job batch identifier
-	rows, err := r.db.Query("select * from pilotctl_create_job_batch($1, $2, $3, $4)", info.Name, info.Notes, "???", info.Label)
+	var owner string
+	if principal != nil {
+		owner = principal.Username
+	}
+	rows, err := r.db.Query("select * from pilotctl_create_job_batch($1, $2, $3, $4, $5)", info.Name, info.Notes, owner, info.Label, OwnerIdentity(principal))
 	if err != nil {
 		return -1, fmt.Errorf("cannot create job batch: %s\n", err)
 	}
@@ -696,6 +908,7 @@ func (r *API) CreateJobBatch(info JobBatchInfo) (int64, error) {
 	}
 	// add jobs to the batch using the batch ID
 	var returnError error
+	created := make([]string, 0, len(info.HostUUID))
 	for _, uuid := range info.HostUUID {
 		err = r.db.RunCommand("select pilotctl_create_job($1, $2, $3, $4)", batchId, uuid, info.FxKey, info.FxVersion)
 		// if there is an error creating the job
@@ -705,13 +918,18 @@ func (r *API) CreateJobBatch(info JobBatchInfo) (int64, error) {
 			}
 			// accumulates the error and continue with the next job
 			returnError = fmt.Errorf("can't create job: %s\n", returnError)
+			continue
 		}
+		created = append(created, uuid)
 	}
+	// hosts waiting for a job get it straight away
+	notifyJob(created...)
 	// return any job creation error
 	return batchId, returnError
 }
 
-func (r *API) GetJobs(oGroup, or, ar, loc string, batchId *int64) ([]Job, error) {
+// only the jobs of the hosts the user can view are returned
+func (r *API) GetJobs(access *Access, oGroup, or, ar, loc string, batchId *int64) ([]Job, error) {
 	jobs := make([]Job, 0)
 	rows, err := r.db.Query("select * from pilotctl_get_jobs($1, $2, $3, $4, $5)", oGroup, or, ar, loc, batchId)
 	if err != nil {
@@ -739,6 +957,9 @@ func (r *API) GetJobs(oGroup, or, ar, loc string, batchId *int64) ([]Job, error)
 		if err != nil {
 			return nil, fmt.Errorf("cannot scan job row: %e\n", err)
 		}
+		if !access.CanAt(PermView, orgGroup.String, org.String, area.String) {
+			continue
+		}
 		jobs = append(jobs, Job{
 			Id:         id,
 			HostUUID:   hostUUID,
@@ -782,32 +1003,148 @@ func (r *API) GetHost(uuid string) (*Host, error) {
 	return nil, fmt.Errorf("host uuid '%s' cannot be found in data source\n", uuid)
 }
 
-func (r *API) GetJobBatches(name, owner *string, from, to *time.Time, label *[]string) ([]JobBatch, error) {
-	batches := make([]JobBatch, 0)
-	rows, err := r.db.Query("select * from pilotctl_get_job_batches($1, $2, $3, $4, $5)", name, from, to, label, owner)
+// GetJobBatches get the job batches matching the filter
+// only the batches owned by the identity of the principal or having jobs on hosts the user can view are returned
+func (r *API) GetJobBatches(principal *h.UserPrincipal, access *Access, name, owner *string, from, to *time.Time, label *[]string) ([]JobBatch, error) {
+	orgGroups, orgs, areas := scopeArgs(access, PermView)
+	var user *string
+	if access != nil {
+		ownerId := OwnerIdentity(principal)
+		user = &ownerId
+	}
+	rows, err := r.db.Query("select * from pilotctl_get_job_batches($1, $2, $3, $4, $5, $6, $7, $8, $9)", name, from, to, label, owner, orgGroups, orgs, areas, user)
 	if err != nil {
 		return nil, fmt.Errorf("cannot get job batches: %s\n", err)
 	}
+	return scanJobBatches(rows)
+}
+
+// GetJobBatch get a job batch using its identifier
+func (r *API) GetJobBatch(batchId int64) (*JobBatch, error) {
+	rows, err := r.db.Query("select * from pilotctl_get_job_batch($1)", batchId)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get job batch: %s\n", err)
+	}
+	batches, err := scanJobBatches(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(batches) == 0 {
+		return nil, fmt.Errorf("job batch %d not found", batchId)
+	}
+	return &batches[0], nil
+}
+
+// CancelJobBatch cancels the jobs of a batch that have not been picked up by their hosts yet
+// returning the number of cancelled jobs
+func (r *API) CancelJobBatch(batchId int64, principal *h.UserPrincipal, access *Access) (int, error) {
+	if _, err := r.batchOwnedBy(batchId, principal, access); err != nil {
+		return 0, err
+	}
+	rows, err := r.db.Query("select * from pilotctl_cancel_job_batch($1, $2)", batchId, principal.Username)
+	if err != nil {
+		return 0, fmt.Errorf("cannot cancel job batch: %s\n", err)
+	}
+	defer rows.Close()
+	var cancelled int
+	if rows.Next() {
+		if err = rows.Scan(&cancelled); err != nil {
+			return 0, fmt.Errorf("cannot scan cancelled jobs: %s\n", err)
+		}
+	}
+	return cancelled, rows.Err()
+}
+
+// RerunJobBatch creates a new batch, owned by the user, running the function of a previous batch on the same hosts
+// if failedOnly is true, only the hosts where the job failed are included
+func (r *API) RerunJobBatch(batchId int64, principal *h.UserPrincipal, access *Access, failedOnly bool) (int64, error) {
+	batch, err := r.batchOwnedBy(batchId, principal, access)
+	if err != nil {
+		return -1, err
+	}
+	jobs, err := r.GetJobs(nil, "", "", "", "", &batchId)
+	if err != nil {
+		return -1, err
+	}
+	info := JobBatchInfo{
+		Name:  batch.Name,
+		Notes: fmt.Sprintf("re-run of job batch %d", batchId),
+		Label: batch.Label,
+	}
+	for _, job := range jobs {
+		if failedOnly && !job.Error {
+			continue
+		}
+		info.FxKey, info.FxVersion = job.FxKey, job.FxVersion
+		info.HostUUID = append(info.HostUUID, job.HostUUID)
+	}
+	if len(info.HostUUID) == 0 {
+		return -1, fmt.Errorf("job batch %d has no jobs to re-run", batchId)
+	}
+	return r.CreateJobBatch(principal, access, info)
+}
+
+// batchOwnedBy returns the batch if the user owns it or has elevated rights
+// with role based access control, elevated rights means being an admin without a logistics scope or an admin of
+// all the hosts in the batch, so that a batch without jobs can only be managed by its owner or an unscoped admin;
+// otherwise it means being one of the configured administrators
+func (r *API) batchOwnedBy(batchId int64, principal *h.UserPrincipal, access *Access) (*JobBatch, error) {
+	batch, err := r.GetJobBatch(batchId)
+	if err != nil {
+		return nil, err
+	}
+	// ownership is checked against the identity of the owner as usernames can be chosen by users
+	if len(batch.OwnerId) > 0 && batch.OwnerId == OwnerIdentity(principal) {
+		return batch, nil
+	}
+	if access == nil {
+		if containsKey(r.conf.RBACAdmins(), principal.Username) {
+			return batch, nil
+		}
+		return nil, fmt.Errorf("%w: job batch %d is owned by '%s'", ErrForbidden, batchId, batch.Owner)
+	}
+	if access.CanGlobally(PermAdmin) {
+		return batch, nil
+	}
+	jobs, err := r.GetJobs(nil, "", "", "", "", &batchId)
+	if err != nil {
+		return nil, err
+	}
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("%w: job batch %d is owned by '%s' and has no jobs in a scope you administer", ErrForbidden, batchId, batch.Owner)
+	}
+	for _, job := range jobs {
+		if !access.CanAt(PermAdmin, job.OrgGroup, job.Org, job.Area) {
+			return nil, fmt.Errorf("%w: job batch %d is owned by '%s'", ErrForbidden, batchId, batch.Owner)
+		}
+	}
+	return batch, nil
+}
+
+func scanJobBatches(rows pgx.Rows) ([]JobBatch, error) {
+	batches := make([]JobBatch, 0)
 	var (
 		id      int64
-		name2   string
+		name    string
 		notes   string
 		created sql.NullTime
-		owner2  string
+		owner   string
 		labels  []string
 		jobs    int
+		ownerId sql.NullString
 	)
 	for rows.Next() {
-		err = rows.Scan(&id, &name2, &notes, &labels, &created, &owner2, &jobs)
+		err := rows.Scan(&id, &name, &notes, &labels, &created, &owner, &jobs, &ownerId)
 		if err != nil {
 			return nil, fmt.Errorf("cannot scan job batch row: %e\n", err)
 		}
 		batches = append(batches, JobBatch{
 			BatchId: id,
-			Name:    name2,
+			Name:    name,
 			Notes:   notes,
 			Label:   labels,
-			Owner:   owner2,
+			Owner:   owner,
+			OwnerId: ownerId.String,
 			Jobs:    jobs,
 			Created: created.Time,
 		})
@@ -897,20 +1234,6 @@ func (r *API) UndoRegistration(mac string) error {
 	return r.db.RunCommand("select pilotctl_unset_registration($1)", mac)
 }
 
-func (r *API) DecommissionHost(hostUUID string) error {
-	if len(hostUUID) == 0 {
-		return fmt.Errorf("HOST-UUID is missing")
-	}
-	// set a decom date for the host
-	err := r.db.RunCommand("select pilotctl_decom_host($1)", hostUUID)
-	if err != nil {
-		return err
-	}
-	// delete host from cmdb
-	_, err = r.iLink.DeleteItem(&ilink.Item{Key: strings.ToUpper(fmt.Sprintf("HOST:%s", hostUUID))})
-	return err
-}
-
 func (r *API) UpsertCVE(hostUUID string, rep *CveReport) error {
 	scanDate := time.Now().UTC()
 	for _, cve := range rep.Cves {
@@ -968,8 +1291,10 @@ func (r *API) UpsertCVE(hostUUID string, rep *CveReport) error {
 	return nil
 }
 
-func (r *API) GetCVEBaseline(score float64, label []string) ([]CvePackage, error) {
-	rows, err := r.db.Query("select * from pilotctl_get_cve_baseline($1, $2)", score, label)
+// only the CVEs of the hosts the user can view are returned
+func (r *API) GetCVEBaseline(access *Access, score float64, label []string) ([]CvePackage, error) {
+	orgGroups, orgs, areas := scopeArgs(access, PermView)
+	rows, err := r.db.Query("select * from pilotctl_get_cve_baseline($1, $2, $3, $4, $5)", score, label, orgGroups, orgs, areas)
 	if err != nil {
 		return nil, fmt.Errorf("cannot get CVE baseline: %s\n", err)
 	}
@@ -994,18 +1319,13 @@ func (r *API) GetCVEBaseline(score float64, label []string) ([]CvePackage, error
 	return list, nil
 }
 
-// SubmitMetrics post the metrics to a backend using a connector
+// SubmitMetrics post the metrics to the telemetry sink of the channel
 func (r *API) SubmitMetrics(channel string, content []byte) ConnResult {
-	var (
-		pbUnmarshall = pmetric.ProtoUnmarshaler{}
-		conn         string
-		ok           bool
-		dpConv       = NewOtelDataPointConverter()
-	)
-	// find the connector to use based on the specified channel
-	if conn, ok = connectorName(channel); !ok {
+	pbUnmarshall := pmetric.ProtoUnmarshaler{}
+	sink, err := r.telemetrySink(channel)
+	if err != nil {
 		return ConnResult{
-			Error:             fmt.Sprintf("telemetry connector not defined, skipping telemetry recording"),
+			Error:             err.Error(),
 			TotalEntries:      -1,
 			SuccessfulEntries: -1,
 		}
@@ -1018,7 +1338,10 @@ func (r *API) SubmitMetrics(channel string, content []byte) ConnResult {
 			SuccessfulEntries: -1,
 		}
 	}
-	result := new(ConnResult)
+	result := ConnResult{
+		TotalEntries:      len(files),
+		SuccessfulEntries: len(files),
+	}
 	for i, file := range files {
 		// unmarshall the protobuf content
 		metrics, err := pbUnmarshall.UnmarshalMetrics(file)
@@ -1029,71 +1352,25 @@ func (r *API) SubmitMetrics(channel string, content []byte) ConnResult {
 				SuccessfulEntries: i,
 			}
 		}
-		// converts content to json
-		dataPoints, err := dpConv.Convert(metrics)
-		if err != nil {
-			return ConnResult{
-				Error:             fmt.Sprintf("cannot convert open telemetry metrics to data points: %s", err),
-				TotalEntries:      len(files),
-				SuccessfulEntries: i,
-			}
-		}
-		data, err := json.Marshal(dataPoints)
-		if err != nil {
-			return ConnResult{
-				Error:             fmt.Sprintf("cannot marshal data points to json: %s", err),
-				TotalEntries:      len(files),
-				SuccessfulEntries: i,
-			}
-		}
-		pointsFile := dataPointsFilename()
-		err = os.WriteFile(pointsFile, data, 0755)
-		if err != nil {
-			return ConnResult{
-				Error:             fmt.Sprintf("cannot write data points to json file: %s", err),
-				TotalEntries:      len(files),
-				SuccessfulEntries: i,
-			}
-		}
-		// execute the connector passing in the json content
-		dir, _ := os.Getwd()
-		c := exec.Command(fmt.Sprintf("%s/%s", dir, conn), pointsFile)
-		c.Env = os.Environ()
-		outBytes, err := c.Output()
-		if err != nil {
-			return ConnResult{
-				Error:             fmt.Sprintf("connector %s error: %s", conn, err),
-				TotalEntries:      len(files),
-				SuccessfulEntries: i,
-			}
-		}
-		_ = os.Remove(pointsFile)
-		// extracts the response for the stdout
-		out := regexp.MustCompile("{\"e\":.*}").FindString(string(outBytes[:]))
-		if len(out) == 0 {
-			return ConnResult{
-				Error:             fmt.Sprintf("connector %s gave an empty response, execution failed: %s", conn, err),
-				TotalEntries:      len(files),
-				SuccessfulEntries: i,
-			}
+		// the legacy connector reports its own result
+		var connResult *ConnResult
+		if legacy, ok := sink.(*execSink); ok {
+			connResult, err = legacy.metrics(channel, metrics)
+		} else {
+			err = sink.Metrics(channel, metrics)
 		}
-		err = json.Unmarshal([]byte(out), result)
 		if err != nil {
 			return ConnResult{
-				Error:             fmt.Sprintf("connector %s gave an invalid result format, unmarshalling failed: %s", conn, err),
+				Error:             fmt.Sprintf("cannot record metrics: %s", err),
 				TotalEntries:      len(files),
 				SuccessfulEntries: i,
 			}
 		}
-		if len(result.Error) > 0 {
-			return ConnResult{
-				Error:             fmt.Sprintf("connector %s returned error: %s", conn, result.Error),
-				TotalEntries:      len(files),
-				SuccessfulEntries: i,
-			}
+		if connResult != nil {
+			result = *connResult
 		}
 	}
-	return *result
+	return result
 }
 
 // dataPointsFilename works out a unique filename for the datapoints file in the telemetry buffer folder
@@ -1103,19 +1380,13 @@ func dataPointsFilename() string {
 	return filepath.Join(path, fmt.Sprintf("%d.json", time.Now().UTC().UnixNano()))
 }
 
-// SubmitLogs post the logs to a backend using a connector
-// TODO: use file buffer to pass logs to connector as done in SubmitMetrics
+// SubmitLogs post the logs to the telemetry sink of the channel
 func (r *API) SubmitLogs(channel string, content []byte) ConnResult {
-	var (
-		pbUnmarshall = plog.ProtoUnmarshaler{}
-		jsonMarshal  = plog.JSONMarshaler{}
-		conn         string
-		ok           bool
-	)
-	// find the connector to use based on the specified channel
-	if conn, ok = connectorName(channel); !ok {
+	pbUnmarshall := plog.ProtoUnmarshaler{}
+	sink, err := r.telemetrySink(channel)
+	if err != nil {
 		return ConnResult{
-			Error:             fmt.Sprintf("telemetry connector not defined, skipping telemetry recording"),
+			Error:             err.Error(),
 			TotalEntries:      -1,
 			SuccessfulEntries: -1,
 		}
@@ -1128,7 +1399,10 @@ func (r *API) SubmitLogs(channel string, content []byte) ConnResult {
 			SuccessfulEntries: -1,
 		}
 	}
-	result := new(ConnResult)
+	result := ConnResult{
+		TotalEntries:      len(files),
+		SuccessfulEntries: len(files),
+	}
 	for i, file := range files {
 		// unmarshall the protobuf content
 		logs, err := pbUnmarshall.UnmarshalLogs(file)
@@ -1139,47 +1413,25 @@ func (r *API) SubmitLogs(channel string, content []byte) ConnResult {
 				SuccessfulEntries: i,
 			}
 		}
-		// converts content to json
-		data, err := jsonMarshal.MarshalLogs(logs)
-		if err != nil {
-			return ConnResult{
-				Error:             fmt.Sprintf("cannot marshal request to json: %s", err),
-				TotalEntries:      len(files),
-				SuccessfulEntries: i,
-			}
-		}
-		// base 64 encode the json content
-		b64Data := base64.StdEncoding.EncodeToString(data)
-		// execute the connector passing in the json content
-		dir, _ := os.Getwd()
-		c := exec.Command(fmt.Sprintf("%s/%s", dir, conn), b64Data)
-		c.Env = os.Environ()
-		outBytes, err := c.Output()
-		out := regexp.MustCompile("{\"e\":.*}").FindString(string(outBytes[:]))
-		if len(out) == 0 {
-			return ConnResult{
-				Error:             fmt.Sprintf("connector %s gave an empty response, execution failed: %s", conn, err),
-				TotalEntries:      len(files),
-				SuccessfulEntries: i,
-			}
+		// the legacy connector reports its own result
+		var connResult *ConnResult
+		if legacy, ok := sink.(*execSink); ok {
+			connResult, err = legacy.logs(channel, logs)
+		} else {
+			err = sink.Logs(channel, logs)
 		}
-		err = json.Unmarshal([]byte(out), result)
 		if err != nil {
 			return ConnResult{
-				Error:             fmt.Sprintf("connector %s gave an invalid result format, unmarshalling failed: %s", conn, err),
+				Error:             fmt.Sprintf("cannot record logs: %s", err),
 				TotalEntries:      len(files),
 				SuccessfulEntries: i,
 			}
 		}
-		if len(result.Error) > 0 {
-			return ConnResult{
-				Error:             fmt.Sprintf("connector %s returned error: %s", conn, result.Error),
-				TotalEntries:      len(files),
-				SuccessfulEntries: i,
-			}
+		if connResult != nil {
+			result = *connResult
 		}
 	}
-	return *result
+	return result
 }
 
 func reverse(str string) (result string) {
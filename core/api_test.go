@@ -19,10 +19,13 @@
 package core
 
 import (
+	"encoding/base64"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestSubmitMetrics(t *testing.T) {
@@ -63,3 +66,100 @@ func TestSubmitMetrics(t *testing.T) {
 		fmt.Println(r.Error)
 	}
 }
+
+// authenticates many hosts concurrently with the shared API and checks each request gets its own host identity
+func TestPilotIdentityConcurrency(t *testing.T) {
+	os.Setenv("PILOT_CTL_LEGACY_PILOT_TOKEN", "allow")
+	defer os.Unsetenv("PILOT_CTL_LEGACY_PILOT_TOKEN")
+	// no internal CA, so that no host can hold a client certificate
+	os.Setenv("PILOT_CTL_CA_PATH", t.TempDir())
+	defer os.Unsetenv("PILOT_CTL_CA_PATH")
+	api := &API{conf: NewConf()}
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			hostUUID := fmt.Sprintf("host-%03d", i)
+			token := reverse(base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s|10.0.0.%d|%s|%d", hostUUID, i%255, hostUUID, time.Now().Unix()))))
+			principal, err := api.AuthenticateRegisteringPilot(token)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			// yields so that other requests authenticate before the identity is read back
+			time.Sleep(time.Millisecond)
+			host, ok := PilotIdentity(principal)
+			if !ok || host.HostUUID != hostUUID {
+				t.Errorf("expected identity of host '%s', got '%s'", hostUUID, host.HostUUID)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// pings the shared API concurrently from many authenticated hosts and checks each ping is recorded for its own host
+// requires a pilotctl database, run with -race to detect any host identity shared between requests
+func TestConcurrentPings(t *testing.T) {
+	if len(os.Getenv("PILOT_CTL_DB_HOST")) == 0 {
+		t.Skip("PILOT_CTL_DB_HOST is not defined")
+	}
+	os.Setenv("PILOT_CTL_LEGACY_PILOT_TOKEN", "allow")
+	defer os.Unsetenv("PILOT_CTL_LEGACY_PILOT_TOKEN")
+	os.Setenv("PILOT_CTL_CA_PATH", t.TempDir())
+	defer os.Unsetenv("PILOT_CTL_CA_PATH")
+	api, err := NewAPI(NewConf())
+	if err != nil {
+		t.Skipf("pilotctl database is not available: %s", err)
+	}
+	start := time.Now().Add(-time.Second)
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			hostUUID := fmt.Sprintf("ping-host-%03d", i)
+			token := reverse(base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s|10.0.1.%d|%s|%d", hostUUID, i%255, hostUUID, time.Now().Unix()))))
+			principal, err := api.AuthenticateRegisteringPilot(token)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			host, _ := PilotIdentity(principal)
+			// only the odd hosts ping so that a ping recorded against another host shows up in the database
+			if i%2 == 0 {
+				return
+			}
+			if _, _, _, err = api.Ping(host.HostUUID); err != nil {
+				t.Error(err)
+				return
+			}
+			// the identity must not have been changed by the pings of other hosts
+			if host, _ = PilotIdentity(principal); host.HostUUID != hostUUID {
+				t.Errorf("expected ping from host '%s', got '%s'", hostUUID, host.HostUUID)
+			}
+			api.HostPingInterval(host.HostUUID, false, 0)
+		}(i)
+	}
+	wg.Wait()
+	hosts, err := api.GetHosts(nil, "", "", "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]time.Time)
+	for _, host := range hosts {
+		if host.LastSeen > 0 {
+			seen[host.HostUUID] = time.Unix(0, host.LastSeen)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		hostUUID := fmt.Sprintf("ping-host-%03d", i)
+		pinged := seen[hostUUID].After(start)
+		if i%2 == 1 && !pinged {
+			t.Errorf("ping of host '%s' not recorded", hostUUID)
+		}
+		if i%2 == 0 && pinged {
+			t.Errorf("host '%s' did not ping but was seen at %s", hostUUID, seen[hostUUID])
+		}
+	}
+}
@@ -0,0 +1,316 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	h "southwinds.dev/http"
+	. "southwinds.dev/pilotctl/types"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the maximum size of a request payload recorded in the audit log
+const maxAuditPayload = 64 * 1024
+
+type auditKey struct{}
+
+// auditRecord collects the information about an action that is only known by its handler
+type auditRecord struct {
+	before string
+}
+
+// the user recorded for the actions of requests that are not authenticated
+const anonymousUser = "anonymous"
+
+// responseRecorder holds the response written by a handler until the outcome of the action has been recorded
+// in the audit log
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (s *responseRecorder) WriteHeader(status int) {
+	s.status = status
+}
+
+func (s *responseRecorder) Write(b []byte) (int, error) {
+	return s.body.Write(b)
+}
+
+// AuditMiddleware records every mutating request made by an admin user or not authenticated in the audit log
+// it must be added after the authentication middleware so that the user principal is known;
+// a pending entry is recorded before the action, which is refused if the entry cannot be recorded, and an entry with
+// the outcome of the action is recorded after it; the response is always sent once the action has run, as it can
+// carry values that are only returned once, such as new tokens or credentials
+func AuditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isMutating(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		principal := h.GetUserPrincipal(r)
+		// actions of host pilots are not administrative actions
+		if _, isPilot := PilotIdentity(principal); isPilot {
+			next.ServeHTTP(w, r)
+			return
+		}
+		username := PrincipalOwner(principal)
+		if principal == nil {
+			username = anonymousUser
+		}
+		payload, err := auditPayload(r)
+		if err != nil {
+			http.Error(w, "cannot read request body", http.StatusBadRequest)
+			return
+		}
+		// actions made with api tokens are recorded against the user who created the token
+		pending := AuditEntry{
+			Time:     time.Now().UTC().Truncate(time.Microsecond),
+			Username: username,
+			Action:   fmt.Sprintf("%s %s", r.Method, routeTemplate(r)),
+			Target:   auditTarget(r),
+			After:    payload,
+			Status:   AuditPending,
+			SourceIP: remoteIP(*r),
+		}
+		if err = Api().AppendAudit(&pending); err != nil {
+			log.Printf("ERROR: cannot record action '%s' by '%s' in the audit log: %s\n", pending.Action, pending.Username, err)
+			http.Error(w, "the action could not be recorded in the audit log and was not performed; check the server logs\n", http.StatusServiceUnavailable)
+			return
+		}
+		record := new(auditRecord)
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), auditKey{}, record)))
+		outcome := pending
+		outcome.Time = time.Now().UTC().Truncate(time.Microsecond)
+		outcome.Before = record.before
+		outcome.Status = recorder.status
+		if err = Api().AppendAudit(&outcome); err != nil {
+			// the action has been performed, its pending entry remains in the audit log without an outcome
+			log.Printf("ERROR: cannot record the outcome, status %d, of action '%s' by '%s' in the audit log (pending entry %s): %s\n",
+				outcome.Status, outcome.Action, outcome.Username, pending.Hash, err)
+		}
+		w.WriteHeader(recorder.status)
+		_, _ = w.Write(recorder.body.Bytes())
+	})
+}
+
+// AuditBefore records the state of the target of an action before it is changed
+func AuditBefore(r *http.Request, before interface{}) {
+	record, ok := r.Context().Value(auditKey{}).(*auditRecord)
+	if !ok || before == nil {
+		return
+	}
+	if content, err := json.Marshal(before); err == nil {
+		record.before = redactSecrets(content)
+	}
+}
+
+func isMutating(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// auditPayload reads the request payload so that it can be recorded, leaving the body readable by the handler
+// payloads that are not json or too large are summarised instead
+func auditPayload(r *http.Request) (string, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return "", nil
+	}
+	var (
+		body []byte
+		err  error
+	)
+	if _, buffered := r.Body.(*bufferedBody); buffered {
+		body, err = requestBody(*r)
+	} else {
+		body, err = io.ReadAll(r.Body)
+		_ = r.Body.Close()
+		r.Body = &bufferedBody{Reader: bytes.NewReader(body)}
+	}
+	if err != nil {
+		return "", err
+	}
+	contentType := r.Header.Get("Content-Type")
+	if len(body) > maxAuditPayload || (len(contentType) > 0 && !strings.Contains(contentType, "json")) {
+		return fmt.Sprintf("<%d bytes of %s>", len(body), contentType), nil
+	}
+	return redactSecrets(body), nil
+}
+
+// the value recorded in place of a secret value
+const redacted = "<redacted>"
+
+// redactSecrets removes secret values, such as passwords, tokens, and the values of command secrets and keys,
+// from a json payload; secret references are kept and the payload is returned unchanged if it has no secret values
+func redactSecrets(content []byte) string {
+	var doc interface{}
+	if err := json.Unmarshal(content, &doc); err != nil {
+		return string(content)
+	}
+	if !redactValue(doc, false) {
+		return string(content)
+	}
+	if result, err := json.Marshal(doc); err == nil {
+		return string(result)
+	}
+	return redacted
+}
+
+// redactValue redacts the secret values in a json document returning true if any value was redacted
+// isSecret is true if the value is an item of a list of secrets or keys
+func redactValue(doc interface{}, isSecret bool) bool {
+	found := false
+	switch v := doc.(type) {
+	case []interface{}:
+		for _, item := range v {
+			found = redactValue(item, isSecret) || found
+		}
+	case map[string]interface{}:
+		// a value of the secret store
+		_, hasPath := v["path"]
+		_, hasKey := v["key"]
+		for name, value := range v {
+			switch str, isStr := value.(string); {
+			case isStr && (strings.EqualFold(name, "pwd") || strings.EqualFold(name, "password") || strings.EqualFold(name, "token") ||
+				(strings.EqualFold(name, "value") && (isSecret || hasPath && hasKey))):
+				if len(str) > 0 && !IsSecretRef(str) {
+					v[name] = redacted
+					found = true
+				}
+			default:
+				_, isList := value.([]interface{})
+				found = redactValue(value, strings.EqualFold(name, "secret") || isList && strings.EqualFold(name, "key")) || found
+			}
+		}
+	}
+	return found
+}
+
+func routeTemplate(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return r.URL.Path
+}
+
+// auditTarget returns the path variables identifying the target of an action
+func auditTarget(r *http.Request) string {
+	vars := mux.Vars(r)
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	target := make([]string, 0, len(names))
+	for _, name := range names {
+		target = append(target, fmt.Sprintf("%s=%s", name, vars[name]))
+	}
+	return strings.Join(target, ",")
+}
+
+// serialises appends from this instance; appends from other instances are detected by the database
+// rejecting an entry not chained to the current head of the log
+var auditMu sync.Mutex
+
+// AppendAudit chains an entry to the head of the audit log and appends it
+func (r *API) AppendAudit(entry *AuditEntry) error {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		if entry.PrevHash, err = r.auditHead(); err != nil {
+			return err
+		}
+		entry.Hash = entry.ComputeHash()
+		err = r.db.RunCommand("select pilotctl_append_audit($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)",
+			entry.Time, entry.Username, entry.Action, entry.Target, entry.Before, entry.After, entry.Status, entry.SourceIP,
+			entry.PrevHash, entry.Hash)
+		if err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot append audit entry: %s\n", err)
+}
+
+// auditHead returns the hash of the last entry in the audit log
+func (r *API) auditHead() (string, error) {
+	rows, err := r.db.Query("select * from pilotctl_get_audit_head()")
+	if err != nil {
+		return "", fmt.Errorf("cannot get audit log head: %s\n", err)
+	}
+	defer rows.Close()
+	var head sql.NullString
+	if rows.Next() {
+		if err = rows.Scan(&head); err != nil {
+			return "", fmt.Errorf("cannot scan audit log head: %s\n", err)
+		}
+	}
+	return head.String, rows.Err()
+}
+
+// GetAuditLog returns the audit entries matching the filter in sequence order
+func (r *API) GetAuditLog(filter AuditFilter) ([]AuditEntry, error) {
+	rows, err := r.db.Query("select * from pilotctl_get_audit_log($1, $2, $3, $4, $5)",
+		filter.Username, filter.Action, filter.Target, filter.From, filter.To)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get audit log: %s\n", err)
+	}
+	var (
+		e                     AuditEntry
+		target, before, after sql.NullString
+	)
+	entries := make([]AuditEntry, 0)
+	for rows.Next() {
+		err = rows.Scan(&e.Seq, &e.Time, &e.Username, &e.Action, &target, &before, &after, &e.Status, &e.SourceIP, &e.PrevHash, &e.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("cannot scan audit log row: %s\n", err)
+		}
+		e.Target, e.Before, e.After = target.String, before.String, after.String
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// VerifyAuditLog checks the hash chain of the whole audit log
+func (r *API) VerifyAuditLog() (*AuditVerification, error) {
+	entries, err := r.GetAuditLog(AuditFilter{})
+	if err != nil {
+		return nil, err
+	}
+	result := VerifyAuditChain(entries)
+	return &result, nil
+}
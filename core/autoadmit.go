@@ -0,0 +1,290 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	. "southwinds.dev/pilotctl/types"
+	"time"
+)
+
+// SetAdmissionRule creates or updates an auto-admission rule
+// the rule logistics are validated against the logistics hierarchy
+func (r *API) SetAdmissionRule(rule AdmissionRule) error {
+	if err := rule.Valid(); err != nil {
+		return err
+	}
+	if err := newLogisticsValidator(r).validate(rule.OrgGroup, rule.Org, rule.Area, rule.Location); err != nil {
+		return fmt.Errorf("admission rule '%s' logistics are not valid: %s", rule.Key, err)
+	}
+	return r.db.RunCommand("select pilotctl_set_admission_rule($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)",
+		rule.Key,
+		rule.Description,
+		rule.Priority,
+		rule.Enabled,
+		rule.MacPrefix,
+		rule.HostnamePattern,
+		rule.Subnet,
+		rule.HardwareId,
+		rule.OrgGroup,
+		rule.Org,
+		rule.Area,
+		rule.Location,
+		rule.Label)
+}
+
+// GetAdmissionRules returns the auto-admission rules in order of evaluation
+func (r *API) GetAdmissionRules() ([]AdmissionRule, error) {
+	rows, err := r.db.Query("select * from pilotctl_get_admission_rules()")
+	if err != nil {
+		return nil, fmt.Errorf("cannot get admission rules: %s\n", err)
+	}
+	var (
+		key, orgGroup, org, area, location                  string
+		description, macPrefix, pattern, subnet, hardwareId sql.NullString
+		priority                                            int
+		enabled                                             bool
+		labels                                              []string
+	)
+	rules := make([]AdmissionRule, 0)
+	for rows.Next() {
+		err = rows.Scan(&key, &description, &priority, &enabled, &macPrefix, &pattern, &subnet, &hardwareId, &orgGroup, &org, &area, &location, &labels)
+		if err != nil {
+			return nil, fmt.Errorf("cannot scan admission rule row: %s\n", err)
+		}
+		rules = append(rules, AdmissionRule{
+			Key:             key,
+			Description:     description.String,
+			Priority:        priority,
+			Enabled:         enabled,
+			MacPrefix:       macPrefix.String,
+			HostnamePattern: pattern.String,
+			Subnet:          subnet.String,
+			HardwareId:      hardwareId.String,
+			OrgGroup:        orgGroup,
+			Org:             org,
+			Area:            area,
+			Location:        location,
+			Label:           labels,
+		})
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].Priority < rules[j].Priority
+	})
+	return rules, rows.Err()
+}
+
+// DeleteAdmissionRule deletes an auto-admission rule
+func (r *API) DeleteAdmissionRule(key string) error {
+	if len(key) == 0 {
+		return fmt.Errorf("admission rule key is missing")
+	}
+	return r.db.RunCommand("select pilotctl_delete_admission_rule($1)", key)
+}
+
+// AutoAdmit admits a registering host that is not yet admitted using the first matching admission rule
+// rules only apply to hosts that authenticated with a bootstrap or join token, as the registration information
+// is reported by the host itself; the subnet criterion is matched against the address the request came from
+// if the host did not present a token or no rule matches, the host is added to the queue of hosts pending admission
+// returns true if the host is admitted
+func (r *API) AutoAdmit(host HostIdentity, reg *RegistrationRequest) (bool, error) {
+	admitted, err := r.isAdmitted(reg.MachineId)
+	if err != nil {
+		return false, fmt.Errorf("cannot check admission status of host '%s': %s", reg.MachineId, err)
+	}
+	if admitted {
+		return true, nil
+	}
+	if host.Auth != PilotAuthBootstrap {
+		return false, r.SetPendingAdmission(reg)
+	}
+	rules, err := r.GetAdmissionRules()
+	if err != nil {
+		return false, err
+	}
+	for _, rule := range rules {
+		if rule.Matches(reg, host.HostIP) {
+			if err = r.useBootstrapToken(host); err != nil {
+				log.Printf("host %s - %s not admitted by admission rule '%s': %s\n", reg.Hostname, reg.MachineId, rule.Key, err)
+				break
+			}
+			if err = r.SetAdmission(rule.Admission(reg.MachineId)); err != nil {
+				return false, fmt.Errorf("cannot admit host '%s' using admission rule '%s': %s", reg.MachineId, rule.Key, err)
+			}
+			log.Printf("host %s - %s admitted by admission rule '%s'\n", reg.Hostname, reg.MachineId, rule.Key)
+			r.issueAdmissionCredential(reg.MachineId)
+			return true, nil
+		}
+	}
+	return false, r.SetPendingAdmission(reg)
+}
+
+// SetPendingAdmission records a host that registered but has not been admitted as awaiting admission
+// new hosts are not queued once the queue holds the configured maximum number of hosts
+func (r *API) SetPendingAdmission(reg *RegistrationRequest) error {
+	rows, err := r.db.Query("select pilotctl_set_pending_admission($1, $2, $3, $4, $5, $6, $7, $8)",
+		reg.MachineId,
+		reg.Hostname,
+		reg.HostIP,
+		reg.MacAddress,
+		reg.HardwareId,
+		reg.OS,
+		reg.Platform,
+		r.conf.MaxPendingAdmissions())
+	if err != nil {
+		return fmt.Errorf("cannot record pending admission: %s\n", err)
+	}
+	defer rows.Close()
+	var queued bool
+	if rows.Next() {
+		if err = rows.Scan(&queued); err != nil {
+			return fmt.Errorf("cannot scan pending admission: %s\n", err)
+		}
+	}
+	if !queued {
+		return fmt.Errorf("host '%s' cannot be queued for admission as the queue holds the maximum of %d hosts", reg.MachineId, r.conf.MaxPendingAdmissions())
+	}
+	return nil
+}
+
+// GetPendingAdmissions returns the hosts that registered but have not been admitted
+func (r *API) GetPendingAdmissions() ([]PendingAdmission, error) {
+	rows, err := r.db.Query("select * from pilotctl_get_pending_admissions()")
+	if err != nil {
+		return nil, fmt.Errorf("cannot get pending admissions: %s\n", err)
+	}
+	var (
+		hostUUID                                 string
+		hostname, hostIP, hardwareId, os, platfm sql.NullString
+		macAddress                               []string
+		registered, lastAttempt                  sql.NullTime
+	)
+	pending := make([]PendingAdmission, 0)
+	for rows.Next() {
+		err = rows.Scan(&hostUUID, &hostname, &hostIP, &macAddress, &hardwareId, &os, &platfm, &registered, &lastAttempt)
+		if err != nil {
+			return nil, fmt.Errorf("cannot scan pending admission row: %s\n", err)
+		}
+		pending = append(pending, PendingAdmission{
+			HostUUID:    hostUUID,
+			Hostname:    hostname.String,
+			HostIP:      hostIP.String,
+			MacAddress:  macAddress,
+			HardwareId:  hardwareId.String,
+			OS:          os.String,
+			Platform:    platfm.String,
+			Registered:  registered.Time,
+			LastAttempt: lastAttempt.Time,
+		})
+	}
+	return pending, rows.Err()
+}
+
+// the minimum period between recording the connection attempts of the same host awaiting admission
+const pendingAttemptInterval = time.Minute
+
+// pendingAttempts throttles the recording of connection attempts so that pings cannot be used to flood the database
+var pendingAttempts = newRateLimiter(int(time.Minute/pendingAttemptInterval), 1)
+
+// touchPendingAdmission records the last attempt of a host that is not admitted to connect to pilotctl
+// only hosts already queued by registering are updated, at most once every pendingAttemptInterval;
+// hosts are only added to the queue by registering
+func (r *API) touchPendingAdmission(hostUUID, hostIP, hostname string) error {
+	if ok, _ := pendingAttempts.allow(hostUUID, time.Now()); !ok {
+		return nil
+	}
+	return r.db.RunCommand("select pilotctl_touch_pending_admission($1, $2, $3)", hostUUID, hostIP, hostname)
+}
+
+// ApprovePendingAdmissions admits hosts awaiting admission, reporting the outcome for each host
+// hosts that are not awaiting admission are reported as failed
+func (r *API) ApprovePendingAdmissions(access *Access, admissions []Admission, allOrNothing bool) ([]AdmissionResult, error) {
+	pending, err := r.pendingHosts()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		results  = make([]AdmissionResult, len(admissions))
+		approved = make([]Admission, 0)
+		index    = make([]int, 0)
+		failed   bool
+	)
+	for i, admission := range admissions {
+		if !pending[admission.HostUUID] {
+			results[i] = AdmissionResult{
+				HostUUID: admission.HostUUID,
+				Status:   AdmissionFailed,
+				Reason:   "host is not awaiting admission",
+			}
+			failed = true
+			continue
+		}
+		approved = append(approved, admission)
+		index = append(index, i)
+	}
+	if allOrNothing && failed {
+		for _, i := range index {
+			results[i] = AdmissionResult{HostUUID: admissions[i].HostUUID}
+		}
+		return notApplied(results, "other hosts in the request are not awaiting admission"), nil
+	}
+	for i, result := range r.SetAdmissions(access, approved, allOrNothing) {
+		results[index[i]] = result
+	}
+	return results, nil
+}
+
+// RejectPendingAdmissions rejects hosts awaiting admission, reporting the outcome for each host
+// rejected hosts are no longer listed as pending and are not queued again when they connect
+func (r *API) RejectPendingAdmissions(hostUUIDs []string, user string) ([]AdmissionResult, error) {
+	pending, err := r.pendingHosts()
+	if err != nil {
+		return nil, err
+	}
+	results := make([]AdmissionResult, len(hostUUIDs))
+	for i, hostUUID := range hostUUIDs {
+		results[i] = AdmissionResult{HostUUID: hostUUID, Status: AdmissionRejected}
+		if !pending[hostUUID] {
+			results[i].Status = AdmissionFailed
+			results[i].Reason = "host is not awaiting admission"
+			continue
+		}
+		if err = r.db.RunCommand("select pilotctl_reject_pending_admission($1, $2)", hostUUID, user); err != nil {
+			results[i].Status = AdmissionFailed
+			results[i].Reason = err.Error()
+		}
+	}
+	return results, nil
+}
+
+// pendingHosts the UUIDs of the hosts awaiting admission
+func (r *API) pendingHosts() (map[string]bool, error) {
+	pending, err := r.GetPendingAdmissions()
+	if err != nil {
+		return nil, err
+	}
+	hosts := make(map[string]bool, len(pending))
+	for _, p := range pending {
+		hosts[p.HostUUID] = true
+	}
+	return hosts, nil
+}
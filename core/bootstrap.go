@@ -0,0 +1,170 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/google/uuid"
+	"log"
+	"net/http"
+	. "southwinds.dev/pilotctl/types"
+	"time"
+)
+
+// CreateBootstrapToken creates a bootstrap token for host pilots that do not hold a credential or a certificate yet
+// the token value is only returned once
+func (r *API) CreateBootstrapToken(user string, req BootstrapTokenRequest) (*BootstrapToken, error) {
+	if req.Uses < 0 || req.ExpiryHours < 0 {
+		return nil, fmt.Errorf("bootstrap token uses and expiry cannot be negative")
+	}
+	uses := req.Uses
+	if uses == 0 {
+		uses = 1
+	}
+	expiry := 24 * time.Hour
+	if req.ExpiryHours > 0 {
+		expiry = time.Duration(req.ExpiryHours) * time.Hour
+	}
+	value, err := NewBootstrapToken()
+	if err != nil {
+		return nil, err
+	}
+	token := &BootstrapToken{
+		Id:        uuid.NewString(),
+		HostUUID:  req.HostUUID,
+		Token:     value,
+		Uses:      uses,
+		Created:   time.Now().UTC(),
+		CreatedBy: user,
+		Expires:   time.Now().Add(expiry).UTC(),
+	}
+	err = r.db.RunCommand("select pilotctl_set_bootstrap_token($1, $2, $3, $4, $5, $6)",
+		token.Id, token.HostUUID, HashApiToken(value), token.Uses, token.Expires, user)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create bootstrap token: %s\n", err)
+	}
+	return token, nil
+}
+
+// GetBootstrapTokens returns the bootstrap tokens that have not expired or been used up, without their values
+func (r *API) GetBootstrapTokens() ([]BootstrapToken, error) {
+	rows, err := r.db.Query("select * from pilotctl_get_bootstrap_tokens()")
+	if err != nil {
+		return nil, fmt.Errorf("cannot get bootstrap tokens: %s\n", err)
+	}
+	tokens := make([]BootstrapToken, 0)
+	for rows.Next() {
+		token, scanErr := scanBootstrapToken(rows)
+		if scanErr != nil {
+			return nil, scanErr
+		}
+		tokens = append(tokens, *token)
+	}
+	return tokens, rows.Err()
+}
+
+// DeleteBootstrapToken deletes a bootstrap token so that it can no longer be used
+func (r *API) DeleteBootstrapToken(id string) error {
+	if len(id) == 0 {
+		return fmt.Errorf("bootstrap token id is missing")
+	}
+	return r.db.RunCommand("select pilotctl_delete_bootstrap_token($1)", id)
+}
+
+// verifyBootstrapAuth checks the bootstrap token in the authorization header can still be used by the host
+// the token is not used up until the host is granted something with it; join tokens are only accepted if allowJoin
+func (r *API) verifyBootstrapAuth(request http.Request, header string, allowJoin bool) (HostIdentity, error) {
+	auth, err := ParsePilotBootstrapAuth(header)
+	if err != nil {
+		log.Printf("authentication failed: %s\n", err)
+		return HostIdentity{}, err
+	}
+	rows, err := r.db.Query("select * from pilotctl_get_bootstrap_token($1)", HashApiToken(auth.Token))
+	if err != nil {
+		return HostIdentity{}, fmt.Errorf("cannot get bootstrap token: %s\n", err)
+	}
+	defer rows.Close()
+	var token *BootstrapToken
+	if rows.Next() {
+		if token, err = scanBootstrapToken(rows); err != nil {
+			return HostIdentity{}, err
+		}
+	}
+	var reason string
+	switch {
+	case token == nil:
+		reason = "invalid bootstrap token"
+	case !token.Usable():
+		reason = fmt.Sprintf("bootstrap token '%s' has expired or has been used up", token.Id)
+	case len(token.HostUUID) == 0 && !allowJoin:
+		reason = fmt.Sprintf("join token '%s' is not accepted for this request", token.Id)
+	case len(token.HostUUID) > 0 && token.HostUUID != auth.HostUUID:
+		reason = fmt.Sprintf("bootstrap token '%s' was not issued to this host", token.Id)
+	}
+	if len(reason) > 0 {
+		msg := fmt.Sprintf("authentication failed for Host UUID='%s': %s", auth.HostUUID, reason)
+		log.Println(msg)
+		return HostIdentity{}, fmt.Errorf(msg)
+	}
+	return HostIdentity{HostUUID: auth.HostUUID, HostIP: remoteIP(request), Auth: PilotAuthBootstrap, KeyId: token.Id}, nil
+}
+
+// useBootstrapToken uses up one of the uses left of the bootstrap token the host authenticated with
+// the use is recorded atomically so that concurrent requests cannot use the token more times than allowed
+func (r *API) useBootstrapToken(host HostIdentity) error {
+	if host.Auth != PilotAuthBootstrap {
+		return fmt.Errorf("host '%s' did not authenticate with a bootstrap token", host.HostUUID)
+	}
+	rows, err := r.db.Query("select pilotctl_use_bootstrap_token($1, $2)", host.KeyId, host.HostUUID)
+	if err != nil {
+		return fmt.Errorf("cannot use bootstrap token: %s\n", err)
+	}
+	defer rows.Close()
+	var used bool
+	if rows.Next() {
+		if err = rows.Scan(&used); err != nil {
+			return fmt.Errorf("cannot scan bootstrap token use: %s\n", err)
+		}
+	}
+	if !used {
+		return fmt.Errorf("bootstrap token '%s' has expired or has been used up", host.KeyId)
+	}
+	return nil
+}
+
+func scanBootstrapToken(rows interface{ Scan(...interface{}) error }) (*BootstrapToken, error) {
+	var (
+		id, createdBy    string
+		hostUUID         sql.NullString
+		uses             int
+		created, expires time.Time
+	)
+	if err := rows.Scan(&id, &hostUUID, &uses, &created, &createdBy, &expires); err != nil {
+		return nil, fmt.Errorf("cannot scan bootstrap token row: %s\n", err)
+	}
+	return &BootstrapToken{
+		Id:        id,
+		HostUUID:  hostUUID.String,
+		Uses:      uses,
+		Created:   created,
+		CreatedBy: createdBy,
+		Expires:   expires,
+	}, nil
+}
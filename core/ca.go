@@ -0,0 +1,247 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	caCertFile = "ca.crt"
+	caKeyFile  = "ca.key"
+)
+
+// CA the internal certificate authority issuing client certificates to host pilots
+type CA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+	// the PEM encoded CA certificate
+	certPEM []byte
+}
+
+// RevokedCert a revoked certificate listed in the certificate revocation list
+type RevokedCert struct {
+	Serial  *big.Int
+	Revoked time.Time
+}
+
+// caExists checks if the certificate of the internal CA has been created in the specified path
+func caExists(path string) bool {
+	_, err := os.Stat(filepath.Join(path, caCertFile))
+	return err == nil
+}
+
+// LoadCA loads the certificate authority from the specified folder, creating it if it does not exist
+func LoadCA(path string) (*CA, error) {
+	certPath, keyPath := filepath.Join(path, caCertFile), filepath.Join(path, caKeyFile)
+	if _, err := os.Stat(certPath); os.IsNotExist(err) {
+		if err = newCA(path); err != nil {
+			return nil, err
+		}
+	}
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read CA certificate: %s", err)
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read CA key: %s", err)
+	}
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return nil, fmt.Errorf("CA certificate is not PEM encoded")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse CA certificate: %s", err)
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, fmt.Errorf("CA key is not PEM encoded")
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse CA key: %s", err)
+	}
+	return &CA{cert: cert, key: key, certPEM: certPEM}, nil
+}
+
+// newCA creates a self-signed certificate authority in the specified folder
+func newCA(path string) error {
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return fmt.Errorf("cannot create CA folder: %s", err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("cannot create CA key: %s", err)
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "pilotctl internal CA", Organization: []string{"pilotctl"}},
+		NotBefore:             time.Now().Add(-5 * time.Minute),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("cannot create CA certificate: %s", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("cannot marshal CA key: %s", err)
+	}
+	if err = os.WriteFile(filepath.Join(path, caKeyFile), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return fmt.Errorf("cannot write CA key: %s", err)
+	}
+	if err = os.WriteFile(filepath.Join(path, caCertFile), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return fmt.Errorf("cannot write CA certificate: %s", err)
+	}
+	return nil
+}
+
+// CertPEM the PEM encoded CA certificate
+func (ca *CA) CertPEM() []byte {
+	return ca.certPEM
+}
+
+// Pool a certificate pool containing the CA certificate to verify client certificates
+func (ca *CA) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// SignHostCSR issues a client certificate for the host from a PEM encoded certificate signing request
+// the subject common name of the certificate is always the host UUID, whatever the request contains
+func (ca *CA) SignHostCSR(hostUUID string, csrPEM []byte, validity time.Duration) (*x509.Certificate, []byte, error) {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, nil, fmt.Errorf("certificate signing request is not PEM encoded")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot parse certificate signing request: %s", err)
+	}
+	if err = csr.CheckSignature(); err != nil {
+		return nil, nil, fmt.Errorf("invalid certificate signing request signature: %s", err)
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: hostUUID, Organization: []string{"pilotctl"}, OrganizationalUnit: []string{"host"}},
+		NotBefore:    time.Now().Add(-5 * time.Minute),
+		NotAfter:     time.Now().Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	return ca.issue(template, csr.PublicKey)
+}
+
+// IssueServerCert issues a server certificate for the specified host names and IP addresses
+func (ca *CA) IssueServerCert(hosts []string, validity time.Duration) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot create server key: %s", err)
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: hosts[0], Organization: []string{"pilotctl"}},
+		NotBefore:    time.Now().Add(-5 * time.Minute),
+		NotAfter:     time.Now().Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	_, certPEM, err = ca.issue(template, &key.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot marshal server key: %s", err)
+	}
+	return certPEM, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+// CRL creates a DER encoded certificate revocation list signed by the CA
+func (ca *CA) CRL(revoked []RevokedCert, number int64, validity time.Duration) ([]byte, error) {
+	list := make([]pkix.RevokedCertificate, len(revoked))
+	for i, r := range revoked {
+		list[i] = pkix.RevokedCertificate{SerialNumber: r.Serial, RevocationTime: r.Revoked}
+	}
+	return x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		RevokedCertificates: list,
+		Number:              big.NewInt(number),
+		ThisUpdate:          time.Now(),
+		NextUpdate:          time.Now().Add(validity),
+	}, ca.cert, ca.key)
+}
+
+func (ca *CA) issue(template *x509.Certificate, pub interface{}) (*x509.Certificate, []byte, error) {
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, pub, ca.key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot create certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot parse issued certificate: %s", err)
+	}
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+// newSerial creates a random certificate serial number
+func newSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("cannot create certificate serial number: %s", err)
+	}
+	return serial, nil
+}
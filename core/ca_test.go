@@ -0,0 +1,72 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"testing"
+	"time"
+)
+
+// issues a host certificate from a CSR and checks it verifies against the CA and can be revoked
+func TestCA(t *testing.T) {
+	ca, err := LoadCA(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		// the CA must ignore the requested subject
+		Subject: pkix.Name{CommonName: "another-host"},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER})
+	cert, _, err := ca.SignHostCSR("host-uuid-01", csrPEM, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Subject.CommonName != "host-uuid-01" {
+		t.Fatalf("expected host UUID in subject, got '%s'", cert.Subject.CommonName)
+	}
+	_, err = cert.Verify(x509.VerifyOptions{Roots: ca.Pool(), KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	if err != nil {
+		t.Fatalf("host certificate does not verify against the CA: %s", err)
+	}
+	der, err := ca.CRL([]RevokedCert{{Serial: cert.SerialNumber, Revoked: time.Now()}}, 1, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = crl.CheckSignatureFrom(ca.cert); err != nil {
+		t.Fatalf("CRL is not signed by the CA: %s", err)
+	}
+	if len(crl.RevokedCertificates) != 1 || crl.RevokedCertificates[0].SerialNumber.Cmp(cert.SerialNumber) != 0 {
+		t.Fatal("expected the host certificate in the CRL")
+	}
+}
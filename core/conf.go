@@ -19,11 +19,14 @@
 package core
 
 import (
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -47,6 +50,10 @@ const (
 	ConfActURI                  ConfKey = "PILOT_CTL_ACTIVATION_URI"
 	ConfActUser                 ConfKey = "PILOT_CTL_ACTIVATION_USER"
 	ConfActPwd                  ConfKey = "PILOT_CTL_ACTIVATION_PWD"
+	ConfActProvider             ConfKey = "PILOT_CTL_ACTIVATION_PROVIDER"
+	ConfActInsecureSkipVerify   ConfKey = "PILOT_CTL_ACTIVATION_INSECURE_SKIP_VERIFY"
+	ConfActKey                  ConfKey = "PILOT_CTL_ACTIVATION_KEY"
+	ConfActTokenDays            ConfKey = "PILOT_CTL_ACTIVATION_TOKEN_DAYS"
 	ConfTenant                  ConfKey = "PILOT_CTL_TENANT"
 	ConfDbMaxConn               ConfKey = "PILOT_CTL_DB_MAXCONN"
 	ConfCorsOrigin              ConfKey = "PILOT_CTL_CORS_ORIGIN"
@@ -54,6 +61,59 @@ const (
 	ConfSyncPath                ConfKey = "PILOT_CTL_SYNC_PATH"
 	ConfTelemBufferPath         ConfKey = "PILOT_CTL_TELEM_BUFFER_PATH"
 	ConfTelemConnectors         ConfKey = "PILOT_CTL_TELEM_CONN"
+	ConfDecomGraceDays          ConfKey = "PILOT_CTL_DECOM_GRACE_DAYS"
+	ConfRetentionDays           ConfKey = "PILOT_CTL_RETENTION_DAYS"
+	ConfPurgeIntervalMins       ConfKey = "PILOT_CTL_PURGE_INTERVAL_MINS"
+	ConfQuarantineAllowedCmds   ConfKey = "PILOT_CTL_QUARANTINE_ALLOWED_CMDS"
+	ConfRegExpiryDays           ConfKey = "PILOT_CTL_REG_EXPIRY_DAYS"
+	ConfMaxPendingAdmissions    ConfKey = "PILOT_CTL_MAX_PENDING_ADMISSIONS"
+	ConfCredentialKey           ConfKey = "PILOT_CTL_CREDENTIAL_KEY"
+	ConfLegacyPilotToken        ConfKey = "PILOT_CTL_LEGACY_PILOT_TOKEN"
+	ConfPilotAuthMode           ConfKey = "PILOT_CTL_PILOT_AUTH_MODE"
+	ConfCAPath                  ConfKey = "PILOT_CTL_CA_PATH"
+	ConfCertValidityDays        ConfKey = "PILOT_CTL_CERT_VALIDITY_DAYS"
+	ConfMTLSPort                ConfKey = "PILOT_CTL_MTLS_PORT"
+	ConfMTLSHosts               ConfKey = "PILOT_CTL_MTLS_HOSTS"
+	ConfMTLSCert                ConfKey = "PILOT_CTL_MTLS_CERT"
+	ConfMTLSKey                 ConfKey = "PILOT_CTL_MTLS_KEY"
+	ConfRBACEnabled             ConfKey = "PILOT_CTL_RBAC_ENABLED"
+	ConfRBACAdmins              ConfKey = "PILOT_CTL_RBAC_ADMINS"
+	ConfApiTokenExpiryDays      ConfKey = "PILOT_CTL_API_TOKEN_EXPIRY_DAYS"
+	ConfApiTokenMaxExpiryDays   ConfKey = "PILOT_CTL_API_TOKEN_MAX_EXPIRY_DAYS"
+	ConfOIDCIssuer              ConfKey = "PILOT_CTL_OIDC_ISSUER"
+	ConfOIDCAudience            ConfKey = "PILOT_CTL_OIDC_AUDIENCE"
+	ConfOIDCUsernameClaim       ConfKey = "PILOT_CTL_OIDC_USERNAME_CLAIM"
+	ConfOIDCGroupsClaim         ConfKey = "PILOT_CTL_OIDC_GROUPS_CLAIM"
+	ConfOIDCGroupMap            ConfKey = "PILOT_CTL_OIDC_GROUP_MAP"
+	ConfSigner                  ConfKey = "PILOT_CTL_SIGNER"
+	ConfTransitAddr             ConfKey = "PILOT_CTL_TRANSIT_ADDR"
+	ConfTransitToken            ConfKey = "PILOT_CTL_TRANSIT_TOKEN"
+	ConfTransitMount            ConfKey = "PILOT_CTL_TRANSIT_MOUNT"
+	ConfTransitKey              ConfKey = "PILOT_CTL_TRANSIT_KEY"
+	ConfTokenPath               ConfKey = "PILOT_CTL_TOKEN_PATH"
+	ConfTokenPin                ConfKey = "PILOT_CTL_TOKEN_PIN"
+	ConfTokenKeyLabel           ConfKey = "PILOT_CTL_TOKEN_KEY_LABEL"
+	ConfPingResponseTTLSecs     ConfKey = "PILOT_CTL_PING_RESPONSE_TTL_SECS"
+	ConfSecretStore             ConfKey = "PILOT_CTL_SECRET_STORE"
+	ConfSecretVaultAddr         ConfKey = "PILOT_CTL_SECRET_VAULT_ADDR"
+	ConfSecretVaultToken        ConfKey = "PILOT_CTL_SECRET_VAULT_TOKEN"
+	ConfSecretVaultMount        ConfKey = "PILOT_CTL_SECRET_VAULT_MOUNT"
+	ConfRateLimitIPPerMin       ConfKey = "PILOT_CTL_RATE_LIMIT_IP_PER_MIN"
+	ConfRateLimitIPBurst        ConfKey = "PILOT_CTL_RATE_LIMIT_IP_BURST"
+	ConfRateLimitHostPerMin     ConfKey = "PILOT_CTL_RATE_LIMIT_HOST_PER_MIN"
+	ConfRateLimitHostBurst      ConfKey = "PILOT_CTL_RATE_LIMIT_HOST_BURST"
+	ConfMaxBodyPingKB           ConfKey = "PILOT_CTL_MAX_BODY_PING_KB"
+	ConfMaxBodyRegisterKB       ConfKey = "PILOT_CTL_MAX_BODY_REGISTER_KB"
+	ConfMaxBodyTelemKB          ConfKey = "PILOT_CTL_MAX_BODY_TELEM_KB"
+	ConfMaxBodyCveKB            ConfKey = "PILOT_CTL_MAX_BODY_CVE_KB"
+	ConfPingBackoffThreshold    ConfKey = "PILOT_CTL_PING_BACKOFF_THRESHOLD"
+	ConfPingBackoffMaxFactor    ConfKey = "PILOT_CTL_PING_BACKOFF_MAX_FACTOR"
+	ConfPingMaxWaitSecs         ConfKey = "PILOT_CTL_PING_MAX_WAIT_SECS"
+	ConfTelemSinks              ConfKey = "PILOT_CTL_TELEM_SINKS"
+	ConfTelemPromURL            ConfKey = "PILOT_CTL_TELEM_PROM_URL"
+	ConfTelemInfluxURL          ConfKey = "PILOT_CTL_TELEM_INFLUX_URL"
+	ConfTelemInfluxToken        ConfKey = "PILOT_CTL_TELEM_INFLUX_TOKEN"
+	ConfTelemOtlpURL            ConfKey = "PILOT_CTL_TELEM_OTLP_URL"
 )
 
 type Conf struct {
@@ -119,6 +179,52 @@ func (c *Conf) GetActivationPwd() string {
 	return c.getValue(ConfActPwd)
 }
 
+// GetActivationProvider the provider issuing host activations, either the external activation service (http)
+// or pilotctl itself (local), defaults to http
+func (c *Conf) GetActivationProvider() string {
+	value := strings.ToLower(os.Getenv(string(ConfActProvider)))
+	if len(value) == 0 {
+		return "http"
+	}
+	return value
+}
+
+// ActivationKey the base64 encoded key of at least 32 bytes signing the tokens issued by the local activation provider
+func (c *Conf) ActivationKey() ([]byte, error) {
+	value, err := c.getValueWithError(ConfActKey)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not base64 encoded: %s", ConfActKey, err)
+	}
+	if len(key) < 32 {
+		return nil, fmt.Errorf("%s must be a key of at least 32 bytes", ConfActKey)
+	}
+	return key, nil
+}
+
+// ActivationTokenValidity the period during which a host can activate with the token issued by the local
+// activation provider when it was registered, defaults to 30 days
+func (c *Conf) ActivationTokenValidity() time.Duration {
+	return time.Duration(c.getPositiveIntValue(ConfActTokenDays, 30)) * 24 * time.Hour
+}
+
+// GetActivationInsecureSkipVerify whether the TLS certificate of the activation service is not verified, defaults to true
+func (c *Conf) GetActivationInsecureSkipVerify() bool {
+	value := os.Getenv(string(ConfActInsecureSkipVerify))
+	if len(value) == 0 {
+		return true
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("WARNING: %s is invalid, defaulting to true\n", ConfActInsecureSkipVerify)
+		return true
+	}
+	return b
+}
+
 // PingIntervalSecs the pilot ping interval
 func (c *Conf) PingIntervalSecs() time.Duration {
 	defaultValue, _ := time.ParseDuration("15s")
@@ -224,3 +330,388 @@ func (c *Conf) GetCorsHeaders() string {
 func (c *Conf) GetArtRegPackageFilter() string {
 	return c.getValue(ConfArtRegPackageFilter)
 }
+
+// getIntValue returns the value of an integer variable or the default value if the variable is not defined or invalid
+func (c *Conf) getIntValue(key ConfKey, defaultValue int) int {
+	value := os.Getenv(string(key))
+	if len(value) == 0 {
+		return defaultValue
+	}
+	v, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("WARNING: %s is invalid, defaulting to %d\n", key, defaultValue)
+		return defaultValue
+	}
+	return v
+}
+
+// getPositiveIntValue returns the value of an integer variable that must be greater than zero
+// or the default value if the variable is not defined, invalid or not positive
+func (c *Conf) getPositiveIntValue(key ConfKey, defaultValue int) int {
+	v := c.getIntValue(key, defaultValue)
+	if v <= 0 {
+		log.Printf("WARNING: %s must be greater than zero, defaulting to %d\n", key, defaultValue)
+		return defaultValue
+	}
+	return v
+}
+
+// DecomGracePeriod the period during which a decommissioned host can be restored
+func (c *Conf) DecomGracePeriod() time.Duration {
+	return time.Duration(c.getIntValue(ConfDecomGraceDays, 7)) * 24 * time.Hour
+}
+
+// RetentionPeriod the period after which the data of retired hosts is purged
+func (c *Conf) RetentionPeriod() time.Duration {
+	return time.Duration(c.getIntValue(ConfRetentionDays, 90)) * 24 * time.Hour
+}
+
+// PurgeInterval how often the purge job looks for host data to remove
+func (c *Conf) PurgeInterval() time.Duration {
+	return time.Duration(c.getPositiveIntValue(ConfPurgeIntervalMins, 60)) * time.Minute
+}
+
+// RegistrationExpiry the period after which registrations of hosts that have not activated are undone
+// a value of zero days disables the expiry of registrations
+func (c *Conf) RegistrationExpiry() time.Duration {
+	return time.Duration(c.getIntValue(ConfRegExpiryDays, 30)) * 24 * time.Hour
+}
+
+// MaxPendingAdmissions the maximum number of hosts that can be awaiting admission, defaults to 10000
+func (c *Conf) MaxPendingAdmissions() int {
+	return c.getPositiveIntValue(ConfMaxPendingAdmissions, 10000)
+}
+
+// QuarantineAllowedCmds the keys of the forensic commands that can still run on quarantined hosts
+// the value of the variable is a comma separated list of command keys
+func (c *Conf) QuarantineAllowedCmds() []string {
+	allowed := make([]string, 0)
+	for _, key := range strings.Split(c.get(ConfQuarantineAllowedCmds), ",") {
+		if key = strings.TrimSpace(key); len(key) > 0 {
+			allowed = append(allowed, key)
+		}
+	}
+	return allowed
+}
+
+// CredentialKey the base64 encoded AES-256 key used to encrypt host credentials at rest
+func (c *Conf) CredentialKey() ([]byte, error) {
+	value, err := c.getValueWithError(ConfCredentialKey)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not base64 encoded: %s", ConfCredentialKey, err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("%s must be a 32 bytes key", ConfCredentialKey)
+	}
+	return key, nil
+}
+
+// LegacyPilotToken when host pilots can authenticate with the legacy token instead of signing requests:
+// "allow" always, "deny" never, or "until-issued" (default) until a credential is issued to the host
+func (c *Conf) LegacyPilotToken() string {
+	value := strings.ToLower(os.Getenv(string(ConfLegacyPilotToken)))
+	switch value {
+	case "allow", "deny", "until-issued":
+		return value
+	case "":
+		return "until-issued"
+	default:
+		log.Printf("WARNING: %s is invalid, defaulting to until-issued\n", ConfLegacyPilotToken)
+		return "until-issued"
+	}
+}
+
+// PilotAuthMode how host pilots authenticate: "token" (default) using the pilot token or signed requests,
+// or "mtls" using client certificates issued by the internal CA
+func (c *Conf) PilotAuthMode() string {
+	value := strings.ToLower(os.Getenv(string(ConfPilotAuthMode)))
+	switch value {
+	case "token", "mtls":
+		return value
+	case "":
+		return "token"
+	default:
+		log.Printf("WARNING: %s is invalid, defaulting to token\n", ConfPilotAuthMode)
+		return "token"
+	}
+}
+
+// CAPath the folder containing the internal CA certificate and key, defaults to ~/.pilotctl/ca
+func (c *Conf) CAPath() string {
+	value := os.Getenv(string(ConfCAPath))
+	if len(value) == 0 {
+		home, _ := os.UserHomeDir()
+		return filepath.Join(home, ".pilotctl", "ca")
+	}
+	return value
+}
+
+// CertValidity the validity period of the client certificates issued to host pilots
+func (c *Conf) CertValidity() time.Duration {
+	return time.Duration(c.getIntValue(ConfCertValidityDays, 90)) * 24 * time.Hour
+}
+
+// MTLSPort the port of the listener authenticating host pilots with client certificates
+func (c *Conf) MTLSPort() int {
+	return c.getIntValue(ConfMTLSPort, 8443)
+}
+
+// MTLSHosts the host names and IP addresses in the server certificate issued by the internal CA for the mTLS listener
+// the value of the variable is a comma separated list, defaults to localhost
+func (c *Conf) MTLSHosts() []string {
+	hosts := make([]string, 0)
+	for _, host := range strings.Split(c.get(ConfMTLSHosts), ",") {
+		if host = strings.TrimSpace(host); len(host) > 0 {
+			hosts = append(hosts, host)
+		}
+	}
+	if len(hosts) == 0 {
+		hosts = append(hosts, "localhost")
+	}
+	return hosts
+}
+
+// MTLSCertFiles the server certificate and key files for the mTLS listener
+// if not defined, the server certificate is issued by the internal CA
+func (c *Conf) MTLSCertFiles() (certFile, keyFile string) {
+	return c.get(ConfMTLSCert), c.get(ConfMTLSKey)
+}
+
+// RBACEnabled whether pilotctl role based access control scopes what users can see and do, defaults to false
+func (c *Conf) RBACEnabled() bool {
+	value := os.Getenv(string(ConfRBACEnabled))
+	if len(value) == 0 {
+		return false
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("WARNING: %s is invalid, defaulting to false\n", ConfRBACEnabled)
+		return false
+	}
+	return b
+}
+
+// RBACAdmins the usernames granted the admin role on all hosts when role based access control is enabled
+// the value of the variable is a comma separated list of usernames
+func (c *Conf) RBACAdmins() []string {
+	admins := make([]string, 0)
+	for _, admin := range strings.Split(c.get(ConfRBACAdmins), ",") {
+		if admin = strings.TrimSpace(admin); len(admin) > 0 {
+			admins = append(admins, admin)
+		}
+	}
+	return admins
+}
+
+// ApiTokenExpiry the validity period of API tokens created without an explicit expiry, defaults to 90 days
+func (c *Conf) ApiTokenExpiry() time.Duration {
+	return time.Duration(c.getIntValue(ConfApiTokenExpiryDays, 90)) * 24 * time.Hour
+}
+
+// ApiTokenMaxExpiry the longest validity period that can be requested for an API token, defaults to 365 days
+func (c *Conf) ApiTokenMaxExpiry() time.Duration {
+	return time.Duration(c.getIntValue(ConfApiTokenMaxExpiryDays, 365)) * 24 * time.Hour
+}
+
+// OIDCIssuer the URL of the OpenID Connect issuer validating admin users, if not set OIDC login is disabled
+func (c *Conf) OIDCIssuer() string {
+	return strings.TrimSuffix(c.get(ConfOIDCIssuer), "/")
+}
+
+// OIDCAudience the audience (client id) that JWT bearer tokens must be issued for, required if an issuer is set
+func (c *Conf) OIDCAudience() string {
+	return c.get(ConfOIDCAudience)
+}
+
+// OIDCUsernameClaim the claim holding the username, defaults to preferred_username
+func (c *Conf) OIDCUsernameClaim() string {
+	if value := c.get(ConfOIDCUsernameClaim); len(value) > 0 {
+		return value
+	}
+	return "preferred_username"
+}
+
+// OIDCGroupsClaim the claim holding the groups of the user, defaults to groups
+func (c *Conf) OIDCGroupsClaim() string {
+	if value := c.get(ConfOIDCGroupsClaim); len(value) > 0 {
+		return value
+	}
+	return "groups"
+}
+
+// OIDCGroupMap the path to the json file mapping identity provider groups to pilotctl controls
+func (c *Conf) OIDCGroupMap() string {
+	return c.get(ConfOIDCGroupMap)
+}
+
+// SignerType the signer of ping responses: keyring (default), transit or softtoken
+func (c *Conf) SignerType() string {
+	value := strings.ToLower(c.get(ConfSigner))
+	switch value {
+	case KeyringSigner, TransitSigner, SoftTokenSigner:
+		return value
+	case "":
+		return KeyringSigner
+	default:
+		log.Printf("WARNING: %s is invalid, defaulting to %s\n", ConfSigner, KeyringSigner)
+		return KeyringSigner
+	}
+}
+
+// TransitAddr the address of the Vault server holding the transit signing key
+func (c *Conf) TransitAddr() string {
+	return c.get(ConfTransitAddr)
+}
+
+// TransitToken the Vault token used to sign with the transit key
+func (c *Conf) TransitToken() string {
+	return c.get(ConfTransitToken)
+}
+
+// TransitMount the path where the transit secrets engine is mounted, defaults to transit
+func (c *Conf) TransitMount() string {
+	if value := c.get(ConfTransitMount); len(value) > 0 {
+		return value
+	}
+	return "transit"
+}
+
+// TransitKey the name of the transit signing key, defaults to pilotctl
+func (c *Conf) TransitKey() string {
+	if value := c.get(ConfTransitKey); len(value) > 0 {
+		return value
+	}
+	return "pilotctl"
+}
+
+// TokenPath the directory of the software token holding the signing key
+func (c *Conf) TokenPath() string {
+	return c.get(ConfTokenPath)
+}
+
+// TokenPin the user PIN of the token holding the signing key
+func (c *Conf) TokenPin() string {
+	return c.get(ConfTokenPin)
+}
+
+// TokenKeyLabel the label of the signing key in the token, defaults to pilotctl
+func (c *Conf) TokenKeyLabel() string {
+	if value := c.get(ConfTokenKeyLabel); len(value) > 0 {
+		return value
+	}
+	return "pilotctl"
+}
+
+// PingResponseTTL the period during which a signed ping response, and the job it delivers, is valid
+// defaults to 300 seconds
+func (c *Conf) PingResponseTTL() time.Duration {
+	return time.Duration(c.getIntValue(ConfPingResponseTTLSecs, 300)) * time.Second
+}
+
+// SecretStore the store holding the secrets referenced by commands: builtin (default) or vault
+func (c *Conf) SecretStore() string {
+	if value := strings.ToLower(c.get(ConfSecretStore)); len(value) > 0 {
+		return value
+	}
+	return BuiltinSecretStore
+}
+
+// SecretVaultAddr the address of the Vault server holding the secrets referenced by commands
+func (c *Conf) SecretVaultAddr() string {
+	return c.get(ConfSecretVaultAddr)
+}
+
+// SecretVaultToken the Vault token used to read and write the secrets referenced by commands
+func (c *Conf) SecretVaultToken() string {
+	return c.get(ConfSecretVaultToken)
+}
+
+// SecretVaultMount the path where the KV version 2 secrets engine is mounted, defaults to secret
+func (c *Conf) SecretVaultMount() string {
+	if value := c.get(ConfSecretVaultMount); len(value) > 0 {
+		return value
+	}
+	return "secret"
+}
+
+// IPRateLimit the average number of requests a minute and the burst of requests accepted from a source IP address
+// on the endpoints accessed by host pilots, defaults to 1200 a minute with bursts of 200; a rate of 0 disables the limit
+// hosts behind a NAT gateway share the limit of the gateway address
+func (c *Conf) IPRateLimit() (perMinute, burst int) {
+	return c.getIntValue(ConfRateLimitIPPerMin, 1200), c.getIntValue(ConfRateLimitIPBurst, 200)
+}
+
+// HostRateLimit the average number of requests a minute and the burst of requests accepted from a host pilot
+// defaults to 60 a minute with bursts of 20; a rate of 0 disables the limit
+func (c *Conf) HostRateLimit() (perMinute, burst int) {
+	return c.getIntValue(ConfRateLimitHostPerMin, 60), c.getIntValue(ConfRateLimitHostBurst, 20)
+}
+
+// PilotBodyLimits the maximum size in bytes of the request bodies of the endpoints accessed by host pilots
+// keyed by route; defaults to 64 KB for pings and registrations, 10 MB for metrics and logs and 50 MB for CVE reports
+func (c *Conf) PilotBodyLimits() map[string]int64 {
+	telem := int64(c.getIntValue(ConfMaxBodyTelemKB, 10*1024)) * 1024
+	return map[string]int64{
+		"/ping":              int64(c.getIntValue(ConfMaxBodyPingKB, 64)) * 1024,
+		"/register":          int64(c.getIntValue(ConfMaxBodyRegisterKB, 64)) * 1024,
+		"/activate":          int64(c.getIntValue(ConfMaxBodyRegisterKB, 64)) * 1024,
+		"/metrics/{channel}": telem,
+		"/logs/{channel}":    telem,
+		"/cve/upload":        int64(c.getIntValue(ConfMaxBodyCveKB, 50*1024)) * 1024,
+	}
+}
+
+// PingBackoffThreshold the number of ping requests processed at the same time above which ping intervals are backed off
+// defaults to 200; a value of 0 disables the backoff
+func (c *Conf) PingBackoffThreshold() int {
+	return c.getIntValue(ConfPingBackoffThreshold, 200)
+}
+
+// PingBackoffMaxFactor the maximum factor by which ping intervals are multiplied under load, defaults to 4
+func (c *Conf) PingBackoffMaxFactor() int {
+	return c.getIntValue(ConfPingBackoffMaxFactor, 4)
+}
+
+// PingMaxWait the maximum period a ping can be held waiting for a job in long-poll mode, defaults to 30 seconds
+// a value of 0 disables long-poll mode so that pings are answered straight away; a held ping is only woken up by
+// jobs created on the same instance, jobs created on other instances are picked up when the wait expires
+func (c *Conf) PingMaxWait() time.Duration {
+	return time.Duration(c.getIntValue(ConfPingMaxWaitSecs, 30)) * time.Second
+}
+
+// TelemetrySinkType the built-in sink recording the telemetry of a channel: jsonl, prometheus, influx or otlp
+// the value of the variable is of the format channel:sink,... (e.g. ch1:jsonl,ch2:otlp)
+// channels without a built-in sink use the legacy connector set in PILOT_CTL_TELEM_CONN
+func (c *Conf) TelemetrySinkType(channel string) (string, bool) {
+	for _, part := range strings.Split(c.get(ConfTelemSinks), ",") {
+		subParts := strings.SplitN(strings.TrimSpace(part), ":", 2)
+		if len(subParts) == 2 && strings.EqualFold(subParts[0], channel) {
+			return strings.ToLower(strings.TrimSpace(subParts[1])), true
+		}
+	}
+	return "", false
+}
+
+// TelemetryPromURL the Prometheus remote-write endpoint of the prometheus telemetry sink
+func (c *Conf) TelemetryPromURL() string {
+	return c.get(ConfTelemPromURL)
+}
+
+// TelemetryInfluxURL the InfluxDB write url of the influx telemetry sink, including the database or bucket
+func (c *Conf) TelemetryInfluxURL() string {
+	return c.get(ConfTelemInfluxURL)
+}
+
+// TelemetryInfluxToken the InfluxDB token of the influx telemetry sink
+func (c *Conf) TelemetryInfluxToken() string {
+	return c.get(ConfTelemInfluxToken)
+}
+
+// TelemetryOtlpURL the base url of the OTLP/HTTP receiver of the otlp telemetry sink, e.g. http://collector:4318
+func (c *Conf) TelemetryOtlpURL() string {
+	return c.get(ConfTelemOtlpURL)
+}
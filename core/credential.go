@@ -0,0 +1,408 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	h "southwinds.dev/http"
+	. "southwinds.dev/pilotctl/types"
+	"time"
+)
+
+// the period during which a signed pilot request is valid
+const signedRequestWindow = 5 * time.Minute
+
+// IssueHostCredential issues a new credential to a host
+// the credential the host holds stays valid until the host collects the new one, which it does either with a request
+// signed with its current credential or, if it holds none, with a bootstrap token delivered out-of-band
+func (r *API) IssueHostCredential(hostUUID string) (*HostCredential, error) {
+	if len(hostUUID) == 0 {
+		return nil, fmt.Errorf("host UUID is missing")
+	}
+	key, err := r.conf.CredentialKey()
+	if err != nil {
+		return nil, fmt.Errorf("cannot issue host credential: %s", err)
+	}
+	secret := make([]byte, 32)
+	if _, err = rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("cannot create host credential secret: %s", err)
+	}
+	kid := make([]byte, 8)
+	if _, err = rand.Read(kid); err != nil {
+		return nil, fmt.Errorf("cannot create host credential key id: %s", err)
+	}
+	encrypted, err := AesCrypto{CipherMode: GCM}.Encrypt(base64.StdEncoding.EncodeToString(secret), key)
+	if err != nil {
+		return nil, fmt.Errorf("cannot encrypt host credential secret: %s", err)
+	}
+	credential := &HostCredential{
+		HostUUID: hostUUID,
+		KeyId:    hex.EncodeToString(kid),
+		Issued:   time.Now().UTC(),
+	}
+	err = r.db.RunCommand("select pilotctl_set_host_credential($1, $2, $3)", hostUUID, credential.KeyId, encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("cannot record host credential: %s\n", err)
+	}
+	return credential, nil
+}
+
+// GetHostCredential returns the credential issued to a host without its secret
+func (r *API) GetHostCredential(hostUUID string) (*HostCredential, error) {
+	credential, _, err := r.hostCredential(hostUUID)
+	return credential, err
+}
+
+// CollectHostCredential returns the secret of the latest credential issued to the host that authenticated the request
+// the host must have signed the request with its current credential or presented a bootstrap token issued to it,
+// the legacy token is never accepted; a credential can only be collected once and replaces the previous credentials
+func (r *API) CollectHostCredential(host HostIdentity) (*HostCredential, error) {
+	hostUUID := host.HostUUID
+	credential, secret, err := r.hostCredential(hostUUID)
+	if err != nil {
+		return nil, err
+	}
+	if credential == nil || credential.Revoked != nil {
+		return nil, fmt.Errorf("no credential has been issued to host '%s'", hostUUID)
+	}
+	if credential.Collected != nil {
+		return nil, fmt.Errorf("the credential issued to host '%s' has already been collected", hostUUID)
+	}
+	switch host.Auth {
+	case PilotAuthHmac, PilotAuthCert:
+		// the request was authenticated with a credential or certificate the host already holds
+	case PilotAuthBootstrap:
+		if err = r.useBootstrapToken(host); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("host '%s' must sign the request with its current credential or present a bootstrap token to collect its credential", hostUUID)
+	}
+	if err = r.db.RunCommand("select pilotctl_collect_host_credential($1, $2)", hostUUID, credential.KeyId); err != nil {
+		return nil, fmt.Errorf("cannot record collection of host credential: %s\n", err)
+	}
+	now := time.Now().UTC()
+	credential.Collected = &now
+	credential.Secret = base64.StdEncoding.EncodeToString(secret)
+	return credential, nil
+}
+
+// RevokeHostCredential revokes the credentials issued to a host
+// the host cannot sign requests until a new credential is issued and collected with a bootstrap token
+func (r *API) RevokeHostCredential(hostUUID string) error {
+	if len(hostUUID) == 0 {
+		return fmt.Errorf("host UUID is missing")
+	}
+	return r.db.RunCommand("select pilotctl_revoke_host_credential($1)", hostUUID)
+}
+
+// hostCredential returns the latest credential issued to a host and its decrypted secret
+// or a nil credential if no credential has been issued
+func (r *API) hostCredential(hostUUID string) (*HostCredential, []byte, error) {
+	return r.queryHostCredential("select * from pilotctl_get_host_credential($1)", hostUUID)
+}
+
+// hostCredentialByKey returns the credential with the specified key id issued to a host and its decrypted secret
+// or a nil credential if there is no such credential
+func (r *API) hostCredentialByKey(hostUUID, keyId string) (*HostCredential, []byte, error) {
+	return r.queryHostCredential("select * from pilotctl_get_host_credential_by_key($1, $2)", hostUUID, keyId)
+}
+
+func (r *API) queryHostCredential(query, hostUUID string, args ...interface{}) (*HostCredential, []byte, error) {
+	rows, err := r.db.Query(query, append([]interface{}{hostUUID}, args...)...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot get host credential: %s\n", err)
+	}
+	var (
+		keyId, encrypted   string
+		issued             time.Time
+		collected, revoked sql.NullTime
+		credential         *HostCredential
+	)
+	for rows.Next() {
+		if err = rows.Scan(&keyId, &encrypted, &issued, &collected, &revoked); err != nil {
+			return nil, nil, fmt.Errorf("cannot scan host credential row: %s\n", err)
+		}
+		credential = &HostCredential{
+			HostUUID:  hostUUID,
+			KeyId:     keyId,
+			Issued:    issued,
+			Collected: timeOrNil(collected),
+			Revoked:   timeOrNil(revoked),
+		}
+	}
+	if err = rows.Err(); err != nil || credential == nil {
+		return nil, nil, err
+	}
+	key, err := r.conf.CredentialKey()
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot decrypt host credential: %s", err)
+	}
+	value, err := AesCrypto{CipherMode: GCM}.Decrypt(encrypted, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot decrypt host credential: %s", err)
+	}
+	secret, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot decode host credential: %s", err)
+	}
+	return credential, secret, nil
+}
+
+// issueAdmissionCredential issues a credential to a newly admitted host
+// the host collects it with a bootstrap token issued to it; failures are logged as the host does not need a credential
+// to authenticate with the legacy token, if allowed
+func (r *API) issueAdmissionCredential(hostUUID string) {
+	if _, err := r.IssueHostCredential(hostUUID); err != nil {
+		log.Printf("WARNING: cannot issue credential to admitted host '%s': %s\n", hostUUID, err)
+	}
+}
+
+// AuthenticatePilotRequest authenticates pilot requests using a client certificate in mtls pilot authentication mode
+// or otherwise using a request signed with the host credential or, if allowed, the legacy token
+func (r *API) AuthenticatePilotRequest(request http.Request) (*h.UserPrincipal, error) {
+	if r.conf.PilotAuthMode() == "mtls" {
+		return r.AuthenticatePilotCert(request)
+	}
+	auth := request.Header.Get("Authorization")
+	if IsPilotHmacAuth(auth) {
+		host, err := r.verifySignedRequest(request, auth)
+		if err != nil {
+			return nil, err
+		}
+		return r.admittedPilot(host)
+	}
+	return r.AuthenticatePilot(auth)
+}
+
+// AuthenticatePilotEnrolment authenticates admitted host pilots requesting their first client certificate
+// using a request signed with the host credential or a bootstrap token issued to the host whatever the pilot
+// authentication mode; the legacy token is never accepted
+func (r *API) AuthenticatePilotEnrolment(request http.Request) (*h.UserPrincipal, error) {
+	auth := request.Header.Get("Authorization")
+	switch {
+	case IsPilotHmacAuth(auth):
+		host, err := r.verifySignedRequest(request, auth)
+		if err != nil {
+			return nil, err
+		}
+		return r.admittedPilot(host)
+	case IsPilotBootstrapAuth(auth):
+		host, err := r.verifyBootstrapAuth(request, auth, false)
+		if err != nil {
+			return nil, err
+		}
+		return r.admittedPilot(host)
+	}
+	msg := "authentication failed: a signed request or a bootstrap token is required to enrol a certificate"
+	log.Println(msg)
+	return nil, fmt.Errorf(msg)
+}
+
+// AuthenticateRegisteringPilotRequest authenticates pilot registration requests either signed with the host credential,
+// presenting a bootstrap or join token or, if allowed, using the legacy token; hosts do not have to be admitted
+func (r *API) AuthenticateRegisteringPilotRequest(request http.Request) (*h.UserPrincipal, error) {
+	auth := request.Header.Get("Authorization")
+	if IsPilotHmacAuth(auth) {
+		host, err := r.verifySignedRequest(request, auth)
+		if err != nil {
+			return nil, err
+		}
+		return pilotPrincipal(host), nil
+	}
+	if IsPilotBootstrapAuth(auth) {
+		host, err := r.verifyBootstrapAuth(request, auth, true)
+		if err != nil {
+			return nil, err
+		}
+		return pilotPrincipal(host), nil
+	}
+	return r.AuthenticateRegisteringPilot(auth)
+}
+
+// verifySignedRequest verifies the signature, timestamp and nonce of a signed pilot request
+// returning the identity of the host that signed it
+func (r *API) verifySignedRequest(request http.Request, header string) (HostIdentity, error) {
+	auth, err := ParsePilotHmacAuth(header)
+	if err != nil {
+		log.Printf("authentication failed: %s\n", err)
+		return HostIdentity{}, err
+	}
+	age := time.Since(time.Unix(auth.Timestamp, 0))
+	if age > signedRequestWindow || age < -signedRequestWindow {
+		msg := fmt.Sprintf("authentication failed for Host UUID='%s': request timestamp is outside the allowed window", auth.HostUUID)
+		log.Println(msg)
+		return HostIdentity{}, fmt.Errorf(msg)
+	}
+	credential, secret, err := r.hostCredentialByKey(auth.HostUUID, auth.KeyId)
+	if err != nil {
+		msg := fmt.Sprintf("authentication failed for Host UUID='%s': %s", auth.HostUUID, err)
+		log.Println(msg)
+		return HostIdentity{}, fmt.Errorf(msg)
+	}
+	if credential == nil || credential.Revoked != nil {
+		msg := fmt.Sprintf("authentication failed for Host UUID='%s': credential '%s' is not valid", auth.HostUUID, auth.KeyId)
+		log.Println(msg)
+		return HostIdentity{}, fmt.Errorf(msg)
+	}
+	body, err := requestBody(request)
+	if err != nil {
+		msg := fmt.Sprintf("authentication failed for Host UUID='%s': %s", auth.HostUUID, err)
+		log.Println(msg)
+		return HostIdentity{}, fmt.Errorf(msg)
+	}
+	if !auth.Verify(secret, request.Method, request.URL.Path, body) {
+		msg := fmt.Sprintf("authentication failed for Host UUID='%s': invalid request signature", auth.HostUUID)
+		log.Println(msg)
+		return HostIdentity{}, fmt.Errorf(msg)
+	}
+	// the nonce is only recorded once the signature is verified so that forged requests cannot burn nonces
+	recorded, err := r.useNonce(auth.HostUUID, auth.Nonce)
+	if err != nil {
+		msg := fmt.Sprintf("authentication failed for Host UUID='%s': %s", auth.HostUUID, err)
+		log.Println(msg)
+		return HostIdentity{}, fmt.Errorf(msg)
+	}
+	if !recorded {
+		msg := fmt.Sprintf("authentication failed for Host UUID='%s': nonce has already been used", auth.HostUUID)
+		log.Println(msg)
+		return HostIdentity{}, fmt.Errorf(msg)
+	}
+	return HostIdentity{HostUUID: auth.HostUUID, HostIP: remoteIP(request), Auth: PilotAuthHmac, KeyId: auth.KeyId}, nil
+}
+
+// checkLegacyToken checks if a host can authenticate using the legacy token
+// legacy tokens are never accepted from hosts holding a valid client certificate; otherwise, unless they are always
+// allowed, they are refused as soon as a credential has been issued to the host, whether the host has collected it
+// or not and even if it has since been revoked
+func (r *API) checkLegacyToken(hostUUID string) error {
+	// client certificates can only have been issued once the internal CA has been created
+	if caExists(r.conf.CAPath()) {
+		hasCert, err := r.hasValidCertificate(hostUUID)
+		if err != nil {
+			return fmt.Errorf("authentication failed for Host UUID='%s': %s", hostUUID, err)
+		}
+		if hasCert {
+			return fmt.Errorf("authentication failed for Host UUID='%s': the host holds a client certificate and must use it", hostUUID)
+		}
+	}
+	switch r.conf.LegacyPilotToken() {
+	case "allow":
+		return nil
+	case "deny":
+		return fmt.Errorf("authentication failed for Host UUID='%s': legacy tokens are not allowed", hostUUID)
+	}
+	credential, err := r.GetHostCredential(hostUUID)
+	if err != nil {
+		return fmt.Errorf("authentication failed for Host UUID='%s': %s", hostUUID, err)
+	}
+	if credential != nil {
+		return fmt.Errorf("authentication failed for Host UUID='%s': a credential has been issued to the host and it must sign its requests", hostUUID)
+	}
+	return nil
+}
+
+// AuthenticateCredentialCollection authenticates host pilots collecting their credential
+// using a request signed with their current credential, a bootstrap token issued to them or, in mtls mode,
+// their client certificate; the legacy token is never accepted
+func (r *API) AuthenticateCredentialCollection(request http.Request) (*h.UserPrincipal, error) {
+	auth := request.Header.Get("Authorization")
+	switch {
+	case IsPilotHmacAuth(auth):
+		host, err := r.verifySignedRequest(request, auth)
+		if err != nil {
+			return nil, err
+		}
+		return r.admittedPilot(host)
+	case IsPilotBootstrapAuth(auth):
+		host, err := r.verifyBootstrapAuth(request, auth, false)
+		if err != nil {
+			return nil, err
+		}
+		return r.admittedPilot(host)
+	case r.conf.PilotAuthMode() == "mtls" && PeerCertificate(request) != nil:
+		return r.AuthenticatePilotCert(request)
+	}
+	msg := "authentication failed: a signed request or a bootstrap token is required to collect a credential"
+	log.Println(msg)
+	return nil, fmt.Errorf(msg)
+}
+
+// remoteIP the IP address of the client that sent the request
+func remoteIP(request http.Request) string {
+	ip, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return ip
+}
+
+// bufferedBody a request body that can be read more than once
+// so that signed requests can be verified before the handler reads the body
+type bufferedBody struct {
+	*bytes.Reader
+}
+
+func (b *bufferedBody) Close() error {
+	return nil
+}
+
+// requestBody reads a buffered request body and rewinds it so that the handler can read it
+func requestBody(request http.Request) ([]byte, error) {
+	if request.Body == nil || request.Body == http.NoBody {
+		return []byte{}, nil
+	}
+	body, ok := request.Body.(*bufferedBody)
+	if !ok {
+		return nil, fmt.Errorf("request body has not been buffered")
+	}
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	_, err = body.Seek(0, io.SeekStart)
+	return content, err
+}
+
+// useNonce records the nonce of a signed request, returning false if the host has used it within the signed request
+// window; nonces are recorded in the database so that a request cannot be replayed against another instance
+func (r *API) useNonce(hostUUID, nonce string) (bool, error) {
+	// nonces are kept for twice the window as timestamps can be skewed in both directions
+	rows, err := r.db.Query("select * from pilotctl_use_nonce($1, $2, $3)", hostUUID, nonce, time.Now().Add(2*signedRequestWindow))
+	if err != nil {
+		return false, fmt.Errorf("cannot record request nonce: %s\n", err)
+	}
+	defer rows.Close()
+	var recorded bool
+	if rows.Next() {
+		if err = rows.Scan(&recorded); err != nil {
+			return false, fmt.Errorf("cannot scan request nonce: %s\n", err)
+		}
+	}
+	return recorded, rows.Err()
+}
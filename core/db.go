@@ -157,6 +157,41 @@ func (db *Db) RunCommand(script string, arguments ...interface{}) error {
 	return err
 }
 
+// Command a script and its arguments to run as part of a group of commands
+type Command struct {
+	Script string
+	Args   []interface{}
+}
+
+// RunCommands runs a list of commands within a single database transaction
+// if a command fails the transaction is rolled back and the index of the failed command is returned
+func (db *Db) RunCommands(commands []Command) (int, error) {
+	// acquires a database connection
+	conn, err := db.pool.Acquire(context.Background())
+	// if cannot connect to the server return with the error
+	if err != nil {
+		return -1, err
+	}
+	// release the connection
+	defer conn.Release()
+	// acquires a db transaction
+	tx, err := conn.Begin(context.Background())
+	// if error then return
+	if err != nil {
+		return -1, err
+	}
+	for ix, command := range commands {
+		_, err = tx.Exec(context.Background(), command.Script, command.Args...)
+		// if we have an error rollback all the commands
+		if isNull, err := db.error(err); !isNull {
+			tx.Rollback(context.Background())
+			return ix, err
+		}
+	}
+	// all good so commit the transaction
+	return -1, tx.Commit(context.Background())
+}
+
 func (db *Db) Query(query string, args ...interface{}) (pgx.Rows, error) {
 	// acquires a database connection
 	conn, err := db.pool.Acquire(context.Background())
@@ -0,0 +1,128 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"fmt"
+	. "southwinds.dev/pilotctl/types"
+	"strings"
+	"time"
+)
+
+// JobDelivery the record of a job sent to a host in a signed ping response
+type JobDelivery struct {
+	JobId    int64
+	HostUUID string
+	Sequence int64
+	Nonce    string
+	Expires  time.Time
+}
+
+// NewDelivery allocates the next sequence number of the responses to a host and returns the identity of the response
+// the sequence is incremented in the host record by a single update returning the new value, so that it increases
+// for every response to the host whichever instance issues it
+func (r *API) NewDelivery(hostUUID string) (*PingDelivery, error) {
+	rows, err := r.db.Query("select * from pilotctl_next_ping_sequence($1)", hostUUID)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get ping sequence: %s\n", err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return nil, fmt.Errorf("cannot get ping sequence: %s\n", err)
+		}
+		return nil, fmt.Errorf("cannot get ping sequence: host '%s' not found\n", hostUUID)
+	}
+	var sequence int64
+	if err = rows.Scan(&sequence); err != nil {
+		return nil, fmt.Errorf("cannot scan ping sequence: %s\n", err)
+	}
+	return NewPingDelivery(hostUUID, sequence, r.conf.PingResponseTTL())
+}
+
+// DeliverJob claims a job for the host in the response identified by the delivery
+// the claim is made by a single conditional update so that concurrent pings cannot deliver the same job twice:
+// it succeeds if the job has not been delivered, its previous delivery has expired or it was delivered to the
+// same host, in which case the job is sent again in case the previous response was lost
+// the delivery nonce is set to the nonce of the job delivery, which is kept when the job is sent again to the
+// same host so that the result matches whichever of the responses pilot received
+func (r *API) DeliverJob(jobId int64, delivery *PingDelivery) error {
+	rows, err := r.db.Query("select * from pilotctl_claim_job_delivery($1, $2, $3, $4, $5)",
+		jobId, delivery.HostUUID, delivery.Sequence, delivery.Nonce, delivery.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("cannot claim job delivery: %s\n", err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return fmt.Errorf("cannot claim job delivery: %s\n", err)
+		}
+		return fmt.Errorf("cannot claim job delivery: no delivery returned for job %d\n", jobId)
+	}
+	var (
+		claimed bool
+		holder  string
+		nonce   string
+	)
+	if err = rows.Scan(&claimed, &holder, &nonce); err != nil {
+		return fmt.Errorf("cannot scan job delivery: %s\n", err)
+	}
+	if !claimed {
+		return fmt.Errorf("job %d has been delivered to host '%s'", jobId, holder)
+	}
+	delivery.Nonce = nonce
+	return nil
+}
+
+// GetJobDelivery returns the last delivery of a job or nil if the job has not been delivered
+func (r *API) GetJobDelivery(jobId int64) (*JobDelivery, error) {
+	rows, err := r.db.Query("select * from pilotctl_get_job_delivery($1)", jobId)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get job delivery: %s\n", err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	d := &JobDelivery{JobId: jobId}
+	if err = rows.Scan(&d.HostUUID, &d.Sequence, &d.Nonce, &d.Expires); err != nil {
+		return nil, fmt.Errorf("cannot scan job delivery: %s\n", err)
+	}
+	return d, nil
+}
+
+// checkJobDelivery verifies that a job result comes from the host the job was delivered to
+// and carries the nonce of the delivery
+func (r *API) checkJobDelivery(hostUUID string, result *JobResult) error {
+	delivery, err := r.GetJobDelivery(result.JobId)
+	if err != nil {
+		return err
+	}
+	// results of jobs never claimed by a ping response are rejected
+	if delivery == nil {
+		return fmt.Errorf("job %d has not been delivered", result.JobId)
+	}
+	if !strings.EqualFold(delivery.HostUUID, hostUUID) {
+		return fmt.Errorf("job %d was not delivered to host '%s'", result.JobId, hostUUID)
+	}
+	if result.Nonce != delivery.Nonce {
+		return fmt.Errorf("job %d result does not match its delivery", result.JobId)
+	}
+	return nil
+}
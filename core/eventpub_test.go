@@ -35,6 +35,6 @@ func TestSaveConf(t *testing.T) {
 		},
 	}}
 	bytes, _ := json.Marshal(conf)
-	path, _ := filepath.Abs("ev_receive.json")
+	path := filepath.Join(t.TempDir(), "ev_receive.json")
 	os.WriteFile(path, bytes, os.ModePerm)
 }
@@ -0,0 +1,53 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"log"
+	"time"
+)
+
+// Jobs launches the background jobs run by the service
+func Jobs() error {
+	cfg := NewConf()
+	// removes the data of retired and decommissioned hosts
+	go runEvery("purge hosts", cfg.PurgeInterval(), Api().PurgeHosts)
+	// undoes registrations of hosts that have not activated within the expiry period
+	if cfg.RegistrationExpiry() > 0 {
+		go runEvery("expire registrations", cfg.PurgeInterval(), Api().ExpireRegistrations)
+	}
+	// moves the secret values of commands created before they were kept in the secret store
+	go func() {
+		if err := Api().SealCommandSecrets(); err != nil {
+			log.Printf("ERROR: background job 'seal command secrets' failed: %s\n", err)
+		}
+	}()
+	return nil
+}
+
+// runEvery runs the passed-in function at the specified interval logging any errors
+func runEvery(name string, interval time.Duration, fx func() error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := fx(); err != nil {
+			log.Printf("ERROR: background job '%s' failed: %s\n", name, err)
+		}
+	}
+}
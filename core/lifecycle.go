@@ -0,0 +1,166 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"database/sql"
+	"fmt"
+	ilink "southwinds.dev/interlink-client"
+	. "southwinds.dev/pilotctl/types"
+	"strings"
+	"time"
+)
+
+// GetHostLifecycle get the lifecycle state of a host
+func (r *API) GetHostLifecycle(hostUUID string) (*HostLifecycle, error) {
+	rows, err := r.db.Query("select * from pilotctl_get_host_state($1)", hostUUID)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get host state: %s\n", err)
+	}
+	var (
+		state                       string
+		previous, changedBy, reason sql.NullString
+		changed                     sql.NullTime
+	)
+	for rows.Next() {
+		err = rows.Scan(&state, &previous, &changed, &changedBy, &reason)
+		if err != nil {
+			return nil, fmt.Errorf("cannot scan host state row: %e\n", err)
+		}
+		return &HostLifecycle{
+			HostUUID:      hostUUID,
+			State:         HostState(state),
+			PreviousState: HostState(previous.String),
+			Changed:       changed.Time,
+			ChangedBy:     changedBy.String,
+			Reason:        reason.String,
+		}, nil
+	}
+	return nil, fmt.Errorf("host uuid '%s' cannot be found in data source\n", hostUUID)
+}
+
+// SetHostState moves a host to a different lifecycle state if the transition is allowed
+func (r *API) SetHostState(hostUUID string, to HostState, user, reason string) error {
+	if len(hostUUID) == 0 {
+		return fmt.Errorf("host UUID is missing")
+	}
+	current, err := r.GetHostLifecycle(hostUUID)
+	if err != nil {
+		return err
+	}
+	if !current.State.CanTransitionTo(to) {
+		return fmt.Errorf("host '%s' cannot move from %s to %s state", hostUUID, current.State, to)
+	}
+	if to == HostQuarantined && len(strings.TrimSpace(reason)) == 0 {
+		return fmt.Errorf("a reason is required to quarantine host '%s'", hostUUID)
+	}
+	return r.db.RunCommand("select pilotctl_set_host_state($1, $2, $3, $4)", hostUUID, to, user, reason)
+}
+
+// DecommissionHost removes the host from the list of available hosts
+// the host can be restored within the decommission grace period, after which its data is purged
+func (r *API) DecommissionHost(hostUUID, user string) error {
+	if len(hostUUID) == 0 {
+		return fmt.Errorf("HOST-UUID is missing")
+	}
+	current, err := r.GetHostLifecycle(hostUUID)
+	if err != nil {
+		return err
+	}
+	if !current.State.CanTransitionTo(HostDecommissioned) {
+		return fmt.Errorf("host '%s' cannot be decommissioned from %s state", hostUUID, current.State)
+	}
+	// set a decom date for the host
+	if err = r.db.RunCommand("select pilotctl_decom_host($1, $2)", hostUUID, user); err != nil {
+		return err
+	}
+	pingPolicies.forget(hostUUID)
+	return nil
+}
+
+// RestoreHost returns a decommissioned host to its previous state providing the grace period has not elapsed
+func (r *API) RestoreHost(hostUUID, user string) error {
+	current, err := r.GetHostLifecycle(hostUUID)
+	if err != nil {
+		return err
+	}
+	if current.State != HostDecommissioned {
+		return fmt.Errorf("host '%s' cannot be restored as it is not decommissioned", hostUUID)
+	}
+	if time.Since(current.Changed) > r.conf.DecomGracePeriod() {
+		return fmt.Errorf("host '%s' cannot be restored as it was decommissioned more than %.0f days ago",
+			hostUUID, r.conf.DecomGracePeriod().Hours()/24)
+	}
+	return r.db.RunCommand("select pilotctl_restore_host($1, $2)", hostUUID, user)
+}
+
+// PurgeHosts removes the data of hosts retired longer than the retention period
+// and hosts decommissioned longer than the grace period
+func (r *API) PurgeHosts() error {
+	rows, err := r.db.Query("select * from pilotctl_get_purgeable_hosts($1, $2)",
+		fmt.Sprintf("%.0f secs", r.conf.RetentionPeriod().Seconds()),
+		fmt.Sprintf("%.0f secs", r.conf.DecomGracePeriod().Seconds()))
+	if err != nil {
+		return fmt.Errorf("cannot get hosts to purge: %s\n", err)
+	}
+	var (
+		hostUUID string
+		hosts    []string
+	)
+	for rows.Next() {
+		if err = rows.Scan(&hostUUID); err != nil {
+			return fmt.Errorf("cannot scan host to purge: %s\n", err)
+		}
+		hosts = append(hosts, hostUUID)
+	}
+	for _, host := range hosts {
+		if err = r.db.RunCommand("select pilotctl_purge_host($1)", host); err != nil {
+			return fmt.Errorf("cannot purge host '%s': %s", host, err)
+		}
+		pingPolicies.forget(host)
+		// delete host from cmdb
+		_, err = r.iLink.DeleteItem(&ilink.Item{Key: strings.ToUpper(fmt.Sprintf("HOST:%s", host))})
+		if err != nil {
+			return fmt.Errorf("cannot delete host '%s' from Onix: %s", host, err)
+		}
+	}
+	return nil
+}
+
+// QuarantineHost stops a host receiving jobs, other than allowed forensic commands, while it keeps connecting
+func (r *API) QuarantineHost(hostUUID, user, reason string) error {
+	return r.SetHostState(hostUUID, HostQuarantined, user, reason)
+}
+
+// ReleaseHost returns a quarantined host to service in the state it was in before being quarantined
+func (r *API) ReleaseHost(hostUUID, user, reason string) error {
+	current, err := r.GetHostLifecycle(hostUUID)
+	if err != nil {
+		return err
+	}
+	if current.State != HostQuarantined {
+		return fmt.Errorf("host '%s' is not quarantined", hostUUID)
+	}
+	// hosts quarantined before the previous state was recorded go back to active
+	to := current.PreviousState
+	if !current.State.CanTransitionTo(to) {
+		to = HostActive
+	}
+	return r.SetHostState(hostUUID, to, user, reason)
+}
@@ -0,0 +1,200 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"database/sql"
+	"fmt"
+	. "southwinds.dev/pilotctl/types"
+	"strings"
+)
+
+// logisticsValidator checks logistic placements against the Onix logistics hierarchy
+// lookups are cached so that bulk operations do not query Onix for every entry
+type logisticsValidator struct {
+	api *API
+	// the keys of the orgs, areas and locations under their parent key
+	orgs      map[string][]string
+	areas     map[string][]string
+	locations map[string][]string
+}
+
+func newLogisticsValidator(api *API) *logisticsValidator {
+	return &logisticsValidator{
+		api:       api,
+		orgs:      make(map[string][]string),
+		areas:     make(map[string][]string),
+		locations: make(map[string][]string),
+	}
+}
+
+// validate checks the org and area belong to the org group and the location belongs to the area
+func (v *logisticsValidator) validate(orgGroup, org, area, location string) error {
+	if len(orgGroup) == 0 || len(org) == 0 || len(area) == 0 || len(location) == 0 {
+		return fmt.Errorf("org group, org, area and location are all required")
+	}
+	if _, cached := v.orgs[orgGroup]; !cached {
+		orgs, err := v.api.GetOrgs(orgGroup)
+		if err != nil {
+			return fmt.Errorf("cannot retrieve organisations for org group '%s': %s", orgGroup, err)
+		}
+		v.orgs[orgGroup] = make([]string, 0)
+		for _, o := range orgs {
+			v.orgs[orgGroup] = append(v.orgs[orgGroup], o.Key)
+		}
+	}
+	if !containsKey(v.orgs[orgGroup], org) {
+		return fmt.Errorf("org '%s' does not belong to org group '%s'", org, orgGroup)
+	}
+	if _, cached := v.areas[orgGroup]; !cached {
+		areas, err := v.api.GetAreas(orgGroup)
+		if err != nil {
+			return fmt.Errorf("cannot retrieve areas for org group '%s': %s", orgGroup, err)
+		}
+		v.areas[orgGroup] = make([]string, 0)
+		for _, a := range areas {
+			v.areas[orgGroup] = append(v.areas[orgGroup], a.Key)
+		}
+	}
+	if !containsKey(v.areas[orgGroup], area) {
+		return fmt.Errorf("area '%s' does not belong to org group '%s'", area, orgGroup)
+	}
+	if _, cached := v.locations[area]; !cached {
+		locations, err := v.api.GetLocations(area)
+		if err != nil {
+			return fmt.Errorf("cannot retrieve locations for area '%s': %s", area, err)
+		}
+		v.locations[area] = make([]string, 0)
+		for _, l := range locations {
+			v.locations[area] = append(v.locations[area], l.Key)
+		}
+	}
+	if !containsKey(v.locations[area], location) {
+		return fmt.Errorf("location '%s' does not belong to area '%s'", location, area)
+	}
+	return nil
+}
+
+func containsKey(keys []string, key string) bool {
+	for _, k := range keys {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateLogistics checks a logistic placement exists in the Onix logistics hierarchy
+func (r *API) ValidateLogistics(orgGroup, org, area, location string) error {
+	return newLogisticsValidator(r).validate(orgGroup, org, area, location)
+}
+
+// RelocateHost moves a host to a different org group, org, area and/or location
+// empty values in the relocation are taken from the current host placement
+// the user must be able to approve changes to hosts in both the current and the new placement
+func (r *API) RelocateHost(access *Access, hostUUID string, reloc Relocation, user string) error {
+	return r.relocate(newLogisticsValidator(r), access, hostUUID, reloc, user)
+}
+
+// RelocateHosts moves a list of hosts reporting the outcome for each host
+func (r *API) RelocateHosts(access *Access, relocations []Relocation, user string) []RelocationResult {
+	v := newLogisticsValidator(r)
+	result := make([]RelocationResult, 0)
+	for _, reloc := range relocations {
+		res := RelocationResult{HostUUID: reloc.HostUUID}
+		if err := r.relocate(v, access, reloc.HostUUID, reloc, user); err != nil {
+			res.Error = err.Error()
+		} else {
+			res.Moved = true
+		}
+		result = append(result, res)
+	}
+	return result
+}
+
+func (r *API) relocate(v *logisticsValidator, access *Access, hostUUID string, reloc Relocation, user string) error {
+	if len(hostUUID) == 0 {
+		return fmt.Errorf("host UUID is missing")
+	}
+	if err := r.CheckHostAccess(access, PermApprove, hostUUID); err != nil {
+		return err
+	}
+	host, err := r.GetHost(hostUUID)
+	if err != nil {
+		return err
+	}
+	if len(reloc.OrgGroup) == 0 {
+		reloc.OrgGroup = host.OrgGroup
+	}
+	if len(reloc.Org) == 0 {
+		reloc.Org = host.Org
+	}
+	if len(reloc.Area) == 0 {
+		reloc.Area = host.Area
+	}
+	if len(reloc.Location) == 0 {
+		reloc.Location = host.Location
+	}
+	if !access.CanAt(PermApprove, reloc.OrgGroup, reloc.Org, reloc.Area) {
+		return fmt.Errorf("%w: cannot relocate host '%s' outside of the scope of the user", ErrForbidden, hostUUID)
+	}
+	if err = v.validate(reloc.OrgGroup, reloc.Org, reloc.Area, reloc.Location); err != nil {
+		return fmt.Errorf("cannot relocate host '%s': %s", hostUUID, err)
+	}
+	// updates the host placement and records the previous one in the placement history
+	return r.db.RunCommand("select pilotctl_set_host_logistics($1, $2, $3, $4, $5, $6, $7)",
+		hostUUID,
+		reloc.OrgGroup,
+		reloc.Org,
+		reloc.Area,
+		reloc.Location,
+		user,
+		reloc.Reason)
+}
+
+// GetHostPlacements get the history of logistic placements for a host, most recent first
+func (r *API) GetHostPlacements(hostUUID string) ([]Placement, error) {
+	rows, err := r.db.Query("select * from pilotctl_get_host_logistics_history($1)", hostUUID)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get host placement history: %s\n", err)
+	}
+	var (
+		orgGroup, org, area, location string
+		movedBy, reason               sql.NullString
+		from, to                      sql.NullTime
+	)
+	placements := make([]Placement, 0)
+	for rows.Next() {
+		err = rows.Scan(&orgGroup, &org, &area, &location, &movedBy, &reason, &from, &to)
+		if err != nil {
+			return nil, fmt.Errorf("cannot scan host placement row: %e\n", err)
+		}
+		placements = append(placements, Placement{
+			OrgGroup: orgGroup,
+			Org:      org,
+			Area:     area,
+			Location: location,
+			MovedBy:  movedBy.String,
+			Reason:   reason.String,
+			From:     from.Time,
+			To:       to.Time,
+		})
+	}
+	return placements, rows.Err()
+}
@@ -0,0 +1,342 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	h "southwinds.dev/http"
+	. "southwinds.dev/pilotctl/types"
+	"sync"
+	"time"
+)
+
+var (
+	internalCA   *CA
+	internalCAMu sync.Mutex
+)
+
+// CA returns the internal certificate authority, creating it on first use
+func (r *API) CA() (*CA, error) {
+	internalCAMu.Lock()
+	defer internalCAMu.Unlock()
+	if internalCA == nil {
+		ca, err := LoadCA(r.conf.CAPath())
+		if err != nil {
+			return nil, fmt.Errorf("cannot load internal CA: %s", err)
+		}
+		internalCA = ca
+	}
+	return internalCA, nil
+}
+
+// EnrolHostCertificate issues the first client certificate to an admitted host
+// the host must have signed the request with its credential or presented a bootstrap token issued to it;
+// enrolment is refused if the host already holds a valid certificate, in which case it must renew it
+func (r *API) EnrolHostCertificate(host HostIdentity, csrPEM []byte) (*CertificateResponse, error) {
+	hostUUID := host.HostUUID
+	valid, err := r.hasValidCertificate(hostUUID)
+	if err != nil {
+		return nil, err
+	}
+	if valid {
+		return nil, fmt.Errorf("host '%s' already holds a valid certificate, it must be renewed instead", hostUUID)
+	}
+	switch host.Auth {
+	case PilotAuthHmac:
+		// the request was signed with the credential issued to the host
+	case PilotAuthBootstrap:
+		if err = r.useBootstrapToken(host); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("host '%s' must sign the request with its credential or present a bootstrap token to enrol", hostUUID)
+	}
+	return r.issueHostCertificate(hostUUID, csrPEM)
+}
+
+// hasValidCertificate checks if a host holds a certificate that has neither expired nor been revoked
+func (r *API) hasValidCertificate(hostUUID string) (bool, error) {
+	certs, err := r.GetHostCertificates(hostUUID)
+	if err != nil {
+		return false, err
+	}
+	for _, cert := range certs {
+		if cert.Revoked == nil && cert.NotAfter.After(time.Now()) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// RenewHostCertificate issues a new client certificate to a host revoking the certificate used to request it
+func (r *API) RenewHostCertificate(hostUUID, serial string, csrPEM []byte) (*CertificateResponse, error) {
+	resp, err := r.issueHostCertificate(hostUUID, csrPEM)
+	if err != nil {
+		return nil, err
+	}
+	if err = r.db.RunCommand("select pilotctl_revoke_host_certificate($1, $2)", hostUUID, serial); err != nil {
+		return nil, fmt.Errorf("cannot revoke renewed certificate %s: %s\n", serial, err)
+	}
+	return resp, nil
+}
+
+// RevokeHostCertificates revokes all the client certificates issued to a host
+func (r *API) RevokeHostCertificates(hostUUID string) error {
+	if len(hostUUID) == 0 {
+		return fmt.Errorf("host UUID is missing")
+	}
+	return r.db.RunCommand("select pilotctl_revoke_host_certificates($1)", hostUUID)
+}
+
+// GetHostCertificates returns the client certificates issued to a host
+func (r *API) GetHostCertificates(hostUUID string) ([]HostCertificate, error) {
+	rows, err := r.db.Query("select * from pilotctl_get_host_certificates($1)", hostUUID)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get host certificates: %s\n", err)
+	}
+	var (
+		serial              string
+		notBefore, notAfter time.Time
+		revoked             sql.NullTime
+	)
+	certs := make([]HostCertificate, 0)
+	for rows.Next() {
+		if err = rows.Scan(&serial, &notBefore, &notAfter, &revoked); err != nil {
+			return nil, fmt.Errorf("cannot scan host certificate row: %s\n", err)
+		}
+		certs = append(certs, HostCertificate{
+			HostUUID:  hostUUID,
+			Serial:    serial,
+			NotBefore: notBefore,
+			NotAfter:  notAfter,
+			Revoked:   timeOrNil(revoked),
+		})
+	}
+	return certs, rows.Err()
+}
+
+// CRL returns the DER encoded certificate revocation list of the internal CA
+func (r *API) CRL() ([]byte, error) {
+	ca, err := r.CA()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := r.db.Query("select * from pilotctl_get_revoked_certificates()")
+	if err != nil {
+		return nil, fmt.Errorf("cannot get revoked certificates: %s\n", err)
+	}
+	var (
+		serial  string
+		revoked time.Time
+		list    = make([]RevokedCert, 0)
+	)
+	for rows.Next() {
+		if err = rows.Scan(&serial, &revoked); err != nil {
+			return nil, fmt.Errorf("cannot scan revoked certificate row: %s\n", err)
+		}
+		number, ok := new(big.Int).SetString(serial, 16)
+		if !ok {
+			log.Printf("WARNING: invalid revoked certificate serial number '%s'\n", serial)
+			continue
+		}
+		list = append(list, RevokedCert{Serial: number, Revoked: revoked})
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	// the CRL number only has to increase with every new list
+	return ca.CRL(list, time.Now().Unix(), 24*time.Hour)
+}
+
+func (r *API) issueHostCertificate(hostUUID string, csrPEM []byte) (*CertificateResponse, error) {
+	ca, err := r.CA()
+	if err != nil {
+		return nil, err
+	}
+	cert, certPEM, err := ca.SignHostCSR(hostUUID, csrPEM, r.conf.CertValidity())
+	if err != nil {
+		return nil, err
+	}
+	serial := cert.SerialNumber.Text(16)
+	err = r.db.RunCommand("select pilotctl_set_host_certificate($1, $2, $3, $4)", hostUUID, serial, cert.NotBefore, cert.NotAfter)
+	if err != nil {
+		return nil, fmt.Errorf("cannot record host certificate: %s\n", err)
+	}
+	return &CertificateResponse{
+		Certificate: string(certPEM),
+		CA:          string(ca.CertPEM()),
+		Serial:      serial,
+		NotAfter:    cert.NotAfter,
+	}, nil
+}
+
+// AuthenticatePilotCert authenticates pilot requests using the client certificate verified by the mTLS listener
+// the host UUID is the subject common name of the certificate
+func (r *API) AuthenticatePilotCert(request http.Request) (*h.UserPrincipal, error) {
+	cert := PeerCertificate(request)
+	if cert == nil {
+		msg := "authentication failed: a client certificate issued by the internal CA is required"
+		log.Println(msg)
+		return nil, fmt.Errorf(msg)
+	}
+	hostUUID := cert.Subject.CommonName
+	serial := cert.SerialNumber.Text(16)
+	rows, err := r.db.Query("select * from pilotctl_is_certificate_revoked($1)", serial)
+	if err != nil {
+		msg := fmt.Sprintf("authentication failed for Host UUID='%s': cannot check certificate revocation: %s", hostUUID, err)
+		log.Println(msg)
+		return nil, fmt.Errorf(msg)
+	}
+	var revoked bool
+	for rows.Next() {
+		if err = rows.Scan(&revoked); err != nil {
+			return nil, fmt.Errorf("authentication failed for Host UUID='%s': %s", hostUUID, err)
+		}
+	}
+	if revoked {
+		msg := fmt.Sprintf("authentication failed for Host UUID='%s': certificate %s has been revoked", hostUUID, serial)
+		log.Println(msg)
+		return nil, fmt.Errorf(msg)
+	}
+	return r.admittedPilot(HostIdentity{HostUUID: hostUUID, HostIP: remoteIP(request), Auth: PilotAuthCert, KeyId: serial})
+}
+
+// PeerCertificate returns the verified client certificate of a request or nil if there is none
+func PeerCertificate(request http.Request) *x509.Certificate {
+	if request.TLS == nil || len(request.TLS.VerifiedChains) == 0 || len(request.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return request.TLS.VerifiedChains[0][0]
+}
+
+// ServePilotTLS serves the pilot endpoints on a listener authenticating host pilots with client certificates
+func ServePilotTLS(handler http.Handler) error {
+	cfg := NewConf()
+	ca, err := Api().CA()
+	if err != nil {
+		return err
+	}
+	certFile, keyFile := cfg.MTLSCertFiles()
+	serverCert := &serverCertificate{
+		ca:       ca,
+		certFile: certFile,
+		keyFile:  keyFile,
+		hosts:    cfg.MTLSHosts(),
+		validity: cfg.CertValidity(),
+	}
+	// loads the certificate upfront so that a listener with an invalid certificate is not started
+	if _, err = serverCert.get(time.Now()); err != nil {
+		return fmt.Errorf("cannot load mTLS listener certificate: %s", err)
+	}
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", cfg.MTLSPort()),
+		Handler: handler,
+		TLSConfig: &tls.Config{
+			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return serverCert.get(time.Now())
+			},
+			// client certificates are verified if presented, the authentication middleware requires them on pilot routes
+			ClientAuth: tls.VerifyClientCertIfGiven,
+			ClientCAs:  ca.Pool(),
+			MinVersion: tls.VersionTLS12,
+		},
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	log.Printf("serving pilot endpoints with mutual TLS on port %d\n", cfg.MTLSPort())
+	return server.ListenAndServeTLS("", "")
+}
+
+// the period between checks of the server certificate files for changes
+const serverCertCheckInterval = time.Minute
+
+// serverCertificate the certificate of the mTLS listener, kept up to date while the listener runs
+// a certificate issued by the internal CA is renewed once two thirds of its validity have elapsed,
+// certificate files are loaded again when they change so that they can be renewed externally
+type serverCertificate struct {
+	ca       *CA
+	certFile string
+	keyFile  string
+	hosts    []string
+	validity time.Duration
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	renewAt  time.Time
+	modified time.Time
+	checked  time.Time
+}
+
+// get returns the current server certificate, renewing or loading it again if required
+func (c *serverCertificate) get(now time.Time) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.certFile) > 0 && len(c.keyFile) > 0 {
+		return c.loadFiles(now)
+	}
+	if c.cert != nil && now.Before(c.renewAt) {
+		return c.cert, nil
+	}
+	certPEM, keyPEM, err := c.ca.IssueServerCert(c.hosts, c.validity)
+	if err != nil {
+		return c.fallback(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return c.fallback(err)
+	}
+	c.cert, c.renewAt = &cert, now.Add(c.validity*2/3)
+	log.Printf("mTLS listener certificate issued by the internal CA, renewal due on %s\n", c.renewAt.Format(time.RFC3339))
+	return c.cert, nil
+}
+
+// loadFiles loads the certificate files when they have changed since they were last loaded
+func (c *serverCertificate) loadFiles(now time.Time) (*tls.Certificate, error) {
+	if c.cert != nil && now.Sub(c.checked) < serverCertCheckInterval {
+		return c.cert, nil
+	}
+	c.checked = now
+	info, err := os.Stat(c.certFile)
+	if err != nil {
+		return c.fallback(err)
+	}
+	if c.cert != nil && !info.ModTime().After(c.modified) {
+		return c.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return c.fallback(err)
+	}
+	c.cert, c.modified = &cert, info.ModTime()
+	return c.cert, nil
+}
+
+// fallback keeps serving the current certificate if a new one cannot be obtained
+func (c *serverCertificate) fallback(err error) (*tls.Certificate, error) {
+	if c.cert == nil {
+		return nil, err
+	}
+	log.Printf("WARNING: cannot renew mTLS listener certificate, the current certificate is still served: %s\n", err)
+	return c.cert, nil
+}
@@ -0,0 +1,117 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// jobNotifier wakes up the pings of hosts waiting for a job
+// hosts are only woken up by jobs created on this instance: a ping held by another instance is not notified
+// and only picks the job up when its wait expires
+type jobNotifier struct {
+	mu      sync.Mutex
+	waiting map[string][]chan struct{}
+}
+
+var jobWaiters = &jobNotifier{waiting: make(map[string][]chan struct{})}
+
+// JobWaiter a ping registered to be woken up by the next job created for its host
+type JobWaiter struct {
+	hostUUID string
+	ch       chan struct{}
+}
+
+// NewJobWaiter registers a ping waiting for a job for the host
+// it must be registered before checking if the host has a job, so that a job created after the check wakes it up;
+// Close must be called once the ping is no longer waiting
+func (r *API) NewJobWaiter(hostUUID string) *JobWaiter {
+	return &JobWaiter{hostUUID: hostUUID, ch: jobWaiters.add(hostUUID)}
+}
+
+// Close stops waiting for a job
+func (w *JobWaiter) Close() {
+	jobWaiters.remove(w.hostUUID, w.ch)
+}
+
+// WaitForJob holds a ping until a job is created for the host, the wait is over or the request is cancelled
+// the wait is limited to the maximum set in the configuration; it returns true if a job was created
+func (r *API) WaitForJob(ctx context.Context, waiter *JobWaiter, wait time.Duration) bool {
+	if wait = r.LongPollWait(wait); wait <= 0 {
+		return false
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-waiter.ch:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// LongPollWait returns the period a ping asking to wait for a job is held, limited to the configured maximum
+func (r *API) LongPollWait(wait time.Duration) time.Duration {
+	if maxWait := r.conf.PingMaxWait(); wait > maxWait {
+		return maxWait
+	}
+	return wait
+}
+
+// notifyJob wakes up the pings of the hosts waiting for a job
+func notifyJob(hostUUIDs ...string) {
+	jobWaiters.mu.Lock()
+	defer jobWaiters.mu.Unlock()
+	for _, hostUUID := range hostUUIDs {
+		for _, ch := range jobWaiters.waiting[hostUUID] {
+			close(ch)
+		}
+		delete(jobWaiters.waiting, hostUUID)
+	}
+}
+
+func (n *jobNotifier) add(hostUUID string) chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	ch := make(chan struct{})
+	n.waiting[hostUUID] = append(n.waiting[hostUUID], ch)
+	return ch
+}
+
+// remove removes a channel that has not been notified
+func (n *jobNotifier) remove(hostUUID string, ch chan struct{}) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	waiting := n.waiting[hostUUID]
+	for i, c := range waiting {
+		if c == ch {
+			waiting = append(waiting[:i], waiting[i+1:]...)
+			break
+		}
+	}
+	if len(waiting) == 0 {
+		delete(n.waiting, hostUUID)
+	} else {
+		n.waiting[hostUUID] = waiting
+	}
+}
@@ -0,0 +1,76 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWaitForJob(t *testing.T) {
+	api := &API{conf: NewConf()}
+	// a job created after the waiter is registered, but before the ping is held, still wakes it up
+	waiter := api.NewJobWaiter("host-1")
+	notifyJob("host-2", "host-1")
+	if !api.WaitForJob(context.Background(), waiter, 5*time.Second) {
+		t.Fatal("ping not woken by a job created before it was held")
+	}
+	waiter.Close()
+	waiter = api.NewJobWaiter("host-1")
+	woken := make(chan bool)
+	go func() {
+		woken <- api.WaitForJob(context.Background(), waiter, 5*time.Second)
+	}()
+	notifyJob("host-1")
+	select {
+	case ok := <-woken:
+		if !ok {
+			t.Fatal("ping not woken by the job")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ping still held after the job was created")
+	}
+	waiter.Close()
+	waiter = api.NewJobWaiter("host-1")
+	if api.WaitForJob(context.Background(), waiter, 10*time.Millisecond) {
+		t.Fatal("ping woken without a job")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if api.WaitForJob(ctx, waiter, 5*time.Second) {
+		t.Fatal("cancelled ping woken")
+	}
+	waiter.Close()
+	if waiting("host-1") {
+		t.Fatal("pings no longer held are still waiting")
+	}
+	t.Setenv(string(ConfPingMaxWaitSecs), "0")
+	waiter = api.NewJobWaiter("host-1")
+	defer waiter.Close()
+	if api.WaitForJob(context.Background(), waiter, 5*time.Second) {
+		t.Fatal("ping held with long-poll mode disabled")
+	}
+}
+
+func waiting(hostUUID string) bool {
+	jobWaiters.mu.Lock()
+	defer jobWaiters.mu.Unlock()
+	return len(jobWaiters.waiting[hostUUID]) > 0
+}
@@ -0,0 +1,382 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	h "southwinds.dev/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// the clock skew tolerated when validating token times
+	oidcLeeway = time.Minute
+	// the minimum period between fetches of the issuer keys, preventing unknown key ids from flooding the issuer
+	jwksMinRefresh = time.Minute
+	// the period after which the issuer keys are fetched again to pick up key rotations
+	jwksMaxAge = time.Hour
+)
+
+// GroupControl a pilotctl control granted to the members of an identity provider group
+type GroupControl struct {
+	URI    string   `json:"uri"`
+	Method []string `json:"method"`
+}
+
+// oidcVerifier validates JWT bearer tokens issued by an OpenID Connect provider
+type oidcVerifier struct {
+	issuer   string
+	audience string
+	client   *http.Client
+	mu       sync.Mutex
+	keys     map[string]crypto.PublicKey
+	fetched  time.Time
+}
+
+func newOIDCVerifier(issuer, audience string, client *http.Client) *oidcVerifier {
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	return &oidcVerifier{
+		issuer:   strings.TrimSuffix(issuer, "/"),
+		audience: audience,
+		client:   client,
+	}
+}
+
+var (
+	oidc   *oidcVerifier
+	oidcMu sync.Mutex
+	// the group map is loaded once and loaded again when its file changes
+	groupMaps = &groupMapCache{}
+)
+
+// groupMapCache caches the mapping of identity provider groups to pilotctl controls
+type groupMapCache struct {
+	mu       sync.Mutex
+	path     string
+	modified time.Time
+	size     int64
+	groupMap map[string][]GroupControl
+}
+
+// oidcEnabled true if an OpenID Connect issuer has been configured
+func (r *API) oidcEnabled() bool {
+	return len(r.conf.OIDCIssuer()) > 0
+}
+
+// oidcIdentity the identity of a user authenticated by the OpenID Connect provider
+type oidcIdentity struct {
+	issuer  string
+	subject string
+}
+
+func (i oidcIdentity) String() string {
+	return fmt.Sprintf("oidc:%s#%s", i.issuer, i.subject)
+}
+
+// authenticateOIDC authenticates an admin user presenting a JWT issued by the configured OpenID Connect provider
+// the user rights are the controls mapped to the groups in the token
+func (r *API) authenticateOIDC(token string) (*h.UserPrincipal, error) {
+	oidcMu.Lock()
+	if oidc == nil {
+		oidc = newOIDCVerifier(r.conf.OIDCIssuer(), r.conf.OIDCAudience(), nil)
+	}
+	verifier := oidc
+	oidcMu.Unlock()
+	claims, err := verifier.verify(token)
+	if err != nil {
+		return nil, err
+	}
+	subject, _ := claims["sub"].(string)
+	if len(subject) == 0 {
+		return nil, fmt.Errorf("token has no sub claim")
+	}
+	username, _ := claims[r.conf.OIDCUsernameClaim()].(string)
+	if len(username) == 0 {
+		username = subject
+	}
+	groupMap, err := groupMaps.get(r.conf.OIDCGroupMap())
+	if err != nil {
+		return nil, err
+	}
+	return &h.UserPrincipal{
+		Username: username,
+		Rights:   groupControls(claimValues(claims[r.conf.OIDCGroupsClaim()]), groupMap),
+		Created:  time.Now(),
+		// the username claim can usually be changed by users, the subject identifies them
+		Context: oidcIdentity{issuer: verifier.issuer, subject: subject},
+	}, nil
+}
+
+// loadGroupMap reads the file mapping identity provider groups to pilotctl controls
+func loadGroupMap(path string) (map[string][]GroupControl, error) {
+	groupMap := make(map[string][]GroupControl)
+	if len(path) == 0 {
+		return groupMap, nil
+	}
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read OIDC group map: %s", err)
+	}
+	if err = json.Unmarshal(bytes, &groupMap); err != nil {
+		return nil, fmt.Errorf("cannot parse OIDC group map: %s", err)
+	}
+	return groupMap, nil
+}
+
+// get returns the group map in the specified file, loading it again if the file has changed since it was loaded
+// if the changed file cannot be loaded, the group map previously loaded is kept
+func (c *groupMapCache) get(path string) (map[string][]GroupControl, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(path) == 0 {
+		return make(map[string][]GroupControl), nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return c.fallback(path, fmt.Errorf("cannot read OIDC group map: %s", err))
+	}
+	if c.groupMap != nil && c.path == path && info.ModTime().Equal(c.modified) && info.Size() == c.size {
+		return c.groupMap, nil
+	}
+	groupMap, err := loadGroupMap(path)
+	if err != nil {
+		return c.fallback(path, err)
+	}
+	c.path, c.modified, c.size, c.groupMap = path, info.ModTime(), info.Size(), groupMap
+	return groupMap, nil
+}
+
+func (c *groupMapCache) fallback(path string, err error) (map[string][]GroupControl, error) {
+	if c.groupMap == nil || c.path != path {
+		return nil, err
+	}
+	log.Printf("WARNING: %s, using the group map previously loaded\n", err)
+	return c.groupMap, nil
+}
+
+// groupControls returns the pilotctl controls granted to the specified groups
+func groupControls(groups []string, groupMap map[string][]GroupControl) h.Controls {
+	var controls h.Controls
+	for _, group := range groups {
+		for _, control := range groupMap[group] {
+			controls = append(controls, h.Control{
+				Realm:  "pilotcl",
+				URI:    control.URI,
+				Method: control.Method,
+			})
+		}
+	}
+	return controls
+}
+
+// claimValues returns the values of a claim that can be either a string or a list of strings
+func claimValues(claim interface{}) []string {
+	switch v := claim.(type) {
+	case string:
+		return []string{v}
+	case []string:
+		return v
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// verify checks the token signature against the issuer keys and validates its standard claims
+func (v *oidcVerifier) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid JWT header: %s", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT signature encoding: %s", err)
+	}
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch header.Alg {
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) != nil {
+			return nil, fmt.Errorf("invalid JWT signature")
+		}
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 ||
+			!ecdsa.Verify(pub, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil, fmt.Errorf("invalid JWT signature")
+		}
+	default:
+		return nil, fmt.Errorf("JWT algorithm '%s' is not supported", header.Alg)
+	}
+	claims := make(map[string]interface{})
+	if err = decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid JWT claims: %s", err)
+	}
+	if iss, _ := claims["iss"].(string); iss != v.issuer {
+		return nil, fmt.Errorf("JWT issuer '%s' is not trusted", iss)
+	}
+	if len(v.audience) == 0 || !hasAudience(claimValues(claims["aud"]), v.audience) {
+		return nil, fmt.Errorf("JWT was not issued for audience '%s'", v.audience)
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(oidcLeeway)) {
+		return nil, fmt.Errorf("JWT has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(oidcLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, fmt.Errorf("JWT is not valid yet")
+	}
+	return claims, nil
+}
+
+// key returns the issuer public key with the specified id, fetching the issuer keys if required
+func (v *oidcVerifier) key(kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	key, found := v.keys[kid]
+	stale := time.Since(v.fetched) > jwksMaxAge
+	if found && !stale {
+		return key, nil
+	}
+	if stale || time.Since(v.fetched) > jwksMinRefresh {
+		keys, err := v.fetchKeys()
+		if err != nil {
+			return nil, err
+		}
+		v.keys, v.fetched = keys, time.Now()
+		key, found = v.keys[kid]
+	}
+	if !found {
+		return nil, fmt.Errorf("JWT signing key '%s' is not known by the issuer", kid)
+	}
+	return key, nil
+}
+
+// fetchKeys retrieves the issuer signing keys using OpenID Connect discovery
+func (v *oidcVerifier) fetchKeys() (map[string]crypto.PublicKey, error) {
+	var discovery struct {
+		Issuer  string `json:"issuer"`
+		JwksURI string `json:"jwks_uri"`
+	}
+	if err := v.getJSON(v.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, fmt.Errorf("cannot discover OIDC issuer configuration: %s", err)
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != v.issuer {
+		return nil, fmt.Errorf("OIDC discovery returned issuer '%s' instead of '%s'", discovery.Issuer, v.issuer)
+	}
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := v.getJSON(discovery.JwksURI, &jwks); err != nil {
+		return nil, fmt.Errorf("cannot retrieve OIDC issuer keys: %s", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range jwks.Keys {
+		if len(k.Use) > 0 && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if k.Crv != "P-256" || errX != nil || errY != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	return keys, nil
+}
+
+func (v *oidcVerifier) getJSON(uri string, target interface{}) error {
+	resp, err := v.client.Get(uri)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", uri, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(target)
+}
+
+func hasAudience(audiences []string, audience string) bool {
+	for _, aud := range audiences {
+		if aud == audience {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeSegment(segment string, target interface{}) error {
+	bytes, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bytes, target)
+}
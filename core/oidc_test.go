@@ -0,0 +1,201 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubIssuer a local OpenID Connect provider publishing an RSA and an EC signing key
+type stubIssuer struct {
+	*httptest.Server
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+}
+
+func newStubIssuer(t *testing.T) *stubIssuer {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	s := &stubIssuer{rsaKey: rsaKey, ecKey: ecKey}
+	b64 := base64.RawURLEncoding.EncodeToString
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": s.URL, "jwks_uri": s.URL + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+			{"kid": "rsa", "kty": "RSA", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{"kid": "ec", "kty": "EC", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+		}})
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *stubIssuer) token(t *testing.T, alg string, claims map[string]interface{}) string {
+	kid := map[string]string{"RS256": "rsa", "ES256": "ec"}[alg]
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+	var sig []byte
+	if alg == "RS256" {
+		sig, _ = rsa.SignPKCS1v15(rand.Reader, s.rsaKey, crypto.SHA256, digest[:])
+	} else {
+		r, ss, err := ecdsa.Sign(rand.Reader, s.ecKey, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), ss.FillBytes(make([]byte, 32))...)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestOIDCVerifier(t *testing.T) {
+	issuer := newStubIssuer(t)
+	verifier := newOIDCVerifier(issuer.URL, "pilotctl", issuer.Client())
+	claims := func(mutate func(map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":                issuer.URL,
+			"aud":                []string{"pilotctl", "other"},
+			"exp":                time.Now().Add(time.Hour).Unix(),
+			"preferred_username": "jdoe",
+			"groups":             []string{"ops"},
+		}
+		if mutate != nil {
+			mutate(c)
+		}
+		return c
+	}
+	for _, alg := range []string{"RS256", "ES256"} {
+		got, err := verifier.verify(issuer.token(t, alg, claims(nil)))
+		if err != nil {
+			t.Fatalf("%s token rejected: %s", alg, err)
+		}
+		if got["preferred_username"] != "jdoe" {
+			t.Fatalf("unexpected claims %v", got)
+		}
+	}
+	invalid := map[string]string{
+		"expired":    issuer.token(t, "RS256", claims(func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() })),
+		"audience":   issuer.token(t, "RS256", claims(func(c map[string]interface{}) { c["aud"] = "other" })),
+		"issuer":     issuer.token(t, "ES256", claims(func(c map[string]interface{}) { c["iss"] = "https://evil.example" })),
+		"not before": issuer.token(t, "ES256", claims(func(c map[string]interface{}) { c["nbf"] = time.Now().Add(time.Hour).Unix() })),
+	}
+	tampered := issuer.token(t, "RS256", claims(nil))
+	invalid["signature"] = tampered[:len(tampered)-4] + "AAAA"
+	for name, token := range invalid {
+		if _, err := verifier.verify(token); err == nil {
+			t.Fatalf("token with invalid %s was accepted", name)
+		}
+	}
+	controls := groupControls(claimValues(claims(nil)["groups"]), map[string][]GroupControl{
+		"ops":    {{URI: "/host", Method: []string{"GET"}}},
+		"admins": {{URI: "*", Method: []string{"*"}}},
+	})
+	if len(controls) != 1 || controls[0].URI != "/host" || controls[0].Realm != "pilotcl" {
+		t.Fatalf("unexpected controls %v", controls)
+	}
+}
+
+func TestAuthenticateOIDC(t *testing.T) {
+	issuer := newStubIssuer(t)
+	groupMap := filepath.Join(t.TempDir(), "groups.json")
+	writeMap := func(content string, modified time.Time) {
+		if err := os.WriteFile(groupMap, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(groupMap, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeMap(`{"ops": [{"uri": "/host", "method": ["GET"]}]}`, time.Now().Add(-time.Hour))
+	for key, value := range map[ConfKey]string{
+		ConfOIDCIssuer:   issuer.URL,
+		ConfOIDCAudience: "pilotctl",
+		ConfOIDCGroupMap: groupMap,
+	} {
+		os.Setenv(string(key), value)
+		defer os.Unsetenv(string(key))
+	}
+	oidcMu.Lock()
+	oidc = newOIDCVerifier(issuer.URL, "pilotctl", issuer.Client())
+	oidcMu.Unlock()
+	defer func() { oidc = nil }()
+	api := &API{conf: NewConf()}
+	token := issuer.token(t, "ES256", map[string]interface{}{
+		"iss":                issuer.URL,
+		"aud":                "pilotctl",
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"sub":                "f4c1",
+		"preferred_username": "jdoe",
+		"groups":             []string{"ops", "unmapped"},
+	})
+	principal, err := api.authenticateOIDC(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal.Username != "jdoe" || len(principal.Rights) != 1 || principal.Rights[0].URI != "/host" {
+		t.Fatalf("unexpected principal %+v", principal)
+	}
+	// the group map is loaded again when it changes
+	writeMap(`{"ops": [{"uri": "/job", "method": ["GET", "POST"]}]}`, time.Now())
+	if principal, err = api.authenticateOIDC(token); err != nil {
+		t.Fatal(err)
+	}
+	if len(principal.Rights) != 1 || principal.Rights[0].URI != "/job" {
+		t.Fatalf("group map was not reloaded, got rights %+v", principal.Rights)
+	}
+	// the group map previously loaded is kept if the changed file is not valid
+	writeMap(`{"ops": `, time.Now().Add(time.Minute))
+	if principal, err = api.authenticateOIDC(token); err != nil || len(principal.Rights) != 1 || principal.Rights[0].URI != "/job" {
+		t.Fatalf("expected previous group map to be kept, got %+v, %v", principal, err)
+	}
+	// tokens issued for other clients are rejected
+	other := issuer.token(t, "RS256", map[string]interface{}{
+		"iss": issuer.URL,
+		"aud": "other",
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"sub": "f4c1",
+	})
+	if _, err = api.authenticateOIDC(other); err == nil {
+		t.Fatal("token issued for another audience was accepted")
+	}
+	// an empty audience is rejected at startup
+	os.Setenv(string(ConfOIDCAudience), "")
+	if _, err = NewAPI(NewConf()); err == nil || !strings.Contains(err.Error(), string(ConfOIDCAudience)) {
+		t.Fatalf("expected missing audience to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,299 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"fmt"
+	"log"
+	"math"
+	. "southwinds.dev/pilotctl/types"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the period after which ping policies and host placements are looked up again
+const pingPolicyRefresh = time.Minute
+
+// the period after which the interval recorded for a host that has not pinged is forgotten
+const pingIntervalRetention = time.Hour
+
+// the number of pings a host can miss before it is considered disconnected
+const missedPings = 2
+
+// pingPolicyCache caches the ping policies and the placements of the hosts they are applied to
+// so that pings do not have to query them every time
+type pingPolicyCache struct {
+	mu         sync.Mutex
+	policies   []PingPolicy
+	checked    time.Time
+	placements map[string]hostPlacement
+	// the intervals last recorded for each host
+	recorded map[string]recordedInterval
+}
+
+type hostPlacement struct {
+	host    Host
+	checked time.Time
+}
+
+type recordedInterval struct {
+	secs int
+	// the period in seconds the pings of the host are held waiting for a job, in long-poll mode
+	waitSecs int
+	// the time of the last ping of the host
+	pinged time.Time
+}
+
+var pingPolicies = &pingPolicyCache{
+	placements: make(map[string]hostPlacement),
+	recorded:   make(map[string]recordedInterval),
+}
+
+// the number of ping requests being processed
+var pingsInFlight int64
+
+// TrackPing counts a ping request while it is processed so that ping intervals can be backed off under load
+// the returned function must be called when the request has been processed, or is waiting for a job
+func TrackPing() func() {
+	atomic.AddInt64(&pingsInFlight, 1)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			atomic.AddInt64(&pingsInFlight, -1)
+		})
+	}
+}
+
+// GetPingPolicies get the ping interval policies
+func (r *API) GetPingPolicies() ([]PingPolicy, error) {
+	rows, err := r.db.Query("select * from pilotctl_get_ping_policies()")
+	if err != nil {
+		return nil, fmt.Errorf("cannot get ping policies: %s\n", err)
+	}
+	policies := make([]PingPolicy, 0)
+	for rows.Next() {
+		var p PingPolicy
+		if err = rows.Scan(&p.Name, &p.OrgGroup, &p.Org, &p.Area, &p.Location, &p.Label, &p.IntervalSecs, &p.PendingJobIntervalSecs); err != nil {
+			return nil, fmt.Errorf("cannot read ping policy: %s\n", err)
+		}
+		policies = append(policies, p)
+	}
+	return policies, rows.Err()
+}
+
+// SetPingPolicy creates or updates a ping interval policy
+func (r *API) SetPingPolicy(policy PingPolicy) error {
+	if err := policy.Valid(); err != nil {
+		return err
+	}
+	err := r.db.RunCommand("select pilotctl_set_ping_policy($1, $2, $3, $4, $5, $6, $7, $8)",
+		policy.Name, policy.OrgGroup, policy.Org, policy.Area, policy.Location, policy.Label, policy.IntervalSecs, policy.PendingJobIntervalSecs)
+	if err != nil {
+		return fmt.Errorf("cannot set ping policy: %s\n", err)
+	}
+	pingPolicies.reset()
+	return nil
+}
+
+// DeletePingPolicy deletes a ping interval policy
+func (r *API) DeletePingPolicy(name string) error {
+	if err := r.db.RunCommand("select pilotctl_delete_ping_policy($1)", name); err != nil {
+		return fmt.Errorf("cannot delete ping policy: %s\n", err)
+	}
+	pingPolicies.reset()
+	return nil
+}
+
+// HostPingInterval returns the interval before the next ping of a host
+// the interval of the most specific policy matching the host applies, or the default interval if no policy matches;
+// it is backed off when the number of pings being processed exceeds the configured threshold
+// wait is the period the host asked its pings to be held waiting for a job, zero if it does not long-poll
+func (r *API) HostPingInterval(hostUUID string, pendingJob bool, wait time.Duration) time.Duration {
+	secs := r.policyInterval(hostUUID, pendingJob)
+	factor := backoffFactor(atomic.LoadInt64(&pingsInFlight), r.conf.PingBackoffThreshold(), r.conf.PingBackoffMaxFactor())
+	secs = int(math.Ceil(float64(secs) * factor))
+	r.recordPingInterval(hostUUID, secs, int(math.Ceil(r.LongPollWait(wait).Seconds())))
+	return time.Duration(secs) * time.Second
+}
+
+// policyInterval returns the ping interval in seconds of the policy matching the host
+func (r *API) policyInterval(hostUUID string, pendingJob bool) int {
+	policies, err := r.pingPolicies()
+	if err != nil {
+		log.Printf("WARNING: cannot retrieve ping policies, using the default ping interval: %s\n", err)
+	}
+	if len(policies) == 0 {
+		return r.defaultPingInterval()
+	}
+	host, err := r.hostPlacement(hostUUID)
+	if err != nil {
+		log.Printf("WARNING: cannot retrieve placement of host '%s', using the default ping interval: %s\n", hostUUID, err)
+		return r.defaultPingInterval()
+	}
+	if policy := SelectPingPolicy(policies, *host); policy != nil {
+		return policy.Interval(pendingJob)
+	}
+	return r.defaultPingInterval()
+}
+
+func (r *API) defaultPingInterval() int {
+	return int(r.PingInterval().Seconds())
+}
+
+// pingPolicies returns the cached ping policies
+func (r *API) pingPolicies() ([]PingPolicy, error) {
+	pingPolicies.mu.Lock()
+	defer pingPolicies.mu.Unlock()
+	if time.Since(pingPolicies.checked) < pingPolicyRefresh {
+		return pingPolicies.policies, nil
+	}
+	policies, err := r.GetPingPolicies()
+	if err != nil {
+		return nil, err
+	}
+	pingPolicies.policies, pingPolicies.checked = policies, time.Now()
+	pingPolicies.sweep(pingPolicies.checked)
+	return policies, nil
+}
+
+// hostPlacement returns the cached logistics and labels of a host
+func (r *API) hostPlacement(hostUUID string) (*Host, error) {
+	pingPolicies.mu.Lock()
+	placement, ok := pingPolicies.placements[hostUUID]
+	pingPolicies.mu.Unlock()
+	if ok && time.Since(placement.checked) < pingPolicyRefresh {
+		return &placement.host, nil
+	}
+	host, err := r.GetHost(hostUUID)
+	if err != nil {
+		return nil, err
+	}
+	pingPolicies.mu.Lock()
+	pingPolicies.placements[hostUUID] = hostPlacement{host: *host, checked: time.Now()}
+	pingPolicies.mu.Unlock()
+	return host, nil
+}
+
+// recordPingInterval records the interval given to a host and the period its pings are held when they change
+// so that the host is not considered disconnected before it is due to ping again
+func (r *API) recordPingInterval(hostUUID string, secs, waitSecs int) {
+	recorded := recordedInterval{secs: secs, waitSecs: waitSecs}
+	pingPolicies.mu.Lock()
+	last, ok := pingPolicies.recorded[hostUUID]
+	unchanged := ok && last.secs == secs && last.waitSecs == waitSecs
+	if unchanged {
+		recorded.pinged = time.Now()
+		pingPolicies.recorded[hostUUID] = recorded
+	}
+	pingPolicies.mu.Unlock()
+	if unchanged {
+		return
+	}
+	if err := r.db.RunCommand("select pilotctl_set_ping_interval($1, $2, $3)", hostUUID, secs, waitSecs); err != nil {
+		log.Printf("WARNING: cannot record ping interval of host '%s': %s\n", hostUUID, err)
+		return
+	}
+	recorded.pinged = time.Now()
+	pingPolicies.mu.Lock()
+	pingPolicies.recorded[hostUUID] = recorded
+	pingPolicies.mu.Unlock()
+}
+
+// pingIntervals returns the ping interval and the long-poll wait in seconds last recorded for each host
+func (r *API) pingIntervals() (map[string]recordedInterval, error) {
+	rows, err := r.db.Query("select * from pilotctl_get_ping_intervals()")
+	if err != nil {
+		return nil, fmt.Errorf("cannot get ping intervals: %s\n", err)
+	}
+	intervals := make(map[string]recordedInterval)
+	for rows.Next() {
+		var (
+			hostUUID string
+			interval recordedInterval
+		)
+		if err = rows.Scan(&hostUUID, &interval.secs, &interval.waitSecs); err != nil {
+			return nil, fmt.Errorf("cannot read ping interval: %s\n", err)
+		}
+		intervals[hostUUID] = interval
+	}
+	return intervals, rows.Err()
+}
+
+// hostIntervals returns a function giving the ping interval expected from a host and the period its pings are held,
+// used to find out if it is disconnected
+func (r *API) hostIntervals() (func(host Host) (int, int), error) {
+	intervals, err := r.pingIntervals()
+	if err != nil {
+		return nil, err
+	}
+	policies, err := r.pingPolicies()
+	if err != nil {
+		return nil, err
+	}
+	return func(host Host) (int, int) {
+		if interval, ok := intervals[host.HostUUID]; ok && interval.secs > 0 {
+			return interval.secs, interval.waitSecs
+		}
+		if policy := SelectPingPolicy(policies, host); policy != nil {
+			return policy.IntervalSecs, 0
+		}
+		return r.defaultPingInterval(), 0
+	}, nil
+}
+
+// reset forces the policies and placements to be looked up again
+func (c *pingPolicyCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checked = time.Time{}
+	c.placements = make(map[string]hostPlacement)
+}
+
+// sweep removes the placements that are out of date and the intervals of the hosts that have stopped pinging
+// so that the cache does not keep growing with hosts that are gone; the caller must hold the lock
+func (c *pingPolicyCache) sweep(now time.Time) {
+	for hostUUID, placement := range c.placements {
+		if now.Sub(placement.checked) >= pingPolicyRefresh {
+			delete(c.placements, hostUUID)
+		}
+	}
+	for hostUUID, recorded := range c.recorded {
+		if now.Sub(recorded.pinged) >= pingIntervalRetention {
+			delete(c.recorded, hostUUID)
+		}
+	}
+}
+
+// forget removes a host that has been decommissioned or purged
+func (c *pingPolicyCache) forget(hostUUID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.placements, hostUUID)
+	delete(c.recorded, hostUUID)
+}
+
+// backoffFactor returns the factor by which ping intervals are multiplied when the number of pings being processed
+// exceeds the threshold, it grows with the load up to the maximum factor
+func backoffFactor(inFlight int64, threshold, maxFactor int) float64 {
+	if threshold <= 0 || inFlight <= int64(threshold) {
+		return 1
+	}
+	return math.Max(1, math.Min(float64(inFlight)/float64(threshold), float64(maxFactor)))
+}
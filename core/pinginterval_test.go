@@ -0,0 +1,68 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffFactor(t *testing.T) {
+	cases := []struct {
+		inFlight  int64
+		threshold int
+		expected  float64
+	}{
+		{inFlight: 10, threshold: 0, expected: 1},
+		{inFlight: 100, threshold: 200, expected: 1},
+		{inFlight: 300, threshold: 200, expected: 1.5},
+		{inFlight: 2000, threshold: 200, expected: 4},
+	}
+	for _, c := range cases {
+		if factor := backoffFactor(c.inFlight, c.threshold, 4); factor != c.expected {
+			t.Fatalf("%d pings in flight with threshold %d: expected factor %.2f, got %.2f", c.inFlight, c.threshold, c.expected, factor)
+		}
+	}
+}
+
+func TestPingPolicyCacheSweep(t *testing.T) {
+	now := time.Now()
+	cache := &pingPolicyCache{
+		placements: map[string]hostPlacement{
+			"fresh": {checked: now},
+			"stale": {checked: now.Add(-pingPolicyRefresh)},
+		},
+		recorded: map[string]recordedInterval{
+			"pinging": {secs: 60, pinged: now.Add(-time.Minute)},
+			"gone":    {secs: 60, pinged: now.Add(-pingIntervalRetention)},
+		},
+	}
+	cache.sweep(now)
+	if _, ok := cache.placements["stale"]; ok || len(cache.placements) != 1 {
+		t.Fatalf("stale placement not removed: %v", cache.placements)
+	}
+	if _, ok := cache.recorded["gone"]; ok || len(cache.recorded) != 1 {
+		t.Fatalf("interval of host that stopped pinging not removed: %v", cache.recorded)
+	}
+	cache.forget("pinging")
+	cache.forget("fresh")
+	if len(cache.placements) != 0 || len(cache.recorded) != 0 {
+		t.Fatal("forgotten host still cached")
+	}
+}
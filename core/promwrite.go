@@ -0,0 +1,139 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+	"strings"
+)
+
+// promWriteRequest encodes data points as a Prometheus remote-write WriteRequest protobuf message
+// each numeric field of a point is a sample of the time series named after the field and labelled with the point tags
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func promWriteRequest(points []DataPoint) []byte {
+	var request []byte
+	for _, point := range points {
+		for _, field := range sortedKeys(point.Fields) {
+			value, ok := promValue(point.Fields[field])
+			if !ok {
+				continue
+			}
+			labels := map[string]string{"__name__": promName(field, true)}
+			for name, v := range point.Tags {
+				if len(v) > 0 {
+					labels[promName(name, false)] = v
+				}
+			}
+			names := make([]string, 0, len(labels))
+			for name := range labels {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			var series []byte
+			for _, name := range names {
+				var label []byte
+				label = appendBytes(label, 1, []byte(name))
+				label = appendBytes(label, 2, []byte(labels[name]))
+				series = appendBytes(series, 1, label)
+			}
+			var sample []byte
+			sample = appendTag(sample, 1, 1)
+			sample = binary.LittleEndian.AppendUint64(sample, math.Float64bits(value))
+			sample = appendTag(sample, 2, 0)
+			sample = binary.AppendUvarint(sample, uint64(point.Time.UnixMilli()))
+			series = appendBytes(series, 2, sample)
+			request = appendBytes(request, 1, series)
+		}
+	}
+	return request
+}
+
+func promValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// promName replaces the characters that are not valid in metric (which can have colons) or label names
+func promName(name string, metric bool) string {
+	var b strings.Builder
+	for i, c := range name {
+		switch {
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		case c >= '0' && c <= '9' && i > 0:
+		case c == ':' && metric:
+		case c >= '0' && c <= '9':
+			b.WriteRune('_')
+		default:
+			c = '_'
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func appendTag(buf []byte, field, wireType int) []byte {
+	return binary.AppendUvarint(buf, uint64(field<<3|wireType))
+}
+
+// appendBytes appends a length delimited field
+func appendBytes(buf []byte, field int, value []byte) []byte {
+	buf = appendTag(buf, field, 2)
+	buf = binary.AppendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+// snappyEncode encodes content in the snappy block format required by remote-write
+// the content is written as uncompressed literals, which any snappy decoder accepts
+func snappyEncode(content []byte) []byte {
+	const maxLiteral = 1 << 16
+	buf := binary.AppendUvarint(nil, uint64(len(content)))
+	for len(content) > 0 {
+		n := len(content)
+		if n > maxLiteral {
+			n = maxLiteral
+		}
+		if n <= 60 {
+			buf = append(buf, byte(n-1)<<2)
+		} else {
+			// literal tag 61: the length minus one follows in two bytes
+			buf = append(buf, 61<<2, byte(n-1), byte((n-1)>>8))
+		}
+		buf = append(buf, content[:n]...)
+		content = content[n:]
+	}
+	return buf
+}
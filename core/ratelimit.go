@@ -0,0 +1,222 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"math"
+	"net/http"
+	h "southwinds.dev/http"
+	. "southwinds.dev/pilotctl/types"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// PilotLimits protects the endpoints accessed by host pilots from excessive request rates and payloads
+// requests are limited per source IP address before authentication and per host after authentication
+type PilotLimits struct {
+	byIP   *rateLimiter
+	byHost *rateLimiter
+	// the maximum body size in bytes for each route template
+	bodyLimits map[string]int64
+}
+
+// NewPilotLimits creates the limits set in the configuration
+func NewPilotLimits(cfg *Conf) *PilotLimits {
+	ipRate, ipBurst := cfg.IPRateLimit()
+	hostRate, hostBurst := cfg.HostRateLimit()
+	return &PilotLimits{
+		byIP:       newRateLimiter(ipRate, ipBurst),
+		byHost:     newRateLimiter(hostRate, hostBurst),
+		bodyLimits: cfg.PilotBodyLimits(),
+	}
+}
+
+// IPMiddleware rate limits requests by source IP address and limits bodies to the size limit of the route
+// it must be added before the authentication middleware so that requests are rejected before any work is done
+func (l *PilotLimits) IPMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit, limited := l.bodyLimit(r)
+		if !limited {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if ok, retryAfter := l.byIP.allow(remoteIP(*r), time.Now()); !ok {
+			tooManyRequests(w, retryAfter)
+			return
+		}
+		if r.ContentLength > limit {
+			tooLarge(w, limit)
+			return
+		}
+		// the body is streamed to the handler, which fails to read it past the limit
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// BodyReadStatus the status of a request whose body cannot be read
+// 413 if the body exceeds the size limit of the route, otherwise 400
+func BodyReadStatus(err error) int {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// the body size limit of signed requests to routes without a limit, such as certificate enrolment
+const signedBodyLimit int64 = 64 * 1024
+
+// SignedBodyMiddleware buffers the body of signed pilot requests so that it can be read by the authentication
+// middleware to verify the signature and by the request handler
+// the body is read up to the size limit of the route, so that signed requests cannot be used to exhaust memory
+func (l *PilotLimits) SignedBodyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if IsPilotHmacAuth(r.Header.Get("Authorization")) && r.Body != nil && r.Body != http.NoBody {
+			limit, limited := l.bodyLimit(r)
+			if !limited {
+				limit = signedBodyLimit
+			}
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+			_ = r.Body.Close()
+			if err != nil {
+				if BodyReadStatus(err) == http.StatusRequestEntityTooLarge {
+					tooLarge(w, limit)
+					return
+				}
+				http.Error(w, "cannot read request body", http.StatusBadRequest)
+				return
+			}
+			r.Body = &bufferedBody{Reader: bytes.NewReader(body)}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// HostMiddleware rate limits requests by authenticated host
+// it must be added after the authentication middleware so that the host is known
+func (l *PilotLimits) HostMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, limited := l.bodyLimit(r); limited {
+			if host, isPilot := PilotIdentity(h.GetUserPrincipal(r)); isPilot {
+				if ok, retryAfter := l.byHost.allow(host.HostUUID, time.Now()); !ok {
+					tooManyRequests(w, retryAfter)
+					return
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// bodyLimit returns the body size limit of the route of the request, only routes with a limit are rate limited
+func (l *PilotLimits) bodyLimit(r *http.Request) (int64, bool) {
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			limit, ok := l.bodyLimits[template]
+			return limit, ok
+		}
+	}
+	return 0, false
+}
+
+// tooManyRequests tells the client how long to wait before retrying
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, "too many requests, retry later\n", http.StatusTooManyRequests)
+}
+
+func tooLarge(w http.ResponseWriter, limit int64) {
+	http.Error(w, fmt.Sprintf("request body exceeds the limit of %d bytes\n", limit), http.StatusRequestEntityTooLarge)
+}
+
+// rateLimiter a set of token buckets, one for each key
+// each bucket holds up to burst tokens and is refilled at rate tokens per second
+type rateLimiter struct {
+	rate    float64
+	burst   float64
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter creates a limiter allowing perMinute requests a minute on average and bursts of up to burst requests
+// a limiter with no rate does not limit requests
+func newRateLimiter(perMinute, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token from the bucket of the key, if no token is available it returns the time until there is one
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	if l.rate <= 0 {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = bucket
+	}
+	if elapsed := now.Sub(bucket.last).Seconds(); elapsed > 0 {
+		bucket.tokens = math.Min(l.burst, bucket.tokens+elapsed*l.rate)
+	}
+	bucket.last = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+}
+
+// sweep removes the buckets that have refilled since they were last used, at most once a minute
+// as they are no different from new buckets
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.last) > refill {
+			delete(l.buckets, key)
+		}
+	}
+	l.swept = now
+}
@@ -0,0 +1,128 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"github.com/gorilla/mux"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	. "southwinds.dev/pilotctl/types"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	// one request a second with bursts of two
+	limiter := newRateLimiter(60, 2)
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if ok, _ := limiter.allow("10.0.0.1", now); !ok {
+			t.Fatalf("request %d of the burst rejected", i+1)
+		}
+	}
+	ok, retryAfter := limiter.allow("10.0.0.1", now)
+	if ok || retryAfter != time.Second {
+		t.Fatalf("request over the burst allowed or unexpected retry after %s", retryAfter)
+	}
+	if ok, _ = limiter.allow("10.0.0.2", now); !ok {
+		t.Fatal("request from another key rejected")
+	}
+	if ok, _ = limiter.allow("10.0.0.1", now.Add(time.Second)); !ok {
+		t.Fatal("request rejected after the bucket was refilled")
+	}
+	// idle buckets are removed
+	limiter.allow("10.0.0.3", now.Add(time.Hour))
+	if len(limiter.buckets) != 1 {
+		t.Fatalf("idle buckets not removed, %d buckets left", len(limiter.buckets))
+	}
+	if ok, _ = newRateLimiter(0, 0).allow("10.0.0.1", now); !ok {
+		t.Fatal("request rejected by a limiter with no rate")
+	}
+}
+
+func TestPilotLimitsIPMiddleware(t *testing.T) {
+	limits := &PilotLimits{
+		byIP:       newRateLimiter(60, 1),
+		byHost:     newRateLimiter(60, 1),
+		bodyLimits: map[string]int64{"/ping": 8},
+	}
+	router := mux.NewRouter()
+	router.Use(limits.IPMiddleware)
+	router.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			w.WriteHeader(BodyReadStatus(err))
+		}
+	}).Methods(http.MethodPost)
+	router.HandleFunc("/host", func(w http.ResponseWriter, r *http.Request) {}).Methods(http.MethodGet)
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.ContentLength = -1
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := request(http.MethodPost, "/ping", "{}"); rec.Code != http.StatusOK {
+		t.Fatalf("ping rejected with %d", rec.Code)
+	}
+	rec := request(http.MethodPost, "/ping", "{}")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "1" {
+		t.Fatalf("expected 429 with retry after 1 second, got %d retry after '%s'", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	limits.byIP = newRateLimiter(60, 10)
+	if rec = request(http.MethodPost, "/ping", "0123456789"); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 for a body over the limit, got %d", rec.Code)
+	}
+	for i := 0; i < 3; i++ {
+		if rec = request(http.MethodGet, "/host", ""); rec.Code != http.StatusOK {
+			t.Fatalf("route without limits rejected with %d", rec.Code)
+		}
+	}
+}
+
+func TestPilotLimitsSignedBodyMiddleware(t *testing.T) {
+	limits := &PilotLimits{
+		byIP:       newRateLimiter(0, 0),
+		byHost:     newRateLimiter(0, 0),
+		bodyLimits: map[string]int64{"/ping": 8},
+	}
+	router := mux.NewRouter()
+	router.Use(limits.SignedBodyMiddleware)
+	router.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+		body, err := requestBody(*r)
+		if err != nil || string(body) != "{}" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}).Methods(http.MethodPost)
+	request := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/ping", strings.NewReader(body))
+		req.ContentLength = -1
+		req.Header.Set("Authorization", PilotHmacScheme+" uuid=a,kid=b,ts=1,nonce=c,sig=d")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := request("{}"); rec.Code != http.StatusOK {
+		t.Fatalf("signed body not buffered, got %d", rec.Code)
+	}
+	if rec := request("0123456789"); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 for a signed body over the limit, got %d", rec.Code)
+	}
+}
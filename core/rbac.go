@@ -0,0 +1,186 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	h "southwinds.dev/http"
+	. "southwinds.dev/pilotctl/types"
+	"strings"
+)
+
+// ErrForbidden the user does not have the permission required on the target hosts
+var ErrForbidden = errors.New("access denied")
+
+// UserAccess returns the role bindings scoping what the user can see and do
+// if role based access control is disabled, a nil Access granting unrestricted access is returned
+func (r *API) UserAccess(principal *h.UserPrincipal) (*Access, error) {
+	// api tokens are always limited to the role binding they were created with
+	if principal != nil {
+		if token, ok := principal.Context.(ApiToken); ok {
+			return &Access{Username: principal.Username, Bindings: []RoleBinding{token.Binding()}}, nil
+		}
+	}
+	if !r.conf.RBACEnabled() {
+		return nil, nil
+	}
+	if principal == nil {
+		return &Access{}, nil
+	}
+	// the administrators in the configuration bootstrap role based access control
+	for _, admin := range r.conf.RBACAdmins() {
+		if strings.EqualFold(admin, principal.Username) {
+			return &Access{
+				Username: principal.Username,
+				Bindings: []RoleBinding{{Username: principal.Username, Role: RoleAdmin}},
+			}, nil
+		}
+	}
+	bindings, err := r.GetRoleBindings(principal.Username)
+	if err != nil {
+		return nil, err
+	}
+	return &Access{Username: principal.Username, Bindings: bindings}, nil
+}
+
+// OwnerIdentity returns the identity recorded as the owner of the resources created with the principal
+// unlike usernames, it cannot be chosen by users: it is the issuer and subject of OpenID Connect users, the identity of
+// the user who created the api token of automation clients, or otherwise the username authenticated by Onix
+func OwnerIdentity(principal *h.UserPrincipal) string {
+	if principal == nil {
+		return ""
+	}
+	switch ctx := principal.Context.(type) {
+	case ApiToken:
+		// tokens created before owner identities were recorded are accounted to their owner
+		if len(ctx.OwnerId) == 0 {
+			return ctx.Owner
+		}
+		return ctx.OwnerId
+	case oidcIdentity:
+		return ctx.String()
+	}
+	return principal.Username
+}
+
+// GetRoleBindings returns the role bindings of a user or of all users if no username is specified
+func (r *API) GetRoleBindings(username string) ([]RoleBinding, error) {
+	rows, err := r.db.Query("select * from pilotctl_get_role_bindings($1)", username)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get role bindings: %s\n", err)
+	}
+	var (
+		user, role          string
+		orgGroup, org, area sql.NullString
+	)
+	bindings := make([]RoleBinding, 0)
+	for rows.Next() {
+		if err = rows.Scan(&user, &role, &orgGroup, &org, &area); err != nil {
+			return nil, fmt.Errorf("cannot scan role binding row: %s\n", err)
+		}
+		bindings = append(bindings, RoleBinding{
+			Username: user,
+			Role:     Role(role),
+			OrgGroup: orgGroup.String,
+			Org:      org.String,
+			Area:     area.String,
+		})
+	}
+	return bindings, rows.Err()
+}
+
+// SetRoleBinding grants a role to a user within a logistics scope
+func (r *API) SetRoleBinding(binding RoleBinding) error {
+	if len(binding.Username) == 0 {
+		return fmt.Errorf("username is missing")
+	}
+	role, err := ParseRole(string(binding.Role))
+	if err != nil {
+		return err
+	}
+	return r.db.RunCommand("select pilotctl_set_role_binding($1, $2, $3, $4, $5)", binding.Username, role, binding.OrgGroup, binding.Org, binding.Area)
+}
+
+// DeleteRoleBinding revokes a role granted to a user within a logistics scope
+func (r *API) DeleteRoleBinding(binding RoleBinding) error {
+	if len(binding.Username) == 0 {
+		return fmt.Errorf("username is missing")
+	}
+	return r.db.RunCommand("select pilotctl_delete_role_binding($1, $2, $3, $4, $5)", binding.Username, binding.Role, binding.OrgGroup, binding.Org, binding.Area)
+}
+
+// hostsInScope returns the UUIDs, among the specified hosts, of the hosts on which the user has the permission
+// or nil if the access is unrestricted; the hosts are filtered by the database using the scopes of the user
+func (r *API) hostsInScope(access *Access, perm Permission, hostUUIDs []string) (map[string]bool, error) {
+	if access == nil {
+		return nil, nil
+	}
+	orgGroups, orgs, areas := scopeArgs(access, perm)
+	rows, err := r.db.Query("select * from pilotctl_get_hosts_in_scope($1, $2, $3, $4)", orgGroups, orgs, areas, hostUUIDs)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get hosts in scope: %s\n", err)
+	}
+	scope := make(map[string]bool)
+	var hostUUID string
+	for rows.Next() {
+		if err = rows.Scan(&hostUUID); err != nil {
+			return nil, fmt.Errorf("cannot scan host in scope row: %s\n", err)
+		}
+		scope[hostUUID] = true
+	}
+	return scope, rows.Err()
+}
+
+// scopeArgs returns the logistics scopes in which the user has the permission as org group, org and area arrays
+// passed to the stored functions filtering hosts, an empty value in the arrays matches any value;
+// nil arrays are returned if the access is unrestricted and empty arrays if the user does not have the permission
+func scopeArgs(access *Access, perm Permission) (orgGroups, orgs, areas []string) {
+	if access == nil {
+		return nil, nil, nil
+	}
+	orgGroups, orgs, areas = make([]string, 0), make([]string, 0), make([]string, 0)
+	for _, b := range access.Bindings {
+		if b.Role.Allows(perm) {
+			orgGroups = append(orgGroups, b.OrgGroup)
+			orgs = append(orgs, b.Org)
+			areas = append(areas, b.Area)
+		}
+	}
+	return orgGroups, orgs, areas
+}
+
+// CheckHostAccess checks if the user has the permission within the logistics scope of the host
+// hosts that cannot be found are reported as forbidden so that their existence is not disclosed
+func (r *API) CheckHostAccess(access *Access, perm Permission, hostUUID string) error {
+	if access == nil {
+		return nil
+	}
+	host, err := r.GetHost(hostUUID)
+	if err != nil {
+		log.Printf("cannot check access to host '%s': %s\n", hostUUID, err)
+		return fmt.Errorf("%w: '%s' permission required on host '%s'", ErrForbidden, perm, hostUUID)
+	}
+	if !access.CanAt(perm, host.OrgGroup, host.Org, host.Area) {
+		return fmt.Errorf("%w: '%s' permission required on host '%s'", ErrForbidden, perm, hostUUID)
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/xuri/excelize/v2"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	. "southwinds.dev/pilotctl/types"
+	"strings"
+)
+
+// the name of the sheet holding registrations in an XLSX import file, if missing the first sheet is used
+const registrationsSheet = "registrations"
+
+// ImportRegistrations imports host registrations from a CSV or XLSX file
+// each row must contain mac-address, org-group, org, area, location and optionally labels separated by pipes
+// the first row is the header and is skipped; all rows are validated before any is provisioned
+// if dryRun is true, rows are only validated
+func ImportRegistrations(file string, api *API, dryRun bool) ([]RegistrationImportResult, error) {
+	file, err := filepath.Abs(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot resolve registrations file path: %s", err)
+	}
+	defer func() {
+		if rmErr := RemoveUpload(file); rmErr != nil {
+			log.Printf("WARNING: %s\n", rmErr)
+		}
+	}()
+	rows, err := loadRegistrationRows(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) < 2 {
+		return nil, fmt.Errorf("the registrations file does not contain any rows after the header")
+	}
+	var (
+		results   = make([]RegistrationImportResult, 0)
+		regs      = make(map[int]Registration)
+		seen      = make(map[string]int)
+		validator = newLogisticsValidator(api)
+	)
+	for ix, row := range rows[1:] {
+		rowNo := ix + 2
+		// skip empty rows
+		if len(strings.TrimSpace(strings.Join(row, ""))) == 0 {
+			continue
+		}
+		reg, err := parseRegistrationRow(row)
+		result := RegistrationImportResult{Row: rowNo, MacAddress: reg.MacAddress, Status: RegistrationValid}
+		if err == nil {
+			if first, dup := seen[macKey(reg.MacAddress)]; dup {
+				err = fmt.Errorf("mac-address is duplicated in row %d", first)
+			}
+		}
+		if err == nil {
+			err = validator.validate(reg.OrgGroup, reg.Org, reg.Area, reg.Location)
+		}
+		if err != nil {
+			result.Status = RegistrationInvalid
+			result.Reason = err.Error()
+		} else {
+			seen[macKey(reg.MacAddress)] = rowNo
+			regs[len(results)] = *reg
+		}
+		results = append(results, result)
+	}
+	if dryRun {
+		return results, nil
+	}
+	for ix := range results {
+		reg, valid := regs[ix]
+		if !valid {
+			continue
+		}
+		activation, err := api.ProvisionRegistration(reg)
+		if err != nil {
+			results[ix].Status = RegistrationFailed
+			results[ix].Reason = err.Error()
+			continue
+		}
+		results[ix].Status = RegistrationRegistered
+		if activation != nil {
+			results[ix].Token = activation.Token
+		}
+	}
+	return results, nil
+}
+
+// loadRegistrationRows reads the rows of a CSV or XLSX registrations file based on its extension
+func loadRegistrationRows(file string) ([][]string, error) {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".csv":
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open registrations file: %s", err)
+		}
+		defer f.Close()
+		reader := csv.NewReader(f)
+		reader.FieldsPerRecord = -1
+		reader.TrimLeadingSpace = true
+		rows, err := reader.ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("cannot read registrations file: %s", err)
+		}
+		return rows, nil
+	case ".xlsx":
+		f, err := excelize.OpenFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open registrations file: %s", err)
+		}
+		defer f.Close()
+		sheet := registrationsSheet
+		if f.GetSheetIndex(sheet) < 0 {
+			sheet = f.GetSheetName(0)
+		}
+		rows, err := f.GetRows(sheet)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read sheet '%s' in registrations file: %s", sheet, err)
+		}
+		return rows, nil
+	default:
+		return nil, fmt.Errorf("registrations file '%s' must be either a .csv or a .xlsx file", filepath.Base(file))
+	}
+}
+
+// parseRegistrationRow parses a row in a registrations file, the registration is returned
+// even if an error occurs so that the mac-address can be reported
+func parseRegistrationRow(row []string) (*Registration, error) {
+	reg := &Registration{
+		MacAddress: strings.TrimSpace(value(row, 0)),
+		OrgGroup:   strings.TrimSpace(value(row, 1)),
+		Org:        strings.TrimSpace(value(row, 2)),
+		Area:       strings.TrimSpace(value(row, 3)),
+		Location:   strings.TrimSpace(value(row, 4)),
+		Label:      make([]string, 0),
+	}
+	for _, label := range strings.Split(value(row, 5), "|") {
+		if label = strings.TrimSpace(label); len(label) > 0 {
+			reg.Label = append(reg.Label, label)
+		}
+	}
+	if len(reg.MacAddress) == 0 {
+		return reg, fmt.Errorf("mac-address is missing")
+	}
+	if _, err := net.ParseMAC(reg.MacAddress); err != nil {
+		return reg, fmt.Errorf("mac-address '%s' is not valid", reg.MacAddress)
+	}
+	return reg, nil
+}
+
+// macKey normalises a valid mac-address so that the same address written in different formats is detected as duplicated
+func macKey(macAddress string) string {
+	mac, err := net.ParseMAC(macAddress)
+	if err != nil {
+		return strings.ToLower(macAddress)
+	}
+	return mac.String()
+}
@@ -0,0 +1,142 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"log"
+	. "southwinds.dev/pilotctl/types"
+	"strings"
+	"time"
+)
+
+// GetRegistrations returns host registrations, optionally filtered by status
+func (r *API) GetRegistrations(status string) ([]RegistrationInfo, error) {
+	if len(status) > 0 {
+		s, err := ParseRegistrationStatus(status)
+		if err != nil {
+			return nil, err
+		}
+		status = string(s)
+	}
+	rows, err := r.db.Query("select * from pilotctl_get_registrations($1)", status)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get registrations: %s\n", err)
+	}
+	return scanRegistrations(rows)
+}
+
+// GetRegistration returns the registration of the specified mac-address or nil if the mac-address is not registered
+func (r *API) GetRegistration(macAddress string) (*RegistrationInfo, error) {
+	if len(macAddress) == 0 {
+		return nil, fmt.Errorf("mac-address is missing\n")
+	}
+	rows, err := r.db.Query("select * from pilotctl_get_registration($1)", macAddress)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get registration: %s\n", err)
+	}
+	registrations, err := scanRegistrations(rows)
+	if err != nil || len(registrations) == 0 {
+		return nil, err
+	}
+	return &registrations[0], nil
+}
+
+// scanRegistrations reads the registrations returned by a registration query
+func scanRegistrations(rows pgx.Rows) ([]RegistrationInfo, error) {
+	var (
+		mac, orgGroup, org, area, location, regStatus string
+		labels                                        []string
+		hostUUID                                      sql.NullString
+		provisioned                                   sql.NullTime
+		activated, admitted, expired                  sql.NullTime
+	)
+	registrations := make([]RegistrationInfo, 0)
+	for rows.Next() {
+		err := rows.Scan(&mac, &orgGroup, &org, &area, &location, &labels, &hostUUID, &regStatus, &provisioned, &activated, &admitted, &expired)
+		if err != nil {
+			return nil, fmt.Errorf("cannot scan registration row: %s\n", err)
+		}
+		registrations = append(registrations, RegistrationInfo{
+			MacAddress:  mac,
+			OrgGroup:    orgGroup,
+			Org:         org,
+			Area:        area,
+			Location:    location,
+			Label:       labels,
+			Status:      RegistrationStatus(regStatus),
+			HostUUID:    hostUUID.String,
+			Provisioned: provisioned.Time,
+			Activated:   timeOrNil(activated),
+			Admitted:    timeOrNil(admitted),
+			Expired:     timeOrNil(expired),
+		})
+	}
+	return registrations, rows.Err()
+}
+
+// ExpireRegistrations undoes the registrations of hosts that have not activated within the expiry period
+// expired registrations are marked as expired rather than deleted so that they can still be listed,
+// they can no longer be activated and are deleted by UndoRegistration or replaced by registering the host again
+func (r *API) ExpireRegistrations() error {
+	expiry := r.conf.RegistrationExpiry()
+	if expiry <= 0 {
+		return nil
+	}
+	rows, err := r.db.Query("select * from pilotctl_get_stale_registrations($1)", fmt.Sprintf("%.0f secs", expiry.Seconds()))
+	if err != nil {
+		return fmt.Errorf("cannot get stale registrations: %s\n", err)
+	}
+	var (
+		mac   string
+		stale []string
+	)
+	for rows.Next() {
+		if err = rows.Scan(&mac); err != nil {
+			return fmt.Errorf("cannot scan stale registration row: %s\n", err)
+		}
+		stale = append(stale, mac)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	// a registration that cannot be expired does not stop the others from expiring
+	var failed []string
+	for _, mac = range stale {
+		if err = r.db.RunCommand("select pilotctl_expire_registration($1)", mac); err != nil {
+			failed = append(failed, fmt.Sprintf("mac-address %s: %s", mac, err))
+			continue
+		}
+		log.Printf("registration for mac-address %s expired as the host did not activate within %s\n", mac, expiry)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("cannot expire %d of %d stale registrations:\n%s\n", len(failed), len(stale), strings.Join(failed, "\n"))
+	}
+	return nil
+}
+
+// timeOrNil returns a pointer to the time if valid, or nil otherwise
+func timeOrNil(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
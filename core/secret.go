@@ -0,0 +1,427 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	. "southwinds.dev/pilotctl/types"
+	"strings"
+	"time"
+)
+
+// the backends of the secret store
+const (
+	// BuiltinSecretStore keeps secrets in the pilotctl database encrypted with the credential key
+	BuiltinSecretStore = "builtin"
+	// VaultSecretStore keeps secrets in a HashiCorp Vault KV (version 2) secrets engine
+	VaultSecretStore = "vault"
+)
+
+// SecretStore holds the secrets referenced by commands as secret://path#key
+type SecretStore interface {
+	// Get returns the value of the key in the secret at the specified path
+	Get(path, key string) (string, error)
+	// Set sets the value of the key in the secret at the specified path
+	Set(path, key, value string) error
+	// Delete removes the key from the secret at the specified path
+	Delete(path, key string) error
+}
+
+// NewSecretStore creates the secret store selected in the configuration
+func NewSecretStore(cfg *Conf, db *Db) (SecretStore, error) {
+	switch cfg.SecretStore() {
+	case BuiltinSecretStore:
+		return &builtinSecretStore{conf: cfg, db: db}, nil
+	case VaultSecretStore:
+		return newVaultSecretStore(cfg.SecretVaultAddr(), cfg.SecretVaultToken(), cfg.SecretVaultMount(), nil)
+	default:
+		return nil, fmt.Errorf("invalid secret store '%s', valid values are '%s' or '%s'", cfg.SecretStore(), BuiltinSecretStore, VaultSecretStore)
+	}
+}
+
+// SetSecret sets a value in the secret store
+func (r *API) SetSecret(secret SecretValue) error {
+	if err := secret.Valid(); err != nil {
+		return err
+	}
+	if len(secret.Value) == 0 {
+		return fmt.Errorf("secret value is missing")
+	}
+	if IsSecretRef(secret.Value) {
+		return fmt.Errorf("a secret value cannot be a secret reference")
+	}
+	if err := r.secrets.Set(secret.Path, secret.Key, secret.Value); err != nil {
+		return fmt.Errorf("cannot set secret %s: %s", secret.SecretRef, err)
+	}
+	return nil
+}
+
+// DeleteSecret removes a value from the secret store
+func (r *API) DeleteSecret(ref SecretRef) error {
+	if err := ref.Valid(); err != nil {
+		return err
+	}
+	if err := r.secrets.Delete(ref.Path, ref.Key); err != nil {
+		return fmt.Errorf("cannot delete secret %s: %s", ref, err)
+	}
+	return nil
+}
+
+// ResolveSecrets replaces the secret references in the information of a command with their values
+// it is called when a job is dispatched so that secret values are only sent to the host running the job
+func (r *API) ResolveSecrets(info *CmdInfo) error {
+	return resolveSecrets(r.secrets, info)
+}
+
+func resolveSecrets(store SecretStore, info *CmdInfo) error {
+	var err error
+	if info.User, err = resolveSecret(store, info.User); err != nil {
+		return err
+	}
+	if info.Pwd, err = resolveSecret(store, info.Pwd); err != nil {
+		return err
+	}
+	if info.Input != nil {
+		for _, secret := range info.Input.Secret {
+			if secret.Value, err = resolveSecret(store, secret.Value); err != nil {
+				return fmt.Errorf("cannot resolve input secret '%s': %s", secret.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// resolveSecret returns the value referenced by the specified value or the value itself if it is not a reference
+func resolveSecret(store SecretStore, value string) (string, error) {
+	if !IsSecretRef(value) {
+		return value, nil
+	}
+	ref, err := ParseSecretRef(value)
+	if err != nil {
+		return "", err
+	}
+	secret, err := store.Get(ref.Path, ref.Key)
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve secret %s: %s", ref, err)
+	}
+	return secret, nil
+}
+
+// sealCommandSecrets moves the input secrets of a command to the secret store, replacing them with references
+// so that their values are not kept in Onix
+func sealCommandSecrets(store SecretStore, cmd *Cmd) error {
+	if cmd.Input == nil {
+		return nil
+	}
+	for _, secret := range cmd.Input.Secret {
+		if len(secret.Value) == 0 || IsSecretRef(secret.Value) {
+			continue
+		}
+		ref := commandSecretRef(cmd.Key, secret.Name)
+		if err := ref.Valid(); err != nil {
+			return fmt.Errorf("cannot store input secret '%s': %s", secret.Name, err)
+		}
+		if err := store.Set(ref.Path, ref.Key, secret.Value); err != nil {
+			return fmt.Errorf("cannot store input secret '%s': %s", secret.Name, err)
+		}
+		secret.Value = ref.String()
+	}
+	return nil
+}
+
+// removeCommandSecrets removes the input secrets sealed for a command that has been deleted or updated
+// kept is the updated command, whose references are not removed, or nil if the command has been deleted
+func removeCommandSecrets(store SecretStore, cmd, kept *Cmd) {
+	if cmd.Input == nil {
+		return
+	}
+	refs := make(map[string]bool)
+	if kept != nil && kept.Input != nil {
+		for _, secret := range kept.Input.Secret {
+			refs[secret.Value] = true
+		}
+	}
+	for _, secret := range cmd.Input.Secret {
+		ref := commandSecretRef(cmd.Key, secret.Name)
+		if secret.Value != ref.String() || refs[ref.String()] {
+			// the secret is not owned by the command or is still referenced by it
+			continue
+		}
+		if err := store.Delete(ref.Path, ref.Key); err != nil {
+			log.Printf("WARNING: cannot delete input secret '%s' of command '%s': %s\n", secret.Name, cmd.Key, err)
+		}
+	}
+}
+
+// hasClearSecrets checks if a command keeps any secret values in Onix
+func hasClearSecrets(cmd *Cmd) bool {
+	if len(cmd.Pwd) > 0 && !IsSecretRef(cmd.Pwd) {
+		return true
+	}
+	if cmd.Input != nil {
+		for _, secret := range cmd.Input.Secret {
+			if len(secret.Value) > 0 && !IsSecretRef(secret.Value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SealCommandSecrets moves the secret values of the commands in Onix to the secret store
+// so that commands created before secrets were kept in the store no longer hold them in clear text
+func (r *API) SealCommandSecrets() error {
+	cmds, err := r.GetAllCommands()
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for i := range cmds {
+		if !hasClearSecrets(&cmds[i]) {
+			continue
+		}
+		if err = r.PutCommand(&cmds[i]); err != nil {
+			log.Printf("WARNING: cannot seal the secrets of command '%s': %s\n", cmds[i].Key, err)
+			failed++
+			continue
+		}
+		log.Printf("INFO: moved the secrets of command '%s' to the secret store\n", cmds[i].Key)
+	}
+	if failed > 0 {
+		return fmt.Errorf("cannot seal the secrets of %d commands", failed)
+	}
+	return nil
+}
+
+// commandSecretRef the reference of an input secret sealed for a command
+func commandSecretRef(cmdKey, name string) SecretRef {
+	return SecretRef{Path: fmt.Sprintf("cmd/%s", strings.Replace(cmdKey, " ", "", -1)), Key: name}
+}
+
+// registrySecretRef the reference of the Artisan registry password when it is not configured as a reference
+var registrySecretRef = SecretRef{Path: "registry/artisan", Key: "pwd"}
+
+// registryPwdRef returns the reference to the Artisan registry password recorded in commands
+// a password configured as a value is kept in the secret store
+func (r *API) registryPwdRef() (string, error) {
+	pwd := r.conf.getArtRegPwd()
+	if IsSecretRef(pwd) {
+		return pwd, nil
+	}
+	if err := r.secrets.Set(registrySecretRef.Path, registrySecretRef.Key, pwd); err != nil {
+		return "", fmt.Errorf("cannot store Artisan registry password: %s", err)
+	}
+	return registrySecretRef.String(), nil
+}
+
+// registryPwd returns the password of the Artisan registry, resolving it if it is configured as a reference
+func (r *API) registryPwd() (string, error) {
+	return resolveSecret(r.secrets, r.conf.getArtRegPwd())
+}
+
+// builtinSecretStore keeps secrets in the pilotctl database encrypted with the credential key
+type builtinSecretStore struct {
+	conf *Conf
+	db   *Db
+}
+
+func (s *builtinSecretStore) Get(path, key string) (string, error) {
+	encKey, err := s.conf.CredentialKey()
+	if err != nil {
+		return "", err
+	}
+	rows, err := s.db.Query("select * from pilotctl_get_secret($1, $2)", path, key)
+	if err != nil {
+		return "", fmt.Errorf("cannot get secret: %s\n", err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return "", fmt.Errorf("secret not found")
+	}
+	var encrypted string
+	if err = rows.Scan(&encrypted); err != nil {
+		return "", fmt.Errorf("cannot read secret: %s\n", err)
+	}
+	value, err := AesCrypto{CipherMode: GCM}.Decrypt(encrypted, encKey)
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt secret: %s", err)
+	}
+	return value, nil
+}
+
+func (s *builtinSecretStore) Set(path, key, value string) error {
+	encKey, err := s.conf.CredentialKey()
+	if err != nil {
+		return err
+	}
+	encrypted, err := AesCrypto{CipherMode: GCM}.Encrypt(value, encKey)
+	if err != nil {
+		return fmt.Errorf("cannot encrypt secret: %s", err)
+	}
+	if err = s.db.RunCommand("select pilotctl_set_secret($1, $2, $3)", path, key, encrypted); err != nil {
+		return fmt.Errorf("cannot record secret: %s\n", err)
+	}
+	return nil
+}
+
+func (s *builtinSecretStore) Delete(path, key string) error {
+	if err := s.db.RunCommand("select pilotctl_delete_secret($1, $2)", path, key); err != nil {
+		return fmt.Errorf("cannot delete secret: %s\n", err)
+	}
+	return nil
+}
+
+// vaultSecretStore keeps secrets in a HashiCorp Vault KV version 2 secrets engine
+// each path is a Vault secret and each key a field of the secret
+type vaultSecretStore struct {
+	addr   string
+	token  string
+	mount  string
+	client *http.Client
+}
+
+func newVaultSecretStore(addr, token, mount string, client *http.Client) (*vaultSecretStore, error) {
+	if len(addr) == 0 {
+		return nil, fmt.Errorf("vault secret store requires the Vault address")
+	}
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	return &vaultSecretStore{
+		addr:   strings.TrimSuffix(addr, "/"),
+		token:  token,
+		mount:  strings.Trim(mount, "/"),
+		client: client,
+	}, nil
+}
+
+func (s *vaultSecretStore) Get(path, key string) (string, error) {
+	data, _, err := s.read(path)
+	if err != nil {
+		return "", err
+	}
+	value, ok := data[key]
+	if !ok {
+		return "", fmt.Errorf("secret not found")
+	}
+	str, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("secret value is not a string")
+	}
+	return str, nil
+}
+
+func (s *vaultSecretStore) Set(path, key, value string) error {
+	data, version, err := s.read(path)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+	data[key] = value
+	return s.write(path, data, version)
+}
+
+func (s *vaultSecretStore) Delete(path, key string) error {
+	data, version, err := s.read(path)
+	if err != nil {
+		return err
+	}
+	if _, ok := data[key]; !ok {
+		return nil
+	}
+	delete(data, key)
+	return s.write(path, data, version)
+}
+
+// read returns the fields and version of the latest version of a secret, or no fields if the secret does not exist
+func (s *vaultSecretStore) read(path string) (map[string]interface{}, int, error) {
+	var resp struct {
+		Data struct {
+			Data     map[string]interface{} `json:"data"`
+			Metadata struct {
+				Version int `json:"version"`
+			} `json:"metadata"`
+		} `json:"data"`
+	}
+	status, err := s.call(http.MethodGet, path, nil, &resp)
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot read Vault secret '%s': %s", path, err)
+	}
+	if status == http.StatusNotFound {
+		return nil, 0, nil
+	}
+	return resp.Data.Data, resp.Data.Metadata.Version, nil
+}
+
+// write writes a new version of a secret, failing if the secret was changed since it was read
+func (s *vaultSecretStore) write(path string, data map[string]interface{}, version int) error {
+	req := map[string]interface{}{
+		"options": map[string]interface{}{"cas": version},
+		"data":    data,
+	}
+	status, err := s.call(http.MethodPost, path, req, nil)
+	if err == nil && status == http.StatusNotFound {
+		err = fmt.Errorf("secrets engine not found")
+	}
+	if err != nil {
+		return fmt.Errorf("cannot write Vault secret '%s': %s", path, err)
+	}
+	return nil
+}
+
+func (s *vaultSecretStore) call(method, path string, body, result interface{}) (int, error) {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return 0, err
+		}
+	}
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	req, err := http.NewRequest(method, fmt.Sprintf("%s/v1/%s/data/%s", s.addr, s.mount, strings.Join(segments, "/")), bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("X-Vault-Token", s.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return resp.StatusCode, nil
+	case resp.StatusCode == http.StatusNoContent || result == nil && resp.StatusCode < 300:
+		return resp.StatusCode, nil
+	case resp.StatusCode != http.StatusOK:
+		return resp.StatusCode, fmt.Errorf("%s %s returned %s", method, path, resp.Status)
+	}
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(result)
+}
@@ -0,0 +1,155 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"southwinds.dev/artisan/data"
+	. "southwinds.dev/pilotctl/types"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// kvStandIn a minimal Vault KV version 2 secrets engine mounted at /v1/secret
+type kvStandIn struct {
+	mu      sync.Mutex
+	secrets map[string]map[string]interface{}
+	version map[string]int
+}
+
+func (s *kvStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Vault-Token") != "root" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/v1/secret/data/")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+		secret, ok := s.secrets[path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{"data": secret, "metadata": map[string]interface{}{"version": s.version[path]}},
+		})
+	case http.MethodPost:
+		var req struct {
+			Options struct {
+				Cas int `json:"cas"`
+			} `json:"options"`
+			Data map[string]interface{} `json:"data"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Options.Cas != s.version[path] {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.secrets[path] = req.Data
+		s.version[path]++
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"version": s.version[path]}})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// seals the input secrets of a command in a Vault KV store and resolves them at dispatch time
+func TestVaultSecretStore(t *testing.T) {
+	vault := httptest.NewServer(&kvStandIn{secrets: map[string]map[string]interface{}{}, version: map[string]int{}})
+	defer vault.Close()
+	store, err := newVaultSecretStore(vault.URL, "root", "secret", vault.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Set("registry/artisan", "pwd", "reg-pwd"); err != nil {
+		t.Fatal(err)
+	}
+	cmd := &Cmd{
+		Key: "backup db",
+		Input: &data.Input{
+			Secret: data.Secrets{
+				{Name: "DB_PWD", Value: "db-pwd"},
+				{Name: "API_KEY", Value: "secret://registry/artisan#pwd"},
+			},
+		},
+	}
+	if err = sealCommandSecrets(store, cmd); err != nil {
+		t.Fatal(err)
+	}
+	if cmd.Input.Secret[0].Value != "secret://cmd/backupdb#DB_PWD" {
+		t.Fatalf("input secret not sealed: %s", cmd.Input.Secret[0].Value)
+	}
+	if cmd.Input.Secret[1].Value != "secret://registry/artisan#pwd" {
+		t.Fatalf("input secret reference changed: %s", cmd.Input.Secret[1].Value)
+	}
+	info := &CmdInfo{User: "admin", Pwd: "secret://registry/artisan#pwd", Input: cmd.Input}
+	if err = resolveSecrets(store, info); err != nil {
+		t.Fatal(err)
+	}
+	if info.User != "admin" || info.Pwd != "reg-pwd" || info.Input.Secret[0].Value != "db-pwd" || info.Input.Secret[1].Value != "reg-pwd" {
+		t.Fatalf("secrets not resolved: %+v", info)
+	}
+	if err = store.Delete("registry/artisan", "pwd"); err != nil {
+		t.Fatal(err)
+	}
+	if err = resolveSecrets(store, &CmdInfo{Pwd: "secret://registry/artisan#pwd"}); err == nil {
+		t.Fatal("deleted secret resolved")
+	}
+}
+
+// removes the secrets sealed for a command that its update no longer references
+func TestRemoveCommandSecrets(t *testing.T) {
+	vault := httptest.NewServer(&kvStandIn{secrets: map[string]map[string]interface{}{}, version: map[string]int{}})
+	defer vault.Close()
+	store, err := newVaultSecretStore(vault.URL, "root", "secret", vault.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := &Cmd{
+		Key: "backup db",
+		Input: &data.Input{
+			Secret: data.Secrets{
+				{Name: "DB_PWD", Value: "db-pwd"},
+				{Name: "API_KEY", Value: "api-key"},
+			},
+		},
+	}
+	if err = sealCommandSecrets(store, previous); err != nil {
+		t.Fatal(err)
+	}
+	updated := &Cmd{
+		Key: "backup db",
+		Input: &data.Input{
+			Secret: data.Secrets{
+				{Name: "DB_PWD", Value: "secret://cmd/backupdb#DB_PWD"},
+			},
+		},
+	}
+	removeCommandSecrets(store, previous, updated)
+	if value, err := store.Get("cmd/backupdb", "DB_PWD"); err != nil || value != "db-pwd" {
+		t.Fatalf("referenced secret removed: %v", err)
+	}
+	if _, err = store.Get("cmd/backupdb", "API_KEY"); err == nil {
+		t.Fatal("orphaned secret not removed")
+	}
+}
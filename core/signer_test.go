@@ -0,0 +1,116 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	. "southwinds.dev/pilotctl/types"
+	"testing"
+)
+
+// signs with each key type of the transit stand-in and checks that key rotations are picked up
+func TestTransitSigner(t *testing.T) {
+	for _, keyType := range []string{"rsa-2048", "ecdsa-p256"} {
+		vault := httptest.NewServer(newTransitStandIn("root", keyType))
+		signer, err := newTransitSigner(vault.URL, "root", "transit", "pilotctl", vault.Client())
+		if err != nil {
+			t.Fatal(err)
+		}
+		v1, err := signer.current()
+		if err != nil {
+			t.Fatal(err)
+		}
+		verifySigner(t, v1)
+		// rotates the key and forces the signer to look it up again
+		resp, err := vault.Client().Do(rotateRequest(t, vault.URL))
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("cannot rotate key: %v", err)
+		}
+		signer.info = nil
+		v2, err := signer.current()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v1.KeyId() == v2.KeyId() {
+			t.Fatalf("key id did not change after rotation: %s", v2.KeyId())
+		}
+		verifySigner(t, v2)
+		vault.Close()
+	}
+	if _, err := newTransitSigner("http://127.0.0.1:1", "root", "transit", "pilotctl", nil); err == nil {
+		t.Fatal("transit signer created without a reachable Vault")
+	}
+}
+
+// provisions a token as the provision-token command does and signs with its key
+func TestTokenSigner(t *testing.T) {
+	dir := t.TempDir()
+	os.Setenv("PILOT_CTL_TOKEN_PATH", dir)
+	os.Setenv("PILOT_CTL_TOKEN_PIN", "1234")
+	defer os.Unsetenv("PILOT_CTL_TOKEN_PATH")
+	defer os.Unsetenv("PILOT_CTL_TOKEN_PIN")
+	public, err := ProvisionSoftToken(NewConf(), "ecdsa-p256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ProvisionSoftToken(NewConf(), "ecdsa-p256"); err == nil {
+		t.Fatal("provisioning replaced an existing key")
+	}
+	if _, err = newTokenSigner(NewSoftToken(dir), "0000", "pilotctl"); err == nil {
+		t.Fatal("token login succeeded with an incorrect PIN")
+	}
+	signer, err := newTokenSigner(NewSoftToken(dir), "1234", "pilotctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current, _ := signer.PublicKey(); !bytes.Equal(current, public) {
+		t.Fatal("provisioned public key does not match the signing key")
+	}
+	verifySigner(t, signer)
+}
+
+func verifySigner(t *testing.T, signer publicSigner) {
+	message := []byte("ping response checksum")
+	sig, err := signer.Sign(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := signer.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = VerifySignature(signer.Algorithm(), public, message, sig); err != nil {
+		t.Fatalf("%s signature by '%s' does not verify: %s", signer.Algorithm(), signer.KeyId(), err)
+	}
+	if err = VerifySignature(signer.Algorithm(), public, []byte("tampered"), sig); err == nil {
+		t.Fatal("signature of a different message verified")
+	}
+}
+
+func rotateRequest(t *testing.T, url string) *http.Request {
+	req, err := http.NewRequest(http.MethodPost, url+"/v1/transit/keys/pilotctl/rotate", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Vault-Token", "root")
+	return req
+}
@@ -0,0 +1,364 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	. "southwinds.dev/pilotctl/types"
+	"sync"
+	"time"
+)
+
+// the signers of ping responses
+const (
+	// KeyringSigner signs with the primary key of the signing keyring, or the signing key file if it has no active keys
+	KeyringSigner = "keyring"
+	// TransitSigner signs with a key held by a HashiCorp Vault Transit secrets engine
+	TransitSigner = "transit"
+	// SoftTokenSigner signs with a key held by a software token
+	SoftTokenSigner = "softtoken"
+)
+
+// publicSigner a signer able to publish its verification key
+type publicSigner interface {
+	Signer
+	PublicKey() ([]byte, error)
+}
+
+var (
+	externalSigner   interface{}
+	externalSignerMu sync.Mutex
+)
+
+// Signer returns the signer of ping responses
+// a nil signer means the signing key file must be used
+func (r *API) Signer() (Signer, error) {
+	switch r.conf.SignerType() {
+	case TransitSigner, SoftTokenSigner:
+		return r.externalSigner()
+	default:
+		key, err := r.SigningKey()
+		if err != nil || key == nil {
+			return nil, err
+		}
+		return key, nil
+	}
+}
+
+// externalSigner returns the signer keeping the private key outside pilotctl, creating it on first use
+func (r *API) externalSigner() (publicSigner, error) {
+	externalSignerMu.Lock()
+	defer externalSignerMu.Unlock()
+	var err error
+	if externalSigner == nil {
+		switch r.conf.SignerType() {
+		case TransitSigner:
+			externalSigner, err = newTransitSigner(r.conf.TransitAddr(), r.conf.TransitToken(), r.conf.TransitMount(), r.conf.TransitKey(), nil)
+		case SoftTokenSigner:
+			externalSigner, err = newTokenSigner(NewSoftToken(r.conf.TokenPath()), r.conf.TokenPin(), r.conf.TokenKeyLabel())
+		}
+		if err != nil {
+			externalSigner = nil
+			return nil, fmt.Errorf("cannot create %s signer: %s", r.conf.SignerType(), err)
+		}
+	}
+	switch signer := externalSigner.(type) {
+	case *transitSigner:
+		// the latest version of the transit key is used so that key rotations in Vault are picked up
+		return signer.current()
+	case *tokenSigner:
+		return signer, nil
+	}
+	return nil, fmt.Errorf("unknown signer")
+}
+
+// the period after which the primary signing key is looked up again, so that
+// keys activated or retired by other instances are picked up
+const signingKeyRefresh = time.Minute
+
+// signingKeyring caches the primary signing key
+type signingKeyring struct {
+	mu      sync.Mutex
+	primary *PGP
+	checked time.Time
+}
+
+var keyring = new(signingKeyring)
+
+// GenerateSigningKey generates a new signing key in pending status
+// the key is published to pilots straight away but only signs ping responses once it is activated
+func (r *API) GenerateSigningKey(user string) (*SigningKey, error) {
+	encKey, err := r.conf.CredentialKey()
+	if err != nil {
+		return nil, fmt.Errorf("cannot generate signing key: %s", err)
+	}
+	pgp, err := NewPGP("pilotctl", "ping response signing key", "", 2048)
+	if err != nil {
+		return nil, err
+	}
+	public, err := pgp.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	private, err := pgp.PrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := AesCrypto{CipherMode: GCM}.Encrypt(string(private), encKey)
+	if err != nil {
+		return nil, fmt.Errorf("cannot encrypt signing key: %s", err)
+	}
+	err = r.db.RunCommand("select pilotctl_set_signing_key($1, $2, $3, $4)", pgp.KeyId(), string(public), encrypted, user)
+	if err != nil {
+		return nil, fmt.Errorf("cannot save signing key: %s\n", err)
+	}
+	return &SigningKey{
+		KeyId:     pgp.KeyId(),
+		Status:    SigningKeyPending,
+		CreatedBy: user,
+		Created:   time.Now(),
+		Algorithm: AlgPGP,
+		PublicKey: string(public),
+	}, nil
+}
+
+// ActivateSigningKey makes a key the primary key signing ping responses
+// previously active keys remain active, and published, until they are retired
+func (r *API) ActivateSigningKey(keyId, user string) error {
+	key, err := r.findSigningKey(keyId)
+	if err != nil {
+		return err
+	}
+	if key.Status == SigningKeyRetired {
+		return fmt.Errorf("signing key '%s' has been retired and cannot be activated", keyId)
+	}
+	if err = r.db.RunCommand("select pilotctl_activate_signing_key($1, $2)", keyId, user); err != nil {
+		return fmt.Errorf("cannot activate signing key: %s\n", err)
+	}
+	keyring.reset()
+	return nil
+}
+
+// RetireSigningKey stops a key from being used and published
+// the last active key cannot be retired, a new key has to be activated first
+func (r *API) RetireSigningKey(keyId, user string) error {
+	key, err := r.findSigningKey(keyId)
+	if err != nil {
+		return err
+	}
+	if key.Status == SigningKeyActive {
+		keys, err := r.GetSigningKeys()
+		if err != nil {
+			return err
+		}
+		active := 0
+		for _, k := range keys {
+			if k.Status == SigningKeyActive {
+				active++
+			}
+		}
+		if active == 1 {
+			return fmt.Errorf("signing key '%s' is the last active key, activate another key before retiring it", keyId)
+		}
+	}
+	if err = r.db.RunCommand("select pilotctl_retire_signing_key($1, $2)", keyId, user); err != nil {
+		return fmt.Errorf("cannot retire signing key: %s\n", err)
+	}
+	keyring.reset()
+	return nil
+}
+
+// GetSigningKeys returns all the keys in the signing keyring
+func (r *API) GetSigningKeys() ([]SigningKey, error) {
+	rows, err := r.db.Query("select * from pilotctl_get_signing_keys()")
+	if err != nil {
+		return nil, fmt.Errorf("cannot get signing keys: %s\n", err)
+	}
+	var (
+		keyId, status, public string
+		createdBy             sql.NullString
+		created               time.Time
+		activated, retired    sql.NullTime
+	)
+	keys := make([]SigningKey, 0)
+	for rows.Next() {
+		if err = rows.Scan(&keyId, &status, &createdBy, &created, &activated, &retired, &public); err != nil {
+			return nil, fmt.Errorf("cannot scan signing key row: %s\n", err)
+		}
+		keys = append(keys, SigningKey{
+			KeyId:     keyId,
+			Status:    SigningKeyStatus(status),
+			CreatedBy: createdBy.String,
+			Created:   created,
+			Activated: timeOrNil(activated),
+			Retired:   timeOrNil(retired),
+			Algorithm: AlgPGP,
+			PublicKey: public,
+		})
+	}
+	return keys, rows.Err()
+}
+
+// GetSigningKeySet returns the verification keys pilots should trust: the active keys and the pending keys
+// about to be activated
+// if the keyring has no active keys, the keyset contains the key in the signing key file
+// if the private key is held outside pilotctl, the keyset contains the key of the external signer
+func (r *API) GetSigningKeySet() (*SigningKeySet, error) {
+	if signerType := r.conf.SignerType(); signerType == TransitSigner || signerType == SoftTokenSigner {
+		signer, err := r.externalSigner()
+		if err != nil {
+			return nil, err
+		}
+		public, err := signer.PublicKey()
+		if err != nil {
+			return nil, err
+		}
+		return &SigningKeySet{
+			Primary: signer.KeyId(),
+			Keys: []SigningKey{{
+				KeyId:     signer.KeyId(),
+				Status:    SigningKeyActive,
+				Algorithm: signer.Algorithm(),
+				PublicKey: string(public),
+			}},
+		}, nil
+	}
+	keys, err := r.GetSigningKeys()
+	if err != nil {
+		return nil, err
+	}
+	set := &SigningKeySet{Keys: make([]SigningKey, 0)}
+	for _, key := range keys {
+		if key.Status == SigningKeyRetired {
+			continue
+		}
+		set.Keys = append(set.Keys, key)
+	}
+	if primary := primarySigningKey(keys); primary != nil {
+		set.Primary = primary.KeyId
+		return set, nil
+	}
+	// if the keyring has no active keys, ping responses are signed by the key in the signing key file
+	// and verified with the key in the verification key file
+	key, err := SigningKeyFile()
+	if err != nil {
+		return nil, err
+	}
+	path, err := KeyFilePath("verify")
+	if err != nil {
+		return nil, err
+	}
+	public, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read verification key file: %s", err)
+	}
+	set.Primary = key.KeyId()
+	set.Keys = append(set.Keys, SigningKey{
+		KeyId:     key.KeyId(),
+		Status:    SigningKeyActive,
+		Algorithm: key.Algorithm(),
+		PublicKey: string(public),
+	})
+	return set, nil
+}
+
+// SigningKey returns the primary key signing ping responses
+// or nil if the keyring has no active keys, in which case the signing key file is used
+func (r *API) SigningKey() (*PGP, error) {
+	keyring.mu.Lock()
+	defer keyring.mu.Unlock()
+	if time.Since(keyring.checked) < signingKeyRefresh {
+		return keyring.primary, nil
+	}
+	keys, err := r.GetSigningKeys()
+	if err != nil {
+		return nil, err
+	}
+	primary := primarySigningKey(keys)
+	switch {
+	case primary == nil:
+		keyring.primary = nil
+	case keyring.primary == nil || keyring.primary.KeyId() != primary.KeyId:
+		if keyring.primary, err = r.loadSigningKey(primary.KeyId); err != nil {
+			return nil, err
+		}
+	}
+	keyring.checked = time.Now()
+	return keyring.primary, nil
+}
+
+// loadSigningKey retrieves and decrypts the private part of a signing key
+func (r *API) loadSigningKey(keyId string) (*PGP, error) {
+	encKey, err := r.conf.CredentialKey()
+	if err != nil {
+		return nil, fmt.Errorf("cannot load signing key: %s", err)
+	}
+	rows, err := r.db.Query("select * from pilotctl_get_signing_key_secret($1)", keyId)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get signing key: %s\n", err)
+	}
+	defer rows.Close()
+	var encrypted string
+	if !rows.Next() {
+		return nil, fmt.Errorf("signing key '%s' not found", keyId)
+	}
+	if err = rows.Scan(&encrypted); err != nil {
+		return nil, fmt.Errorf("cannot scan signing key: %s\n", err)
+	}
+	private, err := AesCrypto{CipherMode: GCM}.Decrypt(encrypted, encKey)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt signing key '%s': %s", keyId, err)
+	}
+	return LoadPGPBytes([]byte(private))
+}
+
+func (r *API) findSigningKey(keyId string) (*SigningKey, error) {
+	keys, err := r.GetSigningKeys()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if key.KeyId == keyId {
+			return &key, nil
+		}
+	}
+	return nil, fmt.Errorf("signing key '%s' not found", keyId)
+}
+
+// primarySigningKey returns the most recently activated key, if any
+func primarySigningKey(keys []SigningKey) *SigningKey {
+	var primary *SigningKey
+	for i, key := range keys {
+		if key.Status != SigningKeyActive || key.Activated == nil {
+			continue
+		}
+		if primary == nil || key.Activated.After(*primary.Activated) {
+			primary = &keys[i]
+		}
+	}
+	return primary
+}
+
+func (k *signingKeyring) reset() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.checked = time.Time{}
+}
@@ -0,0 +1,281 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"golang.org/x/crypto/scrypt"
+	"os"
+	"path/filepath"
+	. "southwinds.dev/pilotctl/types"
+)
+
+// Token a store of private keys opened with a user PIN, used to sign ping responses
+// SoftToken is the only implementation; it is not a PKCS#11 token, keys held by a hardware security module
+// need a Token on top of the module's PKCS#11 library so that they never leave it
+type Token interface {
+	// Login opens a session on the token with the user PIN
+	Login(pin string) error
+	// FindKey returns the private key with the specified label
+	FindKey(label string) (crypto.Signer, error)
+}
+
+// the value encrypted with the PIN derived key to check the PIN on login
+const softTokenCheck = "pilotctl-soft-token"
+
+// SoftToken a software token keeping its keys in files encrypted with a key derived from the PIN
+// it only protects the keys at rest: they are decrypted in the pilotctl process to sign, so anyone able to read
+// its memory, or the token files and the PIN, can use them; the token directory should be mounted from outside
+// the pilotctl filesystem, e.g. a secrets volume, and is provisioned with "pilotctl provision-token"
+type SoftToken struct {
+	path string
+	key  []byte
+}
+
+// softTokenInfo the token metadata used to derive and check the PIN key
+type softTokenInfo struct {
+	Salt  string `json:"salt"`
+	Check string `json:"check"`
+}
+
+// NewSoftToken returns the software token in the specified directory
+func NewSoftToken(path string) *SoftToken {
+	return &SoftToken{path: path}
+}
+
+// InitSoftToken creates an empty software token protected by the PIN
+func InitSoftToken(path, pin string) (*SoftToken, error) {
+	if _, err := os.Stat(filepath.Join(path, "token.json")); err == nil {
+		return nil, fmt.Errorf("a token already exists in '%s'", path)
+	}
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, fmt.Errorf("cannot create token directory: %s", err)
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key, err := pinKey(pin, salt)
+	if err != nil {
+		return nil, err
+	}
+	check, err := AesCrypto{CipherMode: GCM}.Encrypt(softTokenCheck, key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := json.Marshal(softTokenInfo{Salt: base64.StdEncoding.EncodeToString(salt), Check: check})
+	if err != nil {
+		return nil, err
+	}
+	if err = os.WriteFile(filepath.Join(path, "token.json"), info, 0600); err != nil {
+		return nil, fmt.Errorf("cannot write token: %s", err)
+	}
+	return &SoftToken{path: path, key: key}, nil
+}
+
+func (t *SoftToken) Login(pin string) error {
+	content, err := os.ReadFile(filepath.Join(t.path, "token.json"))
+	if err != nil {
+		return fmt.Errorf("cannot read token: %s", err)
+	}
+	var info softTokenInfo
+	if err = json.Unmarshal(content, &info); err != nil {
+		return fmt.Errorf("cannot parse token: %s", err)
+	}
+	salt, err := base64.StdEncoding.DecodeString(info.Salt)
+	if err != nil {
+		return fmt.Errorf("cannot parse token: %s", err)
+	}
+	key, err := pinKey(pin, salt)
+	if err != nil {
+		return err
+	}
+	if check, decErr := (AesCrypto{CipherMode: GCM}).Decrypt(info.Check, key); decErr != nil || check != softTokenCheck {
+		return fmt.Errorf("incorrect token PIN")
+	}
+	t.key = key
+	return nil
+}
+
+// GenerateKey creates a private key on the token, either ecdsa-p256 or rsa-2048
+func (t *SoftToken) GenerateKey(label, keyType string) (crypto.PublicKey, error) {
+	if t.key == nil {
+		return nil, fmt.Errorf("token session is not logged in")
+	}
+	if _, err := os.Stat(t.keyFile(label)); err == nil {
+		return nil, fmt.Errorf("key '%s' already exists", label)
+	}
+	var (
+		key crypto.Signer
+		err error
+	)
+	switch keyType {
+	case "ecdsa-p256":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "rsa-2048":
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		return nil, fmt.Errorf("key type '%s' is not supported", keyType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := AesCrypto{CipherMode: GCM}.Encrypt(base64.StdEncoding.EncodeToString(der), t.key)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.WriteFile(t.keyFile(label), []byte(encrypted), 0600); err != nil {
+		return nil, fmt.Errorf("cannot write key: %s", err)
+	}
+	return key.Public(), nil
+}
+
+// FindKey decrypts the private key with the specified label, which is held in memory from then on
+func (t *SoftToken) FindKey(label string) (crypto.Signer, error) {
+	if t.key == nil {
+		return nil, fmt.Errorf("token session is not logged in")
+	}
+	encrypted, err := os.ReadFile(t.keyFile(label))
+	if err != nil {
+		return nil, fmt.Errorf("key '%s' not found in token", label)
+	}
+	encoded, err := AesCrypto{CipherMode: GCM}.Decrypt(string(encrypted), t.key)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt key '%s': %s", label, err)
+	}
+	der, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse key '%s': %s", label, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("key '%s' cannot sign", label)
+	}
+	return signer, nil
+}
+
+// ProvisionSoftToken creates the software token of the configuration, if it does not exist, and generates its
+// signing key, either ecdsa-p256 or rsa-2048, returning the public key in PEM format
+func ProvisionSoftToken(conf *Conf, keyType string) ([]byte, error) {
+	path, pin := conf.TokenPath(), conf.TokenPin()
+	if len(path) == 0 {
+		return nil, fmt.Errorf("%s is not set", ConfTokenPath)
+	}
+	var (
+		token *SoftToken
+		err   error
+	)
+	if _, statErr := os.Stat(filepath.Join(path, "token.json")); statErr == nil {
+		token = NewSoftToken(path)
+		err = token.Login(pin)
+	} else {
+		token, err = InitSoftToken(path, pin)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err = token.GenerateKey(conf.TokenKeyLabel(), keyType); err != nil {
+		return nil, err
+	}
+	signer, err := newTokenSigner(token, pin, conf.TokenKeyLabel())
+	if err != nil {
+		return nil, err
+	}
+	return signer.PublicKey()
+}
+
+func (t *SoftToken) keyFile(label string) string {
+	return filepath.Join(t.path, fmt.Sprintf("%s.key", filepath.Base(label)))
+}
+
+func pinKey(pin string, salt []byte) ([]byte, error) {
+	if len(pin) == 0 {
+		return nil, fmt.Errorf("token PIN is missing")
+	}
+	return scrypt.Key([]byte(pin), salt, 32768, 8, 1, 32)
+}
+
+// tokenSigner signs messages with a private key held by a token
+type tokenSigner struct {
+	label string
+	key   crypto.Signer
+}
+
+// newTokenSigner logs into the token and finds the signing key
+func newTokenSigner(token Token, pin, label string) (*tokenSigner, error) {
+	if err := token.Login(pin); err != nil {
+		return nil, err
+	}
+	key, err := token.FindKey(label)
+	if err != nil {
+		return nil, err
+	}
+	switch key.Public().(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+	default:
+		return nil, fmt.Errorf("key '%s' is neither an RSA nor an ECDSA key", label)
+	}
+	return &tokenSigner{label: label, key: key}, nil
+}
+
+// KeyId the key label followed by a fingerprint of the public key
+func (s *tokenSigner) KeyId() string {
+	der, _ := x509.MarshalPKIXPublicKey(s.key.Public())
+	sum := sha256.Sum256(der)
+	return fmt.Sprintf("%s-%s", s.label, hex.EncodeToString(sum[:8]))
+}
+
+func (s *tokenSigner) Algorithm() string {
+	if _, ok := s.key.Public().(*ecdsa.PublicKey); ok {
+		return AlgEcdsaSha256
+	}
+	return AlgRsaSha256
+}
+
+func (s *tokenSigner) PublicKey() ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(s.key.Public())
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+func (s *tokenSigner) Sign(message []byte) ([]byte, error) {
+	digest := sha256.Sum256(message)
+	return s.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
@@ -36,8 +36,13 @@ import (
 )
 
 func SaveInfo(f multipart.File) (string, error) {
+	return SaveUpload(f, "sync.xlsx")
+}
+
+// SaveUpload saves an uploaded file with the specified name in a new temporary sync folder
+func SaveUpload(f multipart.File, filename string) (string, error) {
 	tmp := SyncTemp()
-	filePath := path.Join(tmp, "sync.xlsx")
+	filePath := path.Join(tmp, filepath.Base(filename))
 	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE, os.ModePerm)
 	if err != nil {
 		_ = os.RemoveAll(tmp)
@@ -56,6 +61,23 @@ func SaveInfo(f multipart.File) (string, error) {
 	return filePath, nil
 }
 
+// RemoveUpload removes the temporary sync folder holding a file saved by SaveUpload
+// folders that are not directly within the sync path were not created by SaveUpload and are left untouched
+func RemoveUpload(file string) error {
+	dir := filepath.Dir(file)
+	syncPath, err := filepath.Abs(SyncPath())
+	if err != nil {
+		return fmt.Errorf("cannot resolve sync path: %s", err)
+	}
+	if filepath.Dir(dir) != syncPath {
+		return fmt.Errorf("'%s' is not an upload folder", dir)
+	}
+	if err = os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("cannot remove upload folder '%s': %s", dir, err)
+	}
+	return nil
+}
+
 // SyncInfo syncs the content of the input spreadsheet file
 // compares the logistics information in the spreadsheet and commits any differences to Onix CMDB
 func SyncInfo(file string, api *API, dryRun bool) (diff *Diff, err error) {
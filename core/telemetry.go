@@ -0,0 +1,456 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/plog"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the built-in telemetry sinks
+const (
+	// JsonlSink appends metric data points and logs as json lines to a file per channel in the telemetry buffer path
+	JsonlSink = "jsonl"
+	// PromSink sends metrics to a Prometheus remote-write endpoint, logs go to the connector of the channel or to jsonl
+	PromSink = "prometheus"
+	// InfluxSink writes metrics and logs to an InfluxDB write endpoint using the line protocol
+	InfluxSink = "influx"
+	// OtlpSink forwards metrics and logs to an OpenTelemetry collector using OTLP/HTTP
+	OtlpSink = "otlp"
+	// ExecSink executes a connector binary for each telemetry file, see PILOT_CTL_TELEM_CONN
+	ExecSink = "exec"
+)
+
+// TelemetrySink records the telemetry submitted by host pilots on a channel
+type TelemetrySink interface {
+	// Metrics records a batch of metrics
+	Metrics(channel string, metrics pmetric.Metrics) error
+	// Logs records a batch of logs
+	Logs(channel string, logs plog.Logs) error
+}
+
+var (
+	telemetrySinks   = make(map[string]cachedSink)
+	telemetrySinksMu sync.Mutex
+)
+
+// cachedSink a telemetry sink and the settings it was created with
+type cachedSink struct {
+	settings string
+	sink     TelemetrySink
+}
+
+// telemetrySink returns the sink of a channel, creating it on first use or when its settings change
+// channels without a built-in sink use the legacy connector set for the channel, if any
+func (r *API) telemetrySink(channel string) (TelemetrySink, error) {
+	kind, ok := r.conf.TelemetrySinkType(channel)
+	conn, hasConn := connectorName(channel)
+	if !ok {
+		if !hasConn {
+			return nil, fmt.Errorf("telemetry sink not defined for channel '%s', skipping telemetry recording", channel)
+		}
+		kind = ExecSink
+	}
+	path, _ := filepath.Abs(r.conf.getTelemBufferPath())
+	settings := strings.Join([]string{kind, conn, path, r.conf.TelemetryPromURL(), r.conf.TelemetryInfluxURL(),
+		r.conf.TelemetryInfluxToken(), r.conf.TelemetryOtlpURL()}, "\n")
+	telemetrySinksMu.Lock()
+	defer telemetrySinksMu.Unlock()
+	key := strings.ToLower(channel)
+	if cached, ok := telemetrySinks[key]; ok && cached.settings == settings {
+		return cached.sink, nil
+	}
+	var sink TelemetrySink
+	client := &http.Client{Timeout: 30 * time.Second}
+	switch kind {
+	case JsonlSink:
+		sink = &jsonlSink{path: path}
+	case PromSink:
+		// prometheus does not accept logs, they are passed to the connector of the channel or buffered as json lines
+		var logs TelemetrySink = &jsonlSink{path: path}
+		if hasConn {
+			logs = &execSink{}
+		}
+		sink = &promSink{url: r.conf.TelemetryPromURL(), client: client, logs: logs}
+	case InfluxSink:
+		sink = &influxSink{url: r.conf.TelemetryInfluxURL(), token: r.conf.TelemetryInfluxToken(), client: client}
+	case OtlpSink:
+		sink = &otlpSink{url: strings.TrimSuffix(r.conf.TelemetryOtlpURL(), "/"), client: client}
+	case ExecSink:
+		sink = &execSink{}
+	default:
+		return nil, fmt.Errorf("invalid telemetry sink '%s' for channel '%s'", kind, channel)
+	}
+	if remote, ok := sink.(interface{ endpoint() string }); ok && len(remote.endpoint()) == 0 {
+		return nil, fmt.Errorf("the url of the %s telemetry sink of channel '%s' is not set", kind, channel)
+	}
+	telemetrySinks[key] = cachedSink{settings: settings, sink: sink}
+	return sink, nil
+}
+
+// jsonlSink appends metric data points and logs as json lines to {path}/{channel}-metrics.jsonl and {channel}-logs.jsonl
+type jsonlSink struct {
+	path string
+	mu   sync.Mutex
+}
+
+func (s *jsonlSink) Metrics(channel string, metrics pmetric.Metrics) error {
+	dpConv := NewOtelDataPointConverter()
+	points, err := dpConv.Convert(metrics)
+	if err != nil {
+		return fmt.Errorf("cannot convert open telemetry metrics to data points: %s", err)
+	}
+	var lines bytes.Buffer
+	for _, point := range points {
+		line, err := json.Marshal(point)
+		if err != nil {
+			return fmt.Errorf("cannot marshal data point to json: %s", err)
+		}
+		lines.Write(line)
+		lines.WriteByte('\n')
+	}
+	return s.append(fmt.Sprintf("%s-metrics.jsonl", channel), lines.Bytes())
+}
+
+func (s *jsonlSink) Logs(channel string, logs plog.Logs) error {
+	jsonMarshal := plog.JSONMarshaler{}
+	line, err := jsonMarshal.MarshalLogs(logs)
+	if err != nil {
+		return fmt.Errorf("cannot marshal logs to json: %s", err)
+	}
+	return s.append(fmt.Sprintf("%s-logs.jsonl", channel), append(line, '\n'))
+}
+
+func (s *jsonlSink) append(name string, content []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	file, err := os.OpenFile(filepath.Join(s.path, filepath.Base(name)), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// promSink sends metrics to a Prometheus remote-write endpoint, each numeric field of a data point is a time series
+// logs are recorded by the fallback sink as remote-write does not accept them
+type promSink struct {
+	url    string
+	client *http.Client
+	logs   TelemetrySink
+}
+
+func (s *promSink) Metrics(_ string, metrics pmetric.Metrics) error {
+	dpConv := NewOtelDataPointConverter()
+	points, err := dpConv.Convert(metrics)
+	if err != nil {
+		return fmt.Errorf("cannot convert open telemetry metrics to data points: %s", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(snappyEncode(promWriteRequest(points))))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	return send(s.client, req)
+}
+
+func (s *promSink) endpoint() string {
+	return s.url
+}
+
+func (s *promSink) Logs(channel string, logs plog.Logs) error {
+	if s.logs == nil {
+		return fmt.Errorf("prometheus remote-write does not accept logs")
+	}
+	return s.logs.Logs(channel, logs)
+}
+
+// influxSink writes metrics and logs to an InfluxDB write endpoint using the line protocol
+// the url is the full write url including the database or bucket, e.g. http://influx:8086/api/v2/write?org=o&bucket=b
+type influxSink struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (s *influxSink) Metrics(_ string, metrics pmetric.Metrics) error {
+	dpConv := NewOtelDataPointConverter()
+	points, err := dpConv.Convert(metrics)
+	if err != nil {
+		return fmt.Errorf("cannot convert open telemetry metrics to data points: %s", err)
+	}
+	var lines bytes.Buffer
+	for _, point := range points {
+		writeLine(&lines, point.Measure, point.Tags, point.Fields, point.Time)
+	}
+	return s.write(lines.Bytes())
+}
+
+func (s *influxSink) Logs(_ string, logs plog.Logs) error {
+	var lines bytes.Buffer
+	for i := 0; i < logs.ResourceLogs().Len(); i++ {
+		resourceLogs := logs.ResourceLogs().At(i)
+		resource := stringMap(resourceLogs.Resource().Attributes())
+		for j := 0; j < resourceLogs.ScopeLogs().Len(); j++ {
+			records := resourceLogs.ScopeLogs().At(j).LogRecords()
+			for k := 0; k < records.Len(); k++ {
+				record := records.At(k)
+				tags := make(map[string]string, len(resource)+1)
+				for key, value := range resource {
+					tags[key] = value
+				}
+				if len(record.SeverityText()) > 0 {
+					tags["severity"] = record.SeverityText()
+				}
+				ts := record.Timestamp().AsTime()
+				if record.Timestamp() == 0 {
+					ts = record.ObservedTimestamp().AsTime()
+				}
+				writeLine(&lines, "logs", tags, map[string]interface{}{"body": record.Body().AsString()}, ts)
+			}
+		}
+	}
+	return s.write(lines.Bytes())
+}
+
+func (s *influxSink) endpoint() string {
+	return s.url
+}
+
+func (s *influxSink) write(lines []byte) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(lines))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if len(s.token) > 0 {
+		req.Header.Set("Authorization", fmt.Sprintf("Token %s", s.token))
+	}
+	return send(s.client, req)
+}
+
+// otlpSink forwards metrics and logs to an OpenTelemetry collector using OTLP/HTTP with protobuf encoding
+type otlpSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *otlpSink) Metrics(_ string, metrics pmetric.Metrics) error {
+	pbMarshal := pmetric.ProtoMarshaler{}
+	content, err := pbMarshal.MarshalMetrics(metrics)
+	if err != nil {
+		return fmt.Errorf("cannot marshal metrics: %s", err)
+	}
+	return s.forward("/v1/metrics", content)
+}
+
+func (s *otlpSink) Logs(_ string, logs plog.Logs) error {
+	pbMarshal := plog.ProtoMarshaler{}
+	content, err := pbMarshal.MarshalLogs(logs)
+	if err != nil {
+		return fmt.Errorf("cannot marshal logs: %s", err)
+	}
+	return s.forward("/v1/logs", content)
+}
+
+func (s *otlpSink) endpoint() string {
+	return s.url
+}
+
+func (s *otlpSink) forward(path string, content []byte) error {
+	req, err := http.NewRequest(http.MethodPost, s.url+path, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	return send(s.client, req)
+}
+
+// execSink the legacy sink executing the connector binary set for the channel in PILOT_CTL_TELEM_CONN
+// the connector is in the working directory and writes its result as {"e":...} to stdout
+type execSink struct{}
+
+func (s *execSink) Metrics(channel string, metrics pmetric.Metrics) error {
+	_, err := s.metrics(channel, metrics)
+	return err
+}
+
+func (s *execSink) Logs(channel string, logs plog.Logs) error {
+	_, err := s.logs(channel, logs)
+	return err
+}
+
+// metrics passes the metrics to the connector and returns the result of the connector
+func (s *execSink) metrics(channel string, metrics pmetric.Metrics) (*ConnResult, error) {
+	dpConv := NewOtelDataPointConverter()
+	dataPoints, err := dpConv.Convert(metrics)
+	if err != nil {
+		return nil, fmt.Errorf("cannot convert open telemetry metrics to data points: %s", err)
+	}
+	data, err := json.Marshal(dataPoints)
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal data points to json: %s", err)
+	}
+	pointsFile := dataPointsFilename()
+	if err = os.WriteFile(pointsFile, data, 0755); err != nil {
+		return nil, fmt.Errorf("cannot write data points to json file: %s", err)
+	}
+	defer os.Remove(pointsFile)
+	// execute the connector passing in the json file
+	return s.run(channel, pointsFile)
+}
+
+// logs passes the logs to the connector and returns the result of the connector
+func (s *execSink) logs(channel string, logs plog.Logs) (*ConnResult, error) {
+	jsonMarshal := plog.JSONMarshaler{}
+	data, err := jsonMarshal.MarshalLogs(logs)
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal request to json: %s", err)
+	}
+	// execute the connector passing in the base 64 encoded json content
+	return s.run(channel, base64.StdEncoding.EncodeToString(data))
+}
+
+func (s *execSink) run(channel, arg string) (*ConnResult, error) {
+	conn, ok := connectorName(channel)
+	if !ok {
+		return nil, fmt.Errorf("telemetry connector not defined, skipping telemetry recording")
+	}
+	dir, _ := os.Getwd()
+	c := exec.Command(fmt.Sprintf("%s/%s", dir, conn), arg)
+	c.Env = os.Environ()
+	outBytes, err := c.Output()
+	// extracts the response for the stdout
+	out := regexp.MustCompile("{\"e\":.*}").FindString(string(outBytes[:]))
+	if len(out) == 0 {
+		return nil, fmt.Errorf("connector %s gave an empty response, execution failed: %v", conn, err)
+	}
+	result := new(ConnResult)
+	if err = json.Unmarshal([]byte(out), result); err != nil {
+		return nil, fmt.Errorf("connector %s gave an invalid result format, unmarshalling failed: %s", conn, err)
+	}
+	if len(result.Error) > 0 {
+		return nil, fmt.Errorf("connector %s returned error: %s", conn, result.Error)
+	}
+	return result, nil
+}
+
+// send sends a request to a telemetry backend, any 2xx status is a success
+func send(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s returned %s: %s", req.Method, req.URL.Redacted(), resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// stringMap returns the attributes as strings
+func stringMap(attributes pcommon.Map) map[string]string {
+	result := make(map[string]string, attributes.Len())
+	attributes.Range(func(k string, v pcommon.Value) bool {
+		result[k] = v.AsString()
+		return true
+	})
+	return result
+}
+
+// writeLine writes a point in InfluxDB line protocol, tags are sorted and fields without a supported type are skipped
+func writeLine(buf *bytes.Buffer, measurement string, tags map[string]string, fields map[string]interface{}, ts time.Time) {
+	var fieldSet []string
+	for _, key := range sortedKeys(fields) {
+		var value string
+		switch v := fields[key].(type) {
+		case float64:
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				continue
+			}
+			value = strconv.FormatFloat(v, 'g', -1, 64)
+		case int64:
+			value = fmt.Sprintf("%di", v)
+		case uint64:
+			value = fmt.Sprintf("%du", v)
+		case bool:
+			value = strconv.FormatBool(v)
+		case string:
+			value = fmt.Sprintf("\"%s\"", strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v))
+		default:
+			continue
+		}
+		fieldSet = append(fieldSet, fmt.Sprintf("%s=%s", lineEscape(key), value))
+	}
+	if len(fieldSet) == 0 {
+		return
+	}
+	buf.WriteString(strings.NewReplacer(",", `\,`, " ", `\ `).Replace(measurement))
+	tagKeys := make([]string, 0, len(tags))
+	for key := range tags {
+		if len(tags[key]) > 0 {
+			tagKeys = append(tagKeys, key)
+		}
+	}
+	sort.Strings(tagKeys)
+	for _, key := range tagKeys {
+		buf.WriteString(fmt.Sprintf(",%s=%s", lineEscape(key), lineEscape(tags[key])))
+	}
+	buf.WriteString(fmt.Sprintf(" %s %d\n", strings.Join(fieldSet, ","), ts.UnixNano()))
+}
+
+// lineEscape escapes tag keys, tag values and field keys in line protocol
+func lineEscape(value string) string {
+	return strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`).Replace(value)
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,201 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/plog"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// received a request received by a telemetry backend stand-in
+type received struct {
+	path    string
+	headers http.Header
+	body    []byte
+}
+
+func telemetryBackend(t *testing.T) (*httptest.Server, chan received) {
+	requests := make(chan received, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- received{path: r.URL.Path, headers: r.Header, body: body}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+func testMetrics(ts time.Time) pmetric.Metrics {
+	metrics := pmetric.NewMetrics()
+	rm := metrics.ResourceMetrics().AppendEmpty()
+	rm.Resource().Attributes().PutStr("host.name", "host 1")
+	metric := rm.ScopeMetrics().AppendEmpty().Metrics().AppendEmpty()
+	metric.SetName("cpu.load")
+	dp := metric.SetEmptyGauge().DataPoints().AppendEmpty()
+	dp.SetTimestamp(pcommon.NewTimestampFromTime(ts))
+	dp.SetDoubleValue(0.5)
+	return metrics
+}
+
+func testLogs(ts time.Time) plog.Logs {
+	logs := plog.NewLogs()
+	rl := logs.ResourceLogs().AppendEmpty()
+	rl.Resource().Attributes().PutStr("host.name", "host-1")
+	record := rl.ScopeLogs().AppendEmpty().LogRecords().AppendEmpty()
+	record.SetTimestamp(pcommon.NewTimestampFromTime(ts))
+	record.SetSeverityText("ERROR")
+	record.Body().SetStr(`disk "sda" full`)
+	return logs
+}
+
+func TestInfluxSink(t *testing.T) {
+	server, requests := telemetryBackend(t)
+	ts := time.Unix(1700000000, 0)
+	sink := &influxSink{url: server.URL + "/api/v2/write?bucket=pilot", token: "tkn", client: server.Client()}
+	if err := sink.Metrics("test", testMetrics(ts)); err != nil {
+		t.Fatal(err)
+	}
+	req := <-requests
+	if req.headers.Get("Authorization") != "Token tkn" {
+		t.Fatalf("unexpected authorization '%s'", req.headers.Get("Authorization"))
+	}
+	if line := string(req.body); !strings.HasPrefix(line, `cpu.load,host.name=host\ 1`) || !strings.HasSuffix(line, " cpu.load=0.5 1700000000000000000\n") {
+		t.Fatalf("unexpected line '%s'", line)
+	}
+	if err := sink.Logs("test", testLogs(ts)); err != nil {
+		t.Fatal(err)
+	}
+	if line := string((<-requests).body); line != `logs,host.name=host-1,severity=ERROR body="disk \"sda\" full" 1700000000000000000`+"\n" {
+		t.Fatalf("unexpected line '%s'", line)
+	}
+}
+
+func TestPromSink(t *testing.T) {
+	server, requests := telemetryBackend(t)
+	dir := t.TempDir()
+	sink := &promSink{url: server.URL + "/api/v1/write", client: server.Client(), logs: &jsonlSink{path: dir}}
+	if err := sink.Metrics("test", testMetrics(time.Now())); err != nil {
+		t.Fatal(err)
+	}
+	req := <-requests
+	if req.headers.Get("Content-Encoding") != "snappy" || req.headers.Get("X-Prometheus-Remote-Write-Version") != "0.1.0" {
+		t.Fatalf("unexpected headers %v", req.headers)
+	}
+	// decodes the snappy literals
+	size, n := binary.Uvarint(req.body)
+	content := snappyDecodeLiterals(t, req.body[n:])
+	if uint64(len(content)) != size {
+		t.Fatalf("snappy length %d does not match content length %d", size, len(content))
+	}
+	for _, expected := range []string{"__name__", "cpu_load", "host_name", "host 1"} {
+		if !bytes.Contains(content, []byte(expected)) {
+			t.Fatalf("write request does not contain '%s'", expected)
+		}
+	}
+	// logs are recorded by the fallback sink
+	if err := sink.Logs("test", testLogs(time.Now())); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "test-logs.jsonl")); err != nil {
+		t.Fatalf("logs not recorded by the fallback sink: %s", err)
+	}
+}
+
+func snappyDecodeLiterals(t *testing.T, encoded []byte) []byte {
+	var content []byte
+	for len(encoded) > 0 {
+		tag := encoded[0]
+		if tag&3 != 0 {
+			t.Fatalf("unexpected snappy element %x", tag)
+		}
+		n, skip := int(tag>>2)+1, 1
+		if tag>>2 == 61 {
+			n, skip = int(encoded[1])|int(encoded[2])<<8+1, 3
+		}
+		content = append(content, encoded[skip:skip+n]...)
+		encoded = encoded[skip+n:]
+	}
+	return content
+}
+
+func TestOtlpSink(t *testing.T) {
+	server, requests := telemetryBackend(t)
+	sink := &otlpSink{url: server.URL, client: server.Client()}
+	metrics := testMetrics(time.Now())
+	if err := sink.Metrics("test", metrics); err != nil {
+		t.Fatal(err)
+	}
+	req := <-requests
+	if req.path != "/v1/metrics" || req.headers.Get("Content-Type") != "application/x-protobuf" {
+		t.Fatalf("unexpected request to %s", req.path)
+	}
+	pbUnmarshall := pmetric.ProtoUnmarshaler{}
+	forwarded, err := pbUnmarshall.UnmarshalMetrics(req.body)
+	if err != nil || forwarded.DataPointCount() != metrics.DataPointCount() {
+		t.Fatalf("forwarded metrics are not valid: %v", err)
+	}
+	if err = sink.Logs("test", testLogs(time.Now())); err != nil || (<-requests).path != "/v1/logs" {
+		t.Fatalf("logs not forwarded: %v", err)
+	}
+}
+
+func TestJsonlSink(t *testing.T) {
+	dir := t.TempDir()
+	sink := &jsonlSink{path: dir}
+	for i := 0; i < 2; i++ {
+		if err := sink.Metrics("test", testMetrics(time.Now())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	content, err := os.ReadFile(filepath.Join(dir, "test-metrics.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(content)), "\n"); len(lines) != 2 || !strings.Contains(lines[0], `"Measure":"cpu.load"`) {
+		t.Fatalf("unexpected json lines: %s", content)
+	}
+}
+
+// creates the sink of a channel again when its settings change
+func TestTelemetrySinkReload(t *testing.T) {
+	t.Setenv(string(ConfTelemBufferPath), t.TempDir())
+	t.Setenv(string(ConfTelemSinks), "reload:jsonl")
+	api := &API{conf: NewConf()}
+	sink, err := api.telemetrySink("reload")
+	if _, ok := sink.(*jsonlSink); err != nil || !ok {
+		t.Fatalf("expected jsonl sink, got %T: %v", sink, err)
+	}
+	t.Setenv(string(ConfTelemSinks), "reload:prometheus")
+	t.Setenv(string(ConfTelemPromURL), "http://prometheus:9090/api/v1/write")
+	sink, err = api.telemetrySink("reload")
+	if _, ok := sink.(*promSink); err != nil || !ok {
+		t.Fatalf("expected prometheus sink after the settings changed, got %T: %v", sink, err)
+	}
+}
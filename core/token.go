@@ -0,0 +1,234 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/google/uuid"
+	"log"
+	"net/http"
+	h "southwinds.dev/http"
+	. "southwinds.dev/pilotctl/types"
+	"strings"
+	"time"
+)
+
+// the minimum period between updates of the last time a token was used
+const tokenUsageInterval = time.Minute
+
+// CreateApiToken creates an API token for an automation client on behalf of the user creating it, its owner
+// the token cannot grant more than the role of its owner, only administrators can create tokens authenticating as
+// a service account other than themselves and the token value is only returned once
+func (r *API) CreateApiToken(principal *h.UserPrincipal, access *Access, req ApiTokenRequest) (*ApiTokenResponse, error) {
+	owner := PrincipalOwner(principal)
+	if len(req.Name) == 0 {
+		return nil, fmt.Errorf("token name is missing")
+	}
+	role, err := ParseRole(string(req.Role))
+	if err != nil {
+		return nil, err
+	}
+	access = r.tokenOwnerAccess(owner, access)
+	if !access.CanAt(role.Permission(), req.OrgGroup, req.Org, req.Area) {
+		return nil, fmt.Errorf("%w: cannot create a token with role '%s' in the requested scope", ErrForbidden, role)
+	}
+	username := req.ServiceAccount
+	if len(username) == 0 {
+		username = owner
+	}
+	if !strings.EqualFold(username, owner) && !access.Can(PermAdmin) {
+		return nil, fmt.Errorf("%w: only administrators can create tokens for service account '%s'", ErrForbidden, username)
+	}
+	expires, err := r.apiTokenExpiry(principal, req.ExpiryDays)
+	if err != nil {
+		return nil, err
+	}
+	token, err := NewApiToken()
+	if err != nil {
+		return nil, err
+	}
+	id := uuid.NewString()
+	err = r.db.RunCommand("select pilotctl_set_api_token($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)",
+		id, req.Name, username, owner, role, req.OrgGroup, req.Org, req.Area, HashApiToken(token), expires, OwnerIdentity(principal))
+	if err != nil {
+		return nil, fmt.Errorf("cannot create api token: %s\n", err)
+	}
+	return &ApiTokenResponse{Id: id, Token: token, Expires: expires}, nil
+}
+
+// apiTokenExpiry returns when a new token expires, rejecting expiries beyond the configured maximum
+// a token created with another token cannot outlive it, so that a leaked token cannot renew itself indefinitely
+func (r *API) apiTokenExpiry(principal *h.UserPrincipal, expiryDays int) (time.Time, error) {
+	expiry := r.conf.ApiTokenExpiry()
+	if expiryDays > 0 {
+		expiry = time.Duration(expiryDays) * 24 * time.Hour
+	}
+	if maxExpiry := r.conf.ApiTokenMaxExpiry(); expiry > maxExpiry {
+		return time.Time{}, fmt.Errorf("token expiry cannot exceed %d days", int(maxExpiry.Hours()/24))
+	}
+	expires := time.Now().Add(expiry).UTC()
+	if parent, ok := principalToken(principal); ok && expires.After(parent.Expires) {
+		expires = parent.Expires.UTC()
+	}
+	return expires, nil
+}
+
+// tokenOwnerAccess returns the access capping the tokens a user can create
+// without role based access control, only the configured administrators can create admin tokens while other users
+// are limited to the operator role
+func (r *API) tokenOwnerAccess(owner string, access *Access) *Access {
+	if access != nil {
+		return access
+	}
+	role := RoleOperator
+	if containsKey(r.conf.RBACAdmins(), owner) {
+		role = RoleAdmin
+	}
+	return &Access{Username: owner, Bindings: []RoleBinding{{Username: owner, Role: role}}}
+}
+
+// PrincipalOwner returns the user accountable for the requests made with the principal
+// that is the user who created the api token for automation clients, or otherwise the authenticated user
+func PrincipalOwner(principal *h.UserPrincipal) string {
+	if principal == nil {
+		return ""
+	}
+	if token, ok := principalToken(principal); ok {
+		return token.Owner
+	}
+	return principal.Username
+}
+
+// principalToken returns the api token the principal authenticated with, if any
+func principalToken(principal *h.UserPrincipal) (ApiToken, bool) {
+	if principal == nil {
+		return ApiToken{}, false
+	}
+	token, ok := principal.Context.(ApiToken)
+	return token, ok
+}
+
+// GetApiTokens returns the tokens created by a user or all tokens if no owner is specified
+func (r *API) GetApiTokens(owner string) ([]ApiToken, error) {
+	rows, err := r.db.Query("select * from pilotctl_get_api_tokens($1)", owner)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get api tokens: %s\n", err)
+	}
+	tokens := make([]ApiToken, 0)
+	for rows.Next() {
+		token, scanErr := scanApiToken(rows)
+		if scanErr != nil {
+			return nil, scanErr
+		}
+		tokens = append(tokens, *token)
+	}
+	return tokens, rows.Err()
+}
+
+// RevokeApiToken revokes a token, only the owner of the token or an administrator can revoke it
+func (r *API) RevokeApiToken(id, user string, access *Access) error {
+	tokens, err := r.GetApiTokens("")
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		if token.Id == id {
+			if token.Owner != user && !access.CanAt(PermAdmin, token.OrgGroup, token.Org, token.Area) {
+				return fmt.Errorf("%w: cannot revoke token '%s' owned by '%s'", ErrForbidden, id, token.Owner)
+			}
+			return r.db.RunCommand("select pilotctl_revoke_api_token($1)", id)
+		}
+	}
+	return fmt.Errorf("api token '%s' not found", id)
+}
+
+// authenticateApiToken authenticates an automation client presenting a bearer token
+// the rights of the token are those of its owner while its role binding scopes what it can see and do
+func (r *API) authenticateApiToken(value string) (*h.UserPrincipal, error) {
+	rows, err := r.db.Query("select * from pilotctl_get_api_token($1)", HashApiToken(value))
+	if err != nil {
+		return nil, fmt.Errorf("cannot get api token: %s\n", err)
+	}
+	defer rows.Close()
+	var token *ApiToken
+	if rows.Next() {
+		if token, err = scanApiToken(rows); err != nil {
+			return nil, err
+		}
+	}
+	if token == nil {
+		return nil, fmt.Errorf("invalid api token")
+	}
+	if token.Expired() {
+		return nil, fmt.Errorf("api token '%s' expired on %s", token.Id, token.Expires.Format(time.RFC3339))
+	}
+	rights, err := r.Login(token.Owner)
+	if err != nil {
+		return nil, err
+	}
+	if token.LastUsed == nil || time.Since(*token.LastUsed) > tokenUsageInterval {
+		if err = r.db.RunCommand("select pilotctl_touch_api_token($1)", token.Id); err != nil {
+			log.Printf("WARNING: cannot record usage of api token '%s': %s\n", token.Id, err)
+		}
+	}
+	return &h.UserPrincipal{
+		Username: token.Username,
+		Rights:   rights,
+		Created:  time.Now(),
+		Context:  *token,
+	}, nil
+}
+
+// bearerToken returns the bearer token in the authorization header of the request, if any
+func bearerToken(request http.Request) (string, bool) {
+	value := request.Header.Get("Authorization")
+	if !strings.HasPrefix(value, "Bearer ") {
+		return "", false
+	}
+	token := strings.TrimSpace(value[len("Bearer "):])
+	return token, len(token) > 0
+}
+
+func scanApiToken(rows interface{ Scan(...interface{}) error }) (*ApiToken, error) {
+	var (
+		id, name, username, owner, role string
+		orgGroup, org, area             sql.NullString
+		created, expires                time.Time
+		lastUsed                        sql.NullTime
+		ownerId                         sql.NullString
+	)
+	if err := rows.Scan(&id, &name, &username, &owner, &role, &orgGroup, &org, &area, &created, &expires, &lastUsed, &ownerId); err != nil {
+		return nil, fmt.Errorf("cannot scan api token row: %s\n", err)
+	}
+	return &ApiToken{
+		Id:       id,
+		Name:     name,
+		Username: username,
+		Owner:    owner,
+		OwnerId:  ownerId.String,
+		Role:     Role(role),
+		OrgGroup: orgGroup.String,
+		Org:      org.String,
+		Area:     area.String,
+		Created:  created,
+		Expires:  expires,
+		LastUsed: timeOrNil(lastUsed),
+	}, nil
+}
@@ -0,0 +1,52 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"os"
+	h "southwinds.dev/http"
+	. "southwinds.dev/pilotctl/types"
+	"testing"
+	"time"
+)
+
+func TestApiTokenExpiry(t *testing.T) {
+	os.Setenv("PILOT_CTL_API_TOKEN_MAX_EXPIRY_DAYS", "30")
+	defer os.Unsetenv("PILOT_CTL_API_TOKEN_MAX_EXPIRY_DAYS")
+	api := &API{conf: NewConf()}
+	if _, err := api.apiTokenExpiry(&h.UserPrincipal{Username: "jdoe"}, 31); err == nil {
+		t.Fatal("expected an expiry beyond the maximum to be rejected")
+	}
+	expires, err := api.apiTokenExpiry(&h.UserPrincipal{Username: "jdoe"}, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expires.Before(time.Now().Add(29 * 24 * time.Hour)) {
+		t.Fatalf("unexpected expiry %s", expires)
+	}
+	// a token created with another token expires no later than it
+	parent := ApiToken{Id: "parent", Owner: "jdoe", Expires: time.Now().Add(48 * time.Hour)}
+	expires, err = api.apiTokenExpiry(&h.UserPrincipal{Username: "ci", Context: parent}, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !expires.Equal(parent.Expires.UTC()) {
+		t.Fatalf("expected the expiry of the parent token %s, got %s", parent.Expires, expires)
+	}
+}
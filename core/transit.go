@@ -0,0 +1,183 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	. "southwinds.dev/pilotctl/types"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// transitSigner signs messages with a key held by a HashiCorp Vault Transit secrets engine
+// so that the private key never leaves Vault
+type transitSigner struct {
+	addr   string
+	token  string
+	mount  string
+	key    string
+	client *http.Client
+	mu     sync.Mutex
+	info   *transitKey
+	loaded time.Time
+}
+
+// transitKey the information about the latest version of a transit key
+type transitKey struct {
+	version   int
+	algorithm string
+	publicKey string
+}
+
+func newTransitSigner(addr, token, mount, key string, client *http.Client) (*transitSigner, error) {
+	if len(addr) == 0 || len(key) == 0 {
+		return nil, fmt.Errorf("transit signer requires the Vault address and the key name")
+	}
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	s := &transitSigner{
+		addr:   strings.TrimSuffix(addr, "/"),
+		token:  token,
+		mount:  strings.Trim(mount, "/"),
+		key:    key,
+		client: client,
+	}
+	// fails fast if the key cannot be used
+	if _, err := s.keyInfo(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// current returns a signer for the latest version of the key
+func (s *transitSigner) current() (*transitKeyVersion, error) {
+	info, err := s.keyInfo()
+	if err != nil {
+		return nil, err
+	}
+	return &transitKeyVersion{signer: s, info: info}, nil
+}
+
+// transitKeyVersion signs with a specific version of a transit key
+// so that the key id matches the signature even if the key is rotated in the meantime
+type transitKeyVersion struct {
+	signer *transitSigner
+	info   *transitKey
+}
+
+func (v *transitKeyVersion) KeyId() string {
+	return fmt.Sprintf("%s-v%d", v.signer.key, v.info.version)
+}
+
+func (v *transitKeyVersion) Algorithm() string {
+	return v.info.algorithm
+}
+
+func (v *transitKeyVersion) PublicKey() ([]byte, error) {
+	return []byte(v.info.publicKey), nil
+}
+
+func (v *transitKeyVersion) Sign(message []byte) ([]byte, error) {
+	req := map[string]interface{}{
+		"input":       base64.StdEncoding.EncodeToString(message),
+		"key_version": v.info.version,
+	}
+	if v.info.algorithm == AlgRsaSha256 {
+		req["signature_algorithm"] = "pkcs1v15"
+	}
+	var resp struct {
+		Data struct {
+			Signature string `json:"signature"`
+		} `json:"data"`
+	}
+	if err := v.signer.call(http.MethodPost, fmt.Sprintf("sign/%s/sha2-256", v.signer.key), req, &resp); err != nil {
+		return nil, fmt.Errorf("cannot sign with transit key '%s': %s", v.signer.key, err)
+	}
+	// signatures have the format vault:v{version}:{base64 signature}
+	parts := strings.SplitN(resp.Data.Signature, ":", 3)
+	if len(parts) != 3 || parts[1] != fmt.Sprintf("v%d", v.info.version) {
+		return nil, fmt.Errorf("unexpected transit signature '%s'", resp.Data.Signature)
+	}
+	return base64.StdEncoding.DecodeString(parts[2])
+}
+
+// keyInfo returns the latest version of the key, checking for key rotations at most once a minute
+func (s *transitSigner) keyInfo() (*transitKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.info != nil && time.Since(s.loaded) < time.Minute {
+		return s.info, nil
+	}
+	var resp struct {
+		Data struct {
+			Type          string `json:"type"`
+			LatestVersion int    `json:"latest_version"`
+			Keys          map[string]struct {
+				PublicKey string `json:"public_key"`
+			} `json:"keys"`
+		} `json:"data"`
+	}
+	if err := s.call(http.MethodGet, "keys/"+s.key, nil, &resp); err != nil {
+		return nil, fmt.Errorf("cannot read transit key '%s': %s", s.key, err)
+	}
+	info := &transitKey{version: resp.Data.LatestVersion}
+	switch {
+	case strings.HasPrefix(resp.Data.Type, "rsa-"):
+		info.algorithm = AlgRsaSha256
+	case resp.Data.Type == "ecdsa-p256":
+		info.algorithm = AlgEcdsaSha256
+	default:
+		return nil, fmt.Errorf("transit key type '%s' cannot sign ping responses", resp.Data.Type)
+	}
+	info.publicKey = resp.Data.Keys[strconv.Itoa(info.version)].PublicKey
+	s.info, s.loaded = info, time.Now()
+	return info, nil
+}
+
+func (s *transitSigner) call(method, path string, body, result interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, fmt.Sprintf("%s/v1/%s/%s", s.addr, s.mount, path), bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", s.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s returned %s", method, path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
@@ -0,0 +1,154 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// transitStandIn a local stand-in for a Vault Transit secrets engine mounted at /v1/transit
+// it supports reading, signing with and rotating RSA (rsa-2048) or ECDSA (ecdsa-p256) keys held in memory
+type transitStandIn struct {
+	token   string
+	keyType string
+	mu      sync.Mutex
+	keys    map[string][]crypto.Signer
+}
+
+// newTransitStandIn creates a stand-in accepting the specified token and creating keys of the specified type on first use
+func newTransitStandIn(token, keyType string) *transitStandIn {
+	return &transitStandIn{token: token, keyType: keyType, keys: make(map[string][]crypto.Signer)}
+}
+
+func (t *transitStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Vault-Token") != t.token {
+		http.Error(w, "permission denied", http.StatusForbidden)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/transit/"), "/")
+	switch {
+	case r.Method == http.MethodGet && len(parts) == 2 && parts[0] == "keys":
+		t.readKey(w, parts[1])
+	case r.Method == http.MethodPost && len(parts) == 3 && parts[0] == "keys" && parts[2] == "rotate":
+		if _, err := t.versions(parts[1], true); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		t.readKey(w, parts[1])
+	case r.Method == http.MethodPost && len(parts) == 3 && parts[0] == "sign" && parts[2] == "sha2-256":
+		t.sign(w, r, parts[1])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// versions returns the versions of a key, creating the key if it does not exist and adding a version if rotating
+func (t *transitStandIn) versions(name string, rotate bool) ([]crypto.Signer, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.keys[name]) == 0 || rotate {
+		var (
+			key crypto.Signer
+			err error
+		)
+		if t.keyType == "ecdsa-p256" {
+			key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		} else {
+			key, err = rsa.GenerateKey(rand.Reader, 2048)
+		}
+		if err != nil {
+			return nil, err
+		}
+		t.keys[name] = append(t.keys[name], key)
+	}
+	return t.keys[name], nil
+}
+
+func (t *transitStandIn) readKey(w http.ResponseWriter, name string) {
+	versions, err := t.versions(name, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	keys := make(map[string]interface{})
+	for i, key := range versions {
+		der, _ := x509.MarshalPKIXPublicKey(key.Public())
+		keys[strconv.Itoa(i+1)] = map[string]string{
+			"public_key": string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+		}
+	}
+	keyType := t.keyType
+	if keyType != "ecdsa-p256" {
+		keyType = "rsa-2048"
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"data": map[string]interface{}{"type": keyType, "latest_version": len(versions), "keys": keys},
+	})
+}
+
+func (t *transitStandIn) sign(w http.ResponseWriter, r *http.Request, name string) {
+	var req struct {
+		Input      string `json:"input"`
+		KeyVersion int    `json:"key_version"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	versions, err := t.versions(name, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if req.KeyVersion == 0 {
+		req.KeyVersion = len(versions)
+	}
+	if req.KeyVersion > len(versions) {
+		http.Error(w, "requested version does not exist", http.StatusBadRequest)
+		return
+	}
+	input, err := base64.StdEncoding.DecodeString(req.Input)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	digest := sha256.Sum256(input)
+	sig, err := versions[req.KeyVersion-1].Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"data": map[string]string{"signature": fmt.Sprintf("vault:v%d:%s", req.KeyVersion, base64.StdEncoding.EncodeToString(sig))},
+	})
+}
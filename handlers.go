@@ -27,16 +27,15 @@ package main
 // @license.url https://www.gnu.org/licenses/agpl-3.0-standalone.html
 
 import (
-	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
-	"os"
 	h "southwinds.dev/http"
 	"southwinds.dev/pilotctl/core"
 	_ "southwinds.dev/pilotctl/docs"
@@ -47,11 +46,23 @@ import (
 )
 
 // pingHandler excluded from swagger as it is accessed by pilot with a special time-bound access token
+// pilot can pass ?wait={secs} to hold the ping until a job is created for the host, older pilots keep polling
+// only jobs created on the instance holding the ping end the wait, jobs created on other instances are picked up
+// when the wait expires
 func pingHandler(w http.ResponseWriter, r *http.Request) {
+	// the number of pings being processed drives the backoff of ping intervals
+	done := core.TrackPing()
+	defer done()
+	// in long-poll mode, pilot asks for the ping to be held until a job is available
+	wait, err := waitParam(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid wait parameter: %s\n", err), http.StatusBadRequest)
+		return
+	}
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		log.Printf("cannot read ping request body: %s\n", err)
-		http.Error(w, "cannot read ping request body, check the server logs\n", http.StatusBadRequest)
+		http.Error(w, "cannot read ping request body, check the server logs\n", core.BodyReadStatus(err))
 		return
 	}
 	if len(body) > 0 {
@@ -65,7 +76,7 @@ func pingHandler(w http.ResponseWriter, r *http.Request) {
 		// if the ping request contains a job result
 		if pingRequest.Result != nil {
 			// persist the result of the job
-			err = core.Api().CompleteJob(pingRequest.Result)
+			err = core.Api().CompleteJob(pilotHost(r).HostUUID, pingRequest.Result)
 			if err != nil {
 				log.Printf("cannot set job status: %s\n", err)
 				http.Error(w, "set job status, check the server logs\n", http.StatusBadRequest)
@@ -73,13 +84,52 @@ func pingHandler(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 	}
+	hostUUID := pilotHost(r).HostUUID
+	var waiter *core.JobWaiter
+	if wait > 0 {
+		// registered before looking for a job so that a job created in between wakes the ping up
+		waiter = core.Api().NewJobWaiter(hostUUID)
+		defer waiter.Close()
+	}
 	// todo: add support for fx version
-	jobId, fxKey, _, err := core.Api().Ping()
+	jobId, fxKey, _, err := core.Api().Ping(hostUUID)
 	if err != nil {
 		log.Printf("can't record ping time: %v\n", err)
 		http.Error(w, "can't record ping time, check the server logs\n", http.StatusInternalServerError)
 		return
 	}
+	if jobId <= 0 && waiter != nil {
+		// held pings do not add to the load
+		done()
+		core.Api().WaitForJob(r.Context(), waiter, wait)
+		if r.Context().Err() != nil {
+			// pilot is gone
+			return
+		}
+		// picks up jobs created while waiting, including by other instances
+		jobId, fxKey, _, err = core.Api().Ping(hostUUID)
+		if err != nil {
+			log.Printf("can't record ping time: %v\n", err)
+			http.Error(w, "can't record ping time, check the server logs\n", http.StatusInternalServerError)
+			return
+		}
+	}
+	// identifies the response so that pilot can discard replayed responses
+	delivery, err := core.Api().NewDelivery(hostUUID)
+	if err != nil {
+		log.Printf("can't create ping response delivery: %v\n", err)
+		http.Error(w, "can't create ping response, check the server logs\n", http.StatusInternalServerError)
+		return
+	}
+	if jobId > 0 {
+		if err = core.Api().DeliverJob(jobId, delivery); err != nil {
+			log.Printf("can't deliver job %d: %v\n", jobId, err)
+			http.Error(w, "can't deliver job, check the server logs\n", http.StatusInternalServerError)
+			return
+		}
+	}
+	// the host pings again sooner while it has a job to run, once the job is claimed for the response
+	interval := core.Api().HostPingInterval(hostUUID, jobId > 0, wait)
 	// create a command with no job
 	var cmdValue = &CmdInfo{
 		JobId: jobId,
@@ -96,7 +146,13 @@ func pingHandler(w http.ResponseWriter, r *http.Request) {
 		// set the job reference
 		cmdValue.JobId = jobId
 	}
-	cr, err := NewPingResponse(*cmdValue, core.Api().PingInterval())
+	signer, err := core.Api().Signer()
+	if err != nil {
+		log.Printf("can't load signer: %v\n", err)
+		http.Error(w, "can't sign ping response, check the server logs\n", http.StatusInternalServerError)
+		return
+	}
+	cr, err := NewSignedPingResponse(*cmdValue, interval, *delivery, signer)
 	if err != nil {
 		log.Printf("can't sign ping response: %v\n", err)
 		http.Error(w, "can't sign ping response, check the server logs\n", http.StatusInternalServerError)
@@ -115,7 +171,7 @@ func cveReportExportHandler(w http.ResponseWriter, r *http.Request) {
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		log.Printf("cannot read CVE export payload: %s\n", err)
-		http.Error(w, "cannot read CVE export payload, check the server logs\n", http.StatusBadRequest)
+		http.Error(w, "cannot read CVE export payload, check the server logs\n", core.BodyReadStatus(err))
 		return
 	}
 	cveRequest := new(CveRequest)
@@ -131,7 +187,14 @@ func cveReportExportHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "cannot load CVE report, check the server logs\n", http.StatusBadRequest)
 		return
 	}
-	err = core.Api().UpsertCVE(cveRequest.HostUUID, report)
+	// a host can only report its own CVEs
+	host := pilotHost(r)
+	if len(cveRequest.HostUUID) > 0 && !strings.EqualFold(cveRequest.HostUUID, host.HostUUID) {
+		log.Printf("host %s cannot upload CVE report for host %s\n", host.HostUUID, cveRequest.HostUUID)
+		http.Error(w, "the CVE report host does not match the authenticated host\n", http.StatusForbidden)
+		return
+	}
+	err = core.Api().UpsertCVE(host.HostUUID, report)
 	if err != nil {
 		log.Printf("cannot update CVE information: %s\n", err)
 		http.Error(w, "cannot update CVE information, check the server logs\n", http.StatusBadRequest)
@@ -156,7 +219,11 @@ func getCVEBaselineHandler(w http.ResponseWriter, r *http.Request) {
 		label = strings.Split(labels, "|")
 	}
 	score, err := strconv.ParseFloat(minScore, 32)
-	list, err := core.Api().GetCVEBaseline(score, label)
+	access, ok := userAccess(w, r)
+	if !ok {
+		return
+	}
+	list, err := core.Api().GetCVEBaseline(access, score, label)
 	if err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -197,7 +264,11 @@ func hostQueryHandler(w http.ResponseWriter, r *http.Request) {
 	if len(labels) > 0 {
 		label = strings.Split(labels, "|")
 	}
-	hosts, err := core.Api().GetHosts(orgGroup, org, area, location, label)
+	access, ok := userAccess(w, r)
+	if !ok {
+		return
+	}
+	hosts, err := core.Api().GetHosts(access, orgGroup, org, area, location, label)
 	if err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -208,6 +279,7 @@ func hostQueryHandler(w http.ResponseWriter, r *http.Request) {
 
 // @Summary Decommissions a host
 // @Description removes the host from the list of available hosts so that it can be no longer managed
+// @Description the host can be restored within the decommission grace period after which its data is purged
 // @Tags Host
 // @Router /host/{host-uuid} [delete]
 // @Param host-uuid path string true "the unique identifier for the host"
@@ -217,7 +289,8 @@ func hostQueryHandler(w http.ResponseWriter, r *http.Request) {
 func hostDecommissionHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	hostUUID := vars["host-uuid"]
-	err := core.Api().DecommissionHost(hostUUID)
+	auditHostLifecycle(r, hostUUID)
+	err := core.Api().DecommissionHost(hostUUID, username(r))
 	if err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -226,202 +299,898 @@ func hostDecommissionHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
-// registerHandler excluded from swagger as it is accessed by pilot with a special time-bound access token
-func registerHandler(w http.ResponseWriter, r *http.Request) {
-	// get http body
-	body, err := io.ReadAll(r.Body)
+// @Summary Restores a decommissioned host
+// @Description returns a decommissioned host to the state it was in before the decommission
+// @Description providing the decommission grace period has not elapsed
+// @Tags Host
+// @Router /host/{host-uuid}/restore [post]
+// @Param host-uuid path string true "the unique identifier for the host"
+// @Produce plain
+// @Failure 400 {string} the host cannot be restored
+// @Success 204 {string} successful restore
+func hostRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	hostUUID := vars["host-uuid"]
+	auditHostLifecycle(r, hostUUID)
+	err := core.Api().RestoreHost(hostUUID, username(r))
 	if err != nil {
-		log.Printf("Error reading body: %v", err)
-		http.Error(w, "can't read body, check the server logs for more details", http.StatusBadRequest)
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	// unmarshal body
-	reg := &RegistrationRequest{}
-	err = json.Unmarshal(body, reg)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// @Summary Get the lifecycle state of a host
+// @Description Returns the current and previous lifecycle states of a host
+// @Tags Host
+// @Router /host/{host-uuid}/state [get]
+// @Param host-uuid path string true "the unique identifier for the host"
+// @Produce json
+// @Failure 500 {string} there was an error in the server, check the server logs
+// @Success 200 {object} types.HostLifecycle
+func getHostStateHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	hostUUID := vars["host-uuid"]
+	lifecycle, err := core.Api().GetHostLifecycle(hostUUID)
 	if err != nil {
-		log.Printf("Error unmarshalling body: %v", err)
-		http.Error(w, "can't unmarshal body, check the server logs for more details", http.StatusBadRequest)
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.Write(w, r, lifecycle)
+}
+
+// @Summary Changes the lifecycle state of a host
+// @Description moves a host to a different lifecycle state (registered, admitted, active, quarantined, retired or decommissioned)
+// @Description only transitions allowed by the host lifecycle are accepted, moving to quarantined requires a reason
+// @Tags Host
+// @Router /host/{host-uuid}/state [put]
+// @Param host-uuid path string true "the unique identifier for the host"
+// @Param state body types.StateChange true "the state to move the host to"
+// @Accepts json
+// @Produce plain
+// @Failure 400 {string} the state transition is not allowed
+// @Success 204 {string} successful state change
+func setHostStateHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	hostUUID := vars["host-uuid"]
+	bytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("failed to read request body: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	regInfo, err := core.Api().Register(reg)
+	change := new(StateChange)
+	err = json.Unmarshal(bytes, change)
 	if err != nil {
-		log.Printf("Failed to register host, Onix responded with an error: %v", err)
-		http.Error(w, "Failed to register host, Onix responded with an error, check the server logs for more details", http.StatusInternalServerError)
+		log.Printf("failed to unmarshal request: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	log.Printf("host %s - %s registered", reg.Hostname, reg.MachineId)
-	bytes, err := json.Marshal(regInfo)
+	state, err := ParseHostState(change.State)
 	if err != nil {
-		log.Printf("Failed to marshal registration configuration: %v", err)
-		http.Error(w, "Failed to marshal registration configuration, check the server logs for more details", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	w.WriteHeader(http.StatusCreated)
-	w.Write(bytes)
+	auditHostLifecycle(r, hostUUID)
+	// decommissions go through the decommission path so that the grace period applies
+	if state == HostDecommissioned {
+		err = core.Api().DecommissionHost(hostUUID, username(r))
+	} else {
+		err = core.Api().SetHostState(hostUUID, state, username(r), change.Reason)
+	}
+	if err != nil {
+		log.Printf("failed to change host state: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
-// @Summary Create or Update a Command
-// @Description creates a new or updates an existing command definition
-// @Tags Command
-// @Router /cmd [put]
-// @Param command body types.Cmd true "the command definition"
+// @Summary Quarantines a host
+// @Description stops a host suspected of being compromised from receiving commands while its pings and telemetry are still accepted
+// @Description only the forensic commands in PILOT_CTL_QUARANTINE_ALLOWED_CMDS are delivered to a quarantined host
+// @Tags Host
+// @Router /host/{host-uuid}/quarantine [put]
+// @Param host-uuid path string true "the unique identifier for the host"
+// @Param quarantine body types.QuarantineRequest true "the reason for quarantining the host"
 // @Accepts json
 // @Produce plain
-// @Failure 500 {string} there was an error in the server, check the server logs
-// @Success 200 {string} OK
-func updateCmdHandler(w http.ResponseWriter, r *http.Request) {
+// @Failure 400 {string} the host cannot be quarantined
+// @Success 204 {string} successful quarantine
+func quarantineHostHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	hostUUID := vars["host-uuid"]
 	bytes, err := io.ReadAll(r.Body)
 	if err != nil {
 		log.Printf("failed to read request body: %s", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	cmd := new(Cmd)
-	err = json.Unmarshal(bytes, cmd)
+	req := new(QuarantineRequest)
+	err = json.Unmarshal(bytes, req)
 	if err != nil {
 		log.Printf("failed to unmarshal request: %s", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	err = core.Api().PutCommand(cmd)
+	auditHostLifecycle(r, hostUUID)
+	err = core.Api().QuarantineHost(hostUUID, username(r), req.Reason)
 	if err != nil {
-		log.Printf("failed to set command: %s", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("failed to quarantine host: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	w.WriteHeader(http.StatusCreated)
+	log.Printf("host %s quarantined by %s: %s", hostUUID, username(r), req.Reason)
+	w.WriteHeader(http.StatusNoContent)
 }
 
-// @Summary Get a Command definition
-// @Description get a specific a command definition
-// @Tags Command
-// @Router /cmd/{name} [get]
-// @Param name path string true "the unique name for the command to retrieve"
-// @Accepts json
+// @Summary Releases a host from quarantine
+// @Description returns a quarantined host to service so that it can receive commands again
+// @Tags Host
+// @Router /host/{host-uuid}/quarantine [delete]
+// @Param host-uuid path string true "the unique identifier for the host"
+// @Param reason query string false "the reason for releasing the host"
 // @Produce plain
-// @Failure 500 {string} there was an error in the server, check the server logs
-// @Success 200 {string} OK
-func getCmdHandler(w http.ResponseWriter, r *http.Request) {
+// @Failure 400 {string} the host cannot be released
+// @Success 204 {string} successful release
+func releaseHostHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	name := vars["name"]
-	cmd, err := core.Api().GetCommand(name)
+	hostUUID := vars["host-uuid"]
+	auditHostLifecycle(r, hostUUID)
+	err := core.Api().ReleaseHost(hostUUID, username(r), r.FormValue("reason"))
 	if err != nil {
-		log.Printf("can't query command with name '%s': %v\n", name, err)
-		http.Error(w, fmt.Sprintf("can't query command with name '%s': %v\n", name, err), http.StatusInternalServerError)
+		log.Printf("failed to release host from quarantine: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	h.Write(w, r, cmd)
+	log.Printf("host %s released from quarantine by %s", hostUUID, username(r))
+	w.WriteHeader(http.StatusNoContent)
 }
 
-// @Summary Delete a Command definition
-// @Description deletes a specific a command definition using the command name
-// @Tags Command
-// @Router /cmd/{name} [delete]
-// @Param name path string true "the unique name for the command to delete"
+// @Summary Relocates a host
+// @Description moves a host to a different org group, org, area and/or location without having to admit it again
+// @Description any logistic values not provided are kept from the current host placement
+// @Description the previous placement is recorded in the host placement history
+// @Tags Host
+// @Router /host/{host-uuid}/logistics [patch]
+// @Param host-uuid path string true "the unique identifier for the host"
+// @Param relocation body types.Relocation true "the new logistic placement for the host"
 // @Accepts json
 // @Produce plain
+// @Failure 400 {string} the relocation is not valid
 // @Failure 500 {string} there was an error in the server, check the server logs
-// @Success 200 {string} OK
-func deleteCmdHandler(w http.ResponseWriter, r *http.Request) {
+// @Success 204 {string} successful relocation
+func relocateHostHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	name := vars["name"]
-	resultingOperation, err := core.Api().DeleteCommand(name)
+	hostUUID := vars["host-uuid"]
+	bytes, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("can't delete command with name '%s': %v\n", name, err)
-		http.Error(w, fmt.Sprintf("can't delete command with name '%s', check server logs for more details\n", name), http.StatusInternalServerError)
+		log.Printf("failed to read request body: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	h.Write(w, r, resultingOperation)
-}
-
-// @Summary Get all Command definitions
-// @Description gets a list of all command definitions
-// @Tags Command
-// @Router /cmd [get]
-// @Accepts json
-// @Produce plain
-// @Failure 500 {string} there was an error in the server, check the server logs
-// @Success 200 {string} OK
-func getAllCmdHandler(w http.ResponseWriter, r *http.Request) {
-	cmds, err := core.Api().GetAllCommands()
+	reloc := new(Relocation)
+	err = json.Unmarshal(bytes, reloc)
 	if err != nil {
-		log.Printf("can't query list of commands: %v\n", err)
-		http.Error(w, fmt.Sprintf("can't query list of commands: %s\n", err), http.StatusInternalServerError)
+		log.Printf("failed to unmarshal request: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	h.Write(w, r, cmds)
+	access, ok := userAccess(w, r)
+	if !ok {
+		return
+	}
+	if placements, plErr := core.Api().GetHostPlacements(hostUUID); plErr == nil && len(placements) > 0 {
+		core.AuditBefore(r, placements[0])
+	}
+	err = core.Api().RelocateHost(access, hostUUID, *reloc, username(r))
+	if err != nil {
+		log.Printf("failed to relocate host: %s", err)
+		status := http.StatusBadRequest
+		if errors.Is(err, core.ErrForbidden) {
+			status = http.StatusForbidden
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
-// @Summary Create a Job
-// @Description create a new job for execution on one or more remote hosts
-// @Tags Job
-// @Router /job [post]
-// @Param command body types.JobBatchInfo true "the information required to create a new job"
+// @Summary Relocates multiple hosts
+// @Description moves a list of hosts to a different org group, org, area and/or location
+// @Description returns the outcome of the relocation for each host
+// @Tags Host
+// @Router /host/logistics [patch]
+// @Param relocations body []types.Relocation true "the new logistic placement for each host"
 // @Accepts json
-// @Produce plain
-// @Failure 500 {string} there was an error in the server, check the server logs
-// @Success 200 {string} OK
-func newJobHandler(w http.ResponseWriter, r *http.Request) {
+// @Produce json
+// @Failure 400 {string} the request is not valid
+// @Success 200 {array} types.RelocationResult
+func relocateHostsHandler(w http.ResponseWriter, r *http.Request) {
 	bytes, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("can't read http body: %v\n", err)
-		http.Error(w, fmt.Sprintf("can't read http body: check server logs\n"), http.StatusInternalServerError)
+		log.Printf("failed to read request body: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	var batch = new(JobBatchInfo)
-	err = json.Unmarshal(bytes, batch)
+	var relocations []Relocation
+	err = json.Unmarshal(bytes, &relocations)
 	if err != nil {
-		log.Printf("can't unmarshal http body: %v\n", err)
-		http.Error(w, fmt.Sprintf("can't unmarshal http body, check the server logs\n"), http.StatusInternalServerError)
+		log.Printf("failed to unmarshal request: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	jobBatchId, err := core.Api().CreateJobBatch(*batch)
-	if err != nil {
-		log.Printf("can't create job batch: %v\n", err)
-		http.Error(w, fmt.Sprintf("can't create job batch, check the server logs\n"), http.StatusInternalServerError)
+	access, ok := userAccess(w, r)
+	if !ok {
 		return
 	}
-	// return the batch ID
-	w.Write([]byte(strconv.FormatInt(jobBatchId, 10)))
+	hostUUIDs := make([]string, len(relocations))
+	for i, reloc := range relocations {
+		hostUUIDs[i] = reloc.HostUUID
+	}
+	auditHosts(r, hostUUIDs)
+	h.Write(w, r, core.Api().RelocateHosts(access, relocations, username(r)))
 }
 
-// @Summary Get Jobs
-// @Description Returns a list of jobs filtered by the specified logistics tags
-// @Tags Job
-// @Router /job [get]
-// @Param bid query int64 false "the unique identifier (number) of the job batch to retrieve"
-// @Param og query string false "the organisation group key to filter the query"
-// @Param or query string false "the organisation key to filter the query"
-// @Param ar query string false "the area key to filter the query"
-// @Param lo query string false "the location key to filter the query"
+// @Summary Get the placement history of a host
+// @Description Returns the logistic placements a host has been in, most recent first
+// @Tags Host
+// @Router /host/{host-uuid}/logistics [get]
+// @Param host-uuid path string true "the unique identifier for the host"
 // @Produce json
 // @Failure 500 {string} there was an error in the server, check the server logs
-// @Success 200 {string} OK
-func getJobsHandler(w http.ResponseWriter, r *http.Request) {
-	var bid *int64
-	batchId := r.FormValue("bid")
-	// if a batch id was provided
-	if len(batchId) > 0 {
-		id, parseErr := strconv.ParseInt(batchId, 10, 64)
-		if isErr(w, parseErr, http.StatusBadRequest, "cannot parse batch Id") {
-			return
-		}
-		bid = &id
+// @Success 200 {array} types.Placement
+func getHostPlacementsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	hostUUID := vars["host-uuid"]
+	placements, err := core.Api().GetHostPlacements(hostUUID)
+	if err != nil {
+		log.Printf("failed to retrieve host placement history: %s\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	orgGroup := r.FormValue("og")
-	org := r.FormValue("or")
-	area := r.FormValue("ar")
-	location := r.FormValue("lo")
+	h.Write(w, r, placements)
+}
 
-	jobs, err := core.Api().GetJobs(orgGroup, org, area, location, bid)
-	if isErr(w, err, http.StatusBadRequest, "cannot retrieve jobs from database") {
+// registerHandler excluded from swagger as it is accessed by pilot with a special time-bound access token
+func registerHandler(w http.ResponseWriter, r *http.Request) {
+	// get http body
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("Error reading body: %v", err)
+		http.Error(w, "can't read body, check the server logs for more details", core.BodyReadStatus(err))
 		return
 	}
-	h.Write(w, r, jobs)
+	// unmarshal body
+	reg := &RegistrationRequest{}
+	err = json.Unmarshal(body, reg)
+	if err != nil {
+		log.Printf("Error unmarshalling body: %v", err)
+		http.Error(w, "can't unmarshal body, check the server logs for more details", http.StatusBadRequest)
+		return
+	}
+	regInfo, err := core.Api().Register(pilotHost(r).HostUUID, reg)
+	if err != nil {
+		log.Printf("Failed to register host: %v", err)
+		http.Error(w, "Failed to register host, check the server logs for more details", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("host %s - %s registered", reg.Hostname, reg.MachineId)
+	// admits the host if it matches an admission rule, or otherwise queues it for approval
+	if _, err = core.Api().AutoAdmit(pilotHost(r), reg); err != nil {
+		log.Printf("cannot apply admission rules to host %s - %s: %v", reg.Hostname, reg.MachineId, err)
+	}
+	bytes, err := json.Marshal(regInfo)
+	if err != nil {
+		log.Printf("Failed to marshal registration configuration: %v", err)
+		http.Error(w, "Failed to marshal registration configuration, check the server logs for more details", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write(bytes)
 }
 
-// @Summary Get Job Batches
-// @Description Returns a list of jobs batches with various filters
+// @Summary Get Admission Rules
+// @Description gets the rules used to automatically admit hosts when they register, in order of evaluation
+// @Tags Admission
+// @Router /admission/rule [get]
+// @Produce application/json, application/yaml, application/xml
+// @Failure 500 {string} there was an error in the server, check the server logs
+// @Success 200 {array} types.AdmissionRule
+func getAdmissionRulesHandler(w http.ResponseWriter, r *http.Request) {
+	rules, err := core.Api().GetAdmissionRules()
+	if err != nil {
+		log.Printf("cannot retrieve admission rules: %s\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.Write(w, r, rules)
+}
+
+// @Summary Create or Update an Admission Rule
+// @Description creates or updates a rule that automatically admits registering hosts matching all its criteria
+// @Description (mac-address prefix, hostname pattern, subnet and hardware id) using the rule logistics information
+// @Tags Admission
+// @Router /admission/rule [put]
+// @Param rule body types.AdmissionRule true "the admission rule"
+// @Accepts json
+// @Produce plain
+// @Failure 400 {string} the rule is not valid
+// @Success 200 {string} OK
+func setAdmissionRuleHandler(w http.ResponseWriter, r *http.Request) {
+	bytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var rule AdmissionRule
+	err = json.Unmarshal(bytes, &rule)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = core.Api().SetAdmissionRule(rule)
+	if err != nil {
+		log.Printf("cannot set admission rule: %s\n", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
+
+// @Summary Delete an Admission Rule
+// @Description deletes a rule used to automatically admit registering hosts
+// @Tags Admission
+// @Router /admission/rule/{key} [delete]
+// @Param key path string true "the key of the admission rule to delete"
+// @Produce plain
+// @Failure 500 {string} there was an error in the server, check the server logs
+// @Success 200 {string} OK
+func deleteAdmissionRuleHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	key := vars["key"]
+	err := core.Api().DeleteAdmissionRule(key)
+	if err != nil {
+		log.Printf("cannot delete admission rule '%s': %s\n", key, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// @Summary Create a Bootstrap Token
+// @Description creates a token that host pilots present before they hold a credential or a certificate
+// @Description a token issued to a host lets it collect its first credential or enrol its first certificate,
+// @Description a join token issued to no host lets any registering host be admitted by the admission rules
+// @Description the token value is only returned once
+// @Tags Admission
+// @Router /bootstrap-token [post]
+// @Param token body types.BootstrapTokenRequest true "the host the token is issued to, its number of uses and expiry"
+// @Accepts json
+// @Produce json
+// @Failure 400 {string} the token request is not valid
+// @Success 201 {object} types.BootstrapToken
+func createBootstrapTokenHandler(w http.ResponseWriter, r *http.Request) {
+	bytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req BootstrapTokenRequest
+	if err = json.Unmarshal(bytes, &req); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	token, err := core.Api().CreateBootstrapToken(username(r), req)
+	if isErr(w, err, http.StatusBadRequest, "cannot create bootstrap token") {
+		return
+	}
+	writeStatus(w, http.StatusCreated, token)
+}
+
+// @Summary Get Bootstrap Tokens
+// @Description gets the bootstrap tokens that can still be used, excluding their values
+// @Tags Admission
+// @Router /bootstrap-token [get]
+// @Produce application/json, application/yaml, application/xml
+// @Failure 500 {string} there was an error in the server, check the server logs
+// @Success 200 {array} types.BootstrapToken
+func getBootstrapTokensHandler(w http.ResponseWriter, r *http.Request) {
+	tokens, err := core.Api().GetBootstrapTokens()
+	if isErr(w, err, http.StatusInternalServerError, "cannot get bootstrap tokens") {
+		return
+	}
+	h.Write(w, r, tokens)
+}
+
+// @Summary Delete a Bootstrap Token
+// @Description deletes a bootstrap token so that it can no longer be used
+// @Tags Admission
+// @Router /bootstrap-token/{id} [delete]
+// @Param id path string true "the identifier of the token"
+// @Produce plain
+// @Failure 500 {string} there was an error in the server, check the server logs
+// @Success 200 {string} OK
+func deleteBootstrapTokenHandler(w http.ResponseWriter, r *http.Request) {
+	err := core.Api().DeleteBootstrapToken(mux.Vars(r)["id"])
+	if isErr(w, err, http.StatusInternalServerError, "cannot delete bootstrap token") {
+		return
+	}
+}
+
+// @Summary Get Hosts Pending Admission
+// @Description gets the hosts that registered but were not admitted by an admission rule and are awaiting admission
+// @Tags Admission
+// @Router /admission/pending [get]
+// @Produce application/json, application/yaml, application/xml
+// @Failure 500 {string} there was an error in the server, check the server logs
+// @Success 200 {array} types.PendingAdmission
+func getPendingAdmissionsHandler(w http.ResponseWriter, r *http.Request) {
+	pending, err := core.Api().GetPendingAdmissions()
+	if err != nil {
+		log.Printf("cannot retrieve pending admissions: %s\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.Write(w, r, pending)
+}
+
+// collectCredentialHandler returns the credential issued to the host pilot so that it can sign its requests
+// the credential can only be collected once
+// excluded from swagger as it is accessed by pilot with a request signed with its current credential or a bootstrap token
+func collectCredentialHandler(w http.ResponseWriter, r *http.Request) {
+	credential, err := core.Api().CollectHostCredential(pilotHost(r))
+	if err != nil {
+		log.Printf("cannot collect host credential: %s\n", err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	h.Write(w, r, credential)
+}
+
+// @Summary Get a Host Credential
+// @Description gets information about the credential issued to a host, the credential secret is never returned
+// @Tags Host
+// @Router /host/{host-uuid}/credential [get]
+// @Param host-uuid path string true "the unique identifier for the host"
+// @Produce application/json, application/yaml, application/xml
+// @Failure 404 {string} no credential has been issued to the host
+// @Failure 500 {string} there was an error in the server, check the server logs
+// @Success 200 {object} types.HostCredential
+func getHostCredentialHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	hostUUID := vars["host-uuid"]
+	credential, err := core.Api().GetHostCredential(hostUUID)
+	if err != nil {
+		log.Printf("cannot retrieve host credential: %s\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if credential == nil {
+		http.Error(w, fmt.Sprintf("no credential has been issued to host '%s'", hostUUID), http.StatusNotFound)
+		return
+	}
+	h.Write(w, r, credential)
+}
+
+// @Summary Rotate a Host Credential
+// @Description issues a new credential to a host, the existing credential stays valid until the host collects the new one
+// @Description the host collects it with a request signed with its current credential or, if it holds none,
+// @Description with a bootstrap token issued to it
+// @Tags Host
+// @Router /host/{host-uuid}/credential [post]
+// @Param host-uuid path string true "the unique identifier for the host"
+// @Produce application/json, application/yaml, application/xml
+// @Failure 500 {string} there was an error in the server, check the server logs
+// @Success 201 {object} types.HostCredential
+func rotateHostCredentialHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	hostUUID := vars["host-uuid"]
+	credential, err := core.Api().IssueHostCredential(hostUUID)
+	if err != nil {
+		log.Printf("cannot rotate host credential: %s\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeStatus(w, http.StatusCreated, credential)
+}
+
+// @Summary Revoke a Host Credential
+// @Description revokes the credentials issued to a host, the host cannot sign requests until a new credential is issued
+// @Description and collected with a bootstrap token
+// @Tags Host
+// @Router /host/{host-uuid}/credential [delete]
+// @Param host-uuid path string true "the unique identifier for the host"
+// @Produce plain
+// @Failure 500 {string} there was an error in the server, check the server logs
+// @Success 200 {string} OK
+func revokeHostCredentialHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	hostUUID := vars["host-uuid"]
+	err := core.Api().RevokeHostCredential(hostUUID)
+	if err != nil {
+		log.Printf("cannot revoke host credential: %s\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// enrolCertificateHandler issues the first client certificate to an admitted host pilot from its certificate signing request
+// excluded from swagger as it is accessed by pilot with a request signed with its credential or a bootstrap token
+func enrolCertificateHandler(w http.ResponseWriter, r *http.Request) {
+	bytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req CertificateRequest
+	if err = json.Unmarshal(bytes, &req); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp, err := core.Api().EnrolHostCertificate(pilotHost(r), []byte(req.CSR))
+	if err != nil {
+		log.Printf("cannot enrol host certificate: %s\n", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeStatus(w, http.StatusCreated, resp)
+}
+
+// renewCertificateHandler issues a new client certificate to a host pilot authenticated with its current certificate
+// excluded from swagger as it is accessed by pilot with its client certificate
+func renewCertificateHandler(w http.ResponseWriter, r *http.Request) {
+	cert := core.PeerCertificate(*r)
+	if cert == nil {
+		http.Error(w, "certificates can only be renewed using the current client certificate", http.StatusForbidden)
+		return
+	}
+	bytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req CertificateRequest
+	if err = json.Unmarshal(bytes, &req); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp, err := core.Api().RenewHostCertificate(pilotHost(r).HostUUID, cert.SerialNumber.Text(16), []byte(req.CSR))
+	if err != nil {
+		log.Printf("cannot renew host certificate: %s\n", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeStatus(w, http.StatusCreated, resp)
+}
+
+// @Summary Get the CA Certificate
+// @Description gets the PEM encoded certificate of the internal CA issuing client certificates to host pilots
+// @Tags Certificate
+// @Router /ca [get]
+// @Produce plain
+// @Failure 500 {string} there was an error in the server, check the server logs
+// @Success 200 {string} the CA certificate
+func getCAHandler(w http.ResponseWriter, r *http.Request) {
+	ca, err := core.Api().CA()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(ca.CertPEM())
+}
+
+// @Summary Get the Certificate Revocation List
+// @Description gets the DER encoded list of host pilot certificates revoked by the internal CA
+// @Tags Certificate
+// @Router /ca/crl [get]
+// @Produce application/pkix-crl
+// @Failure 500 {string} there was an error in the server, check the server logs
+// @Success 200 {string} the certificate revocation list
+func getCRLHandler(w http.ResponseWriter, r *http.Request) {
+	crl, err := core.Api().CRL()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pkix-crl")
+	w.Write(crl)
+}
+
+// @Summary Get Host Certificates
+// @Description gets the client certificates issued to a host by the internal CA
+// @Tags Certificate
+// @Router /host/{host-uuid}/certificate [get]
+// @Param host-uuid path string true "the unique identifier for the host"
+// @Produce application/json, application/yaml, application/xml
+// @Failure 500 {string} there was an error in the server, check the server logs
+// @Success 200 {array} types.HostCertificate
+func getHostCertificatesHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	certs, err := core.Api().GetHostCertificates(vars["host-uuid"])
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.Write(w, r, certs)
+}
+
+// @Summary Revoke Host Certificates
+// @Description revokes all the client certificates issued to a host, the host has to enrol again to obtain a new certificate
+// @Tags Certificate
+// @Router /host/{host-uuid}/certificate [delete]
+// @Param host-uuid path string true "the unique identifier for the host"
+// @Produce plain
+// @Failure 500 {string} there was an error in the server, check the server logs
+// @Success 200 {string} OK
+func revokeHostCertificatesHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	err := core.Api().RevokeHostCertificates(vars["host-uuid"])
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// @Summary Create or Update a Command
+// @Description creates a new or updates an existing command definition
+// @Tags Command
+// @Router /cmd [put]
+// @Param command body types.Cmd true "the command definition"
+// @Accepts json
+// @Produce plain
+// @Failure 500 {string} there was an error in the server, check the server logs
+// @Success 200 {string} OK
+func updateCmdHandler(w http.ResponseWriter, r *http.Request) {
+	bytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("failed to read request body: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cmd := new(Cmd)
+	err = json.Unmarshal(bytes, cmd)
+	if err != nil {
+		log.Printf("failed to unmarshal request: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if before, cmdErr := core.Api().GetCommand(cmd.Key); cmdErr == nil {
+		core.AuditBefore(r, before)
+	}
+	err = core.Api().PutCommand(cmd)
+	if err != nil {
+		log.Printf("failed to set command: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// @Summary Get a Command definition
+// @Description get a specific a command definition
+// @Tags Command
+// @Router /cmd/{name} [get]
+// @Param name path string true "the unique name for the command to retrieve"
+// @Accepts json
+// @Produce plain
+// @Failure 500 {string} there was an error in the server, check the server logs
+// @Success 200 {string} OK
+func getCmdHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+	cmd, err := core.Api().GetCommand(name)
+	if err != nil {
+		log.Printf("can't query command with name '%s': %v\n", name, err)
+		http.Error(w, fmt.Sprintf("can't query command with name '%s': %v\n", name, err), http.StatusInternalServerError)
+		return
+	}
+	h.Write(w, r, cmd)
+}
+
+// @Summary Delete a Command definition
+// @Description deletes a specific a command definition using the command name
+// @Tags Command
+// @Router /cmd/{name} [delete]
+// @Param name path string true "the unique name for the command to delete"
+// @Accepts json
+// @Produce plain
+// @Failure 500 {string} there was an error in the server, check the server logs
+// @Success 200 {string} OK
+func deleteCmdHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+	if before, cmdErr := core.Api().GetCommand(name); cmdErr == nil {
+		core.AuditBefore(r, before)
+	}
+	resultingOperation, err := core.Api().DeleteCommand(name)
+	if err != nil {
+		log.Printf("can't delete command with name '%s': %v\n", name, err)
+		http.Error(w, fmt.Sprintf("can't delete command with name '%s', check server logs for more details\n", name), http.StatusInternalServerError)
+		return
+	}
+	h.Write(w, r, resultingOperation)
+}
+
+// @Summary Get all Command definitions
+// @Description gets a list of all command definitions
+// @Tags Command
+// @Router /cmd [get]
+// @Accepts json
+// @Produce plain
+// @Failure 500 {string} there was an error in the server, check the server logs
+// @Success 200 {string} OK
+func getAllCmdHandler(w http.ResponseWriter, r *http.Request) {
+	cmds, err := core.Api().GetAllCommands()
+	if err != nil {
+		log.Printf("can't query list of commands: %v\n", err)
+		http.Error(w, fmt.Sprintf("can't query list of commands: %s\n", err), http.StatusInternalServerError)
+		return
+	}
+	h.Write(w, r, cmds)
+}
+
+// @Summary Create a Job
+// @Description create a new job for execution on one or more remote hosts
+// @Tags Job
+// @Router /job [post]
+// @Param command body types.JobBatchInfo true "the information required to create a new job"
+// @Accepts json
+// @Produce plain
+// @Failure 500 {string} there was an error in the server, check the server logs
+// @Success 200 {string} OK
+func newJobHandler(w http.ResponseWriter, r *http.Request) {
+	bytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("can't read http body: %v\n", err)
+		http.Error(w, fmt.Sprintf("can't read http body: check server logs\n"), http.StatusInternalServerError)
+		return
+	}
+	var batch = new(JobBatchInfo)
+	err = json.Unmarshal(bytes, batch)
+	if err != nil {
+		log.Printf("can't unmarshal http body: %v\n", err)
+		http.Error(w, fmt.Sprintf("can't unmarshal http body, check the server logs\n"), http.StatusInternalServerError)
+		return
+	}
+	access, ok := userAccess(w, r)
+	if !ok {
+		return
+	}
+	jobBatchId, err := core.Api().CreateJobBatch(h.GetUserPrincipal(r), access, *batch)
+	if errors.Is(err, core.ErrForbidden) {
+		log.Printf("can't create job batch: %v\n", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Printf("can't create job batch: %v\n", err)
+		http.Error(w, fmt.Sprintf("can't create job batch, check the server logs\n"), http.StatusInternalServerError)
+		return
+	}
+	// return the batch ID
+	w.Write([]byte(strconv.FormatInt(jobBatchId, 10)))
+}
+
+// @Summary Get Jobs
+// @Description Returns a list of jobs filtered by the specified logistics tags
+// @Tags Job
+// @Router /job [get]
+// @Param bid query int64 false "the unique identifier (number) of the job batch to retrieve"
+// @Param og query string false "the organisation group key to filter the query"
+// @Param or query string false "the organisation key to filter the query"
+// @Param ar query string false "the area key to filter the query"
+// @Param lo query string false "the location key to filter the query"
+// @Produce json
+// @Failure 500 {string} there was an error in the server, check the server logs
+// @Success 200 {string} OK
+func getJobsHandler(w http.ResponseWriter, r *http.Request) {
+	var bid *int64
+	batchId := r.FormValue("bid")
+	// if a batch id was provided
+	if len(batchId) > 0 {
+		id, parseErr := strconv.ParseInt(batchId, 10, 64)
+		if isErr(w, parseErr, http.StatusBadRequest, "cannot parse batch Id") {
+			return
+		}
+		bid = &id
+	}
+	orgGroup := r.FormValue("og")
+	org := r.FormValue("or")
+	area := r.FormValue("ar")
+	location := r.FormValue("lo")
+	access, ok := userAccess(w, r)
+	if !ok {
+		return
+	}
+	jobs, err := core.Api().GetJobs(access, orgGroup, org, area, location, bid)
+	if isErr(w, err, http.StatusBadRequest, "cannot retrieve jobs from database") {
+		return
+	}
+	h.Write(w, r, jobs)
+}
+
+// @Summary Cancel a Job Batch
+// @Description cancels the jobs of a batch that have not been picked up by their hosts yet
+// @Description only the owner of the batch or a user with elevated rights can cancel it
+// @Tags Job
+// @Router /job/batch/{id}/cancel [post]
+// @Param id path int64 true "the unique identifier (number) of the job batch"
+// @Produce json
+// @Failure 403 {string} the user cannot cancel the batch
+// @Failure 500 {string} there was an error in the server, check the server logs
+// @Success 200 {string} OK
+func cancelJobBatchHandler(w http.ResponseWriter, r *http.Request) {
+	batchId, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if isErr(w, err, http.StatusBadRequest, "cannot parse batch Id") {
+		return
+	}
+	access, ok := userAccess(w, r)
+	if !ok {
+		return
+	}
+	cancelled, err := core.Api().CancelJobBatch(batchId, h.GetUserPrincipal(r), access)
+	if err != nil {
+		writeBatchError(w, "cannot cancel job batch", err)
+		return
+	}
+	h.Write(w, r, map[string]int{"cancelled": cancelled})
+}
+
+// @Summary Re-run a Job Batch
+// @Description creates a new batch running the function of a previous batch on the same hosts
+// @Description only the owner of the batch or a user with elevated rights can re-run it
+// @Tags Job
+// @Router /job/batch/{id}/rerun [post]
+// @Param id path int64 true "the unique identifier (number) of the job batch"
+// @Param failed query bool false "only re-run the jobs that failed"
+// @Produce plain
+// @Failure 403 {string} the user cannot re-run the batch
+// @Failure 500 {string} there was an error in the server, check the server logs
+// @Success 201 {string} the identifier of the new job batch
+func rerunJobBatchHandler(w http.ResponseWriter, r *http.Request) {
+	batchId, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if isErr(w, err, http.StatusBadRequest, "cannot parse batch Id") {
+		return
+	}
+	failedOnly, _ := strconv.ParseBool(r.FormValue("failed"))
+	access, ok := userAccess(w, r)
+	if !ok {
+		return
+	}
+	newBatchId, err := core.Api().RerunJobBatch(batchId, h.GetUserPrincipal(r), access, failedOnly)
+	if err != nil {
+		writeBatchError(w, "cannot re-run job batch", err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(strconv.FormatInt(newBatchId, 10)))
+}
+
+func writeBatchError(w http.ResponseWriter, msg string, err error) {
+	log.Printf("%s: %s\n", msg, err)
+	if errors.Is(err, core.ErrForbidden) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	http.Error(w, fmt.Sprintf("%s, check the server logs\n", msg), http.StatusInternalServerError)
+}
+
+// @Summary Get Job Batches
+// @Description Returns a list of jobs batches with various filters
 // @Tags Job
 // @Router /job/batch [get]
 // @Param name query string false "the name of the batch as in name% format"
@@ -473,7 +1242,11 @@ func getJobBatchHandler(w http.ResponseWriter, r *http.Request) {
 	if len(ownerParam) > 0 {
 		owner = &ownerParam
 	}
-	batches, err := core.Api().GetJobBatches(name, owner, fromTime, toTime, &label)
+	access, ok := userAccess(w, r)
+	if !ok {
+		return
+	}
+	batches, err := core.Api().GetJobBatches(h.GetUserPrincipal(r), access, name, owner, fromTime, toTime, &label)
 	if err != nil {
 		log.Printf("failed to retrieve job batches: %s\n", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -615,13 +1388,16 @@ func syncInfoHandler(w http.ResponseWriter, r *http.Request) {
 // @Summary Admits a host into service
 // @Description inform pilotctl to accept management connections coming from a host pilot agent
 // @Description admitting a host also requires associating the relevant logistic information such as org, area and location for the host
+// @Description all admissions are validated against the logistics hierarchy before any is applied and the outcome for each host is returned
 // @Tags Admission
 // @Router /admission [put]
 // @Param command body []types.Admission true "the required admission information"
+// @Param all-or-nothing query bool false "a flag indicating whether no admission should be applied unless all of them can be applied"
 // @Accepts json
-// @Produce plain
-// @Failure 500 {string} there was an error in the server, check the server logs
-// @Success 200 {string} OK
+// @Produce json
+// @Failure 400 {string} the request is not valid
+// @Success 200 {array} types.AdmissionResult
+// @Success 207 {array} types.AdmissionResult
 func setAdmissionHandler(w http.ResponseWriter, r *http.Request) {
 	bytes, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -633,17 +1409,116 @@ func setAdmissionHandler(w http.ResponseWriter, r *http.Request) {
 	err = json.Unmarshal(bytes, &admissions)
 	if err != nil {
 		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	access, ok := userAccess(w, r)
+	if !ok {
+		return
+	}
+	auditHosts(r, admissionHosts(admissions))
+	allOrNothing, _ := strconv.ParseBool(r.FormValue("all-or-nothing"))
+	results := core.Api().SetAdmissions(access, admissions, allOrNothing)
+	writeAdmissionResults(w, r, results)
+}
+
+// @Summary Approve Hosts Pending Admission
+// @Description admits hosts awaiting admission using the specified logistics information
+// @Description hosts that are not awaiting admission are reported as failed
+// @Tags Admission
+// @Router /admission/pending/approve [post]
+// @Param command body []types.Admission true "the admission information for the hosts to approve"
+// @Param all-or-nothing query bool false "a flag indicating whether no host should be admitted unless all of them can be admitted"
+// @Accepts json
+// @Produce json
+// @Failure 400 {string} the request is not valid
+// @Failure 500 {string} there was an error in the server, check the server logs
+// @Success 200 {array} types.AdmissionResult
+// @Success 207 {array} types.AdmissionResult
+func approvePendingAdmissionsHandler(w http.ResponseWriter, r *http.Request) {
+	bytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var admissions []Admission
+	err = json.Unmarshal(bytes, &admissions)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	access, ok := userAccess(w, r)
+	if !ok {
+		return
+	}
+	auditPendingAdmissions(r, admissionHosts(admissions))
+	allOrNothing, _ := strconv.ParseBool(r.FormValue("all-or-nothing"))
+	results, err := core.Api().ApprovePendingAdmissions(access, admissions, allOrNothing)
+	if err != nil {
+		log.Printf("cannot approve pending admissions: %s\n", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	for _, admission := range admissions {
-		err = core.Api().SetAdmission(admission)
-		if err != nil {
-			log.Println(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	writeAdmissionResults(w, r, results)
+}
+
+// @Summary Reject Hosts Pending Admission
+// @Description rejects hosts awaiting admission so that they are no longer listed as pending
+// @Tags Admission
+// @Router /admission/pending/reject [post]
+// @Param command body []string true "the UUIDs of the hosts to reject"
+// @Accepts json
+// @Produce json
+// @Failure 400 {string} the request is not valid
+// @Failure 500 {string} there was an error in the server, check the server logs
+// @Success 200 {array} types.AdmissionResult
+// @Success 207 {array} types.AdmissionResult
+func rejectPendingAdmissionsHandler(w http.ResponseWriter, r *http.Request) {
+	bytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var hostUUIDs []string
+	err = json.Unmarshal(bytes, &hostUUIDs)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	auditPendingAdmissions(r, hostUUIDs)
+	results, err := core.Api().RejectPendingAdmissions(hostUUIDs, username(r))
+	if err != nil {
+		log.Printf("cannot reject pending admissions: %s\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeAdmissionResults(w, r, results)
+}
+
+// admissionHosts returns the UUIDs of the hosts in a list of admissions
+func admissionHosts(admissions []Admission) []string {
+	hostUUIDs := make([]string, len(admissions))
+	for i, admission := range admissions {
+		hostUUIDs[i] = admission.HostUUID
+	}
+	return hostUUIDs
+}
+
+// writeAdmissionResults writes the results of a bulk admission operation
+// reporting a multi-status if the operation failed or was not applied for any of the hosts
+func writeAdmissionResults(w http.ResponseWriter, r *http.Request, results []AdmissionResult) {
+	for _, result := range results {
+		if result.Status == AdmissionFailed || result.Status == AdmissionNotApplied {
+			log.Printf("admission operation for host '%s' not applied: %s\n", result.HostUUID, result.Reason)
+			writeStatus(w, http.StatusMultiStatus, results)
 			return
 		}
 	}
+	h.Write(w, r, results)
 }
 
 // @Summary Get Artisan Packages
@@ -679,69 +1554,264 @@ func getPackagesApiHandler(w http.ResponseWriter, r *http.Request) {
 		log.Printf("failed to unescape package name '%s': %s\n", name, err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
-	api, err := core.Api().GetPackageAPI(n)
-	if err != nil {
-		log.Printf("failed to get package API from registry: %s\n", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	api, err := core.Api().GetPackageAPI(n)
+	if err != nil {
+		log.Printf("failed to get package API from registry: %s\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.Write(w, r, api)
+}
+
+// @Summary Retrieve the logged user principal
+// @Description Retrieve the logged user principal containing a list of access controls granted to the user
+// @Description use it primarily to log in user interface services and retrieve a list of access controls to inform which
+// @Description operations are available to the user via the user interface
+// @Tags Access Control
+// @Router /user [get]
+// @Accepts json
+// @Produce plain
+// @Failure 401 {string} the request failed to authenticate the user
+// @Failure 500 {string} there was an error in the server, check the server logs
+// @Success 200 {string} OK
+func getUserHandler(w http.ResponseWriter, r *http.Request) {
+	// if we got this far is because the user is authenticated
+	// then return the access controls for the user
+	user := h.GetUserPrincipal(r)
+	if user != nil {
+		h.Write(w, r, user)
+	}
+}
+
+// @Summary Retrieve the service public PGP keys
+// @Description Retrieve the service public PGP keys used to verify the authenticity of the service by pilot agents
+// @Description if json is accepted, the keyset with the active and pending keys is returned so that pilot can pick
+// @Description the key matching the key id of a ping response; otherwise the hex encoded primary key is returned
+// @Tags PGP
+// @Router /pub [get]
+// @Produce plain,json
+// @Failure 500 {string} there was an error in the server, check the server logs
+// @Success 200 {string} OK
+func getKeyHandler(w http.ResponseWriter, r *http.Request) {
+	set, err := core.Api().GetSigningKeySet()
+	if err != nil {
+		log.Printf("cannot retrieve signing keyset: %s\n", err)
+		http.Error(w, "cannot retrieve signing keyset, check the server logs\n", http.StatusInternalServerError)
+		return
+	}
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		h.Write(w, r, set)
+		return
+	}
+	// pilots not supporting key rotation get the primary key
+	for _, k := range set.Keys {
+		if k.KeyId == set.Primary {
+			w.Write([]byte(hex.EncodeToString([]byte(k.PublicKey))))
+			return
+		}
+	}
+	log.Printf("signing keyset has no primary key\n")
+	http.Error(w, "signing keyset has no primary key, check the server logs\n", http.StatusInternalServerError)
+}
+
+// @Summary Get Signing Keys
+// @Description Returns the keys in the signing keyring, including retired keys
+// @Tags PGP
+// @Router /signing-key [get]
+// @Produce json
+// @Failure 500 {string} there was an error in the server, check the server logs
+// @Success 200 {array} types.SigningKey
+func getSigningKeysHandler(w http.ResponseWriter, r *http.Request) {
+	keys, err := core.Api().GetSigningKeys()
+	if isErr(w, err, http.StatusInternalServerError, "cannot retrieve signing keys") {
+		return
+	}
+	h.Write(w, r, keys)
+}
+
+// @Summary Generate a Signing Key
+// @Description generates a new signing key in pending status, the key is published in the keyset straight away
+// @Description so that pilots can fetch it, but it does not sign ping responses until it is activated
+// @Tags PGP
+// @Router /signing-key [post]
+// @Produce json
+// @Failure 500 {string} there was an error in the server, check the server logs
+// @Success 201 {object} types.SigningKey
+func generateSigningKeyHandler(w http.ResponseWriter, r *http.Request) {
+	key, err := core.Api().GenerateSigningKey(username(r))
+	if isErr(w, err, http.StatusInternalServerError, "cannot generate signing key") {
+		return
+	}
+	writeStatus(w, http.StatusCreated, key)
+}
+
+// @Summary Activate a Signing Key
+// @Description makes the key the primary key signing ping responses; other active keys remain published until retired
+// @Tags PGP
+// @Router /signing-key/{key-id}/activate [post]
+// @Param key-id path string true "the identifier of the signing key"
+// @Produce plain
+// @Failure 400 {string} the key cannot be activated
+// @Success 200 {string} OK
+func activateSigningKeyHandler(w http.ResponseWriter, r *http.Request) {
+	err := core.Api().ActivateSigningKey(mux.Vars(r)["key-id"], username(r))
+	if isErr(w, err, http.StatusBadRequest, "cannot activate signing key") {
+		return
+	}
+}
+
+// @Summary Retire a Signing Key
+// @Description stops the key from signing ping responses and removes it from the published keyset
+// @Tags PGP
+// @Router /signing-key/{key-id}/retire [post]
+// @Param key-id path string true "the identifier of the signing key"
+// @Produce plain
+// @Failure 400 {string} the key cannot be retired
+// @Success 200 {string} OK
+func retireSigningKeyHandler(w http.ResponseWriter, r *http.Request) {
+	err := core.Api().RetireSigningKey(mux.Vars(r)["key-id"], username(r))
+	if isErr(w, err, http.StatusBadRequest, "cannot retire signing key") {
+		return
+	}
+}
+
+// @Summary Get Ping Policies
+// @Description gets the policies setting the ping interval of hosts by logistics and labels
+// @Tags Host
+// @Router /ping-policy [get]
+// @Produce json
+// @Failure 500 {string} there was an error in the server, check the server logs
+// @Success 200 {array} types.PingPolicy
+func getPingPoliciesHandler(w http.ResponseWriter, r *http.Request) {
+	policies, err := core.Api().GetPingPolicies()
+	if isErr(w, err, http.StatusInternalServerError, "cannot get ping policies") {
+		return
+	}
+	h.Write(w, r, policies)
+}
+
+// @Summary Set a Ping Policy
+// @Description creates or updates a policy setting the ping interval of the hosts within a logistics scope and having specific labels
+// @Description the most specific policy matching a host applies
+// @Tags Host
+// @Router /ping-policy [put]
+// @Param policy body types.PingPolicy true "the ping policy"
+// @Accepts json
+// @Produce plain
+// @Failure 400 {string} the policy is not valid
+// @Failure 500 {string} there was an error in the server, check the server logs
+// @Success 200 {string} OK
+func setPingPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	policy := new(PingPolicy)
+	err := json.NewDecoder(r.Body).Decode(policy)
+	if isErr(w, err, http.StatusBadRequest, "cannot unmarshal ping policy") {
+		return
+	}
+	if isErr(w, policy.Valid(), http.StatusBadRequest, "invalid ping policy") {
+		return
+	}
+	if before := pingPolicy(policy.Name); before != nil {
+		core.AuditBefore(r, before)
+	}
+	err = core.Api().SetPingPolicy(*policy)
+	if isErr(w, err, http.StatusInternalServerError, "cannot set ping policy") {
+		return
+	}
+}
+
+// @Summary Delete a Ping Policy
+// @Description deletes a ping policy, the hosts it applied to use the next matching policy or the default interval
+// @Tags Host
+// @Router /ping-policy/{name} [delete]
+// @Param name path string true "the name of the ping policy"
+// @Produce plain
+// @Failure 500 {string} there was an error in the server, check the server logs
+// @Success 200 {string} OK
+func deletePingPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if before := pingPolicy(name); before != nil {
+		core.AuditBefore(r, before)
+	}
+	err := core.Api().DeletePingPolicy(name)
+	if isErr(w, err, http.StatusInternalServerError, "cannot delete ping policy") {
 		return
 	}
-	h.Write(w, r, api)
 }
 
-// @Summary Retrieve the logged user principal
-// @Description Retrieve the logged user principal containing a list of access controls granted to the user
-// @Description use it primarily to log in user interface services and retrieve a list of access controls to inform which
-// @Description operations are available to the user via the user interface
-// @Tags Access Control
-// @Router /user [get]
+// pingPolicy returns the ping policy with the specified name or nil if it does not exist
+func pingPolicy(name string) *PingPolicy {
+	policies, err := core.Api().GetPingPolicies()
+	if err != nil {
+		return nil
+	}
+	for _, policy := range policies {
+		if policy.Name == name {
+			return &policy
+		}
+	}
+	return nil
+}
+
+// @Summary Set a Secret
+// @Description sets a value in the secret store, commands reference it as secret://path#key
+// @Tags Secret
+// @Router /secret [put]
+// @Param secret body types.SecretValue true "the path, key and value of the secret"
 // @Accepts json
 // @Produce plain
-// @Failure 401 {string} the request failed to authenticate the user
+// @Failure 400 {string} the secret is not valid
 // @Failure 500 {string} there was an error in the server, check the server logs
 // @Success 200 {string} OK
-func getUserHandler(w http.ResponseWriter, r *http.Request) {
-	// if we got this far is because the user is authenticated
-	// then return the access controls for the user
-	user := h.GetUserPrincipal(r)
-	if user != nil {
-		h.Write(w, r, user)
+func setSecretHandler(w http.ResponseWriter, r *http.Request) {
+	secret := new(SecretValue)
+	err := json.NewDecoder(r.Body).Decode(secret)
+	if isErr(w, err, http.StatusBadRequest, "cannot unmarshal secret") {
+		return
+	}
+	if isErr(w, secret.Valid(), http.StatusBadRequest, "invalid secret") {
+		return
+	}
+	err = core.Api().SetSecret(*secret)
+	if isErr(w, err, http.StatusInternalServerError, "cannot set secret") {
+		return
 	}
 }
 
-// @Summary Retrieve the service public PGP key
-// @Description Retrieve the service public PGP key used to verify the authenticity of the service by pilot agents
-// @Tags PGP
-// @Router /pub [get]
+// @Summary Delete a Secret
+// @Description removes a value from the secret store
+// @Tags Secret
+// @Router /secret [delete]
+// @Param secret body types.SecretRef true "the path and key of the secret"
 // @Accepts json
 // @Produce plain
+// @Failure 400 {string} the secret reference is not valid
 // @Failure 500 {string} there was an error in the server, check the server logs
 // @Success 200 {string} OK
-func getKeyHandler(w http.ResponseWriter, r *http.Request) {
-	// load the verification key
-	path, err := KeyFilePath("verify")
-	if err != nil {
-		log.Printf("cannot find public PGP key: %s\n", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+func deleteSecretHandler(w http.ResponseWriter, r *http.Request) {
+	ref := new(SecretRef)
+	err := json.NewDecoder(r.Body).Decode(ref)
+	if isErr(w, err, http.StatusBadRequest, "cannot unmarshal secret reference") {
 		return
 	}
-	key, err := os.ReadFile(path)
-	if err != nil {
-		log.Printf("cannot read public PGP key file: %s\n", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if isErr(w, ref.Valid(), http.StatusBadRequest, "invalid secret reference") {
+		return
+	}
+	err = core.Api().DeleteSecret(*ref)
+	if isErr(w, err, http.StatusInternalServerError, "cannot delete secret") {
 		return
 	}
-	w.Write([]byte(hex.EncodeToString(key)))
 }
 
 // @Summary Registers a Host so that it can be activated
 // @Description requests the activation service to reserve an activation for a host of the specified mac-address
+// @Description when pilotctl issues activations itself, the activation tokens the hosts must present to activate are returned
 // @Tags Activation
 // @Router /registration [post]
 // @Param command body []types.Registration true "the required registration information"
 // @Accepts json
-// @Produce plain
+// @Produce json
 // @Failure 500 {string} there was an error in the server, check the server logs
-// @Success 201 {string} OK
+// @Success 201 {array} types.Activation
 func registrationHandler(w http.ResponseWriter, r *http.Request) {
 	bytes, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -756,28 +1826,97 @@ func registrationHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	c := core.NewConf()
+	activations := make([]*Activation, 0)
 	for _, registration := range registrations {
-		client := &http.Client{
-			Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
-			Timeout:   60 * time.Second,
-		}
-		// call activation service and reserve the mac-address for this tenant
-		_, err = core.HttpRequest(client, fmt.Sprintf("%s/provision/%s/%s", c.GetActivationURI(), c.GetTenant(), registration.MacAddress), "POST", c.GetActivationUser(), c.GetActivationPwd(), 201)
+		activation, err := core.Api().ProvisionRegistration(registration)
 		if err != nil {
-			log.Printf("cannot provision mac-address %s with activation service: %s\n", registration.MacAddress, err)
-			http.Error(w, fmt.Sprintf("cannot provision mac-address %s with activation service, check the server logs for more information\n", registration.MacAddress), http.StatusInternalServerError)
+			log.Printf("%s\n", err)
+			http.Error(w, fmt.Sprintf("cannot register mac-address %s, check the server logs for more information\n", registration.MacAddress), http.StatusInternalServerError)
 			return
 		}
-		// as the provisioning of the mac-address has been successful records the host in pilot-ctl db
-		err = core.Api().SetRegistration(registration)
-		if err != nil {
-			log.Printf("cannot record registration information in database: %s\n", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if activation != nil {
+			activations = append(activations, activation)
+		}
+	}
+	if len(activations) == 0 {
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	writeStatus(w, http.StatusCreated, activations)
+}
+
+// @Summary Get Host Registrations
+// @Description gets host registrations with their status (provisioned, activated, admitted or expired) and timestamps
+// @Description registrations of hosts that do not activate within the expiry period are undone and reported as expired
+// @Tags Activation
+// @Router /registration [get]
+// @Param status query string false "the status of the registrations to retrieve (i.e. provisioned, activated, admitted or expired)"
+// @Produce application/json, application/yaml, application/xml
+// @Failure 400 {string} the status is not valid
+// @Failure 500 {string} there was an error in the server, check the server logs
+// @Success 200 {array} types.RegistrationInfo
+func getRegistrationsHandler(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if len(status) > 0 {
+		if _, err := ParseRegistrationStatus(status); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 	}
-	w.WriteHeader(http.StatusCreated)
+	registrations, err := core.Api().GetRegistrations(status)
+	if err != nil {
+		log.Printf("cannot retrieve registrations: %s\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.Write(w, r, registrations)
+}
+
+// @Summary Imports Host Registrations
+// @Description uploads a CSV or XLSX file with one host registration per row and the columns mac-address, org-group, org, area, location and labels (separated by pipes)
+// @Description the first row is treated as a header; every row is validated and, unless it is a dry-run, valid rows are provisioned with the activation service
+// @Tags Activation
+// @Router /registration/import [post]
+// @Param dry-run query bool false "a flag indicating whether rows should only be validated without provisioning them (defaults to true)"
+// @Param reg-file formData file true "the CSV or XLSX file containing the registrations"
+// @Accept multipart/form-data
+// @Produce application/json, application/yaml, application/xml
+// @Failure 400 {string} the uploaded file is in incorrect format
+// @Failure 500 {string} there was an error in the server, check the server logs
+// @Success 200 {array} types.RegistrationImportResult
+func importRegistrationsHandler(w http.ResponseWriter, r *http.Request) {
+	// just in case dry-run by default
+	dryRun := true
+	dry := r.FormValue("dry-run")
+	if len(dry) > 0 {
+		dryRun, _ = strconv.ParseBool(dry)
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 250<<20)
+	err := r.ParseMultipartForm(150 << 20)
+	if err != nil {
+		log.Printf("error parsing registrations file: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	regFile, header, err := r.FormFile("reg-file")
+	if err != nil {
+		log.Printf("error retrieving registrations file: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filePath, err := core.SaveUpload(regFile, header.Filename)
+	if err != nil {
+		log.Printf("error saving registrations file: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	results, err := core.ImportRegistrations(filePath, core.Api(), dryRun)
+	if err != nil {
+		log.Printf("error importing registrations file: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.Write(w, r, results)
 }
 
 // @Summary Undo a Host Registration
@@ -849,6 +1988,9 @@ func setDictionaryHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if before, dictErr := core.Api().GetDictionary(dict.Key); dictErr == nil {
+		core.AuditBefore(r, before)
+	}
 	result, err := core.Api().SetDictionary(*dict)
 	if err != nil {
 		log.Printf("can't put dictionary with key '%s': %v\n", dict.Key, err)
@@ -869,6 +2011,9 @@ func setDictionaryHandler(w http.ResponseWriter, r *http.Request) {
 func deleteDictionaryHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	key := vars["key"]
+	if before, dictErr := core.Api().GetDictionary(key); dictErr == nil {
+		core.AuditBefore(r, before)
+	}
 	result, err := core.Api().DeleteDictionary(key)
 	if err != nil {
 		log.Printf("can't delete dictionary with key '%s': %v\n", key, err)
@@ -923,13 +2068,39 @@ func activationHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// activateHandler activates a registered host using the local activation provider
+// used by host pilot agents when pilotctl issues activations itself instead of the activation service
+// not in swagger as it is authenticated by the activation token issued when the host was registered
+func activateHandler(w http.ResponseWriter, r *http.Request) {
+	bytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("cannot read payload: %s\n", err)
+		http.Error(w, err.Error(), core.BodyReadStatus(err))
+		return
+	}
+	var req ActivationRequest
+	err = json.Unmarshal(bytes, &req)
+	if err != nil {
+		log.Printf("cannot unmarshal payload: %s\n", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	activation, err := core.Api().ActivateHost(req)
+	if err != nil {
+		log.Printf("cannot activate host: %s\n", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	writeStatus(w, http.StatusCreated, activation)
+}
+
 func metricsHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	channel := vars["channel"]
 	content, err := io.ReadAll(r.Body)
 	if err != nil {
 		log.Println(err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, err.Error(), core.BodyReadStatus(err))
 		return
 	}
 	result := core.Api().SubmitMetrics(channel, content)
@@ -942,13 +2113,373 @@ func logsHandler(w http.ResponseWriter, r *http.Request) {
 	content, err := io.ReadAll(r.Body)
 	if err != nil {
 		log.Println(err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, err.Error(), core.BodyReadStatus(err))
 		return
 	}
 	result := core.Api().SubmitLogs(channel, content)
 	h.Write(w, r, result)
 }
 
+// @Summary Get Role Bindings
+// @Description Returns the roles granted to users and the logistics scope (org-group, org, area) they apply to
+// @Tags Role
+// @Router /role [get]
+// @Param user query string false "the name of the user whose role bindings should be retrieved"
+// @Produce json
+// @Failure 500 {string} there was an error in the server, check the server logs
+// @Success 200 {string} OK
+func getRoleBindingsHandler(w http.ResponseWriter, r *http.Request) {
+	bindings, err := core.Api().GetRoleBindings(r.FormValue("user"))
+	if err != nil {
+		log.Printf("cannot get role bindings: %s\n", err)
+		http.Error(w, "cannot get role bindings, check the server logs\n", http.StatusInternalServerError)
+		return
+	}
+	h.Write(w, r, bindings)
+}
+
+// @Summary Grant a Role
+// @Description grants a role (viewer, operator, approver or admin) to a user within a logistics scope
+// @Description an empty org-group, org or area extends the scope to all values of that level
+// @Tags Role
+// @Router /role [put]
+// @Param binding body types.RoleBinding true "the role binding"
+// @Accepts json
+// @Produce plain
+// @Failure 400 {string} the role binding is not valid
+// @Success 200 {string} OK
+func setRoleBindingHandler(w http.ResponseWriter, r *http.Request) {
+	binding, ok := readRoleBinding(w, r)
+	if !ok {
+		return
+	}
+	if !canManageRoleBinding(w, r, binding) {
+		return
+	}
+	auditRoleBindings(r, binding.Username)
+	if err := core.Api().SetRoleBinding(*binding); err != nil {
+		log.Printf("cannot set role binding: %s\n", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
+
+// @Summary Revoke a Role
+// @Description revokes a role granted to a user within a logistics scope
+// @Tags Role
+// @Router /role [delete]
+// @Param binding body types.RoleBinding true "the role binding"
+// @Accepts json
+// @Produce plain
+// @Failure 500 {string} there was an error in the server, check the server logs
+// @Success 200 {string} OK
+func deleteRoleBindingHandler(w http.ResponseWriter, r *http.Request) {
+	binding, ok := readRoleBinding(w, r)
+	if !ok {
+		return
+	}
+	if !canManageRoleBinding(w, r, binding) {
+		return
+	}
+	auditRoleBindings(r, binding.Username)
+	if err := core.Api().DeleteRoleBinding(*binding); err != nil {
+		log.Printf("cannot delete role binding: %s\n", err)
+		http.Error(w, "cannot delete role binding, check the server logs\n", http.StatusInternalServerError)
+		return
+	}
+}
+
+// canManageRoleBinding checks that the scope of the binding is within the scope where the user is an administrator
+// so that administrators of a scope cannot grant or revoke roles beyond it
+func canManageRoleBinding(w http.ResponseWriter, r *http.Request, binding *RoleBinding) bool {
+	access, ok := userAccess(w, r)
+	if !ok {
+		return false
+	}
+	if !access.CanAt(PermAdmin, binding.OrgGroup, binding.Org, binding.Area) {
+		http.Error(w, fmt.Sprintf("%s: '%s' permission required in the scope of the role binding\n", core.ErrForbidden, PermAdmin), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func readRoleBinding(w http.ResponseWriter, r *http.Request) (*RoleBinding, bool) {
+	bytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	binding := new(RoleBinding)
+	if err = json.Unmarshal(bytes, binding); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return binding, true
+}
+
+// @Summary Create an API Token
+// @Description creates a long-lived token for automation clients such as CI pipelines or ITSM integrations
+// @Description the token is sent as a bearer token in the authorization header and is scoped by its role binding
+// @Description whose role cannot exceed the role of the user creating it; only administrators can create tokens for
+// @Description service accounts other than themselves and the token value is only returned once
+// @Tags Token
+// @Router /token [post]
+// @Param token body types.ApiTokenRequest true "the information required to create the token"
+// @Accepts json
+// @Produce json
+// @Failure 400 {string} the token request is not valid
+// @Failure 403 {string} the token would grant more access than the user has
+// @Success 201 {object} types.ApiTokenResponse
+func createApiTokenHandler(w http.ResponseWriter, r *http.Request) {
+	bytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req ApiTokenRequest
+	if err = json.Unmarshal(bytes, &req); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	access, ok := userAccess(w, r)
+	if !ok {
+		return
+	}
+	token, err := core.Api().CreateApiToken(h.GetUserPrincipal(r), access, req)
+	if err != nil {
+		log.Printf("cannot create api token: %s\n", err)
+		status := http.StatusBadRequest
+		if errors.Is(err, core.ErrForbidden) {
+			status = http.StatusForbidden
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	writeStatus(w, http.StatusCreated, token)
+}
+
+// @Summary Get API Tokens
+// @Description Returns the API tokens created by a user, excluding their values
+// @Description administrators can retrieve the tokens of any user or of all users if no owner is specified
+// @Tags Token
+// @Router /token [get]
+// @Param owner query string false "the user who created the tokens"
+// @Produce json
+// @Failure 403 {string} the user cannot see the tokens of other users
+// @Failure 500 {string} there was an error in the server, check the server logs
+// @Success 200 {string} OK
+func getApiTokensHandler(w http.ResponseWriter, r *http.Request) {
+	access, ok := userAccess(w, r)
+	if !ok {
+		return
+	}
+	owner, user := r.FormValue("owner"), core.PrincipalOwner(h.GetUserPrincipal(r))
+	if !access.Can(PermAdmin) {
+		if len(owner) > 0 && owner != user {
+			http.Error(w, "cannot retrieve the api tokens of other users\n", http.StatusForbidden)
+			return
+		}
+		owner = user
+	}
+	tokens, err := core.Api().GetApiTokens(owner)
+	if err != nil {
+		log.Printf("cannot get api tokens: %s\n", err)
+		http.Error(w, "cannot get api tokens, check the server logs\n", http.StatusInternalServerError)
+		return
+	}
+	h.Write(w, r, tokens)
+}
+
+// @Summary Revoke an API Token
+// @Description revokes an API token, only its owner or an administrator can revoke it
+// @Tags Token
+// @Router /token/{id} [delete]
+// @Param id path string true "the identifier of the token"
+// @Produce plain
+// @Failure 403 {string} the user cannot revoke the token
+// @Failure 500 {string} there was an error in the server, check the server logs
+// @Success 200 {string} OK
+func revokeApiTokenHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	access, ok := userAccess(w, r)
+	if !ok {
+		return
+	}
+	err := core.Api().RevokeApiToken(vars["id"], core.PrincipalOwner(h.GetUserPrincipal(r)), access)
+	if err != nil {
+		log.Printf("cannot revoke api token: %s\n", err)
+		status := http.StatusInternalServerError
+		if errors.Is(err, core.ErrForbidden) {
+			status = http.StatusForbidden
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+}
+
+// @Summary Get the Audit Log
+// @Description Returns the administrative actions recorded in the audit log, in the order they were performed
+// @Description each action has a pending entry with status 0 recorded before it is performed, followed by an entry with its outcome
+// @Tags Audit
+// @Router /audit [get]
+// @Param user query string false "the user who performed the actions"
+// @Param action query string false "the action route, e.g. DELETE /host/{host-uuid}"
+// @Param target query string false "the target of the actions, e.g. host-uuid=..."
+// @Param from query string false "the RFC3339 time from which to retrieve actions"
+// @Param to query string false "the RFC3339 time up to which to retrieve actions"
+// @Param format query string false "json (default) or csv to export the entries"
+// @Produce json,plain
+// @Failure 400 {string} the filter is not valid
+// @Failure 500 {string} there was an error in the server, check the server logs
+// @Success 200 {array} types.AuditEntry
+func getAuditHandler(w http.ResponseWriter, r *http.Request) {
+	filter := AuditFilter{
+		Username: r.FormValue("user"),
+		Action:   r.FormValue("action"),
+		Target:   r.FormValue("target"),
+	}
+	var err error
+	if filter.From, err = timeParam(r, "from"); isErr(w, err, http.StatusBadRequest, "invalid 'from' time") {
+		return
+	}
+	if filter.To, err = timeParam(r, "to"); isErr(w, err, http.StatusBadRequest, "invalid 'to' time") {
+		return
+	}
+	entries, err := core.Api().GetAuditLog(filter)
+	if isErr(w, err, http.StatusInternalServerError, "cannot retrieve audit log") {
+		return
+	}
+	if strings.EqualFold(r.FormValue("format"), "csv") {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", "attachment; filename=audit.csv")
+		w.Write([]byte(AuditCSV(entries)))
+		return
+	}
+	h.Write(w, r, entries)
+}
+
+// @Summary Verify the Audit Log
+// @Description checks the hash chain of the audit log to detect entries that have been changed, removed or reordered
+// @Tags Audit
+// @Router /audit/verify [get]
+// @Produce json
+// @Failure 500 {string} there was an error in the server, check the server logs
+// @Success 200 {object} types.AuditVerification
+func verifyAuditHandler(w http.ResponseWriter, r *http.Request) {
+	result, err := core.Api().VerifyAuditLog()
+	if isErr(w, err, http.StatusInternalServerError, "cannot verify audit log") {
+		return
+	}
+	h.Write(w, r, result)
+}
+
+// timeParam returns the value of an optional RFC3339 time query parameter
+func timeParam(r *http.Request, name string) (*time.Time, error) {
+	value := r.FormValue(name)
+	if len(value) == 0 {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// waitParam returns the period in seconds a ping can be held waiting for a job, zero if the ping must not be held
+func waitParam(r *http.Request) (time.Duration, error) {
+	value := r.URL.Query().Get("wait")
+	if len(value) == 0 {
+		return 0, nil
+	}
+	secs, err := strconv.Atoi(value)
+	if err != nil || secs < 0 {
+		return 0, fmt.Errorf("'%s' is not a number of seconds", value)
+	}
+	return time.Duration(secs) * time.Second, nil
+}
+
+// username returns the name of the authenticated user making the request
+func username(r *http.Request) string {
+	if user := h.GetUserPrincipal(r); user != nil {
+		return user.Username
+	}
+	return ""
+}
+
+// auditHostLifecycle records the lifecycle state of a host in the audit log before it is changed
+func auditHostLifecycle(r *http.Request, hostUUID string) {
+	if lifecycle, err := core.Api().GetHostLifecycle(hostUUID); err == nil {
+		core.AuditBefore(r, lifecycle)
+	}
+}
+
+// auditHosts records the placement of the hosts that can be found in the audit log before they are changed
+func auditHosts(r *http.Request, hostUUIDs []string) {
+	hosts := make(map[string]*Host)
+	for _, hostUUID := range hostUUIDs {
+		if host, err := core.Api().GetHost(hostUUID); err == nil {
+			hosts[hostUUID] = host
+		}
+	}
+	core.AuditBefore(r, hosts)
+}
+
+// auditPendingAdmissions records the pending admissions of the hosts in the audit log before they are approved or rejected
+func auditPendingAdmissions(r *http.Request, hostUUIDs []string) {
+	pending, err := core.Api().GetPendingAdmissions()
+	if err != nil {
+		return
+	}
+	hosts := make(map[string]bool, len(hostUUIDs))
+	for _, hostUUID := range hostUUIDs {
+		hosts[hostUUID] = true
+	}
+	before := make([]PendingAdmission, 0)
+	for _, p := range pending {
+		if hosts[p.HostUUID] {
+			before = append(before, p)
+		}
+	}
+	core.AuditBefore(r, before)
+}
+
+// auditRoleBindings records the role bindings of a user in the audit log before they are changed
+func auditRoleBindings(r *http.Request, username string) {
+	if bindings, err := core.Api().GetRoleBindings(username); err == nil {
+		core.AuditBefore(r, bindings)
+	}
+}
+
+// userAccess resolves the role bindings of the user making the request, writing an error response if they cannot be
+// retrieved; a nil access means role based access control is disabled
+func userAccess(w http.ResponseWriter, r *http.Request) (*Access, bool) {
+	access, err := core.Api().UserAccess(h.GetUserPrincipal(r))
+	if err != nil {
+		log.Printf("cannot retrieve user access: %s\n", err)
+		http.Error(w, "cannot retrieve user access, check the server logs\n", http.StatusInternalServerError)
+		return nil, false
+	}
+	return access, true
+}
+
+// writeStatus writes the passed-in object as json with a status code other than 200 OK, which h.Write always sets
+func writeStatus(w http.ResponseWriter, statusCode int, o interface{}) {
+	bytes, err := json.Marshal(o)
+	if err != nil {
+		log.Printf("cannot marshal response: %s\n", err)
+		http.Error(w, "cannot marshal response, check the server logs\n", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(bytes)
+}
+
 func isErr(w http.ResponseWriter, err error, statusCode int, msg string) bool {
 	if err != nil {
 		msg = fmt.Sprintf("%s: %s\n", msg, err)
@@ -19,24 +19,42 @@
 package main
 
 import (
+	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
+	"log"
 	"net/http"
+	"os"
 	h "southwinds.dev/http"
 	"southwinds.dev/pilotctl/core"
+	. "southwinds.dev/pilotctl/types"
 )
 
 func main() {
 	godotenv.Load(".env")
+	// provisions the software token holding the ping response signing key, e.g. pilotctl provision-token ecdsa-p256
+	if len(os.Args) > 1 && os.Args[1] == "provision-token" {
+		provisionToken(os.Args[2:])
+		return
+	}
 	// creates a generic http server
 	s := h.New("pilotctl", core.Version)
+	// rate and payload limits of the endpoints accessed by host pilots, shared by the pilot listeners
+	limits := core.NewPilotLimits(core.NewConf())
 	// add handlers
 	s.Http = func(router *mux.Router) {
 		// enable encoded path  vars
 		router.UseEncodedPath()
 		// middleware
 		router.Use(s.LoggingMiddleware)
+		// rejects excessive pilot requests before any work is done on them
+		router.Use(limits.IPMiddleware)
+		// buffers the body of signed pilot requests so that signatures can be verified before the handler reads the body
+		router.Use(limits.SignedBodyMiddleware)
 		router.Use(s.AuthenticationMiddleware)
+		router.Use(limits.HostMiddleware)
+		// records the mutating requests of admin users in the audit log
+		router.Use(core.AuditMiddleware)
 		router.Use(mux.CORSMethodMiddleware(router))
 
 		// we have to process cfg here and not pass it to
@@ -48,55 +66,119 @@ func main() {
 		router.Use(s.CorsMiddleware(origin, headers))
 
 		// pilot http handlers
-		router.HandleFunc("/ping", pingHandler).Methods(http.MethodPost)
-		router.HandleFunc("/register", registerHandler).Methods(http.MethodPost)
-		router.HandleFunc("/cve/upload", cveReportExportHandler).Methods(http.MethodPost)
-		router.HandleFunc("/metrics/{channel}", metricsHandler).Methods(http.MethodPost)
-		router.HandleFunc("/logs/{channel}", logsHandler).Methods(http.MethodPost)
+		pilotRoutes(router)
 
 		// apply authorisation to admin user http handlers
-		router.Handle("/info/sync", s.Authorise(syncInfoHandler)).Methods(http.MethodPost)
+		router.Handle("/info/sync", s.Authorise(requiresGlobal(PermAdmin, syncInfoHandler))).Methods(http.MethodPost)
 		router.Handle("/host", s.Authorise(hostQueryHandler)).Methods(http.MethodGet)
-		router.Handle("/host/{host-uuid}", s.Authorise(hostDecommissionHandler)).Methods(http.MethodDelete)
-		router.Handle("/cmd", s.Authorise(updateCmdHandler)).Methods("PUT")
-		router.Handle("/cmd", s.Authorise(getAllCmdHandler)).Methods(http.MethodGet)
-		router.Handle("/cmd/{name}", s.Authorise(getCmdHandler)).Methods(http.MethodGet)
-		router.Handle("/cmd/{name}", s.Authorise(deleteCmdHandler)).Methods(http.MethodDelete)
+		router.Handle("/host/{host-uuid}", s.Authorise(requiresOnHost(PermApprove, hostDecommissionHandler))).Methods(http.MethodDelete)
+		router.Handle("/host/{host-uuid}/state", s.Authorise(requiresOnHost(PermView, getHostStateHandler))).Methods(http.MethodGet)
+		router.Handle("/host/{host-uuid}/state", s.Authorise(requiresOnHost(PermApprove, setHostStateHandler))).Methods(http.MethodPut)
+		router.Handle("/host/{host-uuid}/quarantine", s.Authorise(requiresOnHost(PermApprove, quarantineHostHandler))).Methods(http.MethodPut)
+		router.Handle("/host/{host-uuid}/quarantine", s.Authorise(requiresOnHost(PermApprove, releaseHostHandler))).Methods(http.MethodDelete)
+		router.Handle("/host/{host-uuid}/restore", s.Authorise(requiresOnHost(PermApprove, hostRestoreHandler))).Methods(http.MethodPost)
+		router.Handle("/host/logistics", s.Authorise(requires(PermApprove, relocateHostsHandler))).Methods(http.MethodPatch)
+		router.Handle("/host/{host-uuid}/logistics", s.Authorise(requires(PermApprove, relocateHostHandler))).Methods(http.MethodPatch)
+		router.Handle("/host/{host-uuid}/logistics", s.Authorise(requiresOnHost(PermView, getHostPlacementsHandler))).Methods(http.MethodGet)
+		router.Handle("/host/{host-uuid}/credential", s.Authorise(requiresOnHost(PermAdmin, getHostCredentialHandler))).Methods(http.MethodGet)
+		router.Handle("/host/{host-uuid}/credential", s.Authorise(requiresOnHost(PermApprove, rotateHostCredentialHandler))).Methods(http.MethodPost)
+		router.Handle("/host/{host-uuid}/credential", s.Authorise(requiresOnHost(PermApprove, revokeHostCredentialHandler))).Methods(http.MethodDelete)
+		router.Handle("/host/{host-uuid}/certificate", s.Authorise(requiresOnHost(PermView, getHostCertificatesHandler))).Methods(http.MethodGet)
+		router.Handle("/host/{host-uuid}/certificate", s.Authorise(requiresOnHost(PermApprove, revokeHostCertificatesHandler))).Methods(http.MethodDelete)
+		router.Handle("/cmd", s.Authorise(requiresGlobal(PermAdmin, updateCmdHandler))).Methods("PUT")
+		router.Handle("/cmd", s.Authorise(requires(PermView, getAllCmdHandler))).Methods(http.MethodGet)
+		router.Handle("/cmd/{name}", s.Authorise(requires(PermView, getCmdHandler))).Methods(http.MethodGet)
+		router.Handle("/cmd/{name}", s.Authorise(requiresGlobal(PermAdmin, deleteCmdHandler))).Methods(http.MethodDelete)
+		router.Handle("/secret", s.Authorise(requiresGlobal(PermAdmin, setSecretHandler))).Methods(http.MethodPut)
+		router.Handle("/secret", s.Authorise(requiresGlobal(PermAdmin, deleteSecretHandler))).Methods(http.MethodDelete)
+		router.Handle("/ping-policy", s.Authorise(requires(PermView, getPingPoliciesHandler))).Methods(http.MethodGet)
+		router.Handle("/ping-policy", s.Authorise(requiresGlobal(PermAdmin, setPingPolicyHandler))).Methods(http.MethodPut)
+		router.Handle("/ping-policy/{name}", s.Authorise(requiresGlobal(PermAdmin, deletePingPolicyHandler))).Methods(http.MethodDelete)
 		router.Handle("/org-group", s.Authorise(getOrgGroupsHandler)).Methods(http.MethodGet)
 		router.Handle("/org-group/{org-group}/area", s.Authorise(getAreasHandler)).Methods(http.MethodGet)
 		router.Handle("/org-group/{org-group}/org", s.Authorise(getOrgHandler)).Methods(http.MethodGet)
 		router.Handle("/area/{area}/location", s.Authorise(getLocationsHandler)).Methods(http.MethodGet)
-		router.Handle("/admission", s.Authorise(setAdmissionHandler)).Methods(http.MethodPut)
+		router.Handle("/admission", s.Authorise(requires(PermApprove, setAdmissionHandler))).Methods(http.MethodPut)
+		router.Handle("/admission/pending", s.Authorise(requires(PermView, getPendingAdmissionsHandler))).Methods(http.MethodGet)
+		router.Handle("/admission/pending/approve", s.Authorise(requires(PermApprove, approvePendingAdmissionsHandler))).Methods(http.MethodPost)
+		router.Handle("/admission/pending/reject", s.Authorise(requires(PermApprove, rejectPendingAdmissionsHandler))).Methods(http.MethodPost)
+		router.Handle("/admission/rule", s.Authorise(requires(PermView, getAdmissionRulesHandler))).Methods(http.MethodGet)
+		router.Handle("/admission/rule", s.Authorise(requires(PermApprove, setAdmissionRuleHandler))).Methods(http.MethodPut)
+		router.Handle("/admission/rule/{key}", s.Authorise(requires(PermApprove, deleteAdmissionRuleHandler))).Methods(http.MethodDelete)
+		router.Handle("/bootstrap-token", s.Authorise(requires(PermApprove, getBootstrapTokensHandler))).Methods(http.MethodGet)
+		router.Handle("/bootstrap-token", s.Authorise(requires(PermApprove, createBootstrapTokenHandler))).Methods(http.MethodPost)
+		router.Handle("/bootstrap-token/{id}", s.Authorise(requires(PermApprove, deleteBootstrapTokenHandler))).Methods(http.MethodDelete)
 		router.Handle("/package", s.Authorise(getPackagesHandler)).Methods(http.MethodGet, http.MethodOptions)
 		router.Handle("/package/{name}/api", s.Authorise(getPackagesApiHandler)).Methods(http.MethodGet)
 		router.Handle("/job", s.Authorise(newJobHandler)).Methods(http.MethodPost)
 		router.Handle("/job", s.Authorise(getJobsHandler)).Methods(http.MethodGet)
 		router.Handle("/job/batch", s.Authorise(getJobBatchHandler)).Methods(http.MethodGet)
+		router.Handle("/job/batch/{id}/cancel", s.Authorise(requires(PermRun, cancelJobBatchHandler))).Methods(http.MethodPost)
+		router.Handle("/job/batch/{id}/rerun", s.Authorise(requires(PermRun, rerunJobBatchHandler))).Methods(http.MethodPost)
 		router.Handle("/user", s.Authorise(getUserHandler)).Methods(http.MethodGet)
 		router.Handle("/dictionary/{key}", s.Authorise(getDictionaryHandler)).Methods(http.MethodGet)
-		router.Handle("/dictionary", s.Authorise(setDictionaryHandler)).Methods(http.MethodPut)
-		router.Handle("/dictionary/{key}", s.Authorise(deleteDictionaryHandler)).Methods(http.MethodDelete)
+		router.Handle("/dictionary", s.Authorise(requiresGlobal(PermAdmin, setDictionaryHandler))).Methods(http.MethodPut)
+		router.Handle("/dictionary/{key}", s.Authorise(requiresGlobal(PermAdmin, deleteDictionaryHandler))).Methods(http.MethodDelete)
 		router.Handle("/dictionary", s.Authorise(getDictionaryListHandler)).Methods(http.MethodGet)
+		router.Handle("/role", s.Authorise(requires(PermAdmin, getRoleBindingsHandler))).Methods(http.MethodGet)
+		router.Handle("/role", s.Authorise(requires(PermAdmin, setRoleBindingHandler))).Methods(http.MethodPut)
+		router.Handle("/role", s.Authorise(requires(PermAdmin, deleteRoleBindingHandler))).Methods(http.MethodDelete)
+		router.Handle("/token", s.Authorise(requires(PermView, createApiTokenHandler))).Methods(http.MethodPost)
+		router.Handle("/token", s.Authorise(requires(PermView, getApiTokensHandler))).Methods(http.MethodGet)
+		router.Handle("/token/{id}", s.Authorise(requires(PermView, revokeApiTokenHandler))).Methods(http.MethodDelete)
+		router.Handle("/audit", s.Authorise(requiresGlobal(PermAdmin, getAuditHandler))).Methods(http.MethodGet)
+		router.Handle("/audit/verify", s.Authorise(requiresGlobal(PermAdmin, verifyAuditHandler))).Methods(http.MethodGet)
+		router.Handle("/signing-key", s.Authorise(requiresGlobal(PermAdmin, getSigningKeysHandler))).Methods(http.MethodGet)
+		router.Handle("/signing-key", s.Authorise(requiresGlobal(PermAdmin, generateSigningKeyHandler))).Methods(http.MethodPost)
+		router.Handle("/signing-key/{key-id}/activate", s.Authorise(requiresGlobal(PermAdmin, activateSigningKeyHandler))).Methods(http.MethodPost)
+		router.Handle("/signing-key/{key-id}/retire", s.Authorise(requiresGlobal(PermAdmin, retireSigningKeyHandler))).Methods(http.MethodPost)
 		router.Handle("/cve/baseline", s.Authorise(getCVEBaselineHandler)).Methods(http.MethodGet)
 
 		router.HandleFunc("/pub", getKeyHandler).Methods(http.MethodGet)
 
 		router.HandleFunc("/activation/{macAddress}/{uuid}", activationHandler).Methods(http.MethodPost)
+		router.HandleFunc("/activate", activateHandler).Methods(http.MethodPost)
 		router.HandleFunc("/registration", registrationHandler).Methods("POST")
+		router.Handle("/registration", s.Authorise(requires(PermApprove, getRegistrationsHandler))).Methods(http.MethodGet)
+		router.Handle("/registration/import", s.Authorise(requires(PermApprove, importRegistrationsHandler))).Methods(http.MethodPost)
 		router.HandleFunc("/registration/{mac-address}", undoRegistrationHandler).Methods(http.MethodDelete)
 	}
 	// set up specific authentication for host pilot agents
 	s.Auth = map[string]func(http.Request) (*h.UserPrincipal, error){
-		"^/register":         pilotAuth,
-		"^/ping":             pilotAuth,
-		"^/cve/upload":       pilotAuth,
-		"^/metrics/*":        pilotAuth,
-		"^/logs/*":           pilotAuth,
-		"^/activation/.*/.*": activationSvc,
-		"^/pub":              nil,
-		"^/$":                nil,
+		"^/register":          registerAuth,
+		"^/ping":              pilotAuth,
+		"^/cve/upload":        pilotAuth,
+		"^/metrics/*":         pilotAuth,
+		"^/logs/*":            pilotAuth,
+		"^/credential$":       credentialAuth,
+		"^/certificate/enrol": enrolAuth,
+		"^/certificate/renew": pilotAuth,
+		"^/ca$":               nil,
+		"^/ca/crl$":           nil,
+		"^/activation/.*/.*":  activationSvc,
+		"^/activate$":         nil,
+		"^/pub":               nil,
+		"^/$":                 nil,
 	}
 	s.DefaultAuth = defaultAuth
+	// background jobs such as purging the data of retired hosts
+	s.Jobs = func() error {
+		// in mtls mode, pilot endpoints are also served on a listener requesting client certificates
+		if core.NewConf().PilotAuthMode() == "mtls" {
+			router := mux.NewRouter()
+			router.UseEncodedPath()
+			router.Use(s.LoggingMiddleware)
+			router.Use(limits.IPMiddleware)
+			router.Use(limits.SignedBodyMiddleware)
+			router.Use(s.AuthenticationMiddleware)
+			router.Use(limits.HostMiddleware)
+			pilotRoutes(router)
+			go func() {
+				log.Fatalf("ERROR: pilot mTLS listener failed: %s", core.ServePilotTLS(router))
+			}()
+		}
+		return core.Jobs()
+	}
 	// s.Jobs = func() error {
 	// 	enableTelemetry := os.Getenv("PILOTCTL_ENABLE_TELEMETRY")
 	// 	if len(enableTelemetry) > 0 {
@@ -109,11 +191,93 @@ func main() {
 	s.Serve()
 }
 
+// pilotRoutes adds the http handlers accessed by host pilot agents
+func pilotRoutes(router *mux.Router) {
+	router.HandleFunc("/ping", pingHandler).Methods(http.MethodPost)
+	router.HandleFunc("/register", registerHandler).Methods(http.MethodPost)
+	router.HandleFunc("/cve/upload", cveReportExportHandler).Methods(http.MethodPost)
+	router.HandleFunc("/metrics/{channel}", metricsHandler).Methods(http.MethodPost)
+	router.HandleFunc("/logs/{channel}", logsHandler).Methods(http.MethodPost)
+	router.HandleFunc("/credential", collectCredentialHandler).Methods(http.MethodGet)
+	router.HandleFunc("/certificate/enrol", enrolCertificateHandler).Methods(http.MethodPost)
+	router.HandleFunc("/certificate/renew", renewCertificateHandler).Methods(http.MethodPost)
+	router.HandleFunc("/ca", getCAHandler).Methods(http.MethodGet)
+	router.HandleFunc("/ca/crl", getCRLHandler).Methods(http.MethodGet)
+}
+
 // the overridden authentication mechanism used by the authentication middleware for specific routes
 // specified in server.Auth map
 var pilotAuth = func(r http.Request) (*h.UserPrincipal, error) {
-	token := r.Header.Get("Authorization")
-	return core.Api().AuthenticatePilot(token)
+	return core.Api().AuthenticatePilotRequest(r)
+}
+
+// authenticates pilot registration requests from hosts that might not have been admitted yet
+var registerAuth = func(r http.Request) (*h.UserPrincipal, error) {
+	return core.Api().AuthenticateRegisteringPilotRequest(r)
+}
+
+// authenticates admitted pilots collecting their credential with a signed request or a bootstrap token
+var credentialAuth = func(r http.Request) (*h.UserPrincipal, error) {
+	return core.Api().AuthenticateCredentialCollection(r)
+}
+
+// authenticates admitted pilots requesting their first client certificate with a token or signed request
+var enrolAuth = func(r http.Request) (*h.UserPrincipal, error) {
+	return core.Api().AuthenticatePilotEnrolment(r)
+}
+
+// pilotHost returns the identity of the host pilot that authenticated the request
+func pilotHost(r *http.Request) HostIdentity {
+	host, _ := core.PilotIdentity(h.GetUserPrincipal(r))
+	return host
+}
+
+// requires wraps an admin user handler so that it can only be accessed by users granted the permission
+// within at least one logistics scope; handlers acting on lists of hosts apply the scope themselves
+func requires(perm Permission, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		access, ok := userAccess(w, r)
+		if !ok {
+			return
+		}
+		if !access.Can(perm) {
+			http.Error(w, fmt.Sprintf("%s: '%s' permission required\n", core.ErrForbidden, perm), http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requiresGlobal wraps an admin user handler acting on resources that are not tied to hosts so that it can only be
+// accessed by users granted the permission without a logistics scope
+func requiresGlobal(perm Permission, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		access, ok := userAccess(w, r)
+		if !ok {
+			return
+		}
+		if !access.CanGlobally(perm) {
+			http.Error(w, fmt.Sprintf("%s: '%s' permission required in all logistics scopes\n", core.ErrForbidden, perm), http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requiresOnHost wraps an admin user handler acting on the host in the route so that it can only be accessed by users
+// granted the permission within the logistics scope of the host
+func requiresOnHost(perm Permission, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		access, ok := userAccess(w, r)
+		if !ok {
+			return
+		}
+		if err := core.Api().CheckHostAccess(access, perm, mux.Vars(r)["host-uuid"]); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
 }
 
 // the default authentication mechanism user by the authentication middleware
@@ -125,3 +289,17 @@ var defaultAuth = func(r http.Request) (*h.UserPrincipal, error) {
 var activationSvc = func(r http.Request) (*h.UserPrincipal, error) {
 	return core.Api().AuthenticateActivationSvc(r)
 }
+
+// provisionToken creates the software token configured by PILOT_CTL_TOKEN_PATH and PILOT_CTL_TOKEN_PIN and generates
+// its signing key, labelled by PILOT_CTL_TOKEN_KEY_LABEL, printing the public key to distribute to the pilots
+func provisionToken(args []string) {
+	keyType := "ecdsa-p256"
+	if len(args) > 0 {
+		keyType = args[0]
+	}
+	publicKey, err := core.ProvisionSoftToken(core.NewConf(), keyType)
+	if err != nil {
+		log.Fatalf("cannot provision token: %s\n", err)
+	}
+	fmt.Print(string(publicKey))
+}
@@ -0,0 +1,44 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package types
+
+import "time"
+
+// ActivationRequest sent by a host pilot agent to activate with the local activation provider
+type ActivationRequest struct {
+	MacAddress string `json:"mac_address"`
+	HostUUID   string `json:"host_uuid"`
+	// the activation token issued when the host was registered
+	Token string `json:"token"`
+	// an optional PEM encoded certificate signing request, a client certificate is issued to the host on activation
+	CSR string `json:"csr,omitempty"`
+}
+
+// Activation an activation issued to a host by the local activation provider
+type Activation struct {
+	MacAddress string `json:"mac_address"`
+	HostUUID   string `json:"host_uuid,omitempty"`
+	Tenant     string `json:"tenant"`
+	// the activation token issued to the host when it is registered, to be presented when the host activates
+	Token   string    `json:"token,omitempty"`
+	Issued  time.Time `json:"issued"`
+	Expires time.Time `json:"expires,omitempty"`
+	// the client certificate issued to the host if the activation request contained a certificate signing request
+	Certificate *CertificateResponse `json:"certificate,omitempty"`
+}
@@ -18,6 +18,8 @@
 
 package types
 
+import "time"
+
 // Admission an admission request
 type Admission struct {
 	HostUUID string   `json:"host_uuid"`
@@ -28,6 +30,30 @@ type Admission struct {
 	Label    []string `json:"label"`
 }
 
+// AdmissionStatus the outcome of an admission request
+type AdmissionStatus string
+
+const (
+	// AdmissionAdmitted the host was admitted for the first time
+	AdmissionAdmitted AdmissionStatus = "admitted"
+	// AdmissionUpdated the admission information of an already admitted host was updated
+	AdmissionUpdated AdmissionStatus = "updated"
+	// AdmissionFailed the admission failed, the reason is reported in the result
+	AdmissionFailed AdmissionStatus = "failed"
+	// AdmissionRejected the host pending admission was rejected
+	AdmissionRejected AdmissionStatus = "rejected"
+	// AdmissionNotApplied the admission was valid but not applied as other admissions failed in all-or-nothing mode
+	AdmissionNotApplied AdmissionStatus = "not_applied"
+)
+
+// AdmissionResult the outcome of admitting a host in a bulk admission
+type AdmissionResult struct {
+	HostUUID string          `json:"host_uuid"`
+	Status   AdmissionStatus `json:"status"`
+	// the reason why the admission failed
+	Reason string `json:"reason,omitempty"`
+}
+
 type Registration struct {
 	MacAddress string   `json:"mac_address"`
 	OrgGroup   string   `json:"org_group"`
@@ -36,3 +62,44 @@ type Registration struct {
 	Location   string   `json:"location"`
 	Label      []string `json:"label"`
 }
+
+// RegistrationImportStatus the outcome of importing a registration row
+type RegistrationImportStatus string
+
+const (
+	// RegistrationValid the row is valid and would be registered if the import was not a dry-run
+	RegistrationValid RegistrationImportStatus = "valid"
+	// RegistrationRegistered the mac-address was provisioned and the registration recorded
+	RegistrationRegistered RegistrationImportStatus = "registered"
+	// RegistrationInvalid the row did not pass validation, the reason is reported in the result
+	RegistrationInvalid RegistrationImportStatus = "invalid"
+	// RegistrationFailed the row was valid but provisioning or recording the registration failed
+	RegistrationFailed RegistrationImportStatus = "failed"
+)
+
+// RegistrationImportResult the outcome of importing a row of a registrations spreadsheet
+type RegistrationImportResult struct {
+	// the spreadsheet row number, starting at 1 for the header row
+	Row        int                      `json:"row"`
+	MacAddress string                   `json:"mac_address"`
+	Status     RegistrationImportStatus `json:"status"`
+	// the reason why the row is invalid or failed
+	Reason string `json:"reason,omitempty"`
+	// the activation token of the registered host, only issued by the local activation provider
+	Token string `json:"token,omitempty"`
+}
+
+// PendingAdmission a host that registered with pilotctl but has not been admitted
+type PendingAdmission struct {
+	HostUUID   string   `json:"host_uuid"`
+	Hostname   string   `json:"hostname"`
+	HostIP     string   `json:"host_ip"`
+	MacAddress []string `json:"mac_address"`
+	HardwareId string   `json:"hardware_id,omitempty"`
+	OS         string   `json:"os"`
+	Platform   string   `json:"platform"`
+	// when the host first registered
+	Registered time.Time `json:"registered"`
+	// when the host last attempted to register or connect
+	LastAttempt time.Time `json:"last_attempt"`
+}
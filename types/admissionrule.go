@@ -0,0 +1,127 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package types
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// AdmissionRule automatically admits hosts registering with pilotctl that match all its criteria
+// rules are evaluated in order of priority and the first matching rule admits the host
+type AdmissionRule struct {
+	// the natural key of the rule
+	Key         string `json:"key"`
+	Description string `json:"description"`
+	// rules with lower values are evaluated first
+	Priority int  `json:"priority"`
+	Enabled  bool `json:"enabled"`
+	// the prefix of any of the host mac-addresses (e.g. the OUI); separators are ignored
+	MacPrefix string `json:"mac_prefix,omitempty"`
+	// a regular expression matching the whole hostname
+	HostnamePattern string `json:"hostname_pattern,omitempty"`
+	// the CIDR of the subnet the address the host registers from belongs to
+	Subnet string `json:"subnet,omitempty"`
+	// the hardware identifier reported by the host
+	HardwareId string `json:"hardware_id,omitempty"`
+	// the logistics information used to admit matching hosts
+	OrgGroup string   `json:"org_group"`
+	Org      string   `json:"org"`
+	Area     string   `json:"area"`
+	Location string   `json:"location"`
+	Label    []string `json:"label"`
+}
+
+// Valid checks the rule has a key, at least one criterion and well-formed criteria
+func (rule *AdmissionRule) Valid() error {
+	if len(rule.Key) == 0 {
+		return fmt.Errorf("admission rule key is missing")
+	}
+	if len(rule.MacPrefix) == 0 && len(rule.HostnamePattern) == 0 && len(rule.Subnet) == 0 && len(rule.HardwareId) == 0 {
+		return fmt.Errorf("admission rule '%s' must have at least one of mac prefix, hostname pattern, subnet or hardware id", rule.Key)
+	}
+	if len(rule.HostnamePattern) > 0 {
+		if _, err := regexp.Compile(rule.HostnamePattern); err != nil {
+			return fmt.Errorf("admission rule '%s' hostname pattern is not valid: %s", rule.Key, err)
+		}
+	}
+	if len(rule.Subnet) > 0 {
+		if _, _, err := net.ParseCIDR(rule.Subnet); err != nil {
+			return fmt.Errorf("admission rule '%s' subnet is not valid: %s", rule.Key, err)
+		}
+	}
+	return nil
+}
+
+// Matches checks if the registering host matches all the criteria in the rule
+// the subnet is matched against the remote address of the registration request rather than the reported host IP
+// disabled or invalid rules never match
+func (rule *AdmissionRule) Matches(reg *RegistrationRequest, remoteIP string) bool {
+	if !rule.Enabled || rule.Valid() != nil {
+		return false
+	}
+	if len(rule.MacPrefix) > 0 {
+		prefix := normaliseMac(rule.MacPrefix)
+		found := false
+		for _, mac := range reg.MacAddress {
+			if strings.HasPrefix(normaliseMac(mac), prefix) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(rule.HostnamePattern) > 0 {
+		if !regexp.MustCompile(fmt.Sprintf("^(?:%s)$", rule.HostnamePattern)).MatchString(reg.Hostname) {
+			return false
+		}
+	}
+	if len(rule.Subnet) > 0 {
+		_, subnet, _ := net.ParseCIDR(rule.Subnet)
+		ip := net.ParseIP(remoteIP)
+		if ip == nil || !subnet.Contains(ip) {
+			return false
+		}
+	}
+	if len(rule.HardwareId) > 0 && !strings.EqualFold(rule.HardwareId, reg.HardwareId) {
+		return false
+	}
+	return true
+}
+
+// Admission the admission of the specified host using the logistics information in the rule
+func (rule *AdmissionRule) Admission(hostUUID string) Admission {
+	return Admission{
+		HostUUID: hostUUID,
+		OrgGroup: rule.OrgGroup,
+		Org:      rule.Org,
+		Area:     rule.Area,
+		Location: rule.Location,
+		Label:    rule.Label,
+	}
+}
+
+// normaliseMac removes separators and lower cases a mac-address or mac-address prefix
+func normaliseMac(mac string) string {
+	return strings.ToLower(strings.NewReplacer(":", "", "-", "", ".", "").Replace(mac))
+}
@@ -0,0 +1,62 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package types
+
+import "testing"
+
+func TestAdmissionRuleMatches(t *testing.T) {
+	reg := &RegistrationRequest{
+		Hostname:   "lab-edge-042",
+		HostIP:     "10.20.30.40",
+		MacAddress: []string{"02:42:ac:11:00:02", "00:1A:2B:3C:4D:5E"},
+		HardwareId: "HW-0042",
+	}
+	cases := []struct {
+		name    string
+		rule    AdmissionRule
+		matches bool
+	}{
+		{"oui", AdmissionRule{MacPrefix: "00-1a-2b"}, true},
+		{"oui mismatch", AdmissionRule{MacPrefix: "00:1a:2c"}, false},
+		{"hostname", AdmissionRule{HostnamePattern: "lab-edge-\\d+"}, true},
+		{"hostname partial", AdmissionRule{HostnamePattern: "edge"}, false},
+		{"subnet", AdmissionRule{Subnet: "10.20.0.0/16"}, true},
+		{"subnet mismatch", AdmissionRule{Subnet: "192.168.0.0/16"}, false},
+		{"hardware id", AdmissionRule{HardwareId: "hw-0042"}, true},
+		{"all criteria", AdmissionRule{MacPrefix: "02:42", HostnamePattern: "lab-.*", Subnet: "10.0.0.0/8"}, true},
+		{"one criterion fails", AdmissionRule{MacPrefix: "02:42", Subnet: "192.168.0.0/16"}, false},
+		{"no criteria", AdmissionRule{}, false},
+		{"invalid pattern", AdmissionRule{HostnamePattern: "lab-("}, false},
+	}
+	for _, c := range cases {
+		c.rule.Key = c.name
+		c.rule.Enabled = true
+		if c.rule.Matches(reg, "10.20.30.40") != c.matches {
+			t.Errorf("rule '%s': expected match=%t", c.name, c.matches)
+		}
+	}
+	spoofed := AdmissionRule{Key: "spoofed", Enabled: true, Subnet: "10.20.0.0/16"}
+	if spoofed.Matches(reg, "172.16.0.9") {
+		t.Error("the subnet must be matched against the remote address, not the reported host IP")
+	}
+	disabled := AdmissionRule{Key: "disabled", HardwareId: "HW-0042"}
+	if disabled.Matches(reg, "10.20.30.40") {
+		t.Error("a disabled rule must not match")
+	}
+}
@@ -0,0 +1,133 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package types
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AuditPending the status of the entry recorded before an action is performed
+// it is followed by an entry for the same action and target with the status of its outcome, a pending entry without
+// an outcome is an action that may have been performed but whose outcome could not be recorded
+const AuditPending = 0
+
+// AuditEntry the record of an administrative action
+// entries are chained by including the hash of the previous entry in their own hash, so that changing,
+// removing or reordering entries breaks the chain
+type AuditEntry struct {
+	// the position of the entry in the audit log, assigned when the entry is appended
+	Seq      int64     `json:"seq"`
+	Time     time.Time `json:"time"`
+	Username string    `json:"username"`
+	// the route of the action, e.g. DELETE /host/{host-uuid}
+	Action string `json:"action"`
+	// the path variables identifying the target of the action, e.g. host-uuid=...
+	Target string `json:"target,omitempty"`
+	// the state of the target before the action, if known
+	Before string `json:"before,omitempty"`
+	// the payload of the action
+	After    string `json:"after,omitempty"`
+	Status   int    `json:"status"`
+	SourceIP string `json:"source_ip"`
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash"`
+}
+
+// ComputeHash returns the hash of the entry content chained to the hash of the previous entry
+func (e AuditEntry) ComputeHash() string {
+	sum := sha256.New()
+	for _, field := range []string{
+		e.PrevHash,
+		e.Time.UTC().Format(time.RFC3339Nano),
+		e.Username,
+		e.Action,
+		e.Target,
+		e.Before,
+		e.After,
+		strconv.Itoa(e.Status),
+		e.SourceIP,
+	} {
+		// length prefixes prevent different field values producing the same hash input
+		sum.Write([]byte(fmt.Sprintf("%d:%s;", len(field), field)))
+	}
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// AuditFilter the criteria used to query the audit log
+type AuditFilter struct {
+	Username string
+	Action   string
+	Target   string
+	From     *time.Time
+	To       *time.Time
+}
+
+// AuditVerification the result of verifying the integrity of the audit log
+type AuditVerification struct {
+	Valid   bool   `json:"valid"`
+	Entries int    `json:"entries"`
+	Head    string `json:"head,omitempty"`
+	// the sequence of the first entry breaking the chain
+	BrokenAt *int64 `json:"broken_at,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// VerifyAuditChain checks that a complete audit log, in sequence order, has not been tampered with
+func VerifyAuditChain(entries []AuditEntry) AuditVerification {
+	prev := ""
+	for i, e := range entries {
+		var reason string
+		switch {
+		case e.PrevHash != prev:
+			reason = "entry is not chained to the previous entry"
+		case e.ComputeHash() != e.Hash:
+			reason = "entry content does not match its hash"
+		}
+		if len(reason) > 0 {
+			seq := e.Seq
+			return AuditVerification{Entries: i, Head: prev, BrokenAt: &seq, Reason: reason}
+		}
+		prev = e.Hash
+	}
+	return AuditVerification{Valid: true, Entries: len(entries), Head: prev}
+}
+
+// AuditCSV returns the audit entries in CSV format
+func AuditCSV(entries []AuditEntry) string {
+	b := strings.Builder{}
+	b.WriteString("SEQ,TIME,USERNAME,ACTION,TARGET,STATUS,SOURCE-IP,BEFORE,AFTER,HASH\n")
+	for _, e := range entries {
+		b.WriteString(fmt.Sprintf("%d,%s,%s,%s,%s,%d,%s,%s,%s,%s\n",
+			e.Seq, e.Time.UTC().Format(time.RFC3339Nano), csvField(e.Username), csvField(e.Action), csvField(e.Target),
+			e.Status, e.SourceIP, csvField(e.Before), csvField(e.After), e.Hash))
+	}
+	return b.String()
+}
+
+func csvField(value string) string {
+	if strings.ContainsAny(value, ",\"\n\r") {
+		return "\"" + strings.ReplaceAll(value, "\"", "\"\"") + "\""
+	}
+	return value
+}
@@ -0,0 +1,55 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package types
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAuditChain(t *testing.T) {
+	var entries []AuditEntry
+	prev := ""
+	for i, action := range []string{"PUT /admission", "PATCH /host/{host-uuid}/logistics", "DELETE /cmd/{name}"} {
+		e := AuditEntry{
+			Seq:      int64(i + 1),
+			Time:     time.Now(),
+			Username: "admin",
+			Action:   action,
+			Status:   200,
+			SourceIP: "10.0.0.1",
+			PrevHash: prev,
+		}
+		e.Hash = e.ComputeHash()
+		prev = e.Hash
+		entries = append(entries, e)
+	}
+	if result := VerifyAuditChain(entries); !result.Valid || result.Entries != 3 {
+		t.Fatalf("untampered audit log failed verification: %+v", result)
+	}
+	tampered := append([]AuditEntry{}, entries...)
+	tampered[1].Username = "someone-else"
+	if result := VerifyAuditChain(tampered); result.Valid || *result.BrokenAt != 2 {
+		t.Fatalf("changed entry not detected: %+v", result)
+	}
+	removed := []AuditEntry{entries[0], entries[2]}
+	if result := VerifyAuditChain(removed); result.Valid || *result.BrokenAt != 3 {
+		t.Fatalf("removed entry not detected: %+v", result)
+	}
+}
@@ -0,0 +1,113 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package types
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// PilotBootstrapScheme the authorization scheme used by host pilots presenting a bootstrap token
+const PilotBootstrapScheme = "PILOT-BOOTSTRAP"
+
+// BootstrapTokenPrefix identifies pilotctl bootstrap tokens
+const BootstrapTokenPrefix = "pbt_"
+
+// BootstrapTokenRequest the information required to create a bootstrap token
+type BootstrapTokenRequest struct {
+	// the host the token is issued to, if empty the token is a join token that any registering host can use
+	// to be admitted by an admission rule
+	HostUUID string `json:"host_uuid,omitempty"`
+	// the number of times the token can be used, defaults to 1
+	Uses int `json:"uses,omitempty"`
+	// the number of hours the token is valid for, defaults to 24
+	ExpiryHours int `json:"expiry_hours,omitempty"`
+}
+
+// BootstrapToken a secret issued by an administrator so that a host pilot can prove it was approved
+// before it holds a credential or a certificate
+type BootstrapToken struct {
+	Id       string `json:"id"`
+	HostUUID string `json:"host_uuid,omitempty"`
+	// the token value, only returned when the token is created
+	Token string `json:"token,omitempty"`
+	// the number of times the token can still be used
+	Uses      int       `json:"uses"`
+	Created   time.Time `json:"created"`
+	CreatedBy string    `json:"created_by"`
+	Expires   time.Time `json:"expires"`
+}
+
+// Usable true if the token has not expired and can still be used
+func (t BootstrapToken) Usable() bool {
+	return t.Uses > 0 && time.Now().Before(t.Expires)
+}
+
+// NewBootstrapToken returns a new random bootstrap token value
+func NewBootstrapToken() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("cannot generate bootstrap token: %s", err)
+	}
+	return BootstrapTokenPrefix + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// PilotBootstrapAuth the parameters of a bootstrap authorization header
+type PilotBootstrapAuth struct {
+	HostUUID string
+	Token    string
+}
+
+// ParsePilotBootstrapAuth parses a bootstrap authorization header with the format
+// PILOT-BOOTSTRAP uuid=<host uuid>,token=<bootstrap token>
+func ParsePilotBootstrapAuth(header string) (*PilotBootstrapAuth, error) {
+	if !IsPilotBootstrapAuth(header) {
+		return nil, fmt.Errorf("authorization header is not of type %s", PilotBootstrapScheme)
+	}
+	auth := new(PilotBootstrapAuth)
+	for _, param := range strings.Split(strings.TrimSpace(header[len(PilotBootstrapScheme):]), ",") {
+		name, value, found := strings.Cut(strings.TrimSpace(param), "=")
+		if !found {
+			return nil, fmt.Errorf("invalid authorization parameter '%s'", param)
+		}
+		switch name {
+		case "uuid":
+			auth.HostUUID = value
+		case "token":
+			auth.Token = value
+		}
+	}
+	if len(auth.HostUUID) == 0 || !strings.HasPrefix(auth.Token, BootstrapTokenPrefix) {
+		return nil, fmt.Errorf("authorization header requires uuid and token parameters")
+	}
+	return auth, nil
+}
+
+// IsPilotBootstrapAuth checks if an authorization header is a bootstrap authorization header
+func IsPilotBootstrapAuth(header string) bool {
+	return strings.HasPrefix(header, PilotBootstrapScheme+" ")
+}
+
+// String the authorization header value
+func (a *PilotBootstrapAuth) String() string {
+	return fmt.Sprintf("%s uuid=%s,token=%s", PilotBootstrapScheme, a.HostUUID, a.Token)
+}
@@ -0,0 +1,39 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package types
+
+import "testing"
+
+func TestPilotBootstrapAuth(t *testing.T) {
+	token, err := NewBootstrapToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := (&PilotBootstrapAuth{HostUUID: "host-1", Token: token}).String()
+	auth, err := ParsePilotBootstrapAuth(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.HostUUID != "host-1" || auth.Token != token {
+		t.Fatalf("unexpected bootstrap auth %+v", auth)
+	}
+	if _, err = ParsePilotBootstrapAuth(PilotBootstrapScheme + " uuid=host-1,token=not-a-token"); err == nil {
+		t.Fatal("a value that is not a bootstrap token must be rejected")
+	}
+}
@@ -0,0 +1,46 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package types
+
+import "time"
+
+// CertificateRequest sent by a host pilot to obtain a client certificate from the internal CA
+type CertificateRequest struct {
+	// the PEM encoded certificate signing request
+	CSR string `json:"csr"`
+}
+
+// CertificateResponse a client certificate issued to a host pilot
+type CertificateResponse struct {
+	// the PEM encoded client certificate
+	Certificate string `json:"certificate"`
+	// the PEM encoded certificate of the issuing CA
+	CA       string    `json:"ca"`
+	Serial   string    `json:"serial"`
+	NotAfter time.Time `json:"not_after"`
+}
+
+// HostCertificate a client certificate issued to a host
+type HostCertificate struct {
+	HostUUID  string     `json:"host_uuid"`
+	Serial    string     `json:"serial"`
+	NotBefore time.Time  `json:"not_before"`
+	NotAfter  time.Time  `json:"not_after"`
+	Revoked   *time.Time `json:"revoked,omitempty"`
+}
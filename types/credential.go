@@ -0,0 +1,124 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package types
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PilotHmacScheme the authorization scheme used by host pilots signing requests with their credential
+const PilotHmacScheme = "PILOT-HMAC-SHA256"
+
+// HostCredential the secret issued to a host pilot to sign its requests
+type HostCredential struct {
+	HostUUID string `json:"host_uuid"`
+	// identifies the credential issued to the host
+	KeyId string `json:"key_id"`
+	// the base64 encoded HMAC secret, only returned when the credential is collected by the host
+	Secret    string     `json:"secret,omitempty"`
+	Issued    time.Time  `json:"issued"`
+	Collected *time.Time `json:"collected,omitempty"`
+	Revoked   *time.Time `json:"revoked,omitempty"`
+}
+
+// PilotHmacAuth the parameters of a signed pilot authorization header
+type PilotHmacAuth struct {
+	HostUUID  string
+	KeyId     string
+	Timestamp int64
+	Nonce     string
+	Signature string
+}
+
+// NewPilotHmacAuth signs a pilot request with the host credential secret
+func NewPilotHmacAuth(hostUUID, keyId string, secret []byte, method, path, nonce string, body []byte) *PilotHmacAuth {
+	auth := &PilotHmacAuth{
+		HostUUID:  hostUUID,
+		KeyId:     keyId,
+		Timestamp: time.Now().Unix(),
+		Nonce:     nonce,
+	}
+	auth.Signature = auth.Sign(secret, method, path, body)
+	return auth
+}
+
+// ParsePilotHmacAuth parses a signed pilot authorization header with the format
+// PILOT-HMAC-SHA256 uuid=<host uuid>,kid=<key id>,ts=<unix time>,nonce=<nonce>,sig=<base64 signature>
+func ParsePilotHmacAuth(header string) (*PilotHmacAuth, error) {
+	if !IsPilotHmacAuth(header) {
+		return nil, fmt.Errorf("authorization header is not of type %s", PilotHmacScheme)
+	}
+	auth := new(PilotHmacAuth)
+	for _, param := range strings.Split(strings.TrimSpace(header[len(PilotHmacScheme):]), ",") {
+		name, value, found := strings.Cut(strings.TrimSpace(param), "=")
+		if !found {
+			return nil, fmt.Errorf("invalid authorization parameter '%s'", param)
+		}
+		switch name {
+		case "uuid":
+			auth.HostUUID = value
+		case "kid":
+			auth.KeyId = value
+		case "ts":
+			ts, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid authorization timestamp: %s", err)
+			}
+			auth.Timestamp = ts
+		case "nonce":
+			auth.Nonce = value
+		case "sig":
+			auth.Signature = value
+		}
+	}
+	if len(auth.HostUUID) == 0 || len(auth.KeyId) == 0 || auth.Timestamp == 0 || len(auth.Nonce) == 0 || len(auth.Signature) == 0 {
+		return nil, fmt.Errorf("authorization header requires uuid, kid, ts, nonce and sig parameters")
+	}
+	return auth, nil
+}
+
+// IsPilotHmacAuth checks if an authorization header is a signed pilot authorization header
+func IsPilotHmacAuth(header string) bool {
+	return strings.HasPrefix(header, PilotHmacScheme+" ")
+}
+
+// Sign calculates the signature of a request over its method, path, timestamp, nonce and body hash
+func (a *PilotHmacAuth) Sign(secret []byte, method, path string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(fmt.Sprintf("%s\n%s\n%d\n%s\n%s", strings.ToUpper(method), path, a.Timestamp, a.Nonce, hex.EncodeToString(bodyHash[:]))))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature of a request
+func (a *PilotHmacAuth) Verify(secret []byte, method, path string, body []byte) bool {
+	return hmac.Equal([]byte(a.Sign(secret, method, path, body)), []byte(a.Signature))
+}
+
+// String the authorization header value
+func (a *PilotHmacAuth) String() string {
+	return fmt.Sprintf("%s uuid=%s,kid=%s,ts=%d,nonce=%s,sig=%s", PilotHmacScheme, a.HostUUID, a.KeyId, a.Timestamp, a.Nonce, a.Signature)
+}
@@ -0,0 +1,49 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package types
+
+import "testing"
+
+func TestPilotHmacAuth(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	body := []byte(`{"hostname":"host-01"}`)
+	auth := NewPilotHmacAuth("b2d2e9f0", "k1", secret, "POST", "/ping", "n-001", body)
+	parsed, err := ParsePilotHmacAuth(auth.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *parsed != *auth {
+		t.Fatalf("parsed header %+v does not match %+v", parsed, auth)
+	}
+	if !parsed.Verify(secret, "POST", "/ping", body) {
+		t.Fatal("expected signature to verify")
+	}
+	if parsed.Verify(secret, "POST", "/ping", []byte(`{"hostname":"host-02"}`)) {
+		t.Fatal("signature must not verify a tampered body")
+	}
+	if parsed.Verify(secret, "POST", "/register", body) {
+		t.Fatal("signature must not verify a different path")
+	}
+	if parsed.Verify([]byte("another secret"), "POST", "/ping", body) {
+		t.Fatal("signature must not verify with a different secret")
+	}
+	if _, err = ParsePilotHmacAuth(PilotHmacScheme + " uuid=b2d2e9f0,ts=1"); err == nil {
+		t.Fatal("expected an error for a header with missing parameters")
+	}
+}
@@ -40,26 +40,16 @@ import (
 	"time"
 )
 
-// Sign create a cryptographic signature for the passed-in object
-func sign(obj interface{}) (string, error) {
+// sign create a cryptographic signature for the passed-in object using the specified signer
+func sign(signer Signer, obj interface{}) (string, error) {
 	// only sign if we have an object
 	if obj != nil {
-		// load the signing key
-		path, err := KeyFilePath("sign")
-		if err != nil {
-			return "", err
-		}
-		// retrieve the verification key from the specified location
-		pgp, err := LoadPGP(path, "")
-		if err != nil {
-			return "", fmt.Errorf("sign => cannot load signing key: %s", err)
-		}
 		// obtain the object checksum
 		cs, err := checksum(obj)
 		if err != nil {
 			return "", fmt.Errorf("sign => cannot create checksum: %s", err)
 		}
-		signature, err := pgp.Sign(cs)
+		signature, err := signer.Sign(cs)
 		if err != nil {
 			return "", fmt.Errorf("sign => cannot create signature: %s", err)
 		}
@@ -69,6 +59,19 @@ func sign(obj interface{}) (string, error) {
 	return "", nil
 }
 
+// SigningKeyFile loads the private signing key from the .pilot_sign.pgp file
+func SigningKeyFile() (*PGP, error) {
+	path, err := KeyFilePath("sign")
+	if err != nil {
+		return nil, err
+	}
+	pgp, err := LoadPGP(path, "")
+	if err != nil {
+		return nil, fmt.Errorf("cannot load signing key: %s", err)
+	}
+	return pgp, nil
+}
+
 // checksum create a checksum of the passed-in object
 func checksum(obj interface{}) ([]byte, error) {
 	source, err := json.Marshal(obj)
@@ -272,6 +275,66 @@ func LoadPGPBytes(key []byte) (*PGP, error) {
 	}, nil
 }
 
+// NewPGP generates a new PGP entity with an RSA key of the specified size
+func NewPGP(name, comment, email string, bits int) (*PGP, error) {
+	conf := &packet.Config{
+		DefaultCipher: defaultCipher,
+		DefaultHash:   defaultDigest,
+		RSABits:       bits,
+		Time: func() time.Time {
+			return time.Now()
+		},
+	}
+	entity, err := openpgp.NewEntity(name, comment, email, conf)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create PGP entity: %s", err)
+	}
+	// self-sign the identities so that the public key can be exported
+	for _, id := range entity.Identities {
+		if err = id.SelfSignature.SignUserId(id.UserId.Id, entity.PrimaryKey, entity.PrivateKey, conf); err != nil {
+			return nil, fmt.Errorf("cannot sign PGP identity: %s", err)
+		}
+	}
+	return &PGP{
+		entity:  entity,
+		conf:    conf,
+		name:    name,
+		comment: comment,
+		email:   email,
+	}, nil
+}
+
+// KeyId returns the hexadecimal identifier of the PGP primary key
+func (p *PGP) KeyId() string {
+	return p.entity.PrimaryKey.KeyIdString()
+}
+
+// PublicKey returns the armored public key
+func (p *PGP) PublicKey() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := p.entity.Serialize(buf); err != nil {
+		return nil, fmt.Errorf("cannot serialise PGP public key: %s", err)
+	}
+	return armorEncode(buf, openpgp.PublicKeyType, p.headers())
+}
+
+// PrivateKey returns the armored private key
+func (p *PGP) PrivateKey() ([]byte, error) {
+	if !p.HasPrivate() {
+		return nil, fmt.Errorf("PGP entity does not have a private key")
+	}
+	buf := new(bytes.Buffer)
+	if err := p.entity.SerializePrivate(buf, p.conf); err != nil {
+		return nil, fmt.Errorf("cannot serialise PGP private key: %s", err)
+	}
+	return armorEncode(buf, openpgp.PrivateKeyType, p.headers())
+}
+
+func (p *PGP) headers() map[string]string {
+	hash := "SHA256"
+	return pemHeaders("1", cipherToString(p.conf.DefaultCipher), hash, p.conf.RSABits, p.entity.PrimaryKey.CreationTime)
+}
+
 // HasPrivate check if the PGP entity has a private key, if not an error is returned
 func (p *PGP) HasPrivate() bool {
 	if p.entity == nil {
@@ -18,22 +18,65 @@
 
 package types
 
+import "time"
+
 // Host monitoring information
 type Host struct {
-	Id             int64    `json:"id"`
-	HostUUID       string   `json:"host_uuid"`
-	HostMacAddress string   `json:"host_mac_address"`
-	OrgGroup       string   `json:"org_group"`
-	Org            string   `json:"org"`
-	Area           string   `json:"area"`
-	Location       string   `json:"location"`
-	Connected      bool     `json:"connected"`
-	LastSeen       int64    `json:"last_seen"`
-	Since          int      `json:"since"`
-	SinceType      string   `json:"since_type"`
-	Label          []string `json:"label"`
-	Critical       int      `json:"critical"`
-	High           int      `json:"high"`
-	Medium         int      `json:"medium"`
-	Low            int      `json:"low"`
+	Id             int64     `json:"id"`
+	HostUUID       string    `json:"host_uuid"`
+	HostMacAddress string    `json:"host_mac_address"`
+	OrgGroup       string    `json:"org_group"`
+	Org            string    `json:"org"`
+	Area           string    `json:"area"`
+	Location       string    `json:"location"`
+	Connected      bool      `json:"connected"`
+	LastSeen       int64     `json:"last_seen"`
+	Since          int       `json:"since"`
+	SinceType      string    `json:"since_type"`
+	Label          []string  `json:"label"`
+	Critical       int       `json:"critical"`
+	High           int       `json:"high"`
+	Medium         int       `json:"medium"`
+	Low            int       `json:"low"`
+	State          HostState `json:"state"`
+	// set if the host is quarantined
+	Quarantine *Quarantine `json:"quarantine,omitempty"`
+	// the ping interval in seconds last given to the host, or otherwise the interval of its ping policy
+	PingInterval int `json:"ping_interval,omitempty"`
+	// the period in seconds the pings of the host are held waiting for a job, if it long-polls
+	PingWait int `json:"ping_wait,omitempty"`
+}
+
+// HostIdentity the identity of an authenticated host pilot
+// it is carried in the context of the request user principal so that it is scoped to the request
+type HostIdentity struct {
+	HostUUID string `json:"host_uuid"`
+	HostIP   string `json:"host_ip"`
+	Hostname string `json:"hostname"`
+	// how the host authenticated, one of the PilotAuth constants
+	Auth string `json:"auth,omitempty"`
+	// the id of the credential or bootstrap token the host authenticated with
+	KeyId string `json:"key_id,omitempty"`
+}
+
+// the ways host pilots authenticate
+const (
+	// PilotAuthToken the legacy pilot token
+	PilotAuthToken = "token"
+	// PilotAuthHmac a request signed with the host credential
+	PilotAuthHmac = "hmac"
+	// PilotAuthCert a client certificate issued by the internal CA
+	PilotAuthCert = "cert"
+	// PilotAuthBootstrap a bootstrap token issued by an administrator
+	PilotAuthBootstrap = "bootstrap"
+)
+
+// Quarantine information about a quarantined host
+type Quarantine struct {
+	// the user that quarantined the host
+	By string `json:"by"`
+	// why the host was quarantined
+	Reason string `json:"reason"`
+	// when the host was quarantined
+	Since time.Time `json:"since"`
 }
@@ -34,6 +34,8 @@ type JobBatch struct {
 	Label []string `json:"label,omitempty"`
 	// owner
 	Owner string `json:"owner"`
+	// the identity of the owner, which unlike the owner username cannot be chosen by users
+	OwnerId string `json:"-"`
 	// jobs
 	Jobs int `json:"jobs"`
 }
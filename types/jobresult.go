@@ -35,4 +35,6 @@ type JobResult struct {
 	Err string
 	// the completion time
 	Time time.Time
+	// the nonce of the ping response that delivered the job, required for jobs delivered in signed responses
+	Nonce string `json:",omitempty"`
 }
@@ -0,0 +1,100 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package types
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// HostState the lifecycle state of a host
+type HostState string
+
+const (
+	// HostRegistered the host has registered with pilotctl but has not been admitted
+	HostRegistered HostState = "registered"
+	// HostAdmitted the host has been admitted into service but has not yet connected
+	HostAdmitted HostState = "admitted"
+	// HostActive the host is admitted and connecting to pilotctl
+	HostActive HostState = "active"
+	// HostQuarantined the host keeps connecting but does not receive jobs
+	HostQuarantined HostState = "quarantined"
+	// HostRetired the host is out of service and its data will be purged after the retention period
+	HostRetired HostState = "retired"
+	// HostDecommissioned the host has been removed and can only be restored within the grace period
+	HostDecommissioned HostState = "decommissioned"
+)
+
+// the states a host can move to from each state
+// note: a decommissioned host can only be restored to its previous state
+var hostTransitions = map[HostState][]HostState{
+	HostRegistered:     {HostAdmitted, HostDecommissioned},
+	HostAdmitted:       {HostActive, HostQuarantined, HostRetired, HostDecommissioned},
+	HostActive:         {HostQuarantined, HostRetired, HostDecommissioned},
+	HostQuarantined:    {HostAdmitted, HostActive, HostRetired, HostDecommissioned},
+	HostRetired:        {HostActive, HostDecommissioned},
+	HostDecommissioned: {},
+}
+
+// ParseHostState converts the passed-in string into a host state
+func ParseHostState(value string) (HostState, error) {
+	state := HostState(strings.ToLower(value))
+	if _, ok := hostTransitions[state]; !ok {
+		return "", fmt.Errorf("invalid host state '%s'", value)
+	}
+	return state, nil
+}
+
+// CanTransitionTo checks if a host in this state can move to the passed-in state
+func (s HostState) CanTransitionTo(to HostState) bool {
+	for _, state := range hostTransitions[s] {
+		if state == to {
+			return true
+		}
+	}
+	return false
+}
+
+// HostLifecycle the lifecycle information of a host
+type HostLifecycle struct {
+	HostUUID string `json:"host_uuid"`
+	// the current state of the host
+	State HostState `json:"state"`
+	// the state the host was in before the current state
+	PreviousState HostState `json:"previous_state,omitempty"`
+	// the time the host moved into the current state
+	Changed time.Time `json:"changed"`
+	// the user that moved the host into the current state
+	ChangedBy string `json:"changed_by,omitempty"`
+	// the reason for moving the host into the current state
+	Reason string `json:"reason,omitempty"`
+}
+
+// StateChange a request to move a host to a different lifecycle state
+type StateChange struct {
+	State  string `json:"state"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// QuarantineRequest a request to quarantine a host
+type QuarantineRequest struct {
+	// why the host is quarantined
+	Reason string `json:"reason"`
+}
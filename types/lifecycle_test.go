@@ -0,0 +1,51 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package types
+
+import "testing"
+
+func TestHostStateTransitions(t *testing.T) {
+	cases := []struct {
+		from, to HostState
+		allowed  bool
+	}{
+		{HostRegistered, HostAdmitted, true},
+		{HostRegistered, HostActive, false},
+		{HostActive, HostQuarantined, true},
+		{HostQuarantined, HostActive, true},
+		{HostQuarantined, HostAdmitted, true},
+		{HostRetired, HostQuarantined, false},
+		{HostDecommissioned, HostActive, false},
+	}
+	for _, c := range cases {
+		if c.from.CanTransitionTo(c.to) != c.allowed {
+			t.Errorf("transition from %s to %s: expected allowed=%t", c.from, c.to, c.allowed)
+		}
+	}
+}
+
+func TestParseHostState(t *testing.T) {
+	state, err := ParseHostState("Retired")
+	if err != nil || state != HostRetired {
+		t.Fatalf("expected retired state, got '%s': %v", state, err)
+	}
+	if _, err = ParseHostState("unknown"); err == nil {
+		t.Fatal("expected an error for an unknown state")
+	}
+}
@@ -20,22 +20,45 @@ package types
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"strings"
 	"time"
 )
 
-// NewPingResponse creates a new ping response
+// NewPingResponse creates a new ping response signed by the key in the signing key file
 func NewPingResponse(cmdInfo CmdInfo, pingInterval time.Duration) (*PingResponse, error) {
+	return NewSignedPingResponse(cmdInfo, pingInterval, PingDelivery{}, nil)
+}
+
+// NewSignedPingResponse creates a new ping response for the delivery, signed by the specified signer
+// if no signer is specified, the key in the signing key file is used
+func NewSignedPingResponse(cmdInfo CmdInfo, pingInterval time.Duration, delivery PingDelivery, signer Signer) (*PingResponse, error) {
+	if signer == nil {
+		key, err := SigningKeyFile()
+		if err != nil {
+			return nil, fmt.Errorf("cannot sign ping response: %s", err)
+		}
+		signer = key
+	}
 	// create a signature for the envelope
 	envelope := PingResponseEnvelope{
-		Command:  cmdInfo,
-		Interval: pingInterval,
+		Command:   cmdInfo,
+		Interval:  pingInterval,
+		HostUUID:  delivery.HostUUID,
+		IssuedAt:  delivery.IssuedAt,
+		ExpiresAt: delivery.ExpiresAt,
+		Sequence:  delivery.Sequence,
+		Nonce:     delivery.Nonce,
 	}
-	signature, err := sign(envelope)
+	signature, err := sign(signer, envelope)
 	if err != nil {
 		return nil, fmt.Errorf("cannot sign ping response: %s", err)
 	}
 	return &PingResponse{
+		KeyId:     signer.KeyId(),
+		Algorithm: signer.Algorithm(),
 		Signature: signature,
 		Envelope:  envelope,
 	}, nil
@@ -43,6 +66,10 @@ func NewPingResponse(cmdInfo CmdInfo, pingInterval time.Duration) (*PingResponse
 
 // PingResponse a command for execution with a job reference
 type PingResponse struct {
+	// the identifier of the key that signed the envelope, so that pilot can pick the verification key during key rotation
+	KeyId string `json:"key_id,omitempty"`
+	// the signature algorithm, pgp if not specified
+	Algorithm string `json:"algorithm,omitempty"`
 	// the envelope signature
 	Signature string `json:"signature"`
 	// the signed content sent to pilot
@@ -55,6 +82,57 @@ type PingResponseEnvelope struct {
 	Command CmdInfo `json:"value"`
 	// the ping interval
 	Interval time.Duration `json:"interval"`
+	// the host the response is for
+	HostUUID string `json:"host_uuid"`
+	// the time the response was issued
+	IssuedAt time.Time `json:"issued_at"`
+	// the time after which pilot must discard the response
+	ExpiresAt time.Time `json:"expires_at"`
+	// increases with every response to the host, pilot must discard responses not newer than the last one received
+	Sequence int64 `json:"sequence"`
+	// a random value identifying the response, or the delivery of the job if the response carries one
+	// pilot must send it back with the job result
+	Nonce string `json:"nonce"`
+}
+
+// Check verifies that the envelope was issued for the host, has not expired and is newer than the last envelope
+// received, so that captured responses cannot be replayed to the same or to a different host
+func (e PingResponseEnvelope) Check(hostUUID string, lastSequence int64, now time.Time) error {
+	if !strings.EqualFold(e.HostUUID, hostUUID) {
+		return fmt.Errorf("ping response was issued for host '%s'", e.HostUUID)
+	}
+	if now.After(e.ExpiresAt) {
+		return fmt.Errorf("ping response expired at %s", e.ExpiresAt.Format(time.RFC3339))
+	}
+	if e.Sequence <= lastSequence {
+		return fmt.Errorf("ping response sequence %d is not newer than %d", e.Sequence, lastSequence)
+	}
+	return nil
+}
+
+// PingDelivery identifies a signed ping response to a host
+type PingDelivery struct {
+	HostUUID  string
+	Sequence  int64
+	Nonce     string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+// NewPingDelivery creates the identity of a ping response valid for the specified period
+func NewPingDelivery(hostUUID string, sequence int64, validity time.Duration) (*PingDelivery, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("cannot create ping response nonce: %s", err)
+	}
+	now := time.Now().UTC()
+	return &PingDelivery{
+		HostUUID:  hostUUID,
+		Sequence:  sequence,
+		Nonce:     hex.EncodeToString(nonce),
+		IssuedAt:  now,
+		ExpiresAt: now.Add(validity),
+	}, nil
 }
 
 type PingRequest struct {
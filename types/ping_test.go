@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"testing"
+	"time"
 )
 
 // drop .pilot_verify.pgp and .pilot_sign.pgp in the user home
@@ -86,3 +87,56 @@ func TestHwId(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+// signs a ping response with a generated keyring key and verifies it with the published public key
+func TestPingSignWithKey(t *testing.T) {
+	key, err := NewPGP("pilotctl", "test", "", 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivery, err := NewPingDelivery("host-01", 7, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := NewSignedPingResponse(CmdInfo{JobId: 1, Package: "test/pack:latest", Function: "run"}, 15000, *delivery, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.KeyId != key.KeyId() {
+		t.Fatalf("expected key id '%s', got '%s'", key.KeyId(), resp.KeyId)
+	}
+	pubKey, err := key.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = verify(resp.Envelope, resp.Signature, pubKey); err != nil {
+		t.Fatal(err)
+	}
+	// the envelope is only accepted once by the host it was issued for, until it expires
+	if err = resp.Envelope.Check("host-01", 6, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Envelope.Check("host-01", 7, time.Now()) == nil {
+		t.Fatal("replayed response was accepted")
+	}
+	if resp.Envelope.Check("host-02", 0, time.Now()) == nil {
+		t.Fatal("response was accepted by a different host")
+	}
+	if resp.Envelope.Check("host-01", 6, time.Now().Add(2*time.Minute)) == nil {
+		t.Fatal("expired response was accepted")
+	}
+	// changing the envelope invalidates the signature
+	resp.Envelope.HostUUID = "host-02"
+	if verify(resp.Envelope, resp.Signature, pubKey) == nil {
+		t.Fatal("tampered envelope verified")
+	}
+	// the private key survives a round trip through its armored form
+	private, err := key.PrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadPGPBytes(private)
+	if err != nil || !loaded.HasPrivate() || loaded.KeyId() != key.KeyId() {
+		t.Fatalf("cannot reload private key: %v", err)
+	}
+}
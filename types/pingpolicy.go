@@ -0,0 +1,119 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package types
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// PingPolicy sets the ping interval of the hosts within a logistics scope and having specific labels
+// e.g. a slower interval for hosts at bandwidth constrained sites
+type PingPolicy struct {
+	// the unique name of the policy
+	Name string `json:"name"`
+	// the logistics scope of the policy, an empty value matches any value
+	OrgGroup string `json:"org_group,omitempty"`
+	Org      string `json:"org,omitempty"`
+	Area     string `json:"area,omitempty"`
+	Location string `json:"location,omitempty"`
+	// the labels that the hosts must have
+	Label []string `json:"label,omitempty"`
+	// the ping interval of the hosts in seconds
+	IntervalSecs int `json:"interval_secs"`
+	// the ping interval in seconds while a host has a job to run, if not set the interval is used
+	PendingJobIntervalSecs int `json:"pending_job_interval_secs,omitempty"`
+}
+
+// Valid checks the policy can be applied
+func (p PingPolicy) Valid() error {
+	if len(p.Name) == 0 {
+		return fmt.Errorf("ping policy name is missing")
+	}
+	if p.IntervalSecs <= 0 {
+		return fmt.Errorf("ping policy '%s' interval must be greater than zero", p.Name)
+	}
+	if p.PendingJobIntervalSecs < 0 {
+		return fmt.Errorf("ping policy '%s' pending job interval cannot be negative", p.Name)
+	}
+	return nil
+}
+
+// Matches true if the host is within the scope of the policy and has all its labels
+func (p PingPolicy) Matches(host Host) bool {
+	if !scopeMatch(p.OrgGroup, host.OrgGroup) || !scopeMatch(p.Org, host.Org) ||
+		!scopeMatch(p.Area, host.Area) || !scopeMatch(p.Location, host.Location) {
+		return false
+	}
+	for _, label := range p.Label {
+		found := false
+		for _, hostLabel := range host.Label {
+			if strings.EqualFold(label, hostLabel) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Interval returns the ping interval in seconds for a host with or without a pending job
+func (p PingPolicy) Interval(pendingJob bool) int {
+	if pendingJob && p.PendingJobIntervalSecs > 0 {
+		return p.PendingJobIntervalSecs
+	}
+	return p.IntervalSecs
+}
+
+// specificity ranks policies so that the most specific policy matching a host applies
+// labels are more specific than logistics and narrower logistics more specific than wider ones
+func (p PingPolicy) specificity() int {
+	score := 16 * len(p.Label)
+	for i, key := range []string{p.OrgGroup, p.Org, p.Area, p.Location} {
+		if len(key) > 0 {
+			score += 1 << i
+		}
+	}
+	return score
+}
+
+// SelectPingPolicy returns the most specific policy matching the host or nil if no policy matches
+// policies that are equally specific are ranked by name
+func SelectPingPolicy(policies []PingPolicy, host Host) *PingPolicy {
+	matches := make([]PingPolicy, 0)
+	for _, policy := range policies {
+		if policy.Matches(host) {
+			matches = append(matches, policy)
+		}
+	}
+	if len(matches) == 0 {
+		return nil
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if si, sj := matches[i].specificity(), matches[j].specificity(); si != sj {
+			return si > sj
+		}
+		return matches[i].Name < matches[j].Name
+	})
+	return &matches[0]
+}
@@ -0,0 +1,48 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package types
+
+import "testing"
+
+func TestSelectPingPolicy(t *testing.T) {
+	policies := []PingPolicy{
+		{Name: "europe", OrgGroup: "ACME", Area: "EU", IntervalSecs: 30},
+		{Name: "acme", OrgGroup: "ACME", IntervalSecs: 60, PendingJobIntervalSecs: 5},
+		{Name: "satellite", Label: []string{"satellite"}, IntervalSecs: 300},
+	}
+	host := Host{OrgGroup: "acme", Org: "OPS", Area: "EU", Location: "LON"}
+	if p := SelectPingPolicy(policies, host); p == nil || p.Name != "europe" {
+		t.Fatalf("expected the europe policy, got %+v", p)
+	}
+	host.Label = []string{"Satellite"}
+	if p := SelectPingPolicy(policies, host); p == nil || p.Name != "satellite" {
+		t.Fatalf("expected the labelled policy to apply, got %+v", p)
+	}
+	host = Host{OrgGroup: "ACME", Area: "US"}
+	p := SelectPingPolicy(policies, host)
+	if p == nil || p.Name != "acme" || p.Interval(false) != 60 || p.Interval(true) != 5 {
+		t.Fatalf("expected the acme policy with a pending job interval, got %+v", p)
+	}
+	if p = SelectPingPolicy(policies, Host{OrgGroup: "OTHER"}); p != nil {
+		t.Fatalf("expected no policy, got %+v", p)
+	}
+	if (PingPolicy{Name: "none"}).Valid() == nil {
+		t.Fatal("policy without an interval is valid")
+	}
+}
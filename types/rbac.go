@@ -0,0 +1,156 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package types
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Role a pilotctl role granting permissions to users within a logistics scope
+type Role string
+
+const (
+	// RoleViewer can see hosts, jobs and CVE information
+	RoleViewer Role = "viewer"
+	// RoleOperator can also run jobs on hosts
+	RoleOperator Role = "operator"
+	// RoleApprover can also admit, relocate and change the state of hosts
+	RoleApprover Role = "approver"
+	// RoleAdmin can do anything including managing roles
+	RoleAdmin Role = "admin"
+)
+
+// Permission an action that a role can perform
+type Permission int
+
+const (
+	PermView Permission = iota
+	PermRun
+	PermApprove
+	PermAdmin
+)
+
+func (p Permission) String() string {
+	switch p {
+	case PermView:
+		return "view"
+	case PermRun:
+		return "run"
+	case PermApprove:
+		return "approve"
+	case PermAdmin:
+		return "admin"
+	}
+	return fmt.Sprintf("permission(%d)", int(p))
+}
+
+// the permissions of each role, each role has the permissions of the roles below it
+var rolePermissions = map[Role]Permission{
+	RoleViewer:   PermView,
+	RoleOperator: PermRun,
+	RoleApprover: PermApprove,
+	RoleAdmin:    PermAdmin,
+}
+
+// ParseRole returns the role for the specified name
+func ParseRole(value string) (Role, error) {
+	role := Role(strings.ToLower(value))
+	if _, ok := rolePermissions[role]; !ok {
+		return "", fmt.Errorf("invalid role '%s', valid roles are viewer, operator, approver or admin", value)
+	}
+	return role, nil
+}
+
+// Allows checks if the role grants the specified permission
+func (r Role) Allows(perm Permission) bool {
+	granted, ok := rolePermissions[r]
+	return ok && granted >= perm
+}
+
+// Permission returns the highest permission granted by the role
+func (r Role) Permission() Permission {
+	return rolePermissions[r]
+}
+
+// RoleBinding grants a role to a user within a logistics scope
+// an empty org group, org or area means any, so a binding with no scope applies to all hosts
+type RoleBinding struct {
+	Username string `json:"username"`
+	Role     Role   `json:"role"`
+	OrgGroup string `json:"org_group,omitempty"`
+	Org      string `json:"org,omitempty"`
+	Area     string `json:"area,omitempty"`
+}
+
+// Covers checks if the binding scope includes a host with the specified logistics
+func (b RoleBinding) Covers(orgGroup, org, area string) bool {
+	return scopeMatch(b.OrgGroup, orgGroup) && scopeMatch(b.Org, org) && scopeMatch(b.Area, area)
+}
+
+func scopeMatch(scope, value string) bool {
+	return len(scope) == 0 || strings.EqualFold(scope, value)
+}
+
+// Access the role bindings of a user used to scope what the user can see and do
+// a nil Access grants unrestricted access as it is used when role based access control is disabled
+type Access struct {
+	Username string
+	Bindings []RoleBinding
+}
+
+// Can checks if the user has the permission anywhere
+func (a *Access) Can(perm Permission) bool {
+	if a == nil {
+		return true
+	}
+	for _, b := range a.Bindings {
+		if b.Role.Allows(perm) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanGlobally checks if the user has the permission in a binding without a logistics scope
+// so that it can act on resources that are not tied to hosts, such as commands or signing keys
+func (a *Access) CanGlobally(perm Permission) bool {
+	if a == nil {
+		return true
+	}
+	for _, b := range a.Bindings {
+		if b.Role.Allows(perm) && len(b.OrgGroup) == 0 && len(b.Org) == 0 && len(b.Area) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// CanAt checks if the user has the permission on hosts with the specified logistics
+func (a *Access) CanAt(perm Permission, orgGroup, org, area string) bool {
+	if a == nil {
+		return true
+	}
+	for _, b := range a.Bindings {
+		if b.Role.Allows(perm) && b.Covers(orgGroup, org, area) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package types
+
+import "testing"
+
+func TestAccessScope(t *testing.T) {
+	access := &Access{
+		Username: "region-ops",
+		Bindings: []RoleBinding{
+			{Role: RoleOperator, OrgGroup: "EMEA", Area: "NORTH"},
+			{Role: RoleViewer, OrgGroup: "EMEA"},
+		},
+	}
+	cases := []struct {
+		perm                Permission
+		orgGroup, org, area string
+		allowed             bool
+	}{
+		{PermRun, "EMEA", "ACME", "NORTH", true},
+		{PermRun, "EMEA", "ACME", "SOUTH", false},
+		{PermView, "EMEA", "ACME", "SOUTH", true},
+		{PermView, "APAC", "ACME", "NORTH", false},
+		{PermApprove, "EMEA", "ACME", "NORTH", false},
+	}
+	for _, c := range cases {
+		if access.CanAt(c.perm, c.orgGroup, c.org, c.area) != c.allowed {
+			t.Errorf("permission %d at %s/%s/%s: expected allowed=%t", c.perm, c.orgGroup, c.org, c.area, c.allowed)
+		}
+	}
+	if access.Can(PermAdmin) {
+		t.Error("operator must not have admin permission")
+	}
+	var unrestricted *Access
+	if !unrestricted.CanAt(PermAdmin, "ANY", "ANY", "ANY") || !unrestricted.CanGlobally(PermAdmin) {
+		t.Error("nil access must be unrestricted")
+	}
+}
+
+func TestAccessGlobal(t *testing.T) {
+	scoped := &Access{Bindings: []RoleBinding{{Role: RoleAdmin, OrgGroup: "EMEA", Area: "NORTH"}}}
+	if scoped.CanGlobally(PermAdmin) {
+		t.Error("administrator of a scope must not act on global resources")
+	}
+	// an administrator of a scope cannot grant a binding covering a wider scope
+	if scoped.CanAt(PermAdmin, "", "", "") || scoped.CanAt(PermAdmin, "EMEA", "", "") {
+		t.Error("administrator of a scope must not manage bindings beyond it")
+	}
+	global := &Access{Bindings: []RoleBinding{{Role: RoleAdmin}, {Role: RoleViewer, OrgGroup: "EMEA"}}}
+	if !global.CanGlobally(PermAdmin) {
+		t.Error("administrator without a scope must act on global resources")
+	}
+}
@@ -18,7 +18,12 @@
 
 package types
 
-import "bytes"
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
 
 // RegistrationRequest information sent by pilot upon host registration
 type RegistrationRequest struct {
@@ -31,6 +36,7 @@ type RegistrationRequest struct {
 	TotalMemory float64  `json:"total_memory"`
 	CPUs        int      `json:"cpus"`
 	MacAddress  []string `json:"mac_address"`
+	HardwareId  string   `json:"hardware_id,omitempty"`
 }
 
 // Reader Get a JSON bytes reader for the Serializable
@@ -53,3 +59,44 @@ type RegistrationResponse struct {
 	// the status of the registration - I: created, U: updated, N: already exist
 	Operation string `json:"operation"`
 }
+
+// RegistrationStatus the stage a host registration is at
+type RegistrationStatus string
+
+const (
+	// RegistrationProvisioned the mac-address was provisioned with the activation service but the host has not activated yet
+	RegistrationProvisioned RegistrationStatus = "provisioned"
+	// RegistrationActivated the host activated and has a host UUID but has not been admitted yet
+	RegistrationActivated RegistrationStatus = "activated"
+	// RegistrationAdmitted the host activated and was admitted
+	RegistrationAdmitted RegistrationStatus = "admitted"
+	// RegistrationExpired the host did not activate within the expiry period and the registration was undone
+	RegistrationExpired RegistrationStatus = "expired"
+)
+
+// ParseRegistrationStatus returns the registration status for the specified value
+func ParseRegistrationStatus(value string) (RegistrationStatus, error) {
+	status := RegistrationStatus(strings.ToLower(value))
+	switch status {
+	case RegistrationProvisioned, RegistrationActivated, RegistrationAdmitted, RegistrationExpired:
+		return status, nil
+	}
+	return "", fmt.Errorf("invalid registration status '%s', valid values are provisioned, activated, admitted or expired", value)
+}
+
+// RegistrationInfo a host registration and its status
+type RegistrationInfo struct {
+	MacAddress string             `json:"mac_address"`
+	OrgGroup   string             `json:"org_group"`
+	Org        string             `json:"org"`
+	Area       string             `json:"area"`
+	Location   string             `json:"location"`
+	Label      []string           `json:"label"`
+	Status     RegistrationStatus `json:"status"`
+	// the UUID of the host, set once the host has activated
+	HostUUID    string     `json:"host_uuid,omitempty"`
+	Provisioned time.Time  `json:"provisioned"`
+	Activated   *time.Time `json:"activated,omitempty"`
+	Admitted    *time.Time `json:"admitted,omitempty"`
+	Expired     *time.Time `json:"expired,omitempty"`
+}
@@ -0,0 +1,59 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package types
+
+import "time"
+
+// Relocation the information required to move a host to a different logistic placement
+// empty values are taken from the current host placement
+type Relocation struct {
+	// the host to relocate, only required for bulk relocations
+	HostUUID string `json:"host_uuid,omitempty"`
+	OrgGroup string `json:"org_group,omitempty"`
+	Org      string `json:"org,omitempty"`
+	Area     string `json:"area,omitempty"`
+	Location string `json:"location,omitempty"`
+	// the reason for moving the host
+	Reason string `json:"reason,omitempty"`
+}
+
+// RelocationResult the outcome of relocating a host in a bulk relocation
+type RelocationResult struct {
+	HostUUID string `json:"host_uuid"`
+	// true if the host was moved
+	Moved bool `json:"moved"`
+	// the reason why the host could not be moved
+	Error string `json:"error,omitempty"`
+}
+
+// Placement a logistic placement a host has been in
+type Placement struct {
+	OrgGroup string `json:"org_group"`
+	Org      string `json:"org"`
+	Area     string `json:"area"`
+	Location string `json:"location"`
+	// the user that moved the host into the placement
+	MovedBy string `json:"moved_by,omitempty"`
+	// the reason for moving the host into the placement
+	Reason string `json:"reason,omitempty"`
+	// the time the host was moved into the placement
+	From time.Time `json:"from"`
+	// the time the host was moved out of the placement
+	To time.Time `json:"to"`
+}
@@ -0,0 +1,89 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package types
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SecretRefScheme the scheme of the values referencing a secret held in the secret store
+const SecretRefScheme = "secret://"
+
+// SecretRef a reference to a secret in the secret store, written as secret://path#key
+// references are kept in place of the secret values and resolved when a job is dispatched
+type SecretRef struct {
+	// the path of the secret in the store, e.g. registry/artisan
+	Path string `json:"path"`
+	// the key of the value within the secret, e.g. pwd
+	Key string `json:"key"`
+}
+
+func (s SecretRef) String() string {
+	return fmt.Sprintf("%s%s#%s", SecretRefScheme, s.Path, s.Key)
+}
+
+// Valid checks the path and key of the reference can be used
+func (s SecretRef) Valid() error {
+	if len(s.Path) == 0 {
+		return fmt.Errorf("secret path is missing")
+	}
+	if len(s.Key) == 0 {
+		return fmt.Errorf("secret key is missing")
+	}
+	if strings.HasPrefix(s.Path, "/") || strings.HasSuffix(s.Path, "/") || strings.Contains(s.Path, "//") {
+		return fmt.Errorf("secret path '%s' is invalid", s.Path)
+	}
+	for _, segment := range strings.Split(s.Path, "/") {
+		if segment == "." || segment == ".." {
+			return fmt.Errorf("secret path '%s' is invalid", s.Path)
+		}
+	}
+	if strings.ContainsAny(s.Key, "#/") {
+		return fmt.Errorf("secret key '%s' is invalid", s.Key)
+	}
+	return nil
+}
+
+// IsSecretRef true if the value references a secret instead of holding it
+func IsSecretRef(value string) bool {
+	return strings.HasPrefix(value, SecretRefScheme)
+}
+
+// ParseSecretRef parses a value in the form secret://path#key
+func ParseSecretRef(value string) (*SecretRef, error) {
+	if !IsSecretRef(value) {
+		return nil, fmt.Errorf("'%s' is not a secret reference", value)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(value, SecretRefScheme), "#", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("secret reference '%s' has no key, the format is %spath#key", value, SecretRefScheme)
+	}
+	ref := &SecretRef{Path: parts[0], Key: parts[1]}
+	if err := ref.Valid(); err != nil {
+		return nil, fmt.Errorf("invalid secret reference '%s': %s", value, err)
+	}
+	return ref, nil
+}
+
+// SecretValue a value to keep in the secret store
+type SecretValue struct {
+	SecretRef
+	Value string `json:"value"`
+}
@@ -0,0 +1,39 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package types
+
+import "testing"
+
+func TestParseSecretRef(t *testing.T) {
+	ref, err := ParseSecretRef("secret://registry/artisan#pwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.Path != "registry/artisan" || ref.Key != "pwd" {
+		t.Fatalf("unexpected reference %+v", ref)
+	}
+	if ref.String() != "secret://registry/artisan#pwd" {
+		t.Fatalf("unexpected reference string '%s'", ref)
+	}
+	for _, value := range []string{"pwd", "secret://registry", "secret://#pwd", "secret://registry#", "secret:///registry#pwd", "secret://a/../b#pwd", "secret://a#b/c"} {
+		if _, err = ParseSecretRef(value); err == nil {
+			t.Fatalf("'%s' parsed as a secret reference", value)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package types
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+)
+
+// the signature algorithms of ping responses
+const (
+	// AlgPGP an armored detached OpenPGP signature
+	AlgPGP = "pgp"
+	// AlgRsaSha256 an RSASSA-PKCS1-v1_5 signature of the SHA-256 digest of the message
+	AlgRsaSha256 = "rsa-pkcs1v15-sha256"
+	// AlgEcdsaSha256 an ASN.1 encoded ECDSA signature of the SHA-256 digest of the message
+	AlgEcdsaSha256 = "ecdsa-sha256"
+)
+
+// Signer creates the signatures of ping responses
+// implementations can keep the private key outside pilotctl, e.g. in Vault transit or a KMS
+type Signer interface {
+	// KeyId the identifier of the key signing messages, so that pilot can pick the verification key
+	KeyId() string
+	// Algorithm the signature algorithm, so that pilot knows how to verify signatures
+	Algorithm() string
+	// Sign returns the signature of the message
+	Sign(message []byte) ([]byte, error)
+}
+
+// Algorithm PGP keys create armored detached OpenPGP signatures
+func (p *PGP) Algorithm() string {
+	return AlgPGP
+}
+
+// VerifySignature verifies the signature of a message created by a Signer
+// the public key is either an armored OpenPGP key or a PEM encoded PKIX public key
+func VerifySignature(algorithm string, publicKey, message, signature []byte) error {
+	if algorithm == AlgPGP || len(algorithm) == 0 {
+		pgp, err := LoadPGPBytes(publicKey)
+		if err != nil {
+			return err
+		}
+		return pgp.Verify(message, signature)
+	}
+	block, _ := pem.Decode(publicKey)
+	if block == nil {
+		return fmt.Errorf("public key is not PEM encoded")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("cannot parse public key: %s", err)
+	}
+	digest := sha256.Sum256(message)
+	switch algorithm {
+	case AlgRsaSha256:
+		key, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("algorithm %s requires an RSA key", algorithm)
+		}
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature)
+	case AlgEcdsaSha256:
+		key, ok := pub.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("algorithm %s requires an ECDSA key", algorithm)
+		}
+		if !ecdsa.VerifyASN1(key, digest[:], signature) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("signature algorithm '%s' is not supported", algorithm)
+}
@@ -0,0 +1,54 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package types
+
+import "time"
+
+// SigningKeyStatus the stage of a signing key in its rotation
+type SigningKeyStatus string
+
+const (
+	// SigningKeyPending the key has been generated and is published so that pilots can fetch it before it is used
+	SigningKeyPending SigningKeyStatus = "pending"
+	// SigningKeyActive the key can sign ping responses, the most recently activated key is used
+	SigningKeyActive SigningKeyStatus = "active"
+	// SigningKeyRetired the key is no longer used or published
+	SigningKeyRetired SigningKeyStatus = "retired"
+)
+
+// SigningKey a key in the signing keyring
+type SigningKey struct {
+	KeyId     string           `json:"key_id"`
+	Status    SigningKeyStatus `json:"status"`
+	CreatedBy string           `json:"created_by,omitempty"`
+	Created   time.Time        `json:"created"`
+	Activated *time.Time       `json:"activated,omitempty"`
+	Retired   *time.Time       `json:"retired,omitempty"`
+	// the signature algorithm of the key
+	Algorithm string `json:"algorithm,omitempty"`
+	// the public key used by pilot to verify signatures, armored for pgp keys or otherwise PEM encoded
+	PublicKey string `json:"public_key,omitempty"`
+}
+
+// SigningKeySet the verification keys published to pilots
+type SigningKeySet struct {
+	// the identifier of the key currently signing ping responses
+	Primary string       `json:"primary"`
+	Keys    []SigningKey `json:"keys"`
+}
@@ -0,0 +1,107 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package types
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ApiTokenPrefix identifies pilotctl API tokens, making them easy to spot in secret scanners
+const ApiTokenPrefix = "pct_"
+
+// ApiTokenRequest the information required to create an API token
+type ApiTokenRequest struct {
+	// a name describing what the token is used for
+	Name string `json:"name"`
+	// the service account the token authenticates as, defaults to the user creating the token
+	ServiceAccount string `json:"service_account,omitempty"`
+	// the role granted to the token, it cannot exceed the access of the user creating the token
+	Role     Role   `json:"role"`
+	OrgGroup string `json:"org_group,omitempty"`
+	Org      string `json:"org,omitempty"`
+	Area     string `json:"area,omitempty"`
+	// the number of days the token is valid for, if zero the configured default is used
+	ExpiryDays int `json:"expiry_days,omitempty"`
+}
+
+// ApiTokenResponse returned when a token is created, the token value cannot be retrieved afterwards
+type ApiTokenResponse struct {
+	Id      string    `json:"id"`
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// ApiToken the information held about an API token, excluding its value
+type ApiToken struct {
+	Id       string     `json:"id"`
+	Name     string     `json:"name"`
+	Username string     `json:"username"`
+	Owner    string     `json:"owner"`
+	Role     Role       `json:"role"`
+	OrgGroup string     `json:"org_group,omitempty"`
+	Org      string     `json:"org,omitempty"`
+	Area     string     `json:"area,omitempty"`
+	Created  time.Time  `json:"created"`
+	Expires  time.Time  `json:"expires"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+	// the identity of the user who created the token, which unlike the owner username cannot be chosen by users
+	OwnerId string `json:"-"`
+}
+
+// Binding returns the role binding scoping what the token can do
+func (t ApiToken) Binding() RoleBinding {
+	return RoleBinding{
+		Username: t.Username,
+		Role:     t.Role,
+		OrgGroup: t.OrgGroup,
+		Org:      t.Org,
+		Area:     t.Area,
+	}
+}
+
+// Expired true if the token can no longer be used
+func (t ApiToken) Expired() bool {
+	return time.Now().After(t.Expires)
+}
+
+// NewApiToken returns a new random token value
+func NewApiToken() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("cannot generate api token: %s", err)
+	}
+	return ApiTokenPrefix + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// IsApiToken true if the value has the format of a pilotctl API token
+func IsApiToken(value string) bool {
+	return strings.HasPrefix(value, ApiTokenPrefix) && len(value) > len(ApiTokenPrefix)
+}
+
+// HashApiToken returns the hash of the token value stored at rest
+func HashApiToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
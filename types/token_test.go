@@ -0,0 +1,45 @@
+/*
+   Pilot Control Service
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package types
+
+import (
+	"testing"
+	"time"
+)
+
+func TestApiToken(t *testing.T) {
+	token, err := NewApiToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsApiToken(token) {
+		t.Fatalf("'%s' is not recognised as an api token", token)
+	}
+	if IsApiToken("pct_") || IsApiToken("dXNlcjpwd2Q=") {
+		t.Fatal("invalid values recognised as api tokens")
+	}
+	other, _ := NewApiToken()
+	if HashApiToken(token) == HashApiToken(other) || HashApiToken(token) != HashApiToken(token) {
+		t.Fatal("token hashes are not unique and deterministic")
+	}
+	expired := ApiToken{Expires: time.Now().Add(-time.Minute)}
+	if !expired.Expired() {
+		t.Fatal("token should be expired")
+	}
+}